@@ -3,14 +3,14 @@ module ehchobyahs
 go 1.24.5
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/gorilla/mux v1.8.1
 	github.com/gorilla/sessions v1.4.0
 	github.com/joho/godotenv v1.5.1
 )
 
 require (
-	github.com/gorilla/securecookie v1.1.2 // indirect
-	github.com/jmoiron/sqlx v1.4.0
+	github.com/gorilla/securecookie v1.1.2
 	github.com/lib/pq v1.10.9
 	golang.org/x/oauth2 v0.30.0
 )
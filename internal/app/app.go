@@ -21,12 +21,25 @@ func Run() {
 	service.InitDB()
 	handlers.UpdateConfig()
 
-	go handlers.StartCacheUpdater() // Обновляет информацию с Twitch раз в минуту
-	go handlers.StartTopUpdater()   // Обновляет лидерборд
+	go handlers.StartCacheUpdater()         // Обновляет информацию с Twitch раз в минуту
+	go handlers.StartTopUpdater()           // Обновляет лидерборд
+	go handlers.StartStatsUpdater()         // Собирает дневную статистику для аналитики
+	go handlers.StartNotificationsCleanup() // Чистит старые уведомления
+	go handlers.StartDigestSender()         // Рассылает email-дайджесты
+	go handlers.StartSessionsCleanup()      // Удаляет истекшие сессии
+	go handlers.StartOutboxWorker()         // Выполняет отложенные внешние действия (выдача VIP, анонсы в чат)
+	go handlers.StartChatBot()              // Отвечает на команды в чате Twitch
 
 	value := os.Getenv("PORT")
+	r := NewRouter()
 
-	// Настройка маршрутов
+	// Запуск сервера
+	log.Println("Запуск сервера. Порт :" + value)
+	go log.Fatal(http.ListenAndServe(":"+value, r))
+}
+
+// Все маршруты сайта и API. Отдельно от Run, чтобы тесты гоняли запросы через тот же роутер
+func NewRouter() *mux.Router {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/", handlers.ServeHomePage)
@@ -39,68 +52,167 @@ func Run() {
 	r.HandleFunc("/feed", handlers.AuthMiddleware(handlers.ServeFeedPage))
 	r.HandleFunc("/upload", handlers.AuthMiddleware(handlers.ServeUploadPage))
 	r.HandleFunc("/shop", handlers.AuthMiddleware(handlers.ServeShopPage))
-	r.HandleFunc("/settings", handlers.AuthMiddleware(handlers.ServeUploadPage))
+	r.HandleFunc("/settings", handlers.AuthMiddleware(handlers.ServeSettingsPage))
 	r.HandleFunc("/logout", handlers.AuthMiddleware(handlers.LogoutHandler))
 	r.HandleFunc("/post/{id}", handlers.ServePostPage)
 	r.HandleFunc("/inventory", handlers.AuthMiddleware(handlers.ServeInventoryPage))
+	r.HandleFunc("/analytics", handlers.AuthMiddleware(handlers.ServeAnalyticsPage))
+	r.HandleFunc("/collections", handlers.AuthMiddleware(handlers.ServeCollectionsPage))
+	r.HandleFunc("/bookmarks", handlers.AuthMiddleware(handlers.ServeBookmarksPage))
+	r.HandleFunc("/notifications", handlers.AuthMiddleware(handlers.ServeNotificationsPage))
+	r.HandleFunc("/collection/{id}", handlers.ServeCollectionPage)
+	r.HandleFunc("/fair/{id}", handlers.ServeFairPage)
 
 	// Модераторские страницы
-	r.HandleFunc("/moderator", handlers.ModeratorMiddleware(handlers.ServeModeratorPage))
+	r.HandleFunc("/moderator", handlers.PermissionMiddleware("approve_posts", handlers.ServeModeratorPage))
 
 	// Админские страницы
-	r.HandleFunc("/admin", handlers.AdminMiddleware(handlers.ServeAdminPage))
-	r.HandleFunc("/admin/twitch", handlers.AdminMiddleware(handlers.AdminAuthHandler))
-	r.HandleFunc("/admin/callback", handlers.AdminMiddleware(handlers.AdminCallbackHandler))
-	r.HandleFunc("/queue", handlers.AdminMiddleware(handlers.ServeQueuePage))
+	r.HandleFunc("/admin", handlers.PermissionMiddleware("admin_panel", handlers.ServeAdminPage))
+	r.HandleFunc("/admin/twitch", handlers.PermissionMiddleware("manage_bot", handlers.AdminAuthHandler))
+	r.HandleFunc("/admin/callback", handlers.PermissionMiddleware("manage_bot", handlers.AdminCallbackHandler))
+	r.HandleFunc("/queue", handlers.PermissionMiddleware("manage_queue", handlers.ServeQueuePage))
 
 	// API Gateway
-	r.HandleFunc("/api/upload", handlers.AuthMiddleware(handlers.UploadHandler))
-	r.HandleFunc("/api/upload/clip", handlers.AuthMiddleware(handlers.UploadClipHandler))
-	r.HandleFunc("/api/like/{id}", handlers.AuthMiddleware(handlers.LikeHandler)).Methods("POST", "DELETE")
+	r.HandleFunc("/api/upload", handlers.APITokenMiddleware("write:posts", handlers.AuthMiddleware(handlers.UploadHandler)))
+	r.HandleFunc("/api/upload/clip", handlers.APITokenMiddleware("write:posts", handlers.AuthMiddleware(handlers.UploadClipHandler)))
+	r.HandleFunc("/api/like/{id}", handlers.APITokenMiddleware("write:posts", handlers.AuthMiddleware(handlers.LikeHandler))).Methods("POST", "DELETE")
 	r.HandleFunc("/api/fuckyou/{id}", handlers.AuthMiddleware(handlers.FuckYouHandler)).Methods("POST", "DELETE")
 	r.HandleFunc("/api/likecomment/{id}", handlers.AuthMiddleware(handlers.LikeCommentHandler)).Methods("POST", "DELETE")
-	r.HandleFunc("/api/comment/{id}", handlers.AuthMiddleware(handlers.CommentHandler)).Methods("POST", "DELETE", "PUT")
-	r.HandleFunc("/api/feed", handlers.AuthMiddleware(handlers.FeedHandler)).Methods("GET")
-	r.HandleFunc("/api/last-files", handlers.AuthMiddleware(handlers.LastFilesHandler)).Methods("GET")
+	r.HandleFunc("/api/comment/{id}", handlers.APITokenMiddleware("write:posts", handlers.AuthMiddleware(handlers.CommentHandler))).Methods("POST", "DELETE", "PUT")
+	r.HandleFunc("/api/comment/{id}/history", handlers.CommentHistoryHandler).Methods("GET")
+	r.HandleFunc("/api/comments/{id}", handlers.GetCommentsHandler).Methods("GET")
+	r.HandleFunc("/api/comments/thread/{id}", handlers.GetCommentThreadHandler).Methods("GET")
+	r.HandleFunc("/api/feed", handlers.APITokenMiddleware("read:posts", handlers.AuthMiddleware(handlers.FeedHandler))).Methods("GET")
+	r.HandleFunc("/api/last-files", handlers.APITokenMiddleware("read:posts", handlers.AuthMiddleware(handlers.LastFilesHandler))).Methods("GET")
 	r.HandleFunc("/api/search", handlers.SearchHandler)
-	r.HandleFunc("/api/buy_item/{id}", handlers.AuthMiddleware(handlers.BuyItemHandler))
+	r.HandleFunc("/api/mentions", handlers.AuthMiddleware(handlers.MentionSearchHandler)).Methods("GET")
+	r.HandleFunc("/api/buy_item/{id}", handlers.AuthMiddleware(handlers.BuyItemHandler)).Methods("POST")
 	r.HandleFunc("/api/notifications", handlers.AuthMiddleware(handlers.GetNotificationsHandler)).Methods("GET")
+	r.HandleFunc("/api/notifications/stream", handlers.AuthMiddleware(handlers.NotificationsStreamHandler)).Methods("GET")
+	r.HandleFunc("/api/notifications/read", handlers.AuthMiddleware(handlers.ReadAllNotificationsHandler)).Methods("POST")
+	r.HandleFunc("/api/notifications/preferences", handlers.AuthMiddleware(handlers.NotificationPreferencesHandler)).Methods("GET", "PUT")
+	r.HandleFunc("/api/notifications/{id}/read", handlers.AuthMiddleware(handlers.ReadNotificationHandler)).Methods("POST")
+	r.HandleFunc("/api/sessions", handlers.AuthMiddleware(handlers.GetSessionsHandler)).Methods("GET")
+	r.HandleFunc("/api/sessions", handlers.AuthMiddleware(handlers.RevokeSessionHandler)).Methods("DELETE")
+	r.HandleFunc("/api/sessions/{id}", handlers.AuthMiddleware(handlers.RevokeSessionHandler)).Methods("DELETE")
+	r.HandleFunc("/api/tokens", handlers.AuthMiddleware(handlers.APITokensHandler)).Methods("GET", "POST")
+	r.HandleFunc("/api/tokens/{id}", handlers.AuthMiddleware(handlers.RevokeAPITokenHandler)).Methods("DELETE")
+	r.HandleFunc("/api/chat-link", handlers.AuthMiddleware(handlers.ChatLinkHandler)).Methods("GET", "POST", "DELETE")
+	r.HandleFunc("/api/digest", handlers.AuthMiddleware(handlers.DigestSettingsHandler)).Methods("GET", "PUT")
+	r.HandleFunc("/unsubscribe", handlers.UnsubscribeDigestHandler).Methods("GET", "POST")
+	r.HandleFunc("/api/push/key", handlers.PushKeyHandler).Methods("GET")
+	r.HandleFunc("/api/push/subscription", handlers.AuthMiddleware(handlers.PushSubscriptionHandler)).Methods("POST", "DELETE")
 	r.HandleFunc("/api/posts/{id}", handlers.GetUserPostsHandler).Methods("GET")
 	r.HandleFunc("/api/follow/{id}", handlers.AuthMiddleware(handlers.SubscribeHandler)).Methods("POST", "DELETE")
 	r.HandleFunc("/api/case-rewards/{id}", handlers.AuthMiddleware(handlers.GetCaseRewardsHandler)).Methods("GET")
 	r.HandleFunc("/api/case-open/{id}", handlers.AuthMiddleware(handlers.OpenCaseHandler)).Methods("POST")
+	r.HandleFunc("/api/inventory/{id}/gift", handlers.AuthMiddleware(handlers.GiftItemHandler)).Methods("POST")
+	r.HandleFunc("/api/inventory/transfers", handlers.AuthMiddleware(handlers.GetInventoryTransfersHandler)).Methods("GET")
+	r.HandleFunc("/api/inventory/{id}/sell", handlers.AuthMiddleware(handlers.SellItemHandler)).Methods("POST")
+	r.HandleFunc("/api/inventory/recycle-duplicates", handlers.AuthMiddleware(handlers.RecycleDuplicatesHandler)).Methods("POST")
+	r.HandleFunc("/api/cosmetics", handlers.AuthMiddleware(handlers.GetOwnedShopItemsHandler)).Methods("GET")
+	r.HandleFunc("/api/cosmetics/{id:[0-9]+}", handlers.AuthMiddleware(handlers.CosmeticHandler)).Methods("POST")
+	r.HandleFunc("/api/cosmetics/{slot:[a-z_]+}", handlers.AuthMiddleware(handlers.CosmeticHandler)).Methods("DELETE")
+	r.HandleFunc("/api/resale-values", handlers.AuthMiddleware(handlers.GetResaleValuesHandler)).Methods("GET")
+	r.HandleFunc("/api/trades", handlers.AuthMiddleware(handlers.GetTradeOffersHandler)).Methods("GET")
+	r.HandleFunc("/api/trades", handlers.AuthMiddleware(handlers.CreateTradeOfferHandler)).Methods("POST")
+	r.HandleFunc("/api/trades/inventory/{username}", handlers.AuthMiddleware(handlers.GetTradePartnerInventoryHandler)).Methods("GET")
+	r.HandleFunc("/api/trades/{id}/{action:accept|decline|cancel}", handlers.AuthMiddleware(handlers.ResolveTradeOfferHandler)).Methods("POST")
+	r.HandleFunc("/api/case-seed", handlers.AuthMiddleware(handlers.GetCaseSeedHandler)).Methods("GET")
+	r.HandleFunc("/api/case-seed", handlers.AuthMiddleware(handlers.RotateCaseSeedHandler)).Methods("POST")
+	r.HandleFunc("/api/case-openings", handlers.AuthMiddleware(handlers.GetCaseOpeningsHandler)).Methods("GET")
+	r.HandleFunc("/api/case-openings/{id}", handlers.GetCaseOpeningHandler).Methods("GET")
 	r.HandleFunc("/api/apply-badge/{id}", handlers.AuthMiddleware(handlers.ApplyBadgeHandler)).Methods("POST")
 	r.HandleFunc("/api/apply-item/{id}", handlers.AuthMiddleware(handlers.ApplyItem)).Methods("POST")
 	r.HandleFunc("/api/live-channels", handlers.GetLiveChannelsHandler).Methods("GET")
 	r.HandleFunc("/api/top-authors", handlers.GetTopAuthorsHandler).Methods("GET")
+	r.HandleFunc("/api/analytics", handlers.APITokenMiddleware("read:posts", handlers.AuthMiddleware(handlers.AnalyticsHandler))).Methods("GET")
+	// Коллекции
+	r.HandleFunc("/api/collections", handlers.AuthMiddleware(handlers.CollectionsHandler)).Methods("GET", "POST")
+	r.HandleFunc("/api/collections/{id}", handlers.GetCollectionHandler).Methods("GET")
+	r.HandleFunc("/api/collections/{id}", handlers.AuthMiddleware(handlers.CollectionHandler)).Methods("PUT", "DELETE")
+	r.HandleFunc("/api/collections/{id}/posts/{post_id}", handlers.AuthMiddleware(handlers.CollectionPostHandler)).Methods("POST", "DELETE")
+	r.HandleFunc("/api/collections/{id}/order", handlers.AuthMiddleware(handlers.CollectionOrderHandler)).Methods("PUT")
+	r.HandleFunc("/api/collections/{id}/follow", handlers.AuthMiddleware(handlers.FollowCollectionHandler)).Methods("POST", "DELETE")
+	// Закладки и "Смотреть позже"
+	r.HandleFunc("/api/bookmarks", handlers.APITokenMiddleware("read:posts", handlers.AuthMiddleware(handlers.GetBookmarksHandler))).Methods("GET")
+	r.HandleFunc("/api/bookmarks/{id}", handlers.AuthMiddleware(handlers.BookmarkHandler)).Methods("POST", "DELETE")
+	r.HandleFunc("/api/watch-later", handlers.APITokenMiddleware("read:posts", handlers.AuthMiddleware(handlers.GetWatchLaterHandler))).Methods("GET")
+	r.HandleFunc("/api/watch-later/{id}", handlers.AuthMiddleware(handlers.WatchLaterHandler)).Methods("POST", "DELETE")
 	// Чат
 	r.HandleFunc("/api/chat/messages", handlers.AuthMiddleware(handlers.LoadMessagesHistoryHandler)).Methods("GET")
-	r.HandleFunc("/api/chat/send", handlers.AuthMiddleware(handlers.SendMessageHandler)).Methods("POST")
+	r.HandleFunc("/api/chat/send", handlers.APITokenMiddleware("chat:send", handlers.AuthMiddleware(handlers.SendMessageHandler))).Methods("POST")
 
 	// Модераторские API
-	r.HandleFunc("/api/moderation/posts/{page}", handlers.ModeratorMiddleware(handlers.GetModerationPostsHandler)).Methods("GET")
-	r.HandleFunc("/api/moderation/approve/{id}", handlers.ModeratorMiddleware(handlers.ApprovePostHandler)).Methods("POST")
-	r.HandleFunc("/api/moderation/reject/{id}", handlers.ModeratorMiddleware(handlers.RejectPostHandler)).Methods("POST")
-	r.HandleFunc("/api/moderation/delete/{id}", handlers.ModeratorMiddleware(handlers.DeletePostHandler)).Methods("POST")
-	r.HandleFunc("/api/moderation/ban/{id}", handlers.ModeratorMiddleware(handlers.BanUserHandler)).Methods("POST")
-	r.HandleFunc("/api/moderation/banusername/{username}", handlers.ModeratorMiddleware(handlers.BanUsernameHandler)).Methods("POST", "DELETE")
+	r.HandleFunc("/api/moderation/posts/{page}", handlers.PermissionMiddleware("approve_posts", handlers.GetModerationPostsHandler)).Methods("GET")
+	r.HandleFunc("/api/moderation/approve/{id}", handlers.PermissionMiddleware("approve_posts", handlers.ApprovePostHandler)).Methods("POST")
+	r.HandleFunc("/api/moderation/reject/{id}", handlers.PermissionMiddleware("approve_posts", handlers.RejectPostHandler)).Methods("POST")
+	r.HandleFunc("/api/moderation/delete/{id}", handlers.PermissionMiddleware("delete_posts", handlers.DeletePostHandler)).Methods("POST")
+	r.HandleFunc("/api/moderation/ban/{id}", handlers.PermissionMiddleware("ban_users", handlers.BanUserHandler)).Methods("POST")
+	r.HandleFunc("/api/moderation/banusername/{username}", handlers.PermissionMiddleware("ban_users", handlers.BanUsernameHandler)).Methods("POST", "DELETE")
 
 	// Админские API
-	r.HandleFunc("/api/admin/moderators", handlers.AdminMiddleware(handlers.GetModeratorsListHandler)).Methods("GET")
-	r.HandleFunc("/api/admin/moderatorrole/{username}", handlers.AdminMiddleware(handlers.ModeratorRoleHandler)).Methods("POST", "DELETE")
-	r.HandleFunc("/api/admin/users", handlers.AdminMiddleware(handlers.UsersSearchHandler))
-	r.HandleFunc("/api/admin/banned", handlers.AdminMiddleware(handlers.GetBannedUsersListHandler)).Methods("GET")
-	r.HandleFunc("/api/admin/uploadbadge", handlers.AdminMiddleware(handlers.UploadBadgeHandler)).Methods("POST")
-	r.HandleFunc("/api/admin/add-case", handlers.AdminMiddleware(handlers.AddCaseHandler)).Methods("POST")
-	r.HandleFunc("/api/admin/add-rewards", handlers.AdminMiddleware(handlers.AddRewardsHandler)).Methods("POST")
-	r.HandleFunc("/api/admin/badges", handlers.AdminMiddleware(handlers.GetBadgesHandler))
-	r.HandleFunc("/api/admin/queue", handlers.AdminMiddleware(handlers.GetQueueHandler)).Methods("GET")
-	r.HandleFunc("/api/admin/queue/{id}", handlers.AdminMiddleware(handlers.DeleteSubmission)).Methods("DELETE")
-	r.HandleFunc("/api/admin/livechannel/{username}", handlers.AdminMiddleware(handlers.AddLiveChannelHandler)).Methods("POST", "DELETE")
+	r.HandleFunc("/api/admin/moderators", handlers.PermissionMiddleware("manage_moderators", handlers.GetModeratorsListHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/moderatorrole/{username}", handlers.PermissionMiddleware("manage_moderators", handlers.ModeratorRoleHandler)).Methods("POST", "DELETE")
+	r.HandleFunc("/api/admin/users", handlers.PermissionMiddleware("admin_panel", handlers.UsersSearchHandler))
+	r.HandleFunc("/api/admin/banned", handlers.PermissionMiddleware("ban_users", handlers.GetBannedUsersListHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/uploadbadge", handlers.PermissionMiddleware("manage_shop", handlers.UploadBadgeHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/add-case", handlers.PermissionMiddleware("manage_cases", handlers.AddCaseHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/add-rewards", handlers.PermissionMiddleware("manage_cases", handlers.AddRewardsHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/cases", handlers.PermissionMiddleware("manage_cases", handlers.GetCaseReportsHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/cases/{id}/normalize", handlers.PermissionMiddleware("manage_cases", handlers.NormalizeCaseRewardsHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/cases/{id}/simulate", handlers.PermissionMiddleware("manage_cases", handlers.SimulateCaseHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/badges", handlers.PermissionMiddleware("manage_shop", handlers.GetBadgesHandler))
+	r.HandleFunc("/api/admin/outbox", handlers.PermissionMiddleware("manage_shop", handlers.GetOutboxHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/vips", handlers.PermissionMiddleware("manage_shop", handlers.GetActiveVIPsHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/shop/items", handlers.PermissionMiddleware("manage_shop", handlers.GetAdminShopItemsHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/shop/items", handlers.PermissionMiddleware("manage_shop", handlers.CreateShopItemHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/shop/types", handlers.PermissionMiddleware("manage_shop", handlers.GetShopItemTypesHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/shop/purchases", handlers.PermissionMiddleware("manage_shop", handlers.GetShopPurchasesHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/shop/purchases/{id}/refund", handlers.PermissionMiddleware("manage_shop", handlers.RefundShopPurchaseHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/shop/redemptions", handlers.PermissionMiddleware("manage_shop", handlers.GetRedemptionsHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/shop/redemptions/{id}/fulfill", handlers.PermissionMiddleware("manage_shop", handlers.FulfillRedemptionHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/shop/items/{id}", handlers.PermissionMiddleware("manage_shop", handlers.UpdateShopItemSettingsHandler)).Methods("PUT")
+	r.HandleFunc("/api/admin/shop/discounts", handlers.PermissionMiddleware("manage_shop", handlers.ShopDiscountsHandler)).Methods("GET", "POST")
+	r.HandleFunc("/api/admin/shop/discounts/{id}", handlers.PermissionMiddleware("manage_shop", handlers.DeleteShopDiscountHandler)).Methods("DELETE")
+	r.HandleFunc("/api/admin/resale-values/{type}", handlers.PermissionMiddleware("manage_shop", handlers.SetResaleValueHandler)).Methods("PUT")
+	r.HandleFunc("/api/admin/outbox/{id}/retry", handlers.PermissionMiddleware("manage_shop", handlers.RetryOutboxJobHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/queue", handlers.APITokenMiddleware("read:queue", handlers.PermissionMiddleware("manage_queue", handlers.GetQueueHandler))).Methods("GET")
+	r.HandleFunc("/api/admin/queue/{id}", handlers.PermissionMiddleware("manage_queue", handlers.DeleteSubmission)).Methods("DELETE")
+	r.HandleFunc("/api/admin/permissions", handlers.PermissionMiddleware("manage_permissions", handlers.GetPermissionsHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/permissions/roles/{role}", handlers.PermissionMiddleware("manage_permissions", handlers.RolePermissionHandler)).Methods("PUT")
+	r.HandleFunc("/api/admin/permissions/users/{username}", handlers.PermissionMiddleware("manage_permissions", handlers.UserPermissionsHandler)).Methods("GET", "PUT")
+	r.HandleFunc("/api/admin/livechannel/{username}", handlers.PermissionMiddleware("manage_live_channels", handlers.AddLiveChannelHandler)).Methods("POST", "DELETE")
+
+	// Публичный API v1
+	v1 := r.PathPrefix("/api/v1").Subrouter()
+	v1.HandleFunc("/openapi.json", handlers.OpenAPIHandler).Methods("GET")
+	v1.HandleFunc("/posts", handlers.APITokenMiddleware("read:posts", handlers.APIPostsHandler)).Methods("GET")
+	v1.HandleFunc("/posts/{id}", handlers.APITokenMiddleware("read:posts", handlers.APIPostHandler)).Methods("GET")
+	v1.HandleFunc("/posts/{id}/like", handlers.APITokenMiddleware("write:posts", handlers.AuthMiddleware(handlers.APIPostLikeHandler))).Methods("PUT", "DELETE")
+	v1.HandleFunc("/posts/{id}/comments", handlers.APITokenMiddleware("read:posts", handlers.APIPostCommentsHandler)).Methods("GET")
+	v1.HandleFunc("/posts/{id}/comments", handlers.APITokenMiddleware("write:posts", handlers.AuthMiddleware(handlers.APIPostCommentsHandler))).Methods("POST")
+	v1.HandleFunc("/users/{login}", handlers.APITokenMiddleware("read:posts", handlers.APIUserHandler)).Methods("GET")
+	v1.HandleFunc("/users/{login}/follow", handlers.APITokenMiddleware("write:follows", handlers.AuthMiddleware(handlers.APIFollowHandler))).Methods("PUT", "DELETE")
+	v1.HandleFunc("/me", handlers.APITokenMiddleware("read:profile", handlers.AuthMiddleware(handlers.APIMeHandler))).Methods("GET")
+	v1.HandleFunc("/shop/items", handlers.APITokenMiddleware("read:profile", handlers.AuthMiddleware(handlers.APIShopItemsHandler))).Methods("GET")
+	v1.HandleFunc("/shop/items/{id}/purchase", handlers.APITokenMiddleware("write:shop", handlers.AuthMiddleware(handlers.APIPurchaseHandler))).Methods("POST")
+	v1.HandleFunc("/cases", handlers.APITokenMiddleware("read:profile", handlers.AuthMiddleware(handlers.APICasesHandler))).Methods("GET")
+	v1.HandleFunc("/cases/{id}/rewards", handlers.APICaseRewardsHandler).Methods("GET")
+	v1.HandleFunc("/cases/{id}/open", handlers.APITokenMiddleware("write:shop", handlers.AuthMiddleware(handlers.APIOpenCaseHandler))).Methods("POST")
+	v1.HandleFunc("/inventory", handlers.APITokenMiddleware("read:profile", handlers.AuthMiddleware(handlers.APIInventoryHandler))).Methods("GET")
+	v1.HandleFunc("/inventory/{id}/apply", handlers.APITokenMiddleware("write:shop", handlers.AuthMiddleware(handlers.APIApplyItemHandler))).Methods("POST")
+	v1.HandleFunc("/queue", handlers.APITokenMiddleware("read:queue", handlers.PermissionMiddleware("manage_queue", handlers.APIQueueHandler))).Methods("GET")
+	v1.HandleFunc("/queue/{id}", handlers.APITokenMiddleware("write:queue", handlers.PermissionMiddleware("manage_queue", handlers.APIQueueItemHandler))).Methods("DELETE")
+	v1.HandleFunc("/live-channels", handlers.APILiveChannelsHandler).Methods("GET")
+
+	r.Use(handlers.PermissionsCacheMiddleware)
+	r.Use(handlers.CSRFMiddleware)
 
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
 
-	// Запуск сервера
-	log.Println("Запуск сервера. Порт :" + value)
-	go log.Fatal(http.ListenAndServe(":"+value, r))
+	r.NotFoundHandler = http.HandlerFunc(handlers.NotFoundHandler)
+	r.MethodNotAllowedHandler = http.HandlerFunc(handlers.MethodNotAllowedHandler)
+
+	return r
 }
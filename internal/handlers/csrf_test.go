@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsSameOrigin(t *testing.T) {
+	t.Setenv("BASE_URL", "https://ehworld.ru")
+
+	tests := []struct {
+		name    string
+		origin  string
+		referer string
+		want    bool
+	}{
+		{"без заголовков", "", "", true},
+		{"тот же хост", "http://example.test", "", true},
+		{"BASE_URL", "https://ehworld.ru", "", true},
+		{"чужой сайт", "https://evil.test", "", false},
+		{"поддомен", "https://ehworld.ru.evil.test", "", false},
+		{"Origin null", "null", "", false},
+		{"Referer своего сайта", "", "http://example.test/settings", true},
+		{"чужой Referer", "", "https://evil.test/page", false},
+		{"Origin важнее Referer", "https://evil.test", "http://example.test/settings", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "http://example.test/api/follow", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			if got := isSameOrigin(r); got != tt.want {
+				t.Errorf("isSameOrigin() = %v, ожидалось %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSRFMiddlewareRejectsForeignOrigin(t *testing.T) {
+	reached := false
+	handler := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	r := httptest.NewRequest("POST", "http://example.test/api/follow", nil)
+	r.Header.Set("Origin", "https://evil.test")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden || reached {
+		t.Fatalf("статус %d, обработчик вызван: %v. Запрос с чужого сайта должен отклоняться", w.Code, reached)
+	}
+}
+
+func TestCSRFMiddlewareSkipsSafeMethodsAndBearer(t *testing.T) {
+	handler := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	get := httptest.NewRequest("GET", "http://example.test/api/follow", nil)
+	get.Header.Set("Origin", "https://evil.test")
+
+	// Токен в заголовке браузер сам не подставит
+	bearer := httptest.NewRequest("POST", "http://example.test/api/v1/posts/1/comments", nil)
+	bearer.Header.Set("Origin", "https://evil.test")
+	bearer.Header.Set("Authorization", "Bearer ehw_test")
+
+	for _, r := range []*http.Request{get, bearer} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("%s %s: статус %d вместо %d", r.Method, r.URL.Path, w.Code, http.StatusNoContent)
+		}
+	}
+}
@@ -1,16 +1,26 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
 	"ehchobyahs/internal/models"
 	"ehchobyahs/internal/service"
+	"encoding/base64"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"maps"
 	"math"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -20,35 +30,39 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	"github.com/lib/pq"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/twitch"
 )
 
 const (
 	sessionName = "ehcho-session"
-	//здесь бы дописать кал на валидацию секретной фразы, и добавить возраст сессии но это на усмотрение свое
+
+	oauthStateKey    = "oauth_state"
+	oauthVerifierKey = "oauth_verifier"
+	oauthReturnKey   = "oauth_return_to"
 )
 
 var (
 	oauthConfig = &oauth2.Config{
 		ClientID:     os.Getenv("TWITCH_CLIENT_ID"),
 		ClientSecret: os.Getenv("TWITCH_CLIENT_SECRET"),
-		RedirectURL:  "https://ehworld.ru/auth/callback",
 		Scopes:       []string{"user:read:email"},
 		Endpoint:     twitch.Endpoint,
 	}
 
-	store *sessions.CookieStore
+	store *pgSessionStore
 )
 
 var adminOAuthConfig = &oauth2.Config{
 	ClientID:     os.Getenv("TWITCH_CLIENT_ID_BOT"),
 	ClientSecret: os.Getenv("TWITCH_CLIENT_SECRET_BOT"),
-	RedirectURL:  "https://ehworld.ru/admin/callback",
-	Scopes:       []string{"chat:edit", "user:write:chat", "moderator:manage:banned_users", "channel:manage:vips"},
+	Scopes:       []string{"chat:read", "chat:edit", "user:write:chat", "moderator:manage:banned_users", "channel:manage:vips"},
 	Endpoint:     twitch.Endpoint,
 }
 
@@ -66,1510 +80,4850 @@ var (
 	leaderboardLastUpdated time.Time
 )
 
-func createAhuetSecureSession() *sessions.CookieStore {
-	sessionSecret := os.Getenv("SESSION_SECRET")
-	store := sessions.NewCookieStore([]byte(sessionSecret))
+var statsRollupInterval = time.Hour
 
-	// store.Options = &sessions.Options{
-	// 	Path:     "/",
-	// 	MaxAge:   604800,
-	// 	Secure:   false,
-	// 	HttpOnly: true,
-	// 	SameSite: http.SameSiteStrictMode,
-	// }
+const (
+	notificationsPageLimit  = 20
+	notificationsPing       = 25 * time.Second
+	notificationsCleanupAge = 24 * time.Hour
+	notificationsReadTTL    = 90 * 24 * time.Hour
+	notificationsUnreadTTL  = 180 * 24 * time.Hour
+	digestCheckInterval     = time.Hour
+	sessionsCleanupInterval = time.Hour
+	outboxInterval          = 30 * time.Second
+)
 
-	return store
+const sessionMaxAge = 604800
+
+// Хранилище сессий в Postgres: в куке лежит только подписанный токен,
+// поэтому сессию можно отозвать, а устройства видно в настройках.
+type pgSessionStore struct {
+	codecs  []securecookie.Codec
+	options sessions.Options
 }
 
-func rotateSession(w http.ResponseWriter, r *http.Request, userID int) error {
-	oldSession, _ := store.Get(r, sessionName)
-	oldSession.Options.MaxAge = -1
-	if err := oldSession.Save(r, w); err != nil {
-		log.Println(err.Error())
-		return err
+// SESSION_SECRET подписывает новые куки. Старые ключи через запятую в SESSION_SECRET_PREVIOUS
+// продолжают приниматься, так что секрет можно сменить без разлогина всех пользователей.
+func createAhuetSecureSession() *pgSessionStore {
+	secrets := []string{os.Getenv("SESSION_SECRET")}
+	secrets = append(secrets, strings.Split(os.Getenv("SESSION_SECRET_PREVIOUS"), ",")...)
+
+	var codecs []securecookie.Codec
+	for _, secret := range secrets {
+		if secret = strings.TrimSpace(secret); secret == "" {
+			continue
+		}
+		codec := securecookie.New([]byte(secret), nil)
+		codec.MaxAge(sessionMaxAge)
+		codecs = append(codecs, codec)
+	}
+
+	options := sessions.Options{
+		Path:     "/",
+		MaxAge:   sessionMaxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	// Домен и Secure только для явно заданного BASE_URL, иначе вход на localhost не работает
+	if os.Getenv("BASE_URL") != "" {
+		if base, err := url.Parse(service.BaseURL()); err == nil {
+			options.Domain = base.Hostname()
+			options.Secure = base.Scheme == "https"
+		}
 	}
 
-	newSession, _ := store.New(r, sessionName)
-	newSession.Options.MaxAge = 604800
-	newSession.Options.HttpOnly = true
-	newSession.Options.Secure = true
-	newSession.Options.Domain = "ehworld.ru"
-	newSession.Values["user_id"] = userID
-	return newSession.Save(r, w)
+	return &pgSessionStore{codecs: codecs, options: options}
 }
 
-func UpdateConfig() {
-	oauthConfig.ClientID = os.Getenv("TWITCH_CLIENT_ID")
-	oauthConfig.ClientSecret = os.Getenv("TWITCH_CLIENT_SECRET")
-	store = createAhuetSecureSession()
+func (s *pgSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
 
-	adminOAuthConfig.ClientID = os.Getenv("TWITCH_CLIENT_ID_BOT")
-	adminOAuthConfig.ClientSecret = os.Getenv("TWITCH_CLIENT_SECRET_BOT")
+func (s *pgSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := s.options
+	session.Options = &options
+	session.IsNew = true
 
-	channelsToCheck = service.LoadChannelsToCheck()
-}
+	// Запросы с API-токеном не используют куки, пользователя подставляет APITokenMiddleware
+	if bearerToken(r) != "" {
+		return session, nil
+	}
 
-func ServeHomePage(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, sessionName)
-	if userID, ok := session.Values["user_id"]; ok {
-		_, err := service.GetUserByID(userID.(int))
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
 
-		if err == nil {
+	var token string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &token, s.codecs...); err != nil {
+		return session, nil
+	}
 
-			user, err := service.GetUserByID(userID.(int))
-			if err != nil {
-				log.Println("Не удалось получить пользователя из БД c ID " + strconv.Itoa(userID.(int)) + " " + err.Error())
-				http.Redirect(w, r, "/", http.StatusFound)
-				return
-			}
+	data, err := service.LoadSession(token, clientIP(r), r.UserAgent())
+	if err != nil {
+		// Сессия отозвана или истекла
+		return session, nil
+	}
 
-			last_files, err := service.GetLastFilesWithAuthors()
-			if err != nil {
-				log.Println("Ошибка получения файлов:", err)
-				last_files = []models.FileWithAuthor{} // Пустой список при ошибке
-			}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		return session, nil
+	}
+	session.ID = token
+	session.IsNew = false
 
-			popular_files, err := service.GetMostPopularWithAuthors()
-			if err != nil {
-				log.Println("Ошибка получения файлов:", err)
-				popular_files = []models.FileWithAuthor{} // Пустой список при ошибке
-			}
+	return session, nil
+}
 
-			last_seen_files, err := service.GetLastSeenFilesWithAuthors(user.ID)
-			if err != nil {
-				log.Println("Ошибка получения файлов:", err)
-				last_seen_files = []models.FileWithAuthor{} // Пустой список при ошибке
-			}
+func (s *pgSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if _, ok := session.Values[apiTokenSessionKey]; ok {
+		return nil
+	}
 
-			new_followings, err := service.GetNewFollowings(user.ID)
-			if err != nil {
-				log.Println("Ошибка получения файлов:", err)
-				new_followings = []models.FileWithAuthor{} // Пустой список при ошибке
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := service.DeleteSession(session.ID); err != nil {
+				return err
 			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
 
-			data := struct {
-				User             *models.User            `json:"user"`
-				MostPopularFiles []models.FileWithAuthor `json:"popular_files"`
-				LastFiles        []models.FileWithAuthor `json:"files"`
-				LastSeen         []models.FileWithAuthor `json:"last_seen"`
-				Followings       []models.FileWithAuthor `json:"followings"`
-			}{
-				User:             user,
-				MostPopularFiles: popular_files,
-				LastFiles:        last_files,
-				LastSeen:         last_seen_files,
-				Followings:       new_followings,
-			}
+	if session.ID == "" {
+		session.ID = base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	}
 
-			tmpl, err := template.New("main.html").Funcs(template.FuncMap{
-				"isVideo": func(filename string) bool {
-					ext := strings.ToLower(filepath.Ext(filename))
-					return ext == ".mp4" || ext == ".mov" || ext == ".avi"
-				},
-				"formatViews":      service.FormatViews,
-				"checkModRole":     service.CheckModeratorOrAdminRole,
-				"checkAdminRole":   service.CheckAdminRole,
-				"hasNotifications": service.HasNotifications,
-				"hasFollowings":    service.HasFollowings,
-				"formatLikes":      service.FormatLikes,
-				"formatValue":      service.FormatValue,
-			}).ParseFiles("templates/main.html")
-			if err != nil {
-				log.Println(err.Error())
-			}
-			err = tmpl.Execute(w, data)
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return err
+	}
+
+	userID, _ := session.Values["user_id"].(int)
+	expiresAt := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	if err := service.SaveSession(session.ID, userID, data.Bytes(), clientIP(r), r.UserAgent(), expiresAt); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// IP клиента с учетом прокси перед приложением
+// Прокси из TRUSTED_PROXIES (адреса или подсети через запятую). Заголовкам
+// X-Real-IP и X-Forwarded-For верим только от них, иначе их подделает клиент
+var trustedProxies []netip.Prefix
+
+func loadTrustedProxies() []netip.Prefix {
+	var result []netip.Prefix
+	for _, value := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
 			if err != nil {
-				log.Println(err.Error())
+				log.Printf("Неверный адрес в TRUSTED_PROXIES: %s", value)
+				continue
 			}
-			return
+			result = append(result, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			log.Printf("Неверная подсеть в TRUSTED_PROXIES: %s", value)
+			continue
 		}
+		result = append(result, prefix.Masked())
 	}
+	return result
+}
 
-	tmpl, err := template.ParseFiles("templates/home.html")
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
 	if err != nil {
-		log.Println("Не удалось получить шаблон страницы профиля" + err.Error())
-		http.Error(w, "Template error", http.StatusInternalServerError)
-		return
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
 	}
+	return false
+}
 
-	err = tmpl.Execute(w, nil)
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	// Левые адреса в X-Forwarded-For дописывает клиент, поэтому берем
+	// самый правый адрес, который не принадлежит нашим прокси
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop != "" && !isTrustedProxy(hop) {
+				return hop
+			}
+		}
+	}
+	return host
+}
+
+// Новый токен сессии при входе, чтобы старая кука не могла быть подсунута заранее
+func rotateSession(w http.ResponseWriter, r *http.Request, userID int) error {
+	oldSession, _ := store.Get(r, sessionName)
+	oldSession.Options.MaxAge = -1
+	if err := oldSession.Save(r, w); err != nil {
 		log.Println(err.Error())
+		return err
 	}
+
+	newSession := sessions.NewSession(store, sessionName)
+	options := store.options
+	newSession.Options = &options
+	newSession.IsNew = true
+	newSession.Values["user_id"] = userID
+	newSession.Values["csrf_token"] = newCSRFToken()
+	return newSession.Save(r, w)
 }
 
-func AuthTwitchHandler(w http.ResponseWriter, r *http.Request) {
-	url := oauthConfig.AuthCodeURL("state", oauth2.AccessTypeOnline)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+// API-токены
+
+const (
+	apiTokenSessionKey = "api_token_id"
+	apiTokenRateLimit  = 60
+	apiTokenRateWindow = time.Minute
+)
+
+type apiTokenUsage struct {
+	windowStart time.Time
+	count       int
 }
 
-func AdminAuthHandler(w http.ResponseWriter, r *http.Request) {
-	url := adminOAuthConfig.AuthCodeURL("state", oauth2.AccessTypeOffline)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+var (
+	apiTokenUsageMutex = &sync.Mutex{}
+	apiTokenUsageByID  = map[int]*apiTokenUsage{}
+	apiTokenUsageSwept time.Time
+)
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
 }
 
-func AdminCallbackHandler(w http.ResponseWriter, r *http.Request) {
-	code := r.URL.Query().Get("code")
-	token, err := adminOAuthConfig.Exchange(r.Context(), code)
+func tokenHasScope(token models.APIToken, scope string) bool {
+	for _, s := range token.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
 
-	log.Println("Access token " + token.AccessToken + "\nRefresh Token " + token.RefreshToken)
+// Фиксированное окно: не больше apiTokenRateLimit запросов в минуту на токен
+func allowAPITokenRequest(tokenID int) (bool, time.Duration) {
+	apiTokenUsageMutex.Lock()
+	defer apiTokenUsageMutex.Unlock()
 
-	if err != nil {
-		log.Printf("Admin token exchange error: %v", err)
-		http.Error(w, "Failed to exchange token", http.StatusInternalServerError)
-		return
+	now := time.Now()
+
+	// Раз в окно выкидываем токены, окно которых уже закончилось
+	if now.Sub(apiTokenUsageSwept) >= apiTokenRateWindow {
+		maps.DeleteFunc(apiTokenUsageByID, func(_ int, usage *apiTokenUsage) bool {
+			return now.Sub(usage.windowStart) >= apiTokenRateWindow
+		})
+		apiTokenUsageSwept = now
 	}
 
-	os.Setenv("TWITCH_BOT_TOKEN", token.AccessToken)
-	err = os.Setenv("TWITCH_BOT_REFRESH_TOKEN", token.RefreshToken)
-	if err != nil {
-		log.Printf("Failed to save: %v", err)
+	usage, ok := apiTokenUsageByID[tokenID]
+	if !ok || now.Sub(usage.windowStart) >= apiTokenRateWindow {
+		usage = &apiTokenUsage{windowStart: now}
+		apiTokenUsageByID[tokenID] = usage
 	}
 
-	service.SaveTokens(token.AccessToken, token.RefreshToken)
+	if usage.count >= apiTokenRateLimit {
+		return false, apiTokenRateWindow - now.Sub(usage.windowStart)
+	}
+	usage.count++
+	return true, 0
+}
 
-	// Получаем ID бота
-	req, _ := http.NewRequest("GET", "https://api.twitch.tv/helix/users", nil)
-	req.Header.Set("Client-ID", os.Getenv("TWITCH_CLIENT_ID_BOT"))
-	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+// Пускает запросы с токеном нужного scope. Без заголовка Authorization
+// просто передает запрос дальше, где его проверит обычная сессионная авторизация.
+func APITokenMiddleware(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := bearerToken(r)
+		if raw == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Failed to get bot info: %v", err)
-		http.Error(w, "Failed to get bot ID", http.StatusInternalServerError)
-		return
+		token, err := service.AuthenticateAPIToken(raw)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Println(err.Error())
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		if !tokenHasScope(token, scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			writeAPIErrorDetails(w, http.StatusForbidden, "Forbidden", map[string]string{"scope": scope})
+			return
+		}
+
+		if ok, retry := allowAPITokenRequest(token.ID); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			writeAPIError(w, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+
+		// Сессия только на время запроса, в базу не сохраняется
+		session, _ := store.Get(r, sessionName)
+		session.Values["user_id"] = token.UserID
+		session.Values[apiTokenSessionKey] = token.ID
+
+		next.ServeHTTP(w, r)
 	}
-	defer resp.Body.Close()
+}
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	var userData struct {
-		Data []struct {
-			ID string `json:"id"`
-		} `json:"data"`
+func APITokensHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
 	}
-	json.Unmarshal(body, &userData)
 
-	log.Println(userData.Data)
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "Wrong request")
+			return
+		}
 
-	if len(userData.Data) == 0 {
-		http.Error(w, "Failed to get bot ID", http.StatusInternalServerError)
+		token, raw, err := service.CreateAPIToken(userID, r.FormValue("name"), r.Form["scope"])
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		token.Token = raw
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(token)
 		return
 	}
 
-	// Перезапускаем приложение
-	http.Redirect(w, r, "/admin", http.StatusFound)
-}
-
-func AuthCallbackHandler(w http.ResponseWriter, r *http.Request) {
-	code := r.URL.Query().Get("code")
-	token, err := oauthConfig.Exchange(r.Context(), code)
+	tokens, err := service.GetAPITokens(userID)
 	if err != nil {
-		log.Printf("Token exchange error: %v", err)
-		http.Error(w, "Failed to exchange token: "+err.Error(), http.StatusInternalServerError)
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
 
-	//log.Println("Token: " + token.AccessToken)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
 
-	// Получаем информацию о пользователе с правильными заголовками
-	req, err := http.NewRequest("GET", "https://api.twitch.tv/helix/users", nil)
+func RevokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		log.Printf("Request creation error: %v", err)
-		http.Error(w, "Failed to create request: "+err.Error(), http.StatusInternalServerError)
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
 		return
 	}
 
-	// Устанавливаем обязательные заголовки
-	req.Header.Set("Client-ID", oauthConfig.ClientID)
-	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	err = service.RevokeAPIToken(userID, tokenID)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
 	if err != nil {
-		log.Printf("API request error: %v", err)
-		http.Error(w, "Failed to get user info: "+err.Error(), http.StatusInternalServerError)
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
-	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
+	apiTokenUsageMutex.Lock()
+	delete(apiTokenUsageByID, tokenID)
+	apiTokenUsageMutex.Unlock()
 
-	//log.Println(string(body))
+	w.WriteHeader(http.StatusOK)
+}
 
-	var userData struct {
-		Data []models.User `json:"data"`
-	}
-	if err := json.Unmarshal(body, &userData); err != nil || len(userData.Data) == 0 {
-		http.Error(w, "Failed to parse user info", http.StatusInternalServerError)
-		return
-	}
+// Ошибки API
+
+var apiErrorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+	http.StatusBadGateway:            "bad_gateway",
+}
 
-	twitchUser := userData.Data[0]
-	user, err := service.CreateOrUpdateUser(twitchUser)
-	if err != nil {
-		log.Println(err.Error())
-		http.Error(w, "Failed to get user info: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+// Статусы для известных ошибок сервиса
+var serviceErrorStatuses = []struct {
+	err    error
+	status int
+}{
+	{sql.ErrNoRows, http.StatusNotFound},
+	{service.ErrPostNotFound, http.StatusNotFound},
+	{service.ErrCommentNotFound, http.StatusNotFound},
+	{service.ErrParentCommentNotFound, http.StatusNotFound},
+	{service.ErrCollectionNotFound, http.StatusNotFound},
+	{service.ErrNotInInventory, http.StatusNotFound},
+	{service.ErrCaseOpeningNotFound, http.StatusNotFound},
+	{service.ErrUserBanned, http.StatusForbidden},
+	{service.ErrPostNotLiked, http.StatusConflict},
+	{service.ErrCommentNotLiked, http.StatusConflict},
+	{service.ErrCommentExists, http.StatusConflict},
+	{service.ErrAlreadyAdmin, http.StatusConflict},
+	{service.ErrNotModerator, http.StatusConflict},
+	{service.ErrNotEnoughBalance, http.StatusConflict},
+	{service.ErrAlreadyFollowing, http.StatusConflict},
+	{service.ErrNotFollowing, http.StatusConflict},
+	{service.ErrDuplicateMessage, http.StatusConflict},
+	{service.ErrTooManyTokens, http.StatusConflict},
+	{service.ErrCaseMisconfigured, http.StatusConflict},
+	{service.ErrCaseSeedChanged, http.StatusConflict},
+	{service.ErrIdempotencyKeyReused, http.StatusUnprocessableEntity},
+	{service.ErrOutboxJobNotFound, http.StatusNotFound},
+	{service.ErrTradeOfferNotFound, http.StatusNotFound},
+	{service.ErrRecipientBanned, http.StatusConflict},
+	{service.ErrTradeItemsMissing, http.StatusConflict},
+	{service.ErrNotSellable, http.StatusConflict},
+	{service.ErrShopItemNotFound, http.StatusNotFound},
+	{service.ErrShopDiscountNotFound, http.StatusNotFound},
+	{service.ErrShopItemUnavailable, http.StatusConflict},
+	{service.ErrShopItemSoldOut, http.StatusConflict},
+	{service.ErrPurchaseLimitReached, http.StatusConflict},
+	{service.ErrAlreadyOwned, http.StatusConflict},
+	{service.ErrPurchaseNotFound, http.StatusNotFound},
+	{service.ErrRedemptionNotFound, http.StatusNotFound},
+}
 
-	// if err != nil {
-	// 	log.Println("Failed to save user " + err.Error())
-	// 	http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
-	// 	return
-	// }
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
 
-	if err := rotateSession(w, r, user.ID); err != nil {
-		log.Println("Ia nakosyachil tut: " + err.Error())
-		http.Error(w, "Failed to create secure session", http.StatusInternalServerError)
-		return
+// Ответ с ошибкой: {"error": {"code": "...", "message": "...", "details": ...}}
+func writeAPIErrorDetails(w http.ResponseWriter, status int, message string, details interface{}) {
+	code, ok := apiErrorCodes[status]
+	if !ok {
+		code = strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
 	}
 
-	// session, _ := store.Get(r, sessionName)
-	// session.Values["user_id"] = user.ID
-	// err = session.Save(r, w)
-	// if err != nil {
-	// 	log.Println("Failed to save session " + err.Error())
-	// 	http.Error(w, "Failed to save session", http.StatusBadRequest)
-	// 	return
-	// }
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error models.APIError `json:"error"`
+	}{models.APIError{Code: code, Message: message, Details: details}})
+}
 
-	http.Redirect(w, r, "/", http.StatusFound)
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIErrorDetails(w, status, message, nil)
 }
 
-func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		session, err := store.Get(r, sessionName)
-		if err != nil {
-			log.Println(err.Error())
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
-		}
-		_, ok := session.Values["user_id"]
-		if !ok {
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
-		}
-		next.ServeHTTP(w, r)
+// Переводит ошибку сервиса в статус. Неизвестные ошибки логируются и отдаются как 500.
+func writeServiceError(w http.ResponseWriter, err error) {
+	var validation *service.ValidationError
+	if errors.As(err, &validation) {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, validation.Message, map[string]string{"field": validation.Field})
+		return
 	}
-}
 
-// Проверка модератора
-func ModeratorMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		session, _ := store.Get(r, sessionName)
-		user_id, ok := session.Values["user_id"]
-		if !ok {
-			http.Redirect(w, r, "/notfound", http.StatusFound)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505": // unique_violation
+			writeAPIError(w, http.StatusConflict, "Already exists")
 			return
-		}
-		if service.CheckModeratorOrAdminRole(user_id.(int)) {
-			next.ServeHTTP(w, r)
-		} else {
-			http.Redirect(w, r, "/notfound", http.StatusFound)
+		case "23503": // foreign_key_violation
+			writeAPIError(w, http.StatusNotFound, "Not found")
 			return
 		}
 	}
-}
 
-// Проверка админа
-func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		session, _ := store.Get(r, sessionName)
-		user_id, ok := session.Values["user_id"]
-		if !ok {
-			http.Redirect(w, r, "/notfound", http.StatusFound)
-			return
-		}
-		if service.CheckAdminRole(user_id.(int)) {
-			next.ServeHTTP(w, r)
-		} else {
-			http.Redirect(w, r, "/notfound", http.StatusFound)
+	for _, e := range serviceErrorStatuses {
+		if errors.Is(err, e.err) {
+			message := err.Error()
+			if e.err == sql.ErrNoRows {
+				message = "Not found"
+			}
+			writeAPIError(w, e.status, message)
 			return
 		}
 	}
-}
-
-func ServeModeratorPage(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
-	if !ok {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
-	}
-
-	user, err := service.GetUserByID(userID.(int))
-	if err != nil {
-		log.Println("Не удалось получить пользователя из БД" + err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
-		return
-	}
-
-	tmpl, err := template.New("moderator.html").Funcs(template.FuncMap{
-		"isVideo": func(filename string) bool {
-			ext := strings.ToLower(filepath.Ext(filename))
-			return ext == ".mp4" || ext == ".mov" || ext == ".avi" || ext == ".webm"
-		},
-		"formatViews":    service.FormatViews,
-		"checkModRole":   service.CheckModeratorOrAdminRole,
-		"checkAdminRole": service.CheckAdminRole,
-		"safeHTML": func(s string) template.HTML {
-			return template.HTML(s)
-		},
-		"hasNotifications": service.HasNotifications,
-	}).ParseFiles("templates/moderator.html")
-	if err != nil {
-		log.Println(err.Error())
-	}
 
-	err = tmpl.Execute(w, user)
-	if err != nil {
-		log.Println(err.Error())
-	}
+	log.Println(err.Error())
+	writeAPIError(w, http.StatusInternalServerError, "Internal error")
 }
 
-func ServeAdminPage(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
-	if !ok {
-		http.Redirect(w, r, "/", http.StatusFound)
+// Неизвестный маршрут: API отвечает JSON, страницы уводят на /notfound
+func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	if isAPIRequest(r) {
+		writeAPIError(w, http.StatusNotFound, "Not found")
 		return
 	}
+	http.Redirect(w, r, "/notfound", http.StatusFound)
+}
 
-	user, err := service.GetUserByID(userID.(int))
-	if err != nil {
-		log.Println("Не удалось получить пользователя из БД" + err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	if isAPIRequest(r) {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
 
-	tmpl, err := template.New("admin.html").Funcs(template.FuncMap{
-		"isVideo": func(filename string) bool {
-			ext := strings.ToLower(filepath.Ext(filename))
-			return ext == ".mp4" || ext == ".mov" || ext == ".avi"
-		},
-		"formatViews":      service.FormatViews,
-		"checkModRole":     service.CheckModeratorOrAdminRole,
-		"checkAdminRole":   service.CheckAdminRole,
-		"hasNotifications": service.HasNotifications,
-	}).ParseFiles("templates/admin.html")
+// Страница ошибки без технических подробностей
+func renderErrorPage(w http.ResponseWriter, status int, message string) {
+	tmpl, err := template.ParseFiles("templates/error.html")
 	if err != nil {
 		log.Println(err.Error())
-	}
-
-	stats, err := service.GetStats()
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		http.Error(w, message, status)
 		return
 	}
 
-	data := struct {
-		User  *models.User
-		Stats models.Stats
-	}{
-		User:  user,
-		Stats: stats,
-	}
-
-	err = tmpl.Execute(w, data)
+	w.WriteHeader(status)
+	err = tmpl.Execute(w, struct {
+		Status  int
+		Message string
+	}{status, message})
 	if err != nil {
 		log.Println(err.Error())
 	}
 }
 
-func GetModerationPostsHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	page, err := strconv.Atoi(vars["page"])
-	if err != nil {
-		http.Error(w, "Wrong request", http.StatusInternalServerError)
-		return
-	}
-
-	if page < 1 {
-		page = 1
-	}
-
-	limit := 10
-	offset := (page - 1) * limit
+// CSRF
 
-	posts, err := service.GetModerationPosts(limit, offset)
-	if err != nil {
-		http.Error(w, "Wrong request", http.StatusInternalServerError)
-		return
-	}
+const (
+	csrfSessionKey = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(posts)
+// Пути, которые изменяют состояние без сессии и защищены своим токеном
+var csrfExemptPaths = map[string]bool{
+	"/unsubscribe": true,
 }
 
-func ApprovePostHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
-	if !ok {
-		http.Error(w, "Wrong request", http.StatusInternalServerError)
-		return
-	}
-	vars := mux.Vars(r)
-	post_id, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		http.Error(w, "Wrong request", http.StatusInternalServerError)
-		return
-	}
-
-	err = service.ApprovePost(userID.(int), post_id)
-	if err != nil {
-		http.Error(w, "Wrong request", http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
+func newCSRFToken() string {
+	return base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
 }
 
-func RejectPostHandler(w http.ResponseWriter, r *http.Request) {
+// Токен текущей сессии для <meta name="csrf-token">. Сессиям, созданным до появления CSRF, выдается новый.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
 	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
-	if !ok {
-		http.Error(w, "Wrong request", http.StatusInternalServerError)
-		return
+	if token, ok := session.Values[csrfSessionKey].(string); ok {
+		return token
 	}
-	vars := mux.Vars(r)
-	post_id, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		http.Error(w, "Wrong request: "+err.Error(), http.StatusInternalServerError)
-		return
+	if _, ok := session.Values["user_id"]; !ok {
+		return ""
 	}
 
-	err = service.RejectPost(userID.(int), post_id)
-	if err != nil {
-		http.Error(w, "Wrong request: "+err.Error(), http.StatusInternalServerError)
-		return
+	token := newCSRFToken()
+	session.Values[csrfSessionKey] = token
+	if err := session.Save(r, w); err != nil {
+		log.Println(err.Error())
+		return ""
 	}
-
-	w.WriteHeader(http.StatusOK)
+	return token
 }
 
-func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
-	if !ok {
-		http.Error(w, "Wrong request", http.StatusInternalServerError)
-		return
-	}
-	vars := mux.Vars(r)
-	post_id, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		http.Error(w, "Wrong request: "+err.Error(), http.StatusInternalServerError)
-		return
+// Запрос пришел с нашего сайта: проверяем Origin, а если его нет - Referer
+func isSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
 	}
-
-	err = service.DeletePost(userID.(int), post_id)
-	if err != nil {
-		http.Error(w, "Wrong request: "+err.Error(), http.StatusInternalServerError)
-		return
+	if origin == "" {
+		// Старые браузеры могут не прислать ни того, ни другого - остается проверка токена
+		return true
 	}
 
-	w.WriteHeader(http.StatusOK)
-}
-
-func BanUserHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
-	if !ok {
-		http.Error(w, "Wrong request", http.StatusInternalServerError)
-		return
-	}
-	vars := mux.Vars(r)
-	user_id, err := strconv.Atoi(vars["id"])
+	u, err := url.Parse(origin)
 	if err != nil {
-		http.Error(w, "Wrong request", http.StatusInternalServerError)
-		log.Println(err.Error())
-		return
+		return false
 	}
-
-	err = service.BanUser(userID.(int), user_id)
-	if err != nil {
-		http.Error(w, "Wrong request", http.StatusInternalServerError)
-		log.Println(err.Error())
-		return
+	if u.Host == r.Host {
+		return true
 	}
-
-	w.WriteHeader(http.StatusOK)
+	base, err := url.Parse(service.BaseURL())
+	return err == nil && u.Host == base.Host
 }
 
-func BanUsernameHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
-	if !ok {
-		http.Error(w, "Wrong request", http.StatusInternalServerError)
+func csrfError(w http.ResponseWriter, r *http.Request, message string) {
+	if isAPIRequest(r) {
+		writeAPIError(w, http.StatusForbidden, message)
 		return
 	}
-	vars := mux.Vars(r)
-	username := vars["username"]
+	http.Error(w, message, http.StatusForbidden)
+}
 
-	target, err := service.GetUserByUsername(username)
-	if err != nil {
-		if !ok {
-			http.Error(w, "Wrong request", http.StatusInternalServerError)
+// Проверяет Origin/Referer и CSRF-токен у всех изменяющих запросов
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Токен в заголовке браузер сам не подставит, так что CSRF здесь невозможен
+		if csrfExemptPaths[r.URL.Path] || bearerToken(r) != "" {
+			next.ServeHTTP(w, r)
 			return
 		}
-	}
 
-	switch r.Method {
-	case "POST":
-		err = service.BanUser(userID.(int), target.ID)
-		if err != nil {
-			http.Error(w, "Wrong request", http.StatusInternalServerError)
-			log.Println(err.Error())
+		if !isSameOrigin(r) {
+			csrfError(w, r, "Forbidden")
 			return
 		}
-	case "DELETE":
-		err = service.UnbanUser(userID.(int), target.ID)
-		if err != nil {
-			http.Error(w, "Wrong request", http.StatusInternalServerError)
-			log.Println(err.Error())
+
+		session, _ := store.Get(r, sessionName)
+		expected, _ := session.Values[csrfSessionKey].(string)
+
+		provided := r.Header.Get(csrfHeader)
+		if provided == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			provided = r.PostFormValue(csrfFormField)
+		}
+
+		if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(provided)) != 1 {
+			csrfError(w, r, "Invalid CSRF token")
 			return
 		}
-	}
 
-	w.WriteHeader(http.StatusOK)
+		next.ServeHTTP(w, r)
+	})
 }
 
-func ServeMainPage(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "/", http.StatusFound)
+func UpdateConfig() {
+	oauthConfig.ClientID = os.Getenv("TWITCH_CLIENT_ID")
+	oauthConfig.ClientSecret = os.Getenv("TWITCH_CLIENT_SECRET")
+	oauthConfig.RedirectURL = service.BaseURL() + "/auth/callback"
+	store = createAhuetSecureSession()
+	trustedProxies = loadTrustedProxies()
+
+	adminOAuthConfig.ClientID = os.Getenv("TWITCH_CLIENT_ID_BOT")
+	adminOAuthConfig.ClientSecret = os.Getenv("TWITCH_CLIENT_SECRET_BOT")
+	adminOAuthConfig.RedirectURL = service.BaseURL() + "/admin/callback"
+
+	channelsToCheck = service.LoadChannelsToCheck()
 }
 
-func ServeFeedPage(w http.ResponseWriter, r *http.Request) {
+func ServeHomePage(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
-	if !ok {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+	if userID, ok := session.Values["user_id"]; ok {
+		_, err := service.GetUserByID(userID.(int))
+
+		if err == nil {
+
+			user, err := service.GetUserByID(userID.(int))
+			if err != nil {
+				log.Println("Не удалось получить пользователя из БД c ID " + strconv.Itoa(userID.(int)) + " " + err.Error())
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+
+			last_files, err := service.GetLastFilesWithAuthors()
+			if err != nil {
+				log.Println("Ошибка получения файлов:", err)
+				last_files = []models.FileWithAuthor{} // Пустой список при ошибке
+			}
+
+			popular_files, err := service.GetMostPopularWithAuthors()
+			if err != nil {
+				log.Println("Ошибка получения файлов:", err)
+				popular_files = []models.FileWithAuthor{} // Пустой список при ошибке
+			}
+
+			last_seen_files, err := service.GetLastSeenFilesWithAuthors(user.ID)
+			if err != nil {
+				log.Println("Ошибка получения файлов:", err)
+				last_seen_files = []models.FileWithAuthor{} // Пустой список при ошибке
+			}
+
+			new_followings, err := service.GetNewFollowings(user.ID)
+			if err != nil {
+				log.Println("Ошибка получения файлов:", err)
+				new_followings = []models.FileWithAuthor{} // Пустой список при ошибке
+			}
+
+			data := struct {
+				User             *models.User            `json:"user"`
+				MostPopularFiles []models.FileWithAuthor `json:"popular_files"`
+				LastFiles        []models.FileWithAuthor `json:"files"`
+				LastSeen         []models.FileWithAuthor `json:"last_seen"`
+				Followings       []models.FileWithAuthor `json:"followings"`
+			}{
+				User:             user,
+				MostPopularFiles: popular_files,
+				LastFiles:        last_files,
+				LastSeen:         last_seen_files,
+				Followings:       new_followings,
+			}
+
+			tmpl, err := template.New("main.html").Funcs(template.FuncMap{
+				"isVideo": func(filename string) bool {
+					ext := strings.ToLower(filepath.Ext(filename))
+					return ext == ".mp4" || ext == ".mov" || ext == ".avi"
+				},
+				"formatViews":      service.FormatViews,
+				"checkModRole":     checkModRole(r),
+				"checkAdminRole":   checkAdminRole(r),
+				"hasNotifications": service.HasNotifications,
+				"csrfToken":        func() string { return csrfToken(w, r) },
+				"hasFollowings":    service.HasFollowings,
+				"formatLikes":      service.FormatLikes,
+				"formatValue":      service.FormatValue,
+			}).ParseFiles("templates/main.html")
+			if err != nil {
+				log.Println(err.Error())
+			}
+			err = tmpl.Execute(w, data)
+			if err != nil {
+				log.Println(err.Error())
+			}
+			return
+		}
 	}
 
-	user, err := service.GetUserByID(userID.(int))
+	tmpl, err := template.ParseFiles("templates/home.html")
 	if err != nil {
-		log.Println("Не удалось получить пользователя из БД" + err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		log.Println("Не удалось получить шаблон страницы профиля" + err.Error())
+		http.Error(w, "Template error", http.StatusInternalServerError)
 		return
 	}
 
-	tmpl, err := template.New("feed.html").Funcs(template.FuncMap{
-		"isVideo": func(filename string) bool {
-			ext := strings.ToLower(filepath.Ext(filename))
-			return ext == ".mp4" || ext == ".mov" || ext == ".avi"
-		},
-		"formatViews":    service.FormatViews,
-		"checkModRole":   service.CheckModeratorOrAdminRole,
-		"checkAdminRole": service.CheckAdminRole,
-		"safeHTML": func(s string) template.HTML {
-			return template.HTML(s)
-		},
-		"hasNotifications": service.HasNotifications,
-	}).ParseFiles("templates/feed.html")
+	err = tmpl.Execute(w, nil)
 	if err != nil {
 		log.Println(err.Error())
 	}
+}
 
-	err = tmpl.Execute(w, user)
-	if err != nil {
-		log.Println(err.Error())
+// Начало OAuth: одноразовые state и PKCE verifier хранятся в серверной сессии
+func startOAuth(w http.ResponseWriter, r *http.Request, config *oauth2.Config, flow string, opts ...oauth2.AuthCodeOption) {
+	session, _ := store.Get(r, sessionName)
+
+	state := newCSRFToken()
+	verifier := oauth2.GenerateVerifier()
+	session.Values[oauthStateKey] = flow + ":" + state
+	session.Values[oauthVerifierKey] = verifier
+	session.Values[oauthReturnKey] = safeReturnPath(r)
+
+	if err := session.Save(r, w); err != nil {
+		log.Println("Не удалось сохранить состояние OAuth: " + err.Error())
+		renderErrorPage(w, http.StatusInternalServerError, "Не удалось начать вход. Попробуйте еще раз.")
+		return
 	}
+
+	opts = append(opts, oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, config.AuthCodeURL(state, opts...), http.StatusTemporaryRedirect)
 }
 
-func ServeUploadPage(w http.ResponseWriter, r *http.Request) {
+// Проверяет state из колбэка и возвращает verifier и страницу возврата.
+// Значения одноразовые: удаляются из сессии при любой проверке.
+func finishOAuth(w http.ResponseWriter, r *http.Request, flow string) (verifier, returnTo string, ok bool) {
 	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
-	if !ok {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+
+	expected, _ := session.Values[oauthStateKey].(string)
+	verifier, _ = session.Values[oauthVerifierKey].(string)
+	returnTo, _ = session.Values[oauthReturnKey].(string)
+
+	delete(session.Values, oauthStateKey)
+	delete(session.Values, oauthVerifierKey)
+	delete(session.Values, oauthReturnKey)
+	if !session.IsNew {
+		if err := session.Save(r, w); err != nil {
+			log.Println(err.Error())
+		}
 	}
 
-	user, err := service.GetUserByID(userID.(int))
-	if err != nil {
-		log.Println("Не удалось получить пользователя из БД" + err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
-		return
+	state := r.URL.Query().Get("state")
+	if expected == "" || verifier == "" || state == "" ||
+		subtle.ConstantTimeCompare([]byte(expected), []byte(flow+":"+state)) != 1 {
+		return "", "", false
 	}
 
-	tmpl, err := template.New("upload.html").Funcs(template.FuncMap{
-		"isVideo": func(filename string) bool {
-			ext := strings.ToLower(filepath.Ext(filename))
-			return ext == ".mp4" || ext == ".mov" || ext == ".avi"
-		},
-		"formatViews":      service.FormatViews,
-		"checkModRole":     service.CheckModeratorOrAdminRole,
-		"checkAdminRole":   service.CheckAdminRole,
-		"hasNotifications": service.HasNotifications,
-	}).ParseFiles("templates/upload.html")
-	if err != nil {
-		log.Println(err.Error())
+	if returnTo == "" {
+		returnTo = "/"
 	}
+	return verifier, returnTo, true
+}
 
-	err = tmpl.Execute(w, user)
-	if err != nil {
-		log.Println(err.Error())
+// Страница, куда вернуть пользователя после входа: ?return_to= или Referer с нашего сайта
+func safeReturnPath(r *http.Request) string {
+	target := r.URL.Query().Get("return_to")
+	if target == "" {
+		if referer, err := url.Parse(r.Referer()); err == nil && referer.Host == r.Host {
+			target = referer.RequestURI()
+		}
+	}
+
+	if !isLocalPath(target) || strings.HasPrefix(target, "/auth/") {
+		return "/"
 	}
+	return target
 }
 
-func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, sessionName)
-	session.Options.MaxAge = -1
-	session.Save(r, w)
-	http.Redirect(w, r, "/", http.StatusFound)
+// Только путь на нашем сайте. Браузеры выкидывают из адреса табы и переводы
+// строк, так что "/\t/evil.com" превратится в "//evil.com": такие символы
+// и обратные слеши отклоняются до разбора
+func isLocalPath(target string) bool {
+	if strings.ContainsFunc(target, func(c rune) bool { return unicode.IsSpace(c) || unicode.IsControl(c) || c == '\\' }) {
+		return false
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return false
+	}
+	return strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") && !strings.HasPrefix(u.Path, "//")
 }
 
-func GenerateTwitchAccessToken(clientID, clientSecret string) (string, error) {
-	// URL для запроса токена
-	authURL := "https://id.twitch.tv/oauth2/token"
+func AuthTwitchHandler(w http.ResponseWriter, r *http.Request) {
+	startOAuth(w, r, oauthConfig, "login", oauth2.AccessTypeOnline)
+}
 
-	// Формируем данные для POST-запроса
-	data := url.Values{}
-	data.Set("client_id", clientID)
-	data.Set("client_secret", clientSecret)
-	data.Set("grant_type", "client_credentials")
+func AdminAuthHandler(w http.ResponseWriter, r *http.Request) {
+	startOAuth(w, r, adminOAuthConfig, "admin", oauth2.AccessTypeOffline)
+}
 
-	// Создаем HTTP-запрос
-	req, err := http.NewRequest("POST", authURL, strings.NewReader(data.Encode()))
+func AdminCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	verifier, _, ok := finishOAuth(w, r, "admin")
+	if !ok {
+		renderErrorPage(w, http.StatusBadRequest, "Сессия входа устарела. Попробуйте авторизовать бота еще раз.")
+		return
+	}
+
+	code := r.URL.Query().Get("code")
+	token, err := adminOAuthConfig.Exchange(r.Context(), code, oauth2.VerifierOption(verifier))
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		log.Printf("Admin token exchange error: %v", err)
+		renderErrorPage(w, http.StatusBadGateway, "Twitch не подтвердил авторизацию бота.")
+		return
 	}
 
-	// Устанавливаем заголовки
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	os.Setenv("TWITCH_BOT_TOKEN", token.AccessToken)
+	err = os.Setenv("TWITCH_BOT_REFRESH_TOKEN", token.RefreshToken)
+	if err != nil {
+		log.Printf("Failed to save: %v", err)
+	}
+
+	service.SaveTokens(token.AccessToken, token.RefreshToken)
+
+	// Получаем ID бота
+	req, _ := http.NewRequest("GET", "https://api.twitch.tv/helix/users", nil)
+	req.Header.Set("Client-ID", os.Getenv("TWITCH_CLIENT_ID_BOT"))
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
 
-	// Отправляем запрос
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("authentication failed: %w", err)
+		log.Printf("Failed to get bot info: %v", err)
+		renderErrorPage(w, http.StatusBadGateway, "Не удалось получить данные бота из Twitch.")
+		return
 	}
 	defer resp.Body.Close()
 
-	// Проверяем статус ответа
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return "", fmt.Errorf("twitch auth error (%d): %s", resp.StatusCode, string(body))
+	body, _ := ioutil.ReadAll(resp.Body)
+	var userData struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
 	}
+	json.Unmarshal(body, &userData)
 
-	// Парсим ответ
-	var tokenData models.TwitchTokenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&tokenData); err != nil {
-		return "", fmt.Errorf("failed to parse token response: %w", err)
+	log.Println(userData.Data)
+
+	if len(userData.Data) == 0 {
+		renderErrorPage(w, http.StatusBadGateway, "Не удалось получить данные бота из Twitch.")
+		return
 	}
 
-	return tokenData.AccessToken, nil
+	// Перезапускаем приложение
+	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
-func UploadClipHandler(w http.ResponseWriter, r *http.Request) {
-	title := r.FormValue("title")
-	if title == "" {
-		http.Error(w, "Название обязательно", http.StatusBadRequest)
+func AuthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	verifier, returnTo, ok := finishOAuth(w, r, "login")
+	if !ok {
+		renderErrorPage(w, http.StatusBadRequest, "Сессия входа устарела. Попробуйте войти еще раз.")
 		return
 	}
 
-	clipURL := r.FormValue("clipUrl")
-	if clipURL == "" {
-		http.Error(w, "Ссылка обязательна", http.StatusBadRequest)
+	// Пользователь отменил вход на стороне Twitch
+	if r.URL.Query().Get("error") != "" {
+		http.Redirect(w, r, returnTo, http.StatusFound)
 		return
 	}
 
-	description := r.FormValue("description")
-
-	parsedURL, err := url.Parse(clipURL)
+	code := r.URL.Query().Get("code")
+	token, err := oauthConfig.Exchange(r.Context(), code, oauth2.VerifierOption(verifier))
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusBadRequest)
-		return
-	}
-
-	// Разбиваем путь на сегменты
-	segments := strings.Split(strings.Trim(parsedURL.Path, "/"), "/")
-	if len(segments) == 0 {
-		http.Error(w, "Internal error", http.StatusBadRequest)
+		log.Printf("Token exchange error: %v", err)
+		renderErrorPage(w, http.StatusBadGateway, "Twitch не подтвердил вход. Попробуйте еще раз.")
 		return
 	}
 
-	// Извлекаем идентификатор клипа (последний сегмент пути)
-	clipID := segments[len(segments)-1]
+	//log.Println("Token: " + token.AccessToken)
 
-	// Валидация идентификатора
-	validID := regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
-	if !validID.MatchString(clipID) {
-		http.Error(w, "Internal error", http.StatusBadRequest)
+	// Получаем информацию о пользователе с правильными заголовками
+	req, err := http.NewRequest("GET", "https://api.twitch.tv/helix/users", nil)
+	if err != nil {
+		log.Printf("Request creation error: %v", err)
+		renderErrorPage(w, http.StatusInternalServerError, "Не удалось выполнить вход. Попробуйте еще раз.")
 		return
 	}
 
-	// Формируем HTML для встраивания
-	embedHTML := fmt.Sprintf(
-		`<iframe src="https://clips.twitch.tv/embed?clip=%s&parent=ehworld.ru" `+
-			`width="640" height="360" frameborder="0" `+
-			`allowfullscreen="true" scrolling="no"></iframe>`,
-		clipID)
+	// Устанавливаем обязательные заголовки
+	req.Header.Set("Client-ID", oauthConfig.ClientID)
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
 
-	thumbnail, err := GetClipThumbnail(clipID)
+	client := &http.Client{}
+	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Println("Error:", err)
+		log.Printf("API request error: %v", err)
+		renderErrorPage(w, http.StatusBadGateway, "Не удалось получить профиль из Twitch.")
 		return
 	}
+	defer resp.Body.Close()
 
-	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
-	if !ok {
-		http.Error(w, "Неавторизованный доступ", http.StatusUnauthorized)
-		return
-	}
+	body, _ := io.ReadAll(resp.Body)
 
-	// Сохраняем информацию в БД
-	fileInfo := models.File{
-		UserID:      userID.(int),
-		Title:       title,
-		FileName:    embedHTML,
-		Thumbnail:   thumbnail,
-		IsPublic:    false,
-		Description: description,
+	//log.Println(string(body))
+
+	var userData struct {
+		Data []models.User `json:"data"`
+	}
+	if err := json.Unmarshal(body, &userData); err != nil || len(userData.Data) == 0 {
+		log.Printf("Не удалось разобрать профиль Twitch: %s", body)
+		renderErrorPage(w, http.StatusBadGateway, "Не удалось получить профиль из Twitch.")
+		return
 	}
 
-	id, err := service.SaveClip(&fileInfo)
+	twitchUser := userData.Data[0]
+	user, err := service.CreateOrUpdateUser(twitchUser)
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusBadRequest)
+		log.Println(err.Error())
+		renderErrorPage(w, http.StatusInternalServerError, "Не удалось сохранить профиль. Попробуйте еще раз.")
 		return
 	}
 
-	data := struct {
-		Id int `json:"id"`
-	}{
-		Id: id,
+	// if err != nil {
+	// 	log.Println("Failed to save user " + err.Error())
+	// 	http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+	// 	return
+	// }
+
+	if err := rotateSession(w, r, user.ID); err != nil {
+		log.Println("Ia nakosyachil tut: " + err.Error())
+		renderErrorPage(w, http.StatusInternalServerError, "Не удалось создать сессию. Попробуйте еще раз.")
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
+	// session, _ := store.Get(r, sessionName)
+	// session.Values["user_id"] = user.ID
+	// err = session.Save(r, w)
+	// if err != nil {
+	// 	log.Println("Failed to save session " + err.Error())
+	// 	http.Error(w, "Failed to save session", http.StatusBadRequest)
+	// 	return
+	// }
+
+	http.Redirect(w, r, returnTo, http.StatusFound)
 }
 
-func GetClipThumbnail(clipID string) (string, error) {
-	// Создаем HTTP-запрос
-	req, err := http.NewRequest("GET", "https://api.twitch.tv/helix/clips", nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+// Страницы без входа уводят на главную, API отвечает 401
+func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := store.Get(r, sessionName)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		if _, ok := session.Values["user_id"]; err != nil || !ok {
+			if isAPIRequest(r) {
+				writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		next.ServeHTTP(w, r)
 	}
+}
 
-	accessToken, err := GenerateTwitchAccessToken(oauthConfig.ClientID, oauthConfig.ClientSecret)
-	if err != nil {
-		return "", nil
-	}
+// Права пользователя загружаются одним запросом и живут до конца HTTP-запроса:
+// их проверяют и middleware, и шаблон в шапке каждой страницы
+type permissionsCacheKey struct{}
 
-	// Добавляем параметры и заголовки
-	q := req.URL.Query()
-	q.Add("id", clipID)
-	req.URL.RawQuery = q.Encode()
-	req.Header.Set("Client-Id", oauthConfig.ClientID)
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+type permissionsCache struct {
+	mu     sync.Mutex
+	byUser map[int]map[string]bool
+}
 
-	// Выполняем запрос
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("API request failed: %w", err)
-	}
-	defer resp.Body.Close()
+func PermissionsCacheMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cache := &permissionsCache{byUser: map[int]map[string]bool{}}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), permissionsCacheKey{}, cache)))
+	})
+}
 
-	// Проверяем статус ответа
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("twitch API error: %s", resp.Status)
+func hasPermission(r *http.Request, userID int, permission string) bool {
+	cache, ok := r.Context().Value(permissionsCacheKey{}).(*permissionsCache)
+	if !ok {
+		return service.HasPermission(userID, permission)
 	}
 
-	// Читаем и парсим ответ
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	set, ok := cache.byUser[userID]
+	if !ok {
+		set = service.GetUserPermissionSet(userID)
+		cache.byUser[userID] = set
 	}
+	return set[permission]
+}
 
-	var clipData models.ClipResponse
-	if err := json.Unmarshal(body, &clipData); err != nil {
-		return "", fmt.Errorf("failed to parse JSON: %w", err)
-	}
+// Функции шаблонов: показывать ли ссылки на модерацию и админ панель
+func checkModRole(r *http.Request) func(int) bool {
+	return func(userID int) bool { return hasPermission(r, userID, "approve_posts") }
+}
 
-	// Проверяем наличие данных
-	if len(clipData.Data) == 0 {
-		return "", fmt.Errorf("clip data not found")
-	}
+func checkAdminRole(r *http.Request) func(int) bool {
+	return func(userID int) bool { return hasPermission(r, userID, "admin_panel") }
+}
 
-	return clipData.Data[0].ThumbnailURL, nil
+func hasPermissionFunc(r *http.Request) func(int, string) bool {
+	return func(userID int, permission string) bool { return hasPermission(r, userID, permission) }
 }
 
-func UploadHandler(w http.ResponseWriter, r *http.Request) {
-	// Ограничиваем размер файла (100 MB)
-	r.ParseMultipartForm(100 << 20)
+// Проверка права из service.Permissions
+func PermissionMiddleware(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, sessionName)
+		userID, ok := session.Values["user_id"].(int)
+		if !ok {
+			if isAPIRequest(r) {
+				writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+			http.Redirect(w, r, "/notfound", http.StatusFound)
+			return
+		}
+		if !hasPermission(r, userID, permission) {
+			if isAPIRequest(r) {
+				writeAPIErrorDetails(w, http.StatusForbidden, "Forbidden", map[string]string{"permission": permission})
+				return
+			}
+			http.Redirect(w, r, "/notfound", http.StatusFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
 
-	file, handler, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "Ошибка при получении файла", http.StatusBadRequest)
+func ServeModeratorPage(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	defer file.Close()
 
-	title := r.FormValue("title")
-	if title == "" {
-		http.Error(w, "Название обязательно", http.StatusBadRequest)
+	user, err := service.GetUserByID(userID.(int))
+	if err != nil {
+		log.Println("Не удалось получить пользователя из БД" + err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
-	description := r.FormValue("description")
+	tmpl, err := template.New("moderator.html").Funcs(template.FuncMap{
+		"isVideo": func(filename string) bool {
+			ext := strings.ToLower(filepath.Ext(filename))
+			return ext == ".mp4" || ext == ".mov" || ext == ".avi" || ext == ".webm"
+		},
+		"formatViews":    service.FormatViews,
+		"checkModRole":   checkModRole(r),
+		"checkAdminRole": checkAdminRole(r),
+		"safeHTML": func(s string) template.HTML {
+			return template.HTML(s)
+		},
+		"hasNotifications": service.HasNotifications,
+		"csrfToken":        func() string { return csrfToken(w, r) },
+	}).ParseFiles("templates/moderator.html")
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	err = tmpl.Execute(w, user)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
 
+func ServeAdminPage(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, sessionName)
 	userID, ok := session.Values["user_id"]
 	if !ok {
-		http.Error(w, "Неавторизованный доступ", http.StatusUnauthorized)
+		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	// Создаем директорию для загрузок
-	os.MkdirAll("./static/uploads", os.ModePerm)
-
-	// Генерируем уникальное имя файла
-	newFileName := service.GenerateUniqueFileName(handler.Filename)
-	filePath := "./static/uploads/" + newFileName
-
-	// Сохраняем файл
-	dst, err := os.Create(filePath)
+	user, err := service.GetUserByID(userID.(int))
 	if err != nil {
-		http.Error(w, "Ошибка сохранения файла", http.StatusInternalServerError)
-		return
-	}
-	defer dst.Close()
-
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Ошибка копирования файла", http.StatusInternalServerError)
+		log.Println("Не удалось получить пользователя из БД" + err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
-	// Сохраняем информацию в БД
-	fileInfo := models.File{
-		UserID:      userID.(int),
-		Title:       title,
-		FileName:    newFileName,
-		FileSize:    handler.Size,
-		IsPublic:    false,
-		Description: description,
+	tmpl, err := template.New("admin.html").Funcs(template.FuncMap{
+		"isVideo": func(filename string) bool {
+			ext := strings.ToLower(filepath.Ext(filename))
+			return ext == ".mp4" || ext == ".mov" || ext == ".avi"
+		},
+		"formatViews":      service.FormatViews,
+		"checkModRole":     checkModRole(r),
+		"checkAdminRole":   checkAdminRole(r),
+		"hasPermission":    hasPermissionFunc(r),
+		"hasNotifications": service.HasNotifications,
+		"csrfToken":        func() string { return csrfToken(w, r) },
+	}).ParseFiles("templates/admin.html")
+	if err != nil {
+		log.Println(err.Error())
 	}
 
-	if service.IsVideoFile(newFileName) {
-		thumbFileName := "thumb_" + strings.ReplaceAll(
-			strings.TrimSuffix(newFileName, filepath.Ext(newFileName)),
-			" ", "_") + ".jpg"
-		thumbPath := "./static/uploads/" + thumbFileName
-
-		if err := service.GenerateThumbnail(filePath, thumbPath); err == nil {
-			fileInfo.Thumbnail = thumbFileName
-		} else {
-			log.Printf("Ошибка генерации превью: %v", err)
-		}
-	}
-	id, err := service.SaveFile(&fileInfo)
+	stats, err := service.GetStats()
 	if err != nil {
-		go os.Remove(filePath)
-		http.Error(w, "Ошибка сохранения информации", http.StatusInternalServerError)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
 	data := struct {
-		Id int `json:"id"`
+		User  *models.User
+		Stats models.Stats
 	}{
-		Id: id,
+		User:  user,
+		Stats: stats,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println(err.Error())
+	}
 }
 
-func ServePostPage(w http.ResponseWriter, r *http.Request) {
-	var authorised bool
+func GetModerationPostsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	fileID, err := strconv.Atoi(vars["id"])
+	page, err := strconv.Atoi(vars["page"])
 	if err != nil {
-		http.Redirect(w, r, "/notfound", http.StatusFound)
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
 		return
 	}
-	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"].(int)
-	var user *models.User
-	if !ok {
-		authorised = false
-	} else {
-		authorised = true
-		user, _ = service.GetUserByID(userID)
+
+	if page < 1 {
+		page = 1
 	}
 
-	// Увеличить просмотры
-	service.IncrementViews(fileID)
+	limit := 10
+	offset := (page - 1) * limit
 
-	// Получить данные
-	var file *models.FileWithAuthor
-	var comments []models.CommentWithAuthor
-	var hasLiked, hasFucked bool
-	if authorised {
-		file, err = service.GetFileByIDAuthorised(fileID, userID)
-		if err != nil {
-			log.Println(err.Error())
-			http.Redirect(w, r, "/notfound", http.StatusNotFound)
-			return
-		}
-		comments, err = service.GetComments(user.ID, fileID)
-		if err != nil {
-			comments = []models.CommentWithAuthor{}
-		}
-		hasLiked, _ = service.HasLiked(userID, fileID)
-		hasFucked, _ = service.HasFuckYou(userID, fileID)
-	} else {
-		file, err = service.GetFileByID(fileID)
-		if err != nil {
-			http.Redirect(w, r, "/notfound", http.StatusNotFound)
-			return
-		}
-		comments, err = service.GetCommentsUnauthorised(fileID)
-		if err != nil {
-			comments = []models.CommentWithAuthor{}
-		}
+	posts, err := service.GetModerationPosts(limit, offset)
+	if err != nil {
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
 	}
 
-	data := struct {
-		User       *models.User
-		File       *models.FileWithAuthor
-		Comments   []models.CommentWithAuthor
-		HasLiked   bool
-		HasFuckYou bool
-	}{
-		User:       user,
-		File:       file,
-		Comments:   comments,
-		HasLiked:   hasLiked,
-		HasFuckYou: hasFucked,
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(posts)
+}
+
+func ApprovePostHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	vars := mux.Vars(r)
+	post_id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
 	}
 
-	if ok {
-		tmpl, err := template.New("post.html").Funcs(template.FuncMap{
-			"isVideo": func(filename string) bool {
-				ext := strings.ToLower(filepath.Ext(filename))
-				return ext == ".mp4" || ext == ".mov" || ext == ".avi" || ext == ".webm"
-			},
-			"formatTimeAgo":  service.FormatTimeAgo,
-			"formatViews":    service.FormatViews,
-			"checkModRole":   service.CheckModeratorOrAdminRole,
-			"checkAdminRole": service.CheckAdminRole,
-			"safeHTML": func(s string) template.HTML {
-				return template.HTML(s)
-			},
-			"hasDescription":   service.HasDescription,
-			"hasNotifications": service.HasNotifications,
-			"hasBadge":         service.HasBadge,
-		}).ParseFiles("templates/post.html")
-		if err != nil {
-			log.Println(err.Error())
-		}
-		err = tmpl.Execute(w, data)
-		if err != nil {
-			log.Println(err.Error())
-		}
-	} else {
-		tmpl, err := template.New("postunauthorised.html").Funcs(template.FuncMap{
-			"isVideo": func(filename string) bool {
-				ext := strings.ToLower(filepath.Ext(filename))
-				return ext == ".mp4" || ext == ".mov" || ext == ".avi" || ext == ".webm"
-			},
-			"formatTimeAgo":  service.FormatTimeAgo,
-			"formatViews":    service.FormatViews,
-			"checkModRole":   service.CheckModeratorOrAdminRole,
-			"checkAdminRole": service.CheckAdminRole,
-			"safeHTML": func(s string) template.HTML {
-				return template.HTML(s)
-			},
-			"hasDescription":   service.HasDescription,
-			"hasNotifications": service.HasNotifications,
-			"hasBadge":         service.HasBadge,
-		}).ParseFiles("templates/postunauthorised.html")
-		if err != nil {
-			log.Println(err.Error())
-		}
-		err = tmpl.Execute(w, data)
-		if err != nil {
-			log.Println(err.Error())
+	err = service.ApprovePost(userID.(int), post_id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeAPIError(w, http.StatusNotFound, "Not found")
+			return
 		}
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
 	}
+	notifyOutbox()
 
+	w.WriteHeader(http.StatusOK)
 }
 
-func LikeHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	fileID, _ := strconv.Atoi(vars["id"])
-
+func RejectPostHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, sessionName)
-	userID, _ := session.Values["user_id"].(int)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	vars := mux.Vars(r)
+	post_id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
 
-	if r.Method == "POST" {
-		err := service.LikeFile(userID, fileID)
-		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, "Internal error", http.StatusInternalServerError)
-			return
-		}
-	} else {
-		err := service.UnlikeFile(userID, fileID)
-		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, "Internal error", http.StatusInternalServerError)
+	err = service.RejectPost(userID.(int), post_id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeAPIError(w, http.StatusNotFound, "Not found")
 			return
 		}
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func FuckYouHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	fileID, _ := strconv.Atoi(vars["id"])
-
+func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, sessionName)
-	userID, _ := session.Values["user_id"].(int)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	vars := mux.Vars(r)
+	post_id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
 
-	if r.Method == "POST" {
-		err := service.FuckYouFile(userID, fileID)
-		if err != nil {
-			http.Error(w, "Internal error", http.StatusInternalServerError)
-			log.Println(err.Error())
-			return
-		}
-	} else {
-		err := service.UnFuckYouFile(userID, fileID)
-		if err != nil {
-			http.Error(w, "Internal error", http.StatusInternalServerError)
-			log.Println(err.Error())
+	err = service.DeletePost(userID.(int), post_id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeAPIError(w, http.StatusNotFound, "Not found")
 			return
 		}
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func LikeCommentHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	fileID, _ := strconv.Atoi(vars["id"])
-
+func BanUserHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, sessionName)
-	userID, _ := session.Values["user_id"].(int)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	vars := mux.Vars(r)
+	user_id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
 
-	if r.Method == "POST" {
-		err := service.LikeComment(userID, fileID)
-		if err != nil {
-			log.Println("Не удалось поставить лайк комментарию: " + err.Error())
-			http.Error(w, "Internal error", http.StatusInternalServerError)
-			return
-		}
-	} else {
-		err := service.UnlikeComment(userID, fileID)
-		if err != nil {
-			log.Println("Не удалось убрать лайк с комментария: " + err.Error())
-			http.Error(w, "Internal error", http.StatusInternalServerError)
-			return
-		}
+	err = service.BanUser(userID.(int), user_id)
+	if err != nil {
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func CommentHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	fileID, _ := strconv.Atoi(vars["id"])
-
+func BanUsernameHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, sessionName)
-	userID, _ := session.Values["user_id"].(int)
-
-	text := r.FormValue("text")
-	parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	vars := mux.Vars(r)
+	username := vars["username"]
 
-	comment := models.Comment{
-		UserID:   userID,
-		FileID:   fileID,
-		Text:     text,
-		ParentID: parentID,
+	target, err := service.GetUserByUsername(username)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
 	}
 
 	switch r.Method {
 	case "POST":
-		id, _ := service.AddComment(&comment)
-		user, _ := service.GetUserByID(userID)
-		comment.AuthorName = user.DisplayName
-		comment.ID = id
-		com_wth_author := models.CommentWithAuthor{
-			Comment:               comment,
-			AuthorProfileImageURL: user.ProfileImageURL,
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(com_wth_author)
-
-	case "DELETE":
-		// Проверка прав
-		comment.ID = fileID
-		comment.UserID = userID
-		if !service.IsCommentOwner(&comment) {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
-		}
-		err := service.DeleteComment(&comment)
+		err = service.BanUser(userID.(int), target.ID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusForbidden)
-			return
-		}
-
-	case "PUT":
-		if !service.IsCommentOwner(&comment) {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+			log.Println(err.Error())
+			writeAPIError(w, http.StatusInternalServerError, "Internal error")
 			return
 		}
-
-		err := service.UpdateComment(&comment)
+	case "DELETE":
+		err = service.UnbanUser(userID.(int), target.ID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusForbidden)
+			log.Println(err.Error())
+			writeAPIError(w, http.StatusInternalServerError, "Internal error")
 			return
 		}
-		json.NewEncoder(w).Encode(comment)
 	}
 
-	// Возвращаем новый комментарий
-	// w.Header().Set("Content-Type", "application/json")
-	// json.NewEncoder(w).Encode(comment)
+	w.WriteHeader(http.StatusOK)
 }
 
-func ServeNotFoundPage(w http.ResponseWriter, r *http.Request) {
-	authorized := true
+func ServeMainPage(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func ServeFeedPage(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, sessionName)
 	userID, ok := session.Values["user_id"]
 	if !ok {
-		authorized = false
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
 	}
 
-	if authorized {
-		user, err := service.GetUserByID(userID.(int))
-		if err != nil {
-			log.Println("Не удалось получить пользователя из БД" + err.Error())
-			http.Redirect(w, r, "/notfound", http.StatusFound)
-			return
-		}
+	user, err := service.GetUserByID(userID.(int))
+	if err != nil {
+		log.Println("Не удалось получить пользователя из БД" + err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
 
-		data := struct {
-			User *models.User `json:"user"`
-		}{
-			User: user,
-		}
+	tmpl, err := template.New("feed.html").Funcs(template.FuncMap{
+		"isVideo": func(filename string) bool {
+			ext := strings.ToLower(filepath.Ext(filename))
+			return ext == ".mp4" || ext == ".mov" || ext == ".avi"
+		},
+		"formatViews":    service.FormatViews,
+		"checkModRole":   checkModRole(r),
+		"checkAdminRole": checkAdminRole(r),
+		"safeHTML": func(s string) template.HTML {
+			return template.HTML(s)
+		},
+		"hasNotifications": service.HasNotifications,
+		"csrfToken":        func() string { return csrfToken(w, r) },
+	}).ParseFiles("templates/feed.html")
+	if err != nil {
+		log.Println(err.Error())
+	}
 
-		tmpl, err := template.New("notfoundauthorised.html").Funcs(template.FuncMap{
-			"checkModRole":     service.CheckModeratorOrAdminRole,
-			"checkAdminRole":   service.CheckAdminRole,
-			"hasNotifications": service.HasNotifications,
+	err = tmpl.Execute(w, user)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func ServeUploadPage(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := service.GetUserByID(userID.(int))
+	if err != nil {
+		log.Println("Не удалось получить пользователя из БД" + err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.New("upload.html").Funcs(template.FuncMap{
+		"isVideo": func(filename string) bool {
+			ext := strings.ToLower(filepath.Ext(filename))
+			return ext == ".mp4" || ext == ".mov" || ext == ".avi"
+		},
+		"formatViews":      service.FormatViews,
+		"checkModRole":     checkModRole(r),
+		"checkAdminRole":   checkAdminRole(r),
+		"hasNotifications": service.HasNotifications,
+		"csrfToken":        func() string { return csrfToken(w, r) },
+	}).ParseFiles("templates/upload.html")
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	err = tmpl.Execute(w, user)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	session.Options.MaxAge = -1
+	session.Save(r, w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func GenerateTwitchAccessToken(clientID, clientSecret string) (string, error) {
+	// URL для запроса токена
+	authURL := "https://id.twitch.tv/oauth2/token"
+
+	// Формируем данные для POST-запроса
+	data := url.Values{}
+	data.Set("client_id", clientID)
+	data.Set("client_secret", clientSecret)
+	data.Set("grant_type", "client_credentials")
+
+	// Создаем HTTP-запрос
+	req, err := http.NewRequest("POST", authURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Устанавливаем заголовки
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Отправляем запрос
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("authentication failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Проверяем статус ответа
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("twitch auth error (%d): %s", resp.StatusCode, string(body))
+	}
+
+	// Парсим ответ
+	var tokenData models.TwitchTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenData); err != nil {
+		return "", fmt.Errorf("failed to parse token response: %w", err)
+	}
+
+	return tokenData.AccessToken, nil
+}
+
+func UploadClipHandler(w http.ResponseWriter, r *http.Request) {
+	title := r.FormValue("title")
+	if title == "" {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Название обязательно", map[string]string{"field": "title"})
+		return
+	}
+
+	clipURL := r.FormValue("clipUrl")
+	if clipURL == "" {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Ссылка обязательна", map[string]string{"field": "clipUrl"})
+		return
+	}
+
+	description := r.FormValue("description")
+
+	parsedURL, err := url.Parse(clipURL)
+	if err != nil {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Неверная ссылка на клип", map[string]string{"field": "clipUrl"})
+		return
+	}
+
+	// Разбиваем путь на сегменты
+	segments := strings.Split(strings.Trim(parsedURL.Path, "/"), "/")
+	if len(segments) == 0 {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Неверная ссылка на клип", map[string]string{"field": "clipUrl"})
+		return
+	}
+
+	// Извлекаем идентификатор клипа (последний сегмент пути)
+	clipID := segments[len(segments)-1]
+
+	// Валидация идентификатора
+	validID := regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	if !validID.MatchString(clipID) {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Неверная ссылка на клип", map[string]string{"field": "clipUrl"})
+		return
+	}
+
+	// Формируем HTML для встраивания
+	embedHTML := fmt.Sprintf(
+		`<iframe src="https://clips.twitch.tv/embed?clip=%s&parent=ehworld.ru" `+
+			`width="640" height="360" frameborder="0" `+
+			`allowfullscreen="true" scrolling="no"></iframe>`,
+		clipID)
+
+	thumbnail, err := GetClipThumbnail(clipID)
+	if err != nil {
+		fmt.Println("Error:", err)
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Клип не найден", map[string]string{"field": "clipUrl"})
+		return
+	}
+
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// Сохраняем информацию в БД
+	fileInfo := models.File{
+		UserID:      userID.(int),
+		Title:       title,
+		FileName:    embedHTML,
+		Thumbnail:   thumbnail,
+		IsPublic:    false,
+		Description: description,
+	}
+
+	id, err := service.SaveClip(&fileInfo)
+	if err != nil {
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	data := struct {
+		Id int `json:"id"`
+	}{
+		Id: id,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func GetClipThumbnail(clipID string) (string, error) {
+	// Создаем HTTP-запрос
+	req, err := http.NewRequest("GET", "https://api.twitch.tv/helix/clips", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	accessToken, err := GenerateTwitchAccessToken(oauthConfig.ClientID, oauthConfig.ClientSecret)
+	if err != nil {
+		return "", nil
+	}
+
+	// Добавляем параметры и заголовки
+	q := req.URL.Query()
+	q.Add("id", clipID)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Client-Id", oauthConfig.ClientID)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	// Выполняем запрос
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Проверяем статус ответа
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("twitch API error: %s", resp.Status)
+	}
+
+	// Читаем и парсим ответ
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var clipData models.ClipResponse
+	if err := json.Unmarshal(body, &clipData); err != nil {
+		return "", fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	// Проверяем наличие данных
+	if len(clipData.Data) == 0 {
+		return "", fmt.Errorf("clip data not found")
+	}
+
+	return clipData.Data[0].ThumbnailURL, nil
+}
+
+func UploadHandler(w http.ResponseWriter, r *http.Request) {
+	// Ограничиваем размер файла (100 MB)
+	r.ParseMultipartForm(100 << 20)
+
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Файл обязателен", map[string]string{"field": "file"})
+		return
+	}
+	defer file.Close()
+
+	title := r.FormValue("title")
+	if title == "" {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Название обязательно", map[string]string{"field": "title"})
+		return
+	}
+
+	description := r.FormValue("description")
+
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// Создаем директорию для загрузок
+	os.MkdirAll("./static/uploads", os.ModePerm)
+
+	// Генерируем уникальное имя файла
+	newFileName := service.GenerateUniqueFileName(handler.Filename)
+	filePath := "./static/uploads/" + newFileName
+
+	// Сохраняем файл
+	dst, err := os.Create(filePath)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Ошибка сохранения файла")
+		return
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, file); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Ошибка копирования файла")
+		return
+	}
+
+	// Сохраняем информацию в БД
+	fileInfo := models.File{
+		UserID:      userID.(int),
+		Title:       title,
+		FileName:    newFileName,
+		FileSize:    handler.Size,
+		IsPublic:    false,
+		Description: description,
+	}
+
+	if service.IsVideoFile(newFileName) {
+		thumbFileName := "thumb_" + strings.ReplaceAll(
+			strings.TrimSuffix(newFileName, filepath.Ext(newFileName)),
+			" ", "_") + ".jpg"
+		thumbPath := "./static/uploads/" + thumbFileName
+
+		if err := service.GenerateThumbnail(filePath, thumbPath); err == nil {
+			fileInfo.Thumbnail = thumbFileName
+		} else {
+			log.Printf("Ошибка генерации превью: %v", err)
+		}
+	}
+	id, err := service.SaveFile(&fileInfo)
+	if err != nil {
+		go os.Remove(filePath)
+		writeAPIError(w, http.StatusInternalServerError, "Ошибка сохранения информации")
+		return
+	}
+
+	data := struct {
+		Id int `json:"id"`
+	}{
+		Id: id,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func ServePostPage(w http.ResponseWriter, r *http.Request) {
+	var authorised bool
+	vars := mux.Vars(r)
+	fileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Redirect(w, r, "/notfound", http.StatusFound)
+		return
+	}
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	var user *models.User
+	if !ok {
+		authorised = false
+	} else {
+		authorised = true
+		user, _ = service.GetUserByID(userID)
+	}
+
+	// Увеличить просмотры
+	service.IncrementViews(fileID)
+
+	// Получить данные
+	var file *models.FileWithAuthor
+	var hasLiked, hasFucked, hasBookmarked, inWatchLater bool
+	if authorised {
+		file, err = service.GetFileByIDAuthorised(fileID, userID)
+		if err != nil {
+			log.Println(err.Error())
+			http.Redirect(w, r, "/notfound", http.StatusNotFound)
+			return
+		}
+		hasLiked, _ = service.HasLiked(userID, fileID)
+		hasFucked, _ = service.HasFuckYou(userID, fileID)
+		hasBookmarked, _ = service.HasBookmarked(userID, fileID)
+		inWatchLater, _ = service.IsInWatchLater(userID, fileID)
+	} else {
+		file, err = service.GetFileByID(fileID)
+		if err != nil {
+			http.Redirect(w, r, "/notfound", http.StatusNotFound)
+			return
+		}
+	}
+
+	data := struct {
+		User          *models.User
+		File          *models.FileWithAuthor
+		HasLiked      bool
+		HasFuckYou    bool
+		HasBookmarked bool
+		InWatchLater  bool
+	}{
+		User:          user,
+		File:          file,
+		HasLiked:      hasLiked,
+		HasFuckYou:    hasFucked,
+		HasBookmarked: hasBookmarked,
+		InWatchLater:  inWatchLater,
+	}
+
+	if ok {
+		tmpl, err := template.New("post.html").Funcs(template.FuncMap{
+			"isVideo": func(filename string) bool {
+				ext := strings.ToLower(filepath.Ext(filename))
+				return ext == ".mp4" || ext == ".mov" || ext == ".avi" || ext == ".webm"
+			},
+			"formatTimeAgo":  service.FormatTimeAgo,
+			"formatViews":    service.FormatViews,
+			"checkModRole":   checkModRole(r),
+			"checkAdminRole": checkAdminRole(r),
+			"safeHTML": func(s string) template.HTML {
+				return template.HTML(s)
+			},
+			"hasDescription":   service.HasDescription,
+			"hasNotifications": service.HasNotifications,
+			"csrfToken":        func() string { return csrfToken(w, r) },
+			"hasBadge":         service.HasBadge,
+		}).ParseFiles("templates/post.html")
+		if err != nil {
+			log.Println(err.Error())
+		}
+		err = tmpl.Execute(w, data)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	} else {
+		tmpl, err := template.New("postunauthorised.html").Funcs(template.FuncMap{
+			"isVideo": func(filename string) bool {
+				ext := strings.ToLower(filepath.Ext(filename))
+				return ext == ".mp4" || ext == ".mov" || ext == ".avi" || ext == ".webm"
+			},
+			"formatTimeAgo":  service.FormatTimeAgo,
+			"formatViews":    service.FormatViews,
+			"checkModRole":   checkModRole(r),
+			"checkAdminRole": checkAdminRole(r),
+			"safeHTML": func(s string) template.HTML {
+				return template.HTML(s)
+			},
+			"hasDescription":   service.HasDescription,
+			"hasNotifications": service.HasNotifications,
+			"csrfToken":        func() string { return csrfToken(w, r) },
+			"hasBadge":         service.HasBadge,
+		}).ParseFiles("templates/postunauthorised.html")
+		if err != nil {
+			log.Println(err.Error())
+		}
+		err = tmpl.Execute(w, data)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+}
+
+func LikeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fileID, _ := strconv.Atoi(vars["id"])
+
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+
+	if r.Method == "POST" {
+		err := service.LikeFile(userID, fileID)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	} else {
+		err := service.UnlikeFile(userID, fileID)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func FuckYouHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fileID, _ := strconv.Atoi(vars["id"])
+
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+
+	if r.Method == "POST" {
+		err := service.FuckYouFile(userID, fileID)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	} else {
+		err := service.UnFuckYouFile(userID, fileID)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func LikeCommentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fileID, _ := strconv.Atoi(vars["id"])
+
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+
+	if r.Method == "POST" {
+		err := service.LikeComment(userID, fileID)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	} else {
+		err := service.UnlikeComment(userID, fileID)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func CommentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+
+	text := strings.TrimSpace(r.FormValue("text"))
+	parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+
+	switch r.Method {
+	case "POST":
+		// Для POST в пути передается ID поста
+		if text == "" {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "text"})
+			return
+		}
+
+		comment := models.Comment{
+			UserID:   userID,
+			FileID:   id,
+			Text:     text,
+			ParentID: parentID,
+		}
+		commentID, err := service.AddComment(&comment)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+
+		created, err := service.GetCommentThread(userID, commentID)
+		if err != nil {
+			log.Println(err.Error())
+			writeAPIError(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(created)
+
+	case "DELETE":
+		// Для DELETE и PUT в пути передается ID комментария
+		comment := models.Comment{ID: id, UserID: userID}
+		if !service.IsCommentOwner(&comment) {
+			writeAPIError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		err := service.DeleteComment(&comment)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case "PUT":
+		comment := models.Comment{ID: id, UserID: userID, Text: text}
+		if text == "" {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "text"})
+			return
+		}
+		if !service.IsCommentOwner(&comment) {
+			writeAPIError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+
+		err := service.UpdateComment(&comment)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(comment)
+	}
+}
+
+func GetCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
+	// Гостям комментарии тоже доступны, просто без отметок лайков
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+
+	query := r.URL.Query()
+	sort := query.Get("sort")
+	if !service.IsCommentsSort(sort) {
+		sort = "new"
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 || limit > 50 {
+		limit = 20
+	}
+
+	page, err := service.GetComments(userID, fileID, sort, query.Get("cursor"), limit)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func GetCommentThreadHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	commentID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+
+	thread, err := service.GetCommentThread(userID, commentID)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(thread)
+}
+
+func CommentHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	commentID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
+	edits, err := service.GetCommentEdits(commentID)
+	if err != nil {
+		log.Println("Не удалось получить историю правок: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(edits)
+}
+
+func ServeNotFoundPage(w http.ResponseWriter, r *http.Request) {
+	authorized := true
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		authorized = false
+	}
+
+	if authorized {
+		user, err := service.GetUserByID(userID.(int))
+		if err != nil {
+			log.Println("Не удалось получить пользователя из БД" + err.Error())
+			http.Redirect(w, r, "/notfound", http.StatusFound)
+			return
+		}
+
+		data := struct {
+			User *models.User `json:"user"`
+		}{
+			User: user,
+		}
+
+		tmpl, err := template.New("notfoundauthorised.html").Funcs(template.FuncMap{
+			"checkModRole":     checkModRole(r),
+			"checkAdminRole":   checkAdminRole(r),
+			"hasNotifications": service.HasNotifications,
+			"csrfToken":        func() string { return csrfToken(w, r) },
 		}).ParseFiles("templates/notfoundauthorised.html")
 		if err != nil {
 			log.Println(err.Error())
 		}
-		err = tmpl.Execute(w, data)
+		err = tmpl.Execute(w, data)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	} else {
+		tmpl, err := template.New("notfoundunauthorised.html").Funcs(template.FuncMap{
+			"isVideo": func(filename string) bool {
+				ext := strings.ToLower(filepath.Ext(filename))
+				return ext == ".mp4" || ext == ".mov" || ext == ".avi"
+			},
+			"formatTimeAgo": service.FormatTimeAgo,
+			"formatViews":   service.FormatViews,
+		}).ParseFiles("templates/notfoundunauthorised.html")
+		if err != nil {
+			log.Println(err.Error())
+		}
+		err = tmpl.Execute(w, nil)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
+func ServeUserPageHandler(w http.ResponseWriter, r *http.Request) {
+	authorized := true
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		authorized = false
+	}
+
+	vars := mux.Vars(r)
+	profileUsername := vars["username"]
+
+	if authorized {
+		user, err := service.GetUserByID(userID.(int))
+		if err != nil {
+			log.Println("Не удалось получить пользователя из БД" + err.Error())
+			http.Redirect(w, r, "/notfound", http.StatusFound)
+			return
+		}
+
+		profileUser, err := service.GetUserByUsername(profileUsername)
+		if err != nil {
+			log.Println("Не удалось получить пользователя из БД" + err.Error())
+			http.Redirect(w, r, "/notfound", http.StatusFound)
+			return
+		}
+
+		stats := struct {
+			Likes int
+			Fucks int
+			Posts int
+		}{
+			Likes: service.GetTotalLikes(profileUser.ID),
+			Fucks: service.GetTotalFucks(profileUser.ID),
+			Posts: service.GetTotalPosts(profileUser.ID),
+		}
+
+		badges, err := service.GetUserBadges(profileUser.ID)
+		if err != nil {
+			log.Println("Не удалось получить значки" + err.Error())
+			http.Redirect(w, r, "/notfound", http.StatusFound)
+			return
+		}
+
+		isFollowing := false
+		if user.ID != profileUser.ID {
+			isFollowing = service.CheckFollow(user.ID, profileUser.ID)
+		}
+
+		data := struct {
+			User        *models.User
+			ProfileUser *models.User
+			Stats       interface{}
+			Badges      []models.Badge
+			IsFollowing bool
+			Cosmetics   models.UserCosmetics
+		}{
+			User:        user,
+			ProfileUser: profileUser,
+			Stats:       stats,
+			Badges:      badges,
+			IsFollowing: isFollowing,
+			Cosmetics:   service.GetUserCosmetics(profileUser.ID),
+		}
+
+		tmpl, err := template.New("user.html").Funcs(template.FuncMap{
+			"isVideo": func(filename string) bool {
+				ext := strings.ToLower(filepath.Ext(filename))
+				return ext == ".mp4" || ext == ".mov" || ext == ".avi"
+			},
+			"formatTimeAgo":    service.FormatTimeAgo,
+			"formatViews":      service.FormatViews,
+			"checkModRole":     checkModRole(r),
+			"checkAdminRole":   checkAdminRole(r),
+			"hasNotifications": service.HasNotifications,
+			"csrfToken":        func() string { return csrfToken(w, r) },
+			"formatFollowers":  service.FormatFollowers,
+			"hasBadge":         service.HasBadge,
+		}).ParseFiles("templates/user.html")
+		if err != nil {
+			log.Println(err.Error())
+		}
+		err = tmpl.Execute(w, data)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	} else {
+		profileUser, err := service.GetUserByUsername(profileUsername)
+		if err != nil {
+			log.Println("Не удалось получить пользователя из БД" + err.Error())
+			http.Redirect(w, r, "/notfound", http.StatusFound)
+			return
+		}
+
+		stats := struct {
+			Likes int
+			Fucks int
+			Posts int
+		}{
+			Likes: service.GetTotalLikes(profileUser.ID),
+			Fucks: service.GetTotalFucks(profileUser.ID),
+			Posts: service.GetTotalPosts(profileUser.ID),
+		}
+
+		badges, err := service.GetUserBadges(profileUser.ID)
+		if err != nil {
+			log.Println("Не удалось получить значки" + err.Error())
+			http.Redirect(w, r, "/notfound", http.StatusFound)
+			return
+		}
+
+		data := struct {
+			ProfileUser *models.User
+			Stats       interface{}
+			Badges      []models.Badge
+			Cosmetics   models.UserCosmetics
+		}{
+			ProfileUser: profileUser,
+			Stats:       stats,
+			Badges:      badges,
+			Cosmetics:   service.GetUserCosmetics(profileUser.ID),
+		}
+
+		tmpl, err := template.New("userunauthorised.html").Funcs(template.FuncMap{
+			"isVideo": func(filename string) bool {
+				ext := strings.ToLower(filepath.Ext(filename))
+				return ext == ".mp4" || ext == ".mov" || ext == ".avi"
+			},
+			"formatTimeAgo":   service.FormatTimeAgo,
+			"formatViews":     service.FormatViews,
+			"formatFollowers": service.FormatFollowers,
+			"hasBadge":        service.HasBadge,
+		}).ParseFiles("templates/userunauthorised.html")
+		if err != nil {
+			log.Println(err.Error())
+		}
+		err = tmpl.Execute(w, data)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
+func ServeInventoryPage(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+
+	user, err := service.GetUserByID(userID.(int))
+	if err != nil {
+		log.Println("Не удалось получить пользователя из БД" + err.Error())
+		http.Redirect(w, r, "/notfound", http.StatusFound)
+		return
+	}
+
+	badges, err := service.GetUserBadges(user.ID)
+	if err != nil {
+		http.Redirect(w, r, "/notfound", http.StatusFound)
+		return
+	}
+
+	items, err := service.GetUserInventory(user.ID)
+	if err != nil {
+		http.Redirect(w, r, "/notfound", http.StatusFound)
+		return
+	}
+
+	data := struct {
+		User   *models.User
+		Badges []models.Badge
+		Items  []models.CaseReward
+	}{
+		User:   user,
+		Badges: badges,
+		Items:  items,
+	}
+
+	tmpl, err := template.New("inventory.html").Funcs(template.FuncMap{
+		"isVideo": func(filename string) bool {
+			ext := strings.ToLower(filepath.Ext(filename))
+			return ext == ".mp4" || ext == ".mov" || ext == ".avi"
+		},
+		"formatTimeAgo":    service.FormatTimeAgo,
+		"formatViews":      service.FormatViews,
+		"checkModRole":     checkModRole(r),
+		"checkAdminRole":   checkAdminRole(r),
+		"hasNotifications": service.HasNotifications,
+		"csrfToken":        func() string { return csrfToken(w, r) },
+		"formatFollowers":  service.FormatFollowers,
+		"hasBadge":         service.HasBadge,
+	}).ParseFiles("templates/inventory.html")
+	if err != nil {
+		log.Println(err.Error())
+	}
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func GetUserPostsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, _ := strconv.Atoi(vars["id"])
+
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	contentType := query.Get("type")
+	sort := query.Get("sort")
+	search := query.Get("search")
+
+	// Параметры по умолчанию
+	if page < 1 {
+		page = 1
+	}
+	if limit == 0 {
+		limit = 12
+	}
+
+	// Получение пользователя
+	user, err := service.GetUserByID(userID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	// Получение постов
+	posts, _, err := service.GetUserPosts(user.ID, page, limit, contentType, sort, search)
+	if err != nil {
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	total := service.GetTotalPosts(user.ID)
+
+	response := struct {
+		Posts      []models.File
+		Total      int
+		Page       int
+		TotalPages int
+	}{
+		Posts:      posts,
+		Total:      total,
+		Page:       page,
+		TotalPages: int(math.Ceil(float64(total) / float64(limit))),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	targetID, _ := strconv.Atoi(vars["id"])
+
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		err := service.Subscribe(userID, targetID)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	case "DELETE":
+		err := service.Unsubscribe(userID, targetID)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func ServeShopPage(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := service.GetUserByID(userID.(int))
+	if err != nil {
+		log.Println("Не удалось получить пользователя из БД" + err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	items := service.GetShopItems(user.ID)
+
+	cases := service.GetCases(user.ID)
+
+	tmpl, err := template.New("shop.html").Funcs(template.FuncMap{
+		"isVideo": func(filename string) bool {
+			ext := strings.ToLower(filepath.Ext(filename))
+			return ext == ".mp4" || ext == ".mov" || ext == ".avi"
+		},
+		"formatViews":    service.FormatViews,
+		"checkModRole":   checkModRole(r),
+		"checkAdminRole": checkAdminRole(r),
+		"safeHTML": func(s string) template.HTML {
+			return template.HTML(s)
+		},
+		"hasNotifications": service.HasNotifications,
+		"csrfToken":        func() string { return csrfToken(w, r) },
+		"isVIP":            service.IsVIP,
+		"hasBadge":         service.HasBadge,
+	}).ParseFiles("templates/shop.html")
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	data := struct {
+		User  *models.User
+		Items []models.ShopItem
+		Cases []models.Case
+	}{
+		User:  user,
+		Items: items,
+		Cases: cases,
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func BuyItemHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	vars := mux.Vars(r)
+	itemID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
+	key, ok := idempotencyKey(w, r)
+	if !ok {
+		return
+	}
+
+	err = service.BuyItem(userID.(int), itemID, purchaseInput(r), key)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	notifyOutbox()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func FeedHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit == 0 {
+		limit = 10 // default value
+	}
+
+	posts, err := service.GetFeedPosts(userID, offset, limit)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(posts)
+}
+
+func LastFilesHandler(w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 8
+	}
+
+	offset := (page - 1) * limit
+
+	posts, err := service.GetLastPosts(limit, offset)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		log.Println(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(posts)
+}
+
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if len(query) < 2 || len(query) > 100 { // Невалидный запрос
+		json.NewEncoder(w).Encode([]models.SearchResult{})
+		return
+	}
+
+	searchTerm := "%" + strings.ToLower(query) + "%"
+	results := service.Search(searchTerm)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func UsersSearchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if len(query) < 2 || len(query) > 100 { // Невалидный запрос
+		json.NewEncoder(w).Encode([]models.UserSearchResult{})
+		return
+	}
+
+	searchTerm := "%" + strings.ToLower(query) + "%"
+	results := service.SearchUsers(searchTerm)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func ModeratorRoleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	username := vars["username"]
+
+	// Право manage_moderators не дает менять роль администраторам
+	role, err := service.GetUserRoleByLogin(username)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if role == "admin" {
+		writeAPIError(w, http.StatusForbidden, "Can't change admin role")
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		err := service.AddModerator(username)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	case "DELETE":
+		err := service.DeleteModerator(username)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetModeratorsListHandler(w http.ResponseWriter, r *http.Request) {
+	list := service.GetModeratorsList()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func GetPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := service.GetRolePermissions()
+	if err != nil {
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"permissions": service.Permissions,
+		"roles":       roles,
+	})
+}
+
+func RolePermissionHandler(w http.ResponseWriter, r *http.Request) {
+	role := mux.Vars(r)["role"]
+	permission := r.FormValue("permission")
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if permission == "" || err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
+	if err := service.SetRolePermission(role, permission, enabled); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func UserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+
+	if r.Method == "PUT" {
+		permission := r.FormValue("permission")
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if permission == "" || err != nil {
+			writeAPIError(w, http.StatusBadRequest, "Wrong request")
+			return
+		}
+
+		err = service.SetUserPermission(userID, username, permission, enabled)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	}
+
+	permissions, err := service.GetUserPermissions(username)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(permissions)
+}
+
+func GetNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	cursor, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = notificationsPageLimit
+	}
+
+	locale := service.ParseLocale(r.Header.Get("Accept-Language"))
+	notifications, err := service.GetNotifications(userID, cursor, limit, locale)
+	if err != nil {
+		log.Println("Не удалось получить уведомления: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications)
+}
+
+// SSE-поток новых уведомлений и счетчика непрочитанных
+func NotificationsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	events, unsubscribe := service.SubscribeNotifications(userID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	locale := service.ParseLocale(r.Header.Get("Accept-Language"))
+
+	writeEvent := func(event models.NotificationEvent) error {
+		// Событие общее для всех вкладок, поэтому рендерим копию
+		if event.Notification != nil {
+			n := *event.Notification
+			service.RenderNotification(&n, locale)
+			event.Notification = &n
+		}
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	// Сразу отдаем актуальный счетчик
+	if err := writeEvent(models.NotificationEvent{Unread: service.GetUnreadNotificationsCount(userID)}); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(notificationsPing)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if err := writeEvent(event); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func PushKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key := service.VAPIDPublicKey()
+	if key == "" {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"key": key})
+}
+
+func PushSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var sub models.PushSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil || sub.Endpoint == "" {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case "POST":
+		err = service.SavePushSubscription(userID, sub)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	case "DELETE":
+		err = service.DeletePushSubscription(userID, sub.Endpoint)
+		if err != nil {
+			log.Println(err.Error())
+			writeAPIError(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func ReadNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	notificationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := service.MarkNotificationRead(userID, notificationID); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func ReadAllNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := service.MarkAllNotificationsRead(userID); err != nil {
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func NotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if r.Method == "PUT" {
+		category := r.FormValue("category")
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if category == "" || err != nil {
+			writeAPIError(w, http.StatusBadRequest, "Wrong request")
+			return
+		}
+
+		if err := service.SetNotificationPreference(userID, category, enabled); err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	}
+
+	preferences, err := service.GetNotificationPreferences(userID)
+	if err != nil {
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preferences)
+}
+
+func ServeNotificationsPage(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := service.GetUserByID(userID.(int))
+	if err != nil {
+		log.Println("Не удалось получить пользователя из БД" + err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	preferences, err := service.GetNotificationPreferences(user.ID)
+	if err != nil {
+		log.Println("Не удалось получить настройки уведомлений: " + err.Error())
+		preferences = service.NotificationCategories
+	}
+
+	digest, err := service.GetDigestSettings(user.ID)
+	if err != nil {
+		log.Println("Не удалось получить настройки дайджеста: " + err.Error())
+		digest = models.DigestSettings{Frequency: "off"}
+	}
+
+	tmpl, err := template.New("notifications.html").Funcs(template.FuncMap{
+		"checkModRole":     checkModRole(r),
+		"checkAdminRole":   checkAdminRole(r),
+		"hasNotifications": service.HasNotifications,
+		"csrfToken":        func() string { return csrfToken(w, r) },
+	}).ParseFiles("templates/notifications.html")
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	data := struct {
+		User        *models.User
+		Preferences []models.NotificationPreference
+		Digest      models.DigestSettings
+	}{
+		User:        user,
+		Preferences: preferences,
+		Digest:      digest,
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func DigestSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if r.Method == "PUT" {
+		frequency := r.FormValue("frequency")
+		if !service.IsDigestFrequency(frequency) {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "frequency"})
+			return
+		}
+
+		if err := service.SetDigestFrequency(userID, frequency); err != nil {
+			log.Println(err.Error())
+			writeAPIError(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	}
+
+	settings, err := service.GetDigestSettings(userID)
+	if err != nil {
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// Отписка от дайджеста по ссылке из письма. GET только показывает подтверждение:
+// ссылки из писем открывают почтовые сканеры. Отписывает POST - с этой страницы
+// или от почтового клиента по List-Unsubscribe-Post (RFC 8058)
+func UnsubscribeDigestHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	var valid, unsubscribed bool
+	var err error
+	if r.Method == "POST" {
+		unsubscribed, err = service.UnsubscribeDigest(token)
+		valid = unsubscribed
+	} else {
+		valid, err = service.DigestTokenExists(token)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// Почтовый клиент присылает List-Unsubscribe=One-Click и страницу не ждет
+	if r.Method == "POST" && r.PostFormValue("List-Unsubscribe") == "One-Click" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/unsubscribe.html")
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Valid        bool
+		Unsubscribed bool
+		Token        string
+	}{valid, unsubscribed, token}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func sendDigests() {
+	recipients, err := service.GetDueDigests()
+	if err != nil {
+		log.Printf("Ошибка при выборке дайджестов: %v", err)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/email/digest.html")
+	if err != nil {
+		log.Printf("Ошибка шаблона дайджеста: %v", err)
+		return
+	}
+
+	for _, recipient := range recipients {
+		digest, err := service.BuildDigest(recipient)
+		if err != nil {
+			log.Printf("Не удалось собрать дайджест для %d: %v", recipient.UserID, err)
+			continue
+		}
+
+		var body bytes.Buffer
+		if err := tmpl.Execute(&body, digest); err != nil {
+			log.Printf("Ошибка шаблона дайджеста: %v", err)
+			continue
+		}
+
+		err = service.SendMail(models.MailMessage{
+			To:      recipient.Email,
+			Subject: "Ehworld: ваш дайджест",
+			HTML:    body.String(),
+			Headers: map[string]string{
+				"List-Unsubscribe":      "<" + digest.UnsubscribeURL + ">",
+				"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+			},
+		})
+		if err != nil {
+			log.Printf("Не удалось отправить дайджест для %d: %v", recipient.UserID, err)
+			continue
+		}
+
+		if err := service.MarkDigestSent(recipient.UserID); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
+// Раз в час рассылает дайджесты тем, кому пора
+func StartDigestSender() {
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		sendDigests()
+		<-ticker.C
+	}
+}
+
+func ServeSettingsPage(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := service.GetUserByID(userID.(int))
+	if err != nil {
+		log.Println("Не удалось получить пользователя из БД" + err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	userSessions, err := service.GetUserSessions(user.ID, session.ID)
+	if err != nil {
+		log.Println("Не удалось получить сессии: " + err.Error())
+		userSessions = []models.UserSession{}
+	}
+
+	tokens, err := service.GetAPITokens(user.ID)
+	if err != nil {
+		log.Println("Не удалось получить API-токены: " + err.Error())
+		tokens = []models.APIToken{}
+	}
+
+	var chatLink *models.ChatLink
+	if service.ChatBotEnabled() {
+		chatLink, err = service.GetChatLink(user.ID)
+		if err != nil {
+			log.Println("Не удалось получить привязку чата: " + err.Error())
+		}
+	}
+
+	tmpl, err := template.New("settings.html").Funcs(template.FuncMap{
+		"checkModRole":     checkModRole(r),
+		"checkAdminRole":   checkAdminRole(r),
+		"hasNotifications": service.HasNotifications,
+		"csrfToken":        func() string { return csrfToken(w, r) },
+	}).ParseFiles("templates/settings.html")
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	data := struct {
+		User     *models.User
+		Sessions []models.UserSession
+		Tokens   []models.APIToken
+		Scopes   []models.APITokenScope
+		ChatBot  bool
+		ChatLink *models.ChatLink
+	}{
+		User:     user,
+		Sessions: userSessions,
+		Tokens:   tokens,
+		Scopes:   service.APITokenScopes,
+		ChatBot:  service.ChatBotEnabled(),
+		ChatLink: chatLink,
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func GetSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	userSessions, err := service.GetUserSessions(userID, session.ID)
+	if err != nil {
+		log.Println(err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userSessions)
+}
+
+// Завершает одну сессию по ID или все, кроме текущей
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var err error
+	if id, has := mux.Vars(r)["id"]; has {
+		sessionID, convErr := strconv.Atoi(id)
+		if convErr != nil {
+			writeAPIError(w, http.StatusBadRequest, "Wrong request")
+			return
+		}
+		err = service.RevokeSession(userID, sessionID)
+	} else {
+		err = service.RevokeOtherSessions(userID, session.ID)
+	}
+
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Раз в час удаляет истекшие сессии
+func StartSessionsCleanup() {
+	ticker := time.NewTicker(sessionsCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := service.CleanupSessions(); err != nil {
+			log.Printf("Ошибка при очистке сессий: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// Outbox внешних действий
+
+var outboxWakeup = make(chan struct{}, 1)
+
+// Будит воркер outbox после покупки, чтобы VIP выдался сразу
+func notifyOutbox() {
+	select {
+	case outboxWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Выполняет задачи outbox и раз в час чистит старые ключи идемпотентности
+func StartOutboxWorker() {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	for {
+		// Истекшие VIP попадают в outbox и отзываются в этом же проходе
+		if expired, err := service.ExpireVIPs(); err != nil {
+			log.Printf("Ошибка при отзыве истекших VIP: %v", err)
+		} else if expired > 0 {
+			log.Printf("Истекло VIP: %d", expired)
+		}
+		if _, err := service.ProcessOutbox(); err != nil {
+			log.Printf("Ошибка при обработке outbox: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-outboxWakeup:
+		case <-cleanup.C:
+			if _, err := service.CleanupIdempotencyKeys(); err != nil {
+				log.Printf("Ошибка при очистке ключей идемпотентности: %v", err)
+			}
+		}
+	}
+}
+
+// Паузы между переподключениями чат-бота
+const (
+	chatBotMinWait = 5 * time.Second
+	chatBotMaxWait = 5 * time.Minute
+)
+
+// Держит подключение чат-бота и переподключается после обрыва
+func StartChatBot() {
+	if !service.ChatBotEnabled() {
+		return
+	}
+
+	wait := chatBotMinWait
+	for {
+		started := time.Now()
+		err := service.RunChatBot()
+		log.Printf("Чат-бот отключился: %v", err)
+
+		// Долго проработавшее соединение - обычный обрыв, ждать долго незачем
+		if time.Since(started) > chatBotMaxWait {
+			wait = chatBotMinWait
+		}
+		time.Sleep(wait)
+		wait = min(wait*2, chatBotMaxWait)
+	}
+}
+
+// Привязка аккаунта Twitch из чата: GET - текущая, POST - новый код, DELETE - отвязать
+func ChatLinkHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		code, err := service.CreateChatLinkCode(userID, r.FormValue("login"))
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(code)
+	case "DELETE":
+		if err := service.UnlinkChat(userID); err != nil {
+			log.Println(err.Error())
+			writeAPIError(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		link, err := service.GetChatLink(userID)
+		if err != nil {
+			log.Println(err.Error())
+			writeAPIError(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(link)
+	}
+}
+
+// Ответ покупателя из JSON-тела {"input": "..."}; тело необязательно
+func purchaseInput(r *http.Request) string {
+	var request struct {
+		Input string `json:"input"`
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+	return request.Input
+}
+
+// Ключ из заголовка Idempotency-Key, пустой если его нет
+func idempotencyKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if len(key) > service.MaxIdempotencyKeyLength {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Idempotency key is too long", map[string]string{"field": "Idempotency-Key"})
+		return "", false
+	}
+	return key, true
+}
+
+func GetOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	jobs, err := service.GetPendingOutboxJobs()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func GetActiveVIPsHandler(w http.ResponseWriter, r *http.Request) {
+	grants, err := service.GetActiveVIPs()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grants)
+}
+
+func RetryOutboxJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	if err := service.RetryOutboxJob(jobID); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	notifyOutbox()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetAdminShopItemsHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := service.GetAdminShopItems()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+func UpdateShopItemSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Item not found")
+		return
+	}
+
+	var settings models.ShopItemSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
+	if err := service.UpdateShopItemSettings(itemID, settings); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func ShopDiscountsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		discounts, err := service.GetShopDiscounts()
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(discounts)
+		return
+	}
+
+	var discount models.ShopDiscount
+	if err := json.NewDecoder(r.Body).Decode(&discount); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
+	id, err := service.AddShopDiscount(discount)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int{"id": id})
+}
+
+func DeleteShopDiscountHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Discount not found")
+		return
+	}
+
+	if err := service.DeleteShopDiscount(id); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func GetShopItemTypesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(service.ShopItemTypes())
+}
+
+// Товар любого типа: type, title, cost, картинка file и параметры типа в полях param_<имя>
+func CreateShopItemHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(100 << 20)
+
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Файл обязателен", map[string]string{"field": "file"})
+		return
+	}
+	defer file.Close()
+
+	cost, err := strconv.Atoi(r.FormValue("cost"))
+	if err != nil {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Стоимость должна быть числом", map[string]string{"field": "cost"})
+		return
+	}
+
+	item := models.ShopItem{
+		Type:   r.FormValue("type"),
+		Title:  r.FormValue("title"),
+		Cost:   cost,
+		Params: map[string]string{},
+	}
+	for key, values := range r.MultipartForm.Value {
+		if name, ok := strings.CutPrefix(key, "param_"); ok && len(values) > 0 {
+			item.Params[name] = values[0]
+		}
+	}
+
+	os.MkdirAll("./static/uploads/shop", os.ModePerm)
+	filePath := "./static/uploads/shop/" + service.GenerateUniqueFileName(handler.Filename)
+
+	dst, err := os.Create(filePath)
+	if err != nil {
+		log.Println("Не удалось создать файл: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, file); err != nil {
+		log.Println("Не удалось скопировать файл: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	item.Image = "." + filePath
+	id, err := service.CreateShopItem(item)
+	if err != nil {
+		go os.Remove(filePath)
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int{"id": id})
+}
+
+func GetShopPurchasesHandler(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+
+	purchases, err := service.GetShopPurchases(50, max(offset, 0))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(purchases)
+}
+
+func RefundShopPurchaseHandler(w http.ResponseWriter, r *http.Request) {
+	purchaseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Purchase not found")
+		return
+	}
+
+	if err := service.RefundShopPurchase(purchaseID); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	notifyOutbox()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetRedemptionsHandler(w http.ResponseWriter, r *http.Request) {
+	redemptions, err := service.GetPendingRedemptions()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(redemptions)
+}
+
+func FulfillRedemptionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Redemption not found")
+		return
+	}
+
+	if err := service.FulfillRedemption(id); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetOwnedShopItemsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	items, err := service.GetOwnedShopItems(userID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// POST /api/cosmetics/{id} надевает предмет, DELETE /api/cosmetics/{slot} снимает
+func CosmeticHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := service.UnequipCosmetic(userID, mux.Vars(r)["slot"]); err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	itemID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Item not found")
+		return
+	}
+	if err := service.EquipCosmetic(userID, itemID); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Раз в день чистит старые уведомления
+func StartNotificationsCleanup() {
+	ticker := time.NewTicker(notificationsCleanupAge)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := service.CleanupNotifications(notificationsReadTTL, notificationsUnreadTTL)
+		if err != nil {
+			log.Printf("Ошибка при очистке уведомлений: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Удалено старых уведомлений: %d", deleted)
+		}
+
+		<-ticker.C
+	}
+}
+
+func GetBannedUsersListHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := service.GetBannedUsersList()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		log.Println(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func UploadBadgeHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(100 << 20)
+
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Файл обязателен", map[string]string{"field": "file"})
+		return
+	}
+	defer file.Close()
+
+	title := r.FormValue("title")
+	if title == "" {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Название обязательно", map[string]string{"field": "title"})
+		return
+	}
+
+	cost := r.FormValue("cost")
+	if cost == "" {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Цена обязательна", map[string]string{"field": "cost"})
+		return
+	}
+
+	session, _ := store.Get(r, sessionName)
+	_, ok := session.Values["user_id"]
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// Создаем директорию для загрузок
+	os.MkdirAll("./static/uploads/badges", os.ModePerm)
+
+	// Генерируем уникальное имя файла
+	newFileName := service.GenerateUniqueFileName(handler.Filename)
+	filePath := "./static/uploads/badges/" + newFileName
+
+	// Сохраняем файл
+	dst, err := os.Create(filePath)
+	if err != nil {
+		log.Println("Failed to create file: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, file); err != nil {
+		log.Println("Failed to copy file: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	costValue, err := strconv.Atoi(cost)
+	if err != nil {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Стоимость должна быть числом", map[string]string{"field": "cost"})
+		return
+	}
+
+	err = service.SaveBadge("."+filePath, title, costValue)
+	if err != nil {
+		go os.Remove(filePath)
+		log.Println("Failed to save file to database: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func AddCaseHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(100 << 20)
+
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Файл обязателен", map[string]string{"field": "file"})
+		return
+	}
+	defer file.Close()
+
+	title := r.FormValue("title")
+	if title == "" {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Название обязательно", map[string]string{"field": "title"})
+		return
+	}
+
+	description := r.FormValue("description")
+
+	price := r.FormValue("price")
+	if price == "" {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Цена обязательна", map[string]string{"field": "price"})
+		return
+	}
+
+	// Создаем директорию для загрузок
+	os.MkdirAll("./static/uploads/cases", os.ModePerm)
+
+	// Генерируем уникальное имя файла
+	newFileName := service.GenerateUniqueFileName(handler.Filename)
+	filePath := "./static/uploads/cases/" + newFileName
+
+	// Сохраняем файл
+	dst, err := os.Create(filePath)
+	if err != nil {
+		log.Println("Failed to create file: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, file); err != nil {
+		log.Println("Failed to copy file: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	priceValue, err := strconv.Atoi(price)
+	if err != nil {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Стоимость должна быть числом", map[string]string{"field": "price"})
+		return
+	}
+
+	id, err := service.SaveCase("."+filePath, title, description, priceValue)
+	if err != nil {
+		go os.Remove(filePath)
+		log.Println("Failed to save file to database: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	data := struct {
+		Id int `json:"id"`
+	}{
+		Id: id,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func GetBadgesHandler(w http.ResponseWriter, r *http.Request) {
+	badges := service.GetBadges()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(badges)
+}
+
+func AddRewardsHandler(w http.ResponseWriter, r *http.Request) {
+	rewardType := r.FormValue("type")
+	if rewardType == "" {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Тип обязателен", map[string]string{"field": "type"})
+		return
+	}
+
+	caseID, err := strconv.Atoi(r.FormValue("case_id"))
+	if err != nil {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "ID кейса обязателен", map[string]string{"field": "case_id"})
+		return
+	}
+
+	probability := r.FormValue("probability")
+	var probability_value float64
+	if probability == "" {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Шанс выпадения обязателен", map[string]string{"field": "probability"})
+		return
+	} else {
+		probability_value, err = strconv.ParseFloat(probability, 64)
+		if err != nil {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Шанс выпадения должен быть числом", map[string]string{"field": "probability"})
+			return
+		}
+	}
+
+	badge := r.FormValue("badge_id")
+	var badge_id, auk_value, vip_days int
+	if badge != "" {
+		badge_id, err = strconv.Atoi(badge)
+		if err != nil {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "badge_id"})
+			return
+		}
+	}
+	auk := r.FormValue("auk_value")
+	if auk != "" {
+		auk_value, err = strconv.Atoi(auk)
+		if err != nil {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "auk_value"})
+			return
+		}
+	}
+
+	if days := r.FormValue("vip_days"); days != "" {
+		vip_days, err = strconv.Atoi(days)
+		if err != nil {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "vip_days"})
+			return
+		}
+	}
+
+	reward := models.CaseReward{
+		Type:        rewardType,
+		CaseID:      caseID,
+		BadgeID:     badge_id,
+		AukValue:    auk_value,
+		VIPDays:     vip_days,
+		Probability: probability_value,
+	}
+
+	normalize, _ := strconv.ParseBool(r.FormValue("normalize"))
+	err = service.AddReward(reward, normalize)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Проверка наград всех кейсов
+func GetCaseReportsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+
+	reports, err := service.GetCaseRewardsReports(userID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+func NormalizeCaseRewardsHandler(w http.ResponseWriter, r *http.Request) {
+	caseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Case not found")
+		return
+	}
+
+	report, err := service.NormalizeCaseRewards(caseID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Виртуальные открытия кейса: ?n=число открытий, ?auk_rate=рейтинг за рубль аука
+func SimulateCaseHandler(w http.ResponseWriter, r *http.Request) {
+	caseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Case not found")
+		return
+	}
+
+	n := 10000
+	if value := r.URL.Query().Get("n"); value != "" {
+		if n, err = strconv.Atoi(value); err != nil {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "n must be a number", map[string]string{"field": "n"})
+			return
+		}
+	}
+	aukRate := 1.0
+	if value := r.URL.Query().Get("auk_rate"); value != "" {
+		if aukRate, err = strconv.ParseFloat(value, 64); err != nil {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "auk rate must be a number", map[string]string{"field": "auk_rate"})
+			return
+		}
+	}
+
+	simulation, err := service.SimulateCase(caseID, n, aukRate)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(simulation)
+}
+
+func GetCaseRewardsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	caseID, _ := strconv.Atoi(vars["id"])
+
+	rewards, err := service.GetCaseRewards(caseID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rewards)
+}
+
+func OpenCaseHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	caseID, _ := strconv.Atoi(vars["id"])
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	key, ok := idempotencyKey(w, r)
+	if !ok {
+		return
+	}
+
+	reward, err := service.OpenCase(caseID, userID.(int), key)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	notifyOutbox()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reward)
+}
+
+// Честное открытие кейсов
+func GetCaseSeedHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	seed, err := service.GetCaseSeed(userID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(seed)
+}
+
+// Раскрывает текущий серверный сид и активирует заранее объявленный следующий
+func RotateCaseSeedHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	revealed, current, err := service.RotateCaseSeed(userID, r.FormValue("client_seed"), r.FormValue("next_server_seed_hash"))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	response := map[string]any{"current": current}
+	if revealed.ID != 0 {
+		response["revealed"] = revealed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func GetCaseOpeningsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	openings, err := service.GetUserCaseOpenings(userID, limit, offset)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openings)
+}
+
+func GetCaseOpeningHandler(w http.ResponseWriter, r *http.Request) {
+	openingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Opening not found")
+		return
+	}
+
+	opening, err := service.GetCaseOpening(openingID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(opening)
+}
+
+// Публичная страница проверки открытия
+func ServeFairPage(w http.ResponseWriter, r *http.Request) {
+	openingID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	opening, err := service.GetCaseOpening(openingID)
+	if err != nil {
+		if !errors.Is(err, service.ErrCaseOpeningNotFound) {
+			log.Println(err.Error())
+		}
+		http.Redirect(w, r, "/notfound", http.StatusFound)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/fair.html")
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, opening)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func ApplyBadgeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	badgeID, _ := strconv.Atoi(vars["id"])
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	err := service.ApplyBadge(badgeID, userID.(int))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func ApplyItem(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(100 << 20)
+	vars := mux.Vars(r)
+	itemID, _ := strconv.Atoi(vars["id"])
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	lot_name := r.FormValue("lot_name")
+
+	err := service.ApplyItem(itemID, userID.(int), lot_name)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	notifyOutbox()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Подарки и обмен предметами
+func GiftItemHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	itemID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Item not found")
+		return
+	}
+
+	login := strings.TrimSpace(r.FormValue("login"))
+	if login == "" {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "recipient login is required", map[string]string{"field": "login"})
+		return
+	}
+	quantity := 1
+	if value := r.FormValue("quantity"); value != "" {
+		if quantity, err = strconv.Atoi(value); err != nil {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "quantity must be a number", map[string]string{"field": "quantity"})
+			return
+		}
+	}
+
+	if err := service.GiftItem(userID, login, itemID, quantity); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func SellItemHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	itemID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Item not found")
+		return
+	}
+
+	quantity := 1
+	if value := r.FormValue("quantity"); value != "" {
+		if quantity, err = strconv.Atoi(value); err != nil {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "quantity must be a number", map[string]string{"field": "quantity"})
+			return
+		}
+	}
+
+	result, err := service.SellItem(userID, itemID, quantity)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func RecycleDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	result, err := service.RecycleDuplicates(userID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func GetResaleValuesHandler(w http.ResponseWriter, r *http.Request) {
+	values, err := service.GetResaleValues()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(values)
+}
+
+func SetResaleValueHandler(w http.ResponseWriter, r *http.Request) {
+	value, err := strconv.Atoi(r.FormValue("value"))
+	if err != nil {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "value must be a number", map[string]string{"field": "value"})
+		return
+	}
+
+	if err := service.SetResaleValue(mux.Vars(r)["type"], value); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetTradeOffersHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	offers, err := service.GetTradeOffers(userID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(offers)
+}
+
+// Тело: {"login": "...", "give": [{"reward_id": 1, "quantity": 2}], "want": [...], "message": "..."}
+func CreateTradeOfferHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var request struct {
+		Login   string             `json:"login"`
+		Give    []models.TradeItem `json:"give"`
+		Want    []models.TradeItem `json:"want"`
+		Message string             `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+	if strings.TrimSpace(request.Login) == "" {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "recipient login is required", map[string]string{"field": "login"})
+		return
+	}
+
+	offerID, err := service.CreateTradeOffer(userID, request.Login, request.Give, request.Want, request.Message)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int{"id": offerID})
+}
+
+// action: accept, decline или cancel
+func ResolveTradeOfferHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	vars := mux.Vars(r)
+	offerID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Trade offer not found")
+		return
+	}
+
+	if err := service.ResolveTradeOffer(userID, offerID, vars["action"]); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Инвентарь другого пользователя, чтобы выбрать, что попросить в обмен
+func GetTradePartnerInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := service.GetUserByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	items, err := service.GetUserInventory(user.ID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	for i := range items {
+		items[i].Batches = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+func GetInventoryTransfersHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	transfers, err := service.GetInventoryTransfers(userID, limit, offset)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transfers)
+}
+
+func ServeQueuePage(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := service.GetUserByID(userID.(int))
+	if err != nil {
+		log.Println("Не удалось получить пользователя из БД" + err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.New("queue.html").Funcs(template.FuncMap{
+		"isVideo": func(filename string) bool {
+			ext := strings.ToLower(filepath.Ext(filename))
+			return ext == ".mp4" || ext == ".mov" || ext == ".avi"
+		},
+		"formatViews":    service.FormatViews,
+		"checkModRole":   checkModRole(r),
+		"checkAdminRole": checkAdminRole(r),
+		"safeHTML": func(s string) template.HTML {
+			return template.HTML(s)
+		},
+		"hasNotifications": service.HasNotifications,
+		"csrfToken":        func() string { return csrfToken(w, r) },
+		"isVIP":            service.IsVIP,
+		"hasBadge":         service.HasBadge,
+	}).ParseFiles("templates/queue.html")
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	data := struct {
+		User *models.User
+	}{
+		User: user,
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func GetQueueHandler(w http.ResponseWriter, r *http.Request) {
+	queue, err := service.GetQueue()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(queue)
+}
+
+func DeleteSubmission(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	subID, _ := strconv.Atoi(vars["id"])
+
+	err := service.DeleteSubmission(subID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetLiveChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	// Устанавливаем заголовки CORS
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Проверяем, нужно ли обновить кэш
+	cacheMutex.RLock()
+	needsUpdate := time.Since(lastUpdateTime) > cacheDuration || len(cachedLiveChannels) == 0
+	cacheMutex.RUnlock()
+
+	if needsUpdate {
+		updateLiveChannelsCache()
+	}
+
+	// Получаем кэшированные данные
+	cacheMutex.RLock()
+	liveChannels := make([]models.TwitchStream, len(cachedLiveChannels))
+	copy(liveChannels, cachedLiveChannels)
+	cacheMutex.RUnlock()
+
+	// Разделяем каналы на онлайн и оффлайн
+	var onlineChannels []models.TwitchStream
+	var offlineChannels []models.TwitchStream
+
+	for _, channel := range liveChannels {
+		if channel.IsLive {
+			onlineChannels = append(onlineChannels, channel)
+		} else {
+			offlineChannels = append(offlineChannels, channel)
+		}
+	}
+
+	// Применяем сортировку только к онлайн-каналам
+	sortOrder := r.URL.Query().Get("sort")
+	if sortOrder == "asc" {
+		sort.Slice(onlineChannels, func(i, j int) bool {
+			return onlineChannels[i].ViewerCount < onlineChannels[j].ViewerCount
+		})
+	} else {
+		// По умолчанию сортируем по убыванию
+		sort.Slice(onlineChannels, func(i, j int) bool {
+			return onlineChannels[i].ViewerCount > onlineChannels[j].ViewerCount
+		})
+	}
+
+	// Объединяем онлайн и оффлайн каналы
+	result := append(onlineChannels, offlineChannels...)
+
+	// Возвращаем данные
+	json.NewEncoder(w).Encode(result)
+}
+
+func updateLiveChannelsCache() {
+	var allChannels []models.TwitchStream
+	var mutex sync.Mutex
+
+	// Создаем клиент с таймаутом
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	token, err := service.RefreshTwitchToken()
+	if err != nil {
+		return
+	}
+
+	// Получаем информацию о текущих стримах
+	streamsURL := "https://api.twitch.tv/helix/streams?"
+	for i, channel := range channelsToCheck {
+		if i > 0 {
+			streamsURL += "&"
+		}
+		streamsURL += "user_login=" + channel
+	}
+
+	reqStreams, err := http.NewRequest("GET", streamsURL, nil)
+	if err != nil {
+		fmt.Printf("Error creating streams request: %v\n", err)
+		return
+	}
+	reqStreams.Header.Set("Client-ID", os.Getenv("TWITCH_CLIENT_ID_BOT"))
+	reqStreams.Header.Set("Authorization", "Bearer "+token)
+
+	respStreams, err := client.Do(reqStreams)
+	if err != nil {
+		fmt.Printf("Error making request to Twitch API (streams): %v\n", err)
+		return
+	}
+	defer respStreams.Body.Close()
+
+	bodyStreams, err := ioutil.ReadAll(respStreams.Body)
+	if err != nil {
+		fmt.Printf("Error reading streams response: %v\n", err)
+		return
+	}
+
+	var streamResponse models.TwitchStreamResponse
+	err = json.Unmarshal(bodyStreams, &streamResponse)
+	if err != nil {
+		fmt.Printf("Error parsing streams JSON: %v\n", err)
+		return
+	}
+
+	// Получаем информацию о пользователях (для всех каналов)
+	usersURL := "https://api.twitch.tv/helix/users?"
+	for i, channel := range channelsToCheck {
+		if i > 0 {
+			usersURL += "&"
+		}
+		usersURL += "login=" + channel
+	}
+
+	reqUsers, err := http.NewRequest("GET", usersURL, nil)
+	if err != nil {
+		fmt.Printf("Error creating users request: %v\n", err)
+		return
+	}
+	reqUsers.Header.Set("Client-ID", os.Getenv("TWITCH_CLIENT_ID_BOT"))
+	reqUsers.Header.Set("Authorization", "Bearer "+token)
+
+	respUsers, err := client.Do(reqUsers)
+	if err != nil {
+		fmt.Printf("Error making request to Twitch API (users): %v\n", err)
+		return
+	}
+	defer respUsers.Body.Close()
+
+	bodyUsers, err := ioutil.ReadAll(respUsers.Body)
+	if err != nil {
+		fmt.Printf("Error reading users response: %v\n", err)
+		return
+	}
+
+	var usersResponse models.TwitchUsersResponse
+	err = json.Unmarshal(bodyUsers, &usersResponse)
+	if err != nil {
+		fmt.Printf("Error parsing users JSON: %v\n", err)
+		return
+	}
+
+	// Создаем мапы для быстрого доступа
+	liveStreamsMap := make(map[string]models.TwitchStream)
+	for _, stream := range streamResponse.Data {
+		liveStreamsMap[stream.UserLogin] = stream
+	}
+
+	usersMap := make(map[string]models.TwitchUser)
+	for _, user := range usersResponse.Data {
+		usersMap[user.Login] = user
+	}
+
+	// Формируем список каналов
+	for _, channelLogin := range channelsToCheck {
+		if stream, exists := liveStreamsMap[channelLogin]; exists {
+			// Канал в эфире
+			if user, userExists := usersMap[channelLogin]; userExists {
+				stream.ProfileImageURL = user.ProfileImageURL
+			}
+			stream.IsLive = true
+			mutex.Lock()
+			allChannels = append(allChannels, stream)
+			mutex.Unlock()
+		} else if user, exists := usersMap[channelLogin]; exists {
+			// Канал не в эфире
+			offlineChannel := models.TwitchStream{
+				UserID:          user.ID,
+				UserLogin:       user.Login,
+				UserName:        user.DisplayName,
+				ProfileImageURL: user.ProfileImageURL,
+				IsLive:          false,
+				ViewerCount:     0,
+			}
+			mutex.Lock()
+			allChannels = append(allChannels, offlineChannel)
+			mutex.Unlock()
+		} else {
+			fmt.Printf("Channel %s not found on Twitch\n", channelLogin)
+		}
+	}
+
+	// Обновляем кэш
+	cacheMutex.Lock()
+	cachedLiveChannels = allChannels
+	lastUpdateTime = time.Now()
+	cacheMutex.Unlock()
+}
+
+func updateTopAuthorsCache() {
+	go func() {
+		authors, err := service.GetLeaderboard()
 		if err != nil {
-			log.Println(err.Error())
+			log.Printf("Ошибка при обновлении кэша: %v", err)
+			return
 		}
-	} else {
-		tmpl, err := template.New("notfoundunauthorised.html").Funcs(template.FuncMap{
-			"isVideo": func(filename string) bool {
-				ext := strings.ToLower(filepath.Ext(filename))
-				return ext == ".mp4" || ext == ".mov" || ext == ".avi"
-			},
-			"formatTimeAgo": service.FormatTimeAgo,
-			"formatViews":   service.FormatViews,
-		}).ParseFiles("templates/notfoundunauthorised.html")
-		if err != nil {
-			log.Println(err.Error())
+
+		leaderboardMutex.Lock()
+		defer leaderboardMutex.Unlock()
+		cachedTopAuthors = authors
+		leaderboardLastUpdated = time.Now()
+	}()
+}
+
+func StartCacheUpdater() {
+	ticker := time.NewTicker(cacheDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			updateLiveChannelsCache()
 		}
-		err = tmpl.Execute(w, nil)
-		if err != nil {
-			log.Println(err.Error())
+	}
+}
+
+func StartTopUpdater() {
+	ticker := time.NewTicker(cacheDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			updateTopAuthorsCache()
 		}
 	}
 }
 
-func ServeUserPageHandler(w http.ResponseWriter, r *http.Request) {
-	authorized := true
-	session, _ := store.Get(r, sessionName)
+func AddLiveChannelHandler(w http.ResponseWriter, r *http.Request) {
+	// TODO
+}
+
+func GetTopAuthorsHandler(w http.ResponseWriter, r *http.Request) {
+	leaderboardMutex.RLock()
+	defer leaderboardMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cachedTopAuthors)
+}
+
+func LoadMessagesHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
+	messages, err := service.LoadMessagesHistory(limit)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	//log.Println("Messages: " + strconv.Itoa(len(messages)))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+func SendMessageHandler(w http.ResponseWriter, r *http.Request) {
+	// Ограничиваем размер запроса (50 MB для сообщений с файлами)
+	r.ParseMultipartForm(50 << 20)
+
+	// Получаем текст сообщения
+	messageText := r.FormValue("message")
+
+	// Проверяем авторизацию пользователя
+	session, err := store.Get(r, sessionName)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Session error")
+		return
+	}
+
 	userID, ok := session.Values["user_id"]
 	if !ok {
-		authorized = false
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+		return
 	}
 
-	vars := mux.Vars(r)
-	profileUsername := vars["username"]
+	// Проверка на бан
+	if service.IsBanned(userID.(int)) {
+		writeAPIError(w, http.StatusForbidden, "Вы забанены и не можете отправлять сообщения в чат")
+		return
+	}
 
-	if authorized {
-		user, err := service.GetUserByID(userID.(int))
-		if err != nil {
-			log.Println("Не удалось получить пользователя из БД" + err.Error())
-			http.Redirect(w, r, "/notfound", http.StatusFound)
-			return
-		}
+	user, err := service.GetUserByID(userID.(int))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
 
-		profileUser, err := service.GetUserByUsername(profileUsername)
-		if err != nil {
-			log.Println("Не удалось получить пользователя из БД" + err.Error())
-			http.Redirect(w, r, "/notfound", http.StatusFound)
-			return
-		}
+	// Обрабатываем прикрепленные файлы
+	files := r.MultipartForm.File["files"]
 
-		stats := struct {
-			Likes int
-			Fucks int
-			Posts int
-		}{
-			Likes: service.GetTotalLikes(profileUser.ID),
-			Fucks: service.GetTotalFucks(profileUser.ID),
-			Posts: service.GetTotalPosts(profileUser.ID),
-		}
+	messageID, err := service.SaveMessage(user.ID, user.CurrentBadgeID, messageText)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
 
-		badges, err := service.GetUserBadges(profileUser.ID)
+	for _, fileHeader := range files {
+		file, err := fileHeader.Open()
 		if err != nil {
-			log.Println("Не удалось получить значки" + err.Error())
-			http.Redirect(w, r, "/notfound", http.StatusFound)
-			return
+			log.Printf("Ошибка открытия файла: %v", err)
+			continue
 		}
+		defer file.Close()
 
-		isFollowing := false
-		if user.ID != profileUser.ID {
-			isFollowing = service.CheckFollow(user.ID, profileUser.ID)
+		// Проверяем тип файла (только изображения и аудио)
+		buff := make([]byte, 512)
+		_, err = file.Read(buff)
+		if err != nil {
+			log.Printf("Ошибка чтения файла: %v", err)
+			continue
 		}
 
-		data := struct {
-			User        *models.User
-			ProfileUser *models.User
-			Stats       interface{}
-			Badges      []models.Badge
-			IsFollowing bool
-		}{
-			User:        user,
-			ProfileUser: profileUser,
-			Stats:       stats,
-			Badges:      badges,
-			IsFollowing: isFollowing,
+		fileType := http.DetectContentType(buff)
+		if !strings.HasPrefix(fileType, "image/") && !strings.HasPrefix(fileType, "audio/") {
+			log.Printf("Недопустимый тип файла: %s", fileType)
+			continue
 		}
 
-		tmpl, err := template.New("user.html").Funcs(template.FuncMap{
-			"isVideo": func(filename string) bool {
-				ext := strings.ToLower(filepath.Ext(filename))
-				return ext == ".mp4" || ext == ".mov" || ext == ".avi"
-			},
-			"formatTimeAgo":    service.FormatTimeAgo,
-			"formatViews":      service.FormatViews,
-			"checkModRole":     service.CheckModeratorOrAdminRole,
-			"checkAdminRole":   service.CheckAdminRole,
-			"hasNotifications": service.HasNotifications,
-			"formatFollowers":  service.FormatFollowers,
-			"hasBadge":         service.HasBadge,
-		}).ParseFiles("templates/user.html")
-		if err != nil {
-			log.Println(err.Error())
-		}
-		err = tmpl.Execute(w, data)
-		if err != nil {
-			log.Println(err.Error())
-		}
-	} else {
-		profileUser, err := service.GetUserByUsername(profileUsername)
-		if err != nil {
-			log.Println("Не удалось получить пользователя из БД" + err.Error())
-			http.Redirect(w, r, "/notfound", http.StatusFound)
-			return
-		}
+		// Возвращаем указатель файла в начало
+		file.Seek(0, 0)
 
-		stats := struct {
-			Likes int
-			Fucks int
-			Posts int
-		}{
-			Likes: service.GetTotalLikes(profileUser.ID),
-			Fucks: service.GetTotalFucks(profileUser.ID),
-			Posts: service.GetTotalPosts(profileUser.ID),
-		}
+		// Создаем директорию для загрузок чата, если её нет
+		os.MkdirAll("./static/chat_uploads", os.ModePerm)
 
-		badges, err := service.GetUserBadges(profileUser.ID)
-		if err != nil {
-			log.Println("Не удалось получить значки" + err.Error())
-			http.Redirect(w, r, "/notfound", http.StatusFound)
-			return
+		// Генерируем уникальное имя файла
+		newFileName := service.GenerateUniqueFileName(fileHeader.Filename)
+		filePath := "./static/chat_uploads/" + newFileName
+
+		// Сохраняем файл
+		dst, err := os.Create(filePath)
+		if err != nil {
+			log.Printf("Ошибка создания файла: %v", err)
+			continue
 		}
 
-		data := struct {
-			ProfileUser *models.User
-			Stats       interface{}
-			Badges      []models.Badge
-		}{
-			ProfileUser: profileUser,
-			Stats:       stats,
-			Badges:      badges,
+		if _, err := io.Copy(dst, file); err != nil {
+			log.Printf("Ошибка копирования файла: %v", err)
+			dst.Close()
+			continue
 		}
+		dst.Close()
+
+		// Сохраняем информацию в БД
+		err = service.ClipFile(messageID, "../static/chat_uploads/"+newFileName)
 
-		tmpl, err := template.New("userunauthorised.html").Funcs(template.FuncMap{
-			"isVideo": func(filename string) bool {
-				ext := strings.ToLower(filepath.Ext(filename))
-				return ext == ".mp4" || ext == ".mov" || ext == ".avi"
-			},
-			"formatTimeAgo":   service.FormatTimeAgo,
-			"formatViews":     service.FormatViews,
-			"formatFollowers": service.FormatFollowers,
-			"hasBadge":        service.HasBadge,
-		}).ParseFiles("templates/userunauthorised.html")
 		if err != nil {
-			log.Println(err.Error())
+			log.Printf("Ошибка сохранения информации о файле: %v", err)
+			continue
 		}
-		err = tmpl.Execute(w, data)
-		if err != nil {
-			log.Println(err.Error())
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func StartStatsUpdater() {
+	if err := service.RollupDailyStats(); err != nil {
+		log.Printf("Ошибка при сборе статистики: %v", err)
+	}
+
+	ticker := time.NewTicker(statsRollupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := service.RollupDailyStats(); err != nil {
+				log.Printf("Ошибка при сборе статистики: %v", err)
+			}
 		}
 	}
 }
 
-func ServeInventoryPage(w http.ResponseWriter, r *http.Request) {
+func ServeAnalyticsPage(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, sessionName)
 	userID, ok := session.Values["user_id"]
 	if !ok {
 		http.Redirect(w, r, "/", http.StatusFound)
+		return
 	}
 
 	user, err := service.GetUserByID(userID.(int))
 	if err != nil {
 		log.Println("Не удалось получить пользователя из БД" + err.Error())
-		http.Redirect(w, r, "/notfound", http.StatusFound)
-		return
-	}
-
-	badges, err := service.GetUserBadges(user.ID)
-	if err != nil {
-		http.Redirect(w, r, "/notfound", http.StatusFound)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
-	items, err := service.GetUserInventory(user.ID)
+	tmpl, err := template.New("analytics.html").Funcs(template.FuncMap{
+		"checkModRole":     checkModRole(r),
+		"checkAdminRole":   checkAdminRole(r),
+		"hasNotifications": service.HasNotifications,
+		"csrfToken":        func() string { return csrfToken(w, r) },
+		"formatValue":      service.FormatValue,
+	}).ParseFiles("templates/analytics.html")
 	if err != nil {
-		http.Redirect(w, r, "/notfound", http.StatusFound)
-		return
+		log.Println(err.Error())
 	}
 
 	data := struct {
-		User   *models.User
-		Badges []models.Badge
-		Items  []models.CaseReward
+		User  *models.User
+		Stats interface{}
 	}{
-		User:   user,
-		Badges: badges,
-		Items:  items,
-	}
-
-	tmpl, err := template.New("inventory.html").Funcs(template.FuncMap{
-		"isVideo": func(filename string) bool {
-			ext := strings.ToLower(filepath.Ext(filename))
-			return ext == ".mp4" || ext == ".mov" || ext == ".avi"
+		User: user,
+		Stats: struct {
+			Likes int
+			Fucks int
+			Posts int
+		}{
+			Likes: service.GetTotalLikes(user.ID),
+			Fucks: service.GetTotalFucks(user.ID),
+			Posts: service.GetTotalPosts(user.ID),
 		},
-		"formatTimeAgo":    service.FormatTimeAgo,
-		"formatViews":      service.FormatViews,
-		"checkModRole":     service.CheckModeratorOrAdminRole,
-		"checkAdminRole":   service.CheckAdminRole,
-		"hasNotifications": service.HasNotifications,
-		"formatFollowers":  service.FormatFollowers,
-		"hasBadge":         service.HasBadge,
-	}).ParseFiles("templates/inventory.html")
-	if err != nil {
-		log.Println(err.Error())
 	}
+
 	err = tmpl.Execute(w, data)
 	if err != nil {
 		log.Println(err.Error())
 	}
 }
 
-func GetUserPostsHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userID, _ := strconv.Atoi(vars["id"])
-
-	query := r.URL.Query()
-	page, _ := strconv.Atoi(query.Get("page"))
-	limit, _ := strconv.Atoi(query.Get("limit"))
-	contentType := query.Get("type")
-	sort := query.Get("sort")
-	search := query.Get("search")
-
-	// Параметры по умолчанию
-	if page < 1 {
-		page = 1
-	}
-	if limit == 0 {
-		limit = 12
-	}
-
-	// Получение пользователя
-	user, err := service.GetUserByID(userID)
-	if err != nil {
-		log.Println(err.Error())
-		http.Error(w, "Internal error getting user", http.StatusInternalServerError)
+func AnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	// Получение постов
-	posts, _, err := service.GetUserPosts(user.ID, page, limit, contentType, sort, search)
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
 	if err != nil {
-		log.Println(err.Error())
-		http.Error(w, "Internal error getting posts", http.StatusInternalServerError)
-		return
-	}
-	total := service.GetTotalPosts(user.ID)
-
-	response := struct {
-		Posts      []models.File
-		Total      int
-		Page       int
-		TotalPages int
-	}{
-		Posts:      posts,
-		Total:      total,
-		Page:       page,
-		TotalPages: int(math.Ceil(float64(total) / float64(limit))),
+		days = 7
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-func SubscribeHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	targetID, _ := strconv.Atoi(vars["id"])
-
-	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"].(int)
-	if !ok {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+	if !service.IsAnalyticsPeriod(days) {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "days"})
 		return
 	}
 
-	switch r.Method {
-	case "POST":
-		err := service.Subscribe(userID, targetID)
+	postID := 0
+	if post := r.URL.Query().Get("post_id"); post != "" {
+		postID, err = strconv.Atoi(post)
 		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, "Internal error", http.StatusInternalServerError)
+			writeAPIError(w, http.StatusBadRequest, "Wrong request")
 			return
 		}
-	case "DELETE":
-		err := service.Unsubscribe(userID, targetID)
+
+		authorID, err := service.GetPostAuthorID(postID)
 		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, "Internal error", http.StatusInternalServerError)
+			writeAPIError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		if authorID != userID && !hasPermission(r, userID, "view_analytics") {
+			writeAPIError(w, http.StatusForbidden, "Forbidden")
 			return
 		}
+		userID = authorID
 	}
 
-	w.WriteHeader(http.StatusOK)
+	analytics, err := service.GetAnalytics(userID, postID, days)
+	if err != nil {
+		log.Println("Не удалось получить аналитику: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analytics)
 }
 
-func ServeShopPage(w http.ResponseWriter, r *http.Request) {
+func ServeCollectionsPage(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, sessionName)
 	userID, ok := session.Values["user_id"]
 	if !ok {
@@ -1584,37 +4938,36 @@ func ServeShopPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	items := service.GetShopItems(user.ID)
+	collections, err := service.GetUserCollections(user.ID, user.ID, 0)
+	if err != nil {
+		log.Println("Не удалось получить коллекции: " + err.Error())
+		collections = []models.Collection{}
+	}
 
-	cases := service.GetCases(user.ID)
+	followed, err := service.GetFollowedCollections(user.ID)
+	if err != nil {
+		log.Println("Не удалось получить коллекции: " + err.Error())
+		followed = []models.Collection{}
+	}
 
-	tmpl, err := template.New("shop.html").Funcs(template.FuncMap{
-		"isVideo": func(filename string) bool {
-			ext := strings.ToLower(filepath.Ext(filename))
-			return ext == ".mp4" || ext == ".mov" || ext == ".avi"
-		},
-		"formatViews":    service.FormatViews,
-		"checkModRole":   service.CheckModeratorOrAdminRole,
-		"checkAdminRole": service.CheckAdminRole,
-		"safeHTML": func(s string) template.HTML {
-			return template.HTML(s)
-		},
+	tmpl, err := template.New("collections.html").Funcs(template.FuncMap{
+		"checkModRole":     checkModRole(r),
+		"checkAdminRole":   checkAdminRole(r),
 		"hasNotifications": service.HasNotifications,
-		"isVIP":            service.IsVIP,
-		"hasBadge":         service.HasBadge,
-	}).ParseFiles("templates/shop.html")
+		"csrfToken":        func() string { return csrfToken(w, r) },
+	}).ParseFiles("templates/collections.html")
 	if err != nil {
 		log.Println(err.Error())
 	}
 
 	data := struct {
-		User  *models.User
-		Items []models.ShopItem
-		Cases []models.Case
+		User        *models.User
+		Collections []models.Collection
+		Followed    []models.Collection
 	}{
-		User:  user,
-		Items: items,
-		Cases: cases,
+		User:        user,
+		Collections: collections,
+		Followed:    followed,
 	}
 
 	err = tmpl.Execute(w, data)
@@ -1623,870 +4976,1046 @@ func ServeShopPage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func BuyItemHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
-	if !ok {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
-	}
-
+func ServeCollectionPage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	itemID, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		http.Error(w, "Wrong request "+err.Error(), http.StatusUnauthorized)
-		log.Println("Wrong request (itemID) " + err.Error())
-		return
-	}
-
-	err = service.BuyItem(userID.(int), itemID)
+	collectionID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Wrong request "+err.Error(), http.StatusUnauthorized)
-		log.Println("Wrong request (buying item) " + err.Error())
+		http.Redirect(w, r, "/notfound", http.StatusFound)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-}
-
-func FeedHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, sessionName)
 	userID, ok := session.Values["user_id"].(int)
-	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
 
-	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
-	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
-	if limit == 0 {
-		limit = 10 // default value
-	}
-
-	posts, err := service.GetFeedPosts(userID, offset, limit)
+	collection, err := service.GetCollection(collectionID, userID)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Redirect(w, r, "/notfound", http.StatusFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(posts)
-}
-
-func LastFilesHandler(w http.ResponseWriter, r *http.Request) {
-	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
-	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
-	if page < 1 {
-		page = 1
-	}
-	if limit < 1 {
-		limit = 8
-	}
-
-	offset := (page - 1) * limit
+	if ok {
+		user, err := service.GetUserByID(userID)
+		if err != nil {
+			log.Println("Не удалось получить пользователя из БД" + err.Error())
+			http.Redirect(w, r, "/notfound", http.StatusFound)
+			return
+		}
 
-	posts, err := service.GetLastPosts(limit, offset)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		log.Println(err.Error())
-		return
-	}
+		data := struct {
+			User       *models.User
+			Collection *models.CollectionWithPosts
+		}{
+			User:       user,
+			Collection: collection,
+		}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(posts)
-}
+		tmpl, err := template.New("collection.html").Funcs(template.FuncMap{
+			"checkModRole":     checkModRole(r),
+			"checkAdminRole":   checkAdminRole(r),
+			"hasNotifications": service.HasNotifications,
+			"csrfToken":        func() string { return csrfToken(w, r) },
+		}).ParseFiles("templates/collection.html")
+		if err != nil {
+			log.Println(err.Error())
+		}
+		err = tmpl.Execute(w, data)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	} else {
+		data := struct {
+			Collection *models.CollectionWithPosts
+		}{
+			Collection: collection,
+		}
 
-func SearchHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if len(query) < 2 || len(query) > 100 { // Невалидный запрос
-		json.NewEncoder(w).Encode([]models.SearchResult{})
-		return
+		tmpl, err := template.ParseFiles("templates/collectionunauthorised.html")
+		if err != nil {
+			log.Println(err.Error())
+		}
+		err = tmpl.Execute(w, data)
+		if err != nil {
+			log.Println(err.Error())
+		}
 	}
-
-	searchTerm := "%" + strings.ToLower(query) + "%"
-	results := service.Search(searchTerm)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(results)
 }
 
-func UsersSearchHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if len(query) < 2 || len(query) > 100 { // Невалидный запрос
-		json.NewEncoder(w).Encode([]models.UserSearchResult{})
+func CollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	searchTerm := "%" + strings.ToLower(query) + "%"
-	results := service.SearchUsers(searchTerm)
+	switch r.Method {
+	case "GET":
+		postID, _ := strconv.Atoi(r.URL.Query().Get("post_id"))
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(results)
-}
+		collections, err := service.GetUserCollections(userID, userID, postID)
+		if err != nil {
+			log.Println("Не удалось получить коллекции: " + err.Error())
+			writeAPIError(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
 
-func ModeratorRoleHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	username := vars["username"]
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(collections)
 
-	switch r.Method {
 	case "POST":
-		err := service.AddModerator(username)
-		if err != nil {
-			http.Error(w, "Wrong request: "+err.Error(), http.StatusInternalServerError)
+		if service.IsBanned(userID) {
+			writeAPIError(w, http.StatusForbidden, "Forbidden")
 			return
 		}
-	case "DELETE":
-		err := service.DeleteModerator(username)
-		if err != nil {
-			http.Error(w, "Wrong request: "+err.Error(), http.StatusInternalServerError)
+
+		collection := models.Collection{
+			UserID:      userID,
+			Title:       strings.TrimSpace(r.FormValue("title")),
+			Description: r.FormValue("description"),
+			IsPublic:    r.FormValue("is_public") != "false",
+		}
+		if collection.Title == "" {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Название обязательно", map[string]string{"field": "title"})
 			return
 		}
-	}
 
-	w.WriteHeader(http.StatusOK)
-}
+		id, err := service.CreateCollection(&collection)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
 
-func GetModeratorsListHandler(w http.ResponseWriter, r *http.Request) {
-	list := service.GetModeratorsList()
+		// Сразу добавляем пост, если коллекция создается со страницы поста
+		if postID, err := strconv.Atoi(r.FormValue("post_id")); err == nil {
+			if err := service.AddPostToCollection(id, postID); err != nil {
+				log.Println("Не удалось добавить пост в коллекцию: " + err.Error())
+			}
+		}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
-}
+		data := struct {
+			Id int `json:"id"`
+		}{
+			Id: id,
+		}
 
-func GetNotificationsHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"].(int)
-	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
 	}
+}
 
-	notifications, err := service.GetNotifications(userID)
+func GetCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	collectionID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(notifications)
-}
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
 
-func GetBannedUsersListHandler(w http.ResponseWriter, r *http.Request) {
-	users, err := service.GetBannedUsersList()
+	collection, err := service.GetCollection(collectionID, userID)
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
-		log.Println(err.Error())
+		writeAPIError(w, http.StatusNotFound, "Not found")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
+	json.NewEncoder(w).Encode(collection)
 }
 
-func UploadBadgeHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseMultipartForm(100 << 20)
-
-	file, handler, err := r.FormFile("file")
+func CollectionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	collectionID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Ошибка при получении файла", http.StatusBadRequest)
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
 		return
 	}
-	defer file.Close()
 
-	title := r.FormValue("title")
-	if title == "" {
-		http.Error(w, "Название обязательно", http.StatusBadRequest)
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+
+	if !service.IsCollectionOwner(userID, collectionID) {
+		writeAPIError(w, http.StatusForbidden, "Forbidden")
 		return
 	}
 
-	cost := r.FormValue("cost")
-	if title == "" {
-		http.Error(w, "Цена обязательна", http.StatusBadRequest)
-		return
+	switch r.Method {
+	case "PUT":
+		collection := models.Collection{
+			ID:          collectionID,
+			Title:       strings.TrimSpace(r.FormValue("title")),
+			Description: r.FormValue("description"),
+			IsPublic:    r.FormValue("is_public") != "false",
+		}
+		if collection.Title == "" {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Название обязательно", map[string]string{"field": "title"})
+			return
+		}
+
+		err = service.UpdateCollection(&collection)
+	case "DELETE":
+		err = service.DeleteCollection(collectionID)
 	}
 
-	session, _ := store.Get(r, sessionName)
-	_, ok := session.Values["user_id"]
-	if !ok {
-		http.Error(w, "Неавторизованный доступ", http.StatusUnauthorized)
+	if err != nil {
+		writeServiceError(w, err)
 		return
 	}
 
-	// Создаем директорию для загрузок
-	os.MkdirAll("./static/uploads/badges", os.ModePerm)
-
-	// Генерируем уникальное имя файла
-	newFileName := service.GenerateUniqueFileName(handler.Filename)
-	filePath := "./static/uploads/badges/" + newFileName
+	w.WriteHeader(http.StatusOK)
+}
 
-	// Сохраняем файл
-	dst, err := os.Create(filePath)
+func CollectionPostHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	collectionID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		log.Println("Failed to create file: " + err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
 		return
 	}
-	defer dst.Close()
-
-	if _, err := io.Copy(dst, file); err != nil {
-		log.Println("Failed to copy file: " + err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+	postID, err := strconv.Atoi(vars["post_id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
 		return
 	}
 
-	costValue, err := strconv.Atoi(cost)
-	if err != nil {
-		http.Error(w, "Стоимость должна быть числом", http.StatusInternalServerError)
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+
+	if !service.IsCollectionOwner(userID, collectionID) {
+		writeAPIError(w, http.StatusForbidden, "Forbidden")
 		return
 	}
 
-	err = service.SaveBadge("."+filePath, title, costValue)
+	switch r.Method {
+	case "POST":
+		err = service.AddPostToCollection(collectionID, postID)
+	case "DELETE":
+		err = service.RemovePostFromCollection(collectionID, postID)
+	}
+
 	if err != nil {
-		go os.Remove(filePath)
-		log.Println("Failed to save file to database: " + err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func AddCaseHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseMultipartForm(100 << 20)
-
-	file, handler, err := r.FormFile("file")
+func CollectionOrderHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	collectionID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Ошибка при получении файла", http.StatusBadRequest)
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
 		return
 	}
-	defer file.Close()
 
-	title := r.FormValue("title")
-	if title == "" {
-		http.Error(w, "Название обязательно", http.StatusBadRequest)
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+
+	if !service.IsCollectionOwner(userID, collectionID) {
+		writeAPIError(w, http.StatusForbidden, "Forbidden")
 		return
 	}
 
-	description := r.FormValue("description")
-
-	price := r.FormValue("price")
-	if title == "" {
-		http.Error(w, "Цена обязательна", http.StatusBadRequest)
+	var order struct {
+		Posts []int `json:"posts"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
 		return
 	}
 
-	// Создаем директорию для загрузок
-	os.MkdirAll("./static/uploads/cases", os.ModePerm)
+	err = service.ReorderCollection(collectionID, order.Posts)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
 
-	// Генерируем уникальное имя файла
-	newFileName := service.GenerateUniqueFileName(handler.Filename)
-	filePath := "./static/uploads/cases/" + newFileName
+	w.WriteHeader(http.StatusOK)
+}
 
-	// Сохраняем файл
-	dst, err := os.Create(filePath)
+func FollowCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	collectionID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		log.Println("Failed to create file: " + err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
 		return
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
-		log.Println("Failed to copy file: " + err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	priceValue, err := strconv.Atoi(price)
-	if err != nil {
-		http.Error(w, "Стоимость должна быть числом", http.StatusInternalServerError)
-		return
+	switch r.Method {
+	case "POST":
+		err = service.FollowCollection(userID, collectionID)
+	case "DELETE":
+		err = service.UnfollowCollection(userID, collectionID)
 	}
 
-	id, err := service.SaveCase("."+filePath, title, description, priceValue)
 	if err != nil {
-		go os.Remove(filePath)
-		log.Println("Failed to save file to database: " + err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
 
-	data := struct {
-		Id int `json:"id"`
-	}{
-		Id: id,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
+	w.WriteHeader(http.StatusOK)
 }
 
-func GetBadgesHandler(w http.ResponseWriter, r *http.Request) {
-	badges := service.GetBadges()
+// Закладки и "Смотреть позже"
+const bookmarksPageLimit = 24
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(badges)
+// Разбирает параметры фильтра и страницы для списка закладок
+func bookmarksQuery(r *http.Request) (string, int) {
+	contentType := r.URL.Query().Get("type")
+	if !service.IsSavedPostType(contentType) {
+		contentType = "all"
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	return contentType, page
 }
 
-func AddRewardsHandler(w http.ResponseWriter, r *http.Request) {
-	rewardType := r.FormValue("type")
-	if rewardType == "" {
-		http.Error(w, "Тип обязателен", http.StatusBadRequest)
+func ServeBookmarksPage(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"]
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	caseID, err := strconv.Atoi(r.FormValue("case_id"))
+	user, err := service.GetUserByID(userID.(int))
 	if err != nil {
-		http.Error(w, "ID кейса обязателен", http.StatusBadRequest)
+		log.Println("Не удалось получить пользователя из БД" + err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
-	probability := r.FormValue("probability")
-	var probability_value float64
-	if probability == "" {
-		http.Error(w, "Шанс выпадения обязателен", http.StatusBadRequest)
-		return
-	} else {
-		probability_value, err = strconv.ParseFloat(probability, 64)
-		if err != nil {
-			http.Error(w, "Internal error", http.StatusBadRequest)
-			return
-		}
+	contentType, page := bookmarksQuery(r)
+	bookmarks, err := service.GetBookmarks(user.ID, contentType, page, bookmarksPageLimit)
+	if err != nil {
+		log.Println("Не удалось получить закладки: " + err.Error())
+		bookmarks = models.BookmarksPage{Posts: []models.SavedPost{}, Type: contentType, Page: page}
 	}
 
-	badge := r.FormValue("badge_id")
-	var badge_id, auk_value int
-	if badge != "" {
-		badge_id, err = strconv.Atoi(badge)
-		if err != nil {
-			http.Error(w, "Internal error", http.StatusBadRequest)
-			log.Println("Error converting badge_id " + err.Error())
-			return
-		}
+	watchLater, err := service.GetWatchLater(user.ID)
+	if err != nil {
+		log.Println("Не удалось получить список \"Смотреть позже\": " + err.Error())
+		watchLater = []models.SavedPost{}
 	}
-	auk := r.FormValue("auk_value")
-	if auk != "" {
-		auk_value, err = strconv.Atoi(auk)
-		if err != nil {
-			http.Error(w, "Internal error", http.StatusBadRequest)
-			log.Println("Error converting auk_value " + err.Error())
-			return
-		}
+
+	tmpl, err := template.New("bookmarks.html").Funcs(template.FuncMap{
+		"checkModRole":     checkModRole(r),
+		"checkAdminRole":   checkAdminRole(r),
+		"hasNotifications": service.HasNotifications,
+		"csrfToken":        func() string { return csrfToken(w, r) },
+		"add": func(a, b int) int {
+			return a + b
+		},
+	}).ParseFiles("templates/bookmarks.html")
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	data := struct {
+		User       *models.User
+		Bookmarks  models.BookmarksPage
+		WatchLater []models.SavedPost
+	}{
+		User:       user,
+		Bookmarks:  bookmarks,
+		WatchLater: watchLater,
 	}
 
-	reward := models.CaseReward{
-		Type:        rewardType,
-		CaseID:      caseID,
-		BadgeID:     badge_id,
-		AukValue:    auk_value,
-		Probability: probability_value,
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println(err.Error())
 	}
+}
 
-	err = service.AddReward(reward)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusBadRequest)
+func GetBookmarksHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-}
-
-func GetCaseRewardsHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	caseID, _ := strconv.Atoi(vars["id"])
+	contentType, page := bookmarksQuery(r)
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = bookmarksPageLimit
+	}
 
-	rewards, err := service.GetCaseRewards(caseID)
+	bookmarks, err := service.GetBookmarks(userID, contentType, page, limit)
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusBadRequest)
+		log.Println("Не удалось получить закладки: " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(rewards)
+	json.NewEncoder(w).Encode(bookmarks)
 }
 
-func OpenCaseHandler(w http.ResponseWriter, r *http.Request) {
+func BookmarkHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	caseID, _ := strconv.Atoi(vars["id"])
+	fileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
 	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
+	userID, ok := session.Values["user_id"].(int)
 	if !ok {
-		http.Error(w, "Unauthorised", http.StatusUnauthorized)
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	reward, err := service.OpenCase(caseID, userID.(int))
+	switch r.Method {
+	case "POST":
+		err = service.AddBookmark(userID, fileID)
+	case "DELETE":
+		err = service.RemoveBookmark(userID, fileID)
+	}
+
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusUnauthorized)
-		log.Println("Failed to open case " + err.Error())
+		writeServiceError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(reward)
+	w.WriteHeader(http.StatusOK)
 }
 
-func ApplyBadgeHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	badgeID, _ := strconv.Atoi(vars["id"])
+func GetWatchLaterHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
+	userID, ok := session.Values["user_id"].(int)
 	if !ok {
-		http.Error(w, "Unauthorised", http.StatusUnauthorized)
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	err := service.ApplyBadge(badgeID, userID.(int))
+	posts, err := service.GetWatchLater(userID)
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusUnauthorized)
+		log.Println("Не удалось получить список \"Смотреть позже\": " + err.Error())
+		writeAPIError(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(posts)
 }
 
-func ApplyItem(w http.ResponseWriter, r *http.Request) {
-	r.ParseMultipartForm(100 << 20)
+// Добавление в очередь и удаление из нее. Страница поста сама вызывает DELETE, когда видео досмотрено.
+func WatchLaterHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	itemID, _ := strconv.Atoi(vars["id"])
+	fileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Wrong request")
+		return
+	}
+
 	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
+	userID, ok := session.Values["user_id"].(int)
 	if !ok {
-		http.Error(w, "Unauthorised", http.StatusUnauthorized)
+		writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	lot_name := r.FormValue("lot_name")
+	switch r.Method {
+	case "POST":
+		err = service.AddToWatchLater(userID, fileID)
+	case "DELETE":
+		err = service.RemoveFromWatchLater(userID, fileID)
+	}
 
-	err := service.ApplyItem(itemID, userID.(int), lot_name)
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusUnauthorized)
-		log.Println(err.Error())
+		writeServiceError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func ServeQueuePage(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, sessionName)
-	userID, ok := session.Values["user_id"]
-	if !ok {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
-	}
+func MentionSearchHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimPrefix(strings.TrimSpace(r.URL.Query().Get("q")), "@")
 
-	user, err := service.GetUserByID(userID.(int))
-	if err != nil {
-		log.Println("Не удалось получить пользователя из БД" + err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
-		return
+	users := service.SearchMentionUsers(prefix)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// API v1
+//
+// Ответ всегда {"data": ...}, списки дополнительно содержат pagination.
+// Страничные списки принимают page и limit, курсорные - cursor и limit.
+// Описание: /api/v1/openapi.json
+
+const (
+	apiDefaultLimit = 20
+	apiMaxLimit     = 100
+	openAPIPath     = "api/openapi.json"
+)
+
+func writeAPIData(w http.ResponseWriter, status int, data interface{}, pagination *models.APIPagination) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(models.APIResponse{Data: data, Pagination: pagination})
+}
+
+// Читает page и limit. При неверных значениях сам отвечает 422 и возвращает ok = false.
+func apiPageParams(w http.ResponseWriter, r *http.Request) (page, limit int, ok bool) {
+	page, limit = 1, apiDefaultLimit
+	query := r.URL.Query()
+
+	if v := query.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "page"})
+			return 0, 0, false
+		}
+		page = n
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > apiMaxLimit {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "limit"})
+			return 0, 0, false
+		}
+		limit = n
 	}
+	return page, limit, true
+}
 
-	tmpl, err := template.New("queue.html").Funcs(template.FuncMap{
-		"isVideo": func(filename string) bool {
-			ext := strings.ToLower(filepath.Ext(filename))
-			return ext == ".mp4" || ext == ".mov" || ext == ".avi"
-		},
-		"formatViews":    service.FormatViews,
-		"checkModRole":   service.CheckModeratorOrAdminRole,
-		"checkAdminRole": service.CheckAdminRole,
-		"safeHTML": func(s string) template.HTML {
-			return template.HTML(s)
-		},
-		"hasNotifications": service.HasNotifications,
-		"isVIP":            service.IsVIP,
-		"hasBadge":         service.HasBadge,
-	}).ParseFiles("templates/queue.html")
-	if err != nil {
-		log.Println(err.Error())
+func apiPagePagination(page, limit, total int) *models.APIPagination {
+	return &models.APIPagination{
+		Page:    page,
+		Limit:   limit,
+		Total:   &total,
+		HasMore: page*limit < total,
 	}
+}
 
-	data := struct {
-		User *models.User
-	}{
-		User: user,
+func apiPathID(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)[name])
+	if err != nil || id < 1 {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return 0, false
 	}
+	return id, true
+}
 
-	err = tmpl.Execute(w, data)
-	if err != nil {
-		log.Println(err.Error())
+func apiComment(c models.CommentWithAuthor) models.APIComment {
+	comment := models.APIComment{
+		ID:           c.ID,
+		PostID:       c.FileID,
+		ParentID:     c.ParentID,
+		Text:         c.Text,
+		Likes:        c.Likes,
+		RepliesCount: c.RepliesCount,
+		IsEdited:     c.IsEdited,
+		IsDeleted:    c.IsDeleted,
+		CreatedAt:    c.CreatedAt,
+		UpdatedAt:    c.UpdatedAt,
+		Author: models.APIUserRef{
+			DisplayName:     c.AuthorName,
+			ProfileImageURL: c.AuthorProfileImageURL,
+		},
 	}
+	for _, reply := range c.Replies {
+		comment.Replies = append(comment.Replies, apiComment(reply))
+	}
+	return comment
 }
 
-func GetQueueHandler(w http.ResponseWriter, r *http.Request) {
-	queue, err := service.GetQueue()
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
-		return
+func apiReward(r models.CaseReward) models.APIReward {
+	return models.APIReward{
+		ID:          r.ID,
+		Type:        r.Type,
+		Title:       r.Title,
+		ImageURL:    service.PublicURL(r.Image),
+		Probability: r.Probability,
+		AukValue:    r.AukValue,
+		OpeningID:   r.OpeningID,
+		Quantity:    r.Quantity,
 	}
+}
 
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(queue)
+	http.ServeFile(w, r, openAPIPath)
 }
 
-func DeleteSubmission(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	subID, _ := strconv.Atoi(vars["id"])
+func APIPostsHandler(w http.ResponseWriter, r *http.Request) {
+	page, limit, ok := apiPageParams(w, r)
+	if !ok {
+		return
+	}
 
-	err := service.DeleteSubmission(subID)
+	authorID := 0
+	if login := r.URL.Query().Get("author"); login != "" {
+		_, id, err := service.GetAPIUser(login)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		authorID = id
+	}
+
+	posts, total, err := service.GetAPIPosts(authorID, limit, (page-1)*limit)
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	writeAPIData(w, http.StatusOK, posts, apiPagePagination(page, limit, total))
 }
 
-func GetLiveChannelsHandler(w http.ResponseWriter, r *http.Request) {
-	// Устанавливаем заголовки CORS
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-
-	// Проверяем, нужно ли обновить кэш
-	cacheMutex.RLock()
-	needsUpdate := time.Since(lastUpdateTime) > cacheDuration || len(cachedLiveChannels) == 0
-	cacheMutex.RUnlock()
+func APIPostHandler(w http.ResponseWriter, r *http.Request) {
+	postID, ok := apiPathID(w, r, "id")
+	if !ok {
+		return
+	}
 
-	if needsUpdate {
-		updateLiveChannelsCache()
+	post, err := service.GetAPIPost(postID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
 	}
 
-	// Получаем кэшированные данные
-	cacheMutex.RLock()
-	liveChannels := make([]models.TwitchStream, len(cachedLiveChannels))
-	copy(liveChannels, cachedLiveChannels)
-	cacheMutex.RUnlock()
+	writeAPIData(w, http.StatusOK, post, nil)
+}
 
-	// Разделяем каналы на онлайн и оффлайн
-	var onlineChannels []models.TwitchStream
-	var offlineChannels []models.TwitchStream
+func APIPostLikeHandler(w http.ResponseWriter, r *http.Request) {
+	postID, ok := apiPathID(w, r, "id")
+	if !ok {
+		return
+	}
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
 
-	for _, channel := range liveChannels {
-		if channel.IsLive {
-			onlineChannels = append(onlineChannels, channel)
-		} else {
-			offlineChannels = append(offlineChannels, channel)
-		}
+	if _, err := service.GetAPIPost(postID); err != nil {
+		writeServiceError(w, err)
+		return
 	}
 
-	// Применяем сортировку только к онлайн-каналам
-	sortOrder := r.URL.Query().Get("sort")
-	if sortOrder == "asc" {
-		sort.Slice(onlineChannels, func(i, j int) bool {
-			return onlineChannels[i].ViewerCount < onlineChannels[j].ViewerCount
-		})
+	var err error
+	if r.Method == "PUT" {
+		err = service.LikeFile(userID, postID)
 	} else {
-		// По умолчанию сортируем по убыванию
-		sort.Slice(onlineChannels, func(i, j int) bool {
-			return onlineChannels[i].ViewerCount > onlineChannels[j].ViewerCount
-		})
+		err = service.UnlikeFile(userID, postID)
+	}
+	if err != nil {
+		writeServiceError(w, err)
+		return
 	}
 
-	// Объединяем онлайн и оффлайн каналы
-	result := append(onlineChannels, offlineChannels...)
-
-	// Возвращаем данные
-	json.NewEncoder(w).Encode(result)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func updateLiveChannelsCache() {
-	var allChannels []models.TwitchStream
-	var mutex sync.Mutex
-
-	// Создаем клиент с таймаутом
-	client := &http.Client{Timeout: 10 * time.Second}
+func APIPostCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	postID, ok := apiPathID(w, r, "id")
+	if !ok {
+		return
+	}
+	// Читать комментарии можно и без входа
+	session, _ := store.Get(r, sessionName)
+	userID, authorized := session.Values["user_id"].(int)
 
-	token, err := service.RefreshTwitchToken()
-	if err != nil {
+	if _, err := service.GetAPIPost(postID); err != nil {
+		writeServiceError(w, err)
 		return
 	}
 
-	// Получаем информацию о текущих стримах
-	streamsURL := "https://api.twitch.tv/helix/streams?"
-	for i, channel := range channelsToCheck {
-		if i > 0 {
-			streamsURL += "&"
+	if r.Method == "POST" {
+		if !authorized {
+			writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+			return
 		}
-		streamsURL += "user_login=" + channel
-	}
 
-	reqStreams, err := http.NewRequest("GET", streamsURL, nil)
-	if err != nil {
-		fmt.Printf("Error creating streams request: %v\n", err)
+		text := strings.TrimSpace(r.FormValue("text"))
+		if text == "" {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "text"})
+			return
+		}
+		parentID := 0
+		if v := r.FormValue("parent_id"); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "parent_id"})
+				return
+			}
+			parentID = id
+		}
+
+		commentID, err := service.AddComment(&models.Comment{UserID: userID, FileID: postID, Text: text, ParentID: parentID})
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		created, err := service.GetCommentThread(userID, commentID)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+
+		writeAPIData(w, http.StatusCreated, apiComment(created), nil)
 		return
 	}
-	reqStreams.Header.Set("Client-ID", os.Getenv("TWITCH_CLIENT_ID_BOT"))
-	reqStreams.Header.Set("Authorization", "Bearer "+token)
 
-	respStreams, err := client.Do(reqStreams)
-	if err != nil {
-		fmt.Printf("Error making request to Twitch API (streams): %v\n", err)
+	query := r.URL.Query()
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "new"
+	}
+	if !service.IsCommentsSort(sort) {
+		writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "sort"})
+		return
+	}
+	_, limit, ok := apiPageParams(w, r)
+	if !ok {
 		return
 	}
-	defer respStreams.Body.Close()
 
-	bodyStreams, err := ioutil.ReadAll(respStreams.Body)
+	page, err := service.GetComments(userID, postID, sort, query.Get("cursor"), limit)
 	if err != nil {
-		fmt.Printf("Error reading streams response: %v\n", err)
+		writeServiceError(w, err)
 		return
 	}
 
-	var streamResponse models.TwitchStreamResponse
-	err = json.Unmarshal(bodyStreams, &streamResponse)
+	comments := []models.APIComment{}
+	for _, c := range page.Comments {
+		comments = append(comments, apiComment(c))
+	}
+
+	writeAPIData(w, http.StatusOK, comments, &models.APIPagination{
+		Limit:      limit,
+		NextCursor: page.NextCursor,
+		HasMore:    page.NextCursor != "",
+	})
+}
+
+func APIUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, _, err := service.GetAPIUser(mux.Vars(r)["login"])
 	if err != nil {
-		fmt.Printf("Error parsing streams JSON: %v\n", err)
+		writeServiceError(w, err)
 		return
 	}
 
-	// Получаем информацию о пользователях (для всех каналов)
-	usersURL := "https://api.twitch.tv/helix/users?"
-	for i, channel := range channelsToCheck {
-		if i > 0 {
-			usersURL += "&"
-		}
-		usersURL += "login=" + channel
-	}
+	writeAPIData(w, http.StatusOK, user, nil)
+}
 
-	reqUsers, err := http.NewRequest("GET", usersURL, nil)
+func APIMeHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+
+	current, err := service.GetUserByID(userID)
 	if err != nil {
-		fmt.Printf("Error creating users request: %v\n", err)
+		writeServiceError(w, err)
 		return
 	}
-	reqUsers.Header.Set("Client-ID", os.Getenv("TWITCH_CLIENT_ID_BOT"))
-	reqUsers.Header.Set("Authorization", "Bearer "+token)
-
-	respUsers, err := client.Do(reqUsers)
+	user, _, err := service.GetAPIUser(current.Login)
 	if err != nil {
-		fmt.Printf("Error making request to Twitch API (users): %v\n", err)
+		writeServiceError(w, err)
 		return
 	}
-	defer respUsers.Body.Close()
 
-	bodyUsers, err := ioutil.ReadAll(respUsers.Body)
+	writeAPIData(w, http.StatusOK, models.APIMe{APIUser: user, Balance: current.Rating}, nil)
+}
+
+func APIFollowHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+
+	_, targetID, err := service.GetAPIUser(mux.Vars(r)["login"])
 	if err != nil {
-		fmt.Printf("Error reading users response: %v\n", err)
+		writeServiceError(w, err)
+		return
+	}
+	if targetID == userID {
+		writeAPIError(w, http.StatusConflict, "Cannot follow yourself")
 		return
 	}
 
-	var usersResponse models.TwitchUsersResponse
-	err = json.Unmarshal(bodyUsers, &usersResponse)
+	if r.Method == "PUT" {
+		err = service.Subscribe(userID, targetID)
+	} else {
+		err = service.Unsubscribe(userID, targetID)
+	}
 	if err != nil {
-		fmt.Printf("Error parsing users JSON: %v\n", err)
+		writeServiceError(w, err)
 		return
 	}
 
-	// Создаем мапы для быстрого доступа
-	liveStreamsMap := make(map[string]models.TwitchStream)
-	for _, stream := range streamResponse.Data {
-		liveStreamsMap[stream.UserLogin] = stream
-	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	usersMap := make(map[string]models.TwitchUser)
-	for _, user := range usersResponse.Data {
-		usersMap[user.Login] = user
-	}
+func APIShopItemsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
 
-	// Формируем список каналов
-	for _, channelLogin := range channelsToCheck {
-		if stream, exists := liveStreamsMap[channelLogin]; exists {
-			// Канал в эфире
-			if user, userExists := usersMap[channelLogin]; userExists {
-				stream.ProfileImageURL = user.ProfileImageURL
-			}
-			stream.IsLive = true
-			mutex.Lock()
-			allChannels = append(allChannels, stream)
-			mutex.Unlock()
-		} else if user, exists := usersMap[channelLogin]; exists {
-			// Канал не в эфире
-			offlineChannel := models.TwitchStream{
-				UserID:          user.ID,
-				UserLogin:       user.Login,
-				UserName:        user.DisplayName,
-				ProfileImageURL: user.ProfileImageURL,
-				IsLive:          false,
-				ViewerCount:     0,
-			}
-			mutex.Lock()
-			allChannels = append(allChannels, offlineChannel)
-			mutex.Unlock()
-		} else {
-			fmt.Printf("Channel %s not found on Twitch\n", channelLogin)
+	items := []models.APIShopItem{}
+	for _, item := range service.GetShopItems(userID) {
+		apiItem := models.APIShopItem{
+			ID:             item.ID,
+			Type:           item.Type,
+			Title:          item.Title,
+			Cost:           item.Cost,
+			BaseCost:       item.BaseCost,
+			Discount:       item.Discount,
+			ImageURL:       service.PublicURL(item.Image),
+			Owned:          item.Owned,
+			AvailableUntil: item.AvailableUntil,
+			PerUserLimit:   item.PerUserLimit,
+			Purchased:      item.Purchased,
+			Featured:       item.FeaturedSlot != nil,
+			InputLabel:     item.InputLabel,
 		}
+		if remaining := item.Remaining(); remaining >= 0 {
+			apiItem.Remaining = &remaining
+		}
+		items = append(items, apiItem)
 	}
 
-	// Обновляем кэш
-	cacheMutex.Lock()
-	cachedLiveChannels = allChannels
-	lastUpdateTime = time.Now()
-	cacheMutex.Unlock()
+	writeAPIData(w, http.StatusOK, items, nil)
 }
 
-func updateTopAuthorsCache() {
-	go func() {
-		authors, err := service.GetLeaderboard()
-		if err != nil {
-			log.Printf("Ошибка при обновлении кэша: %v", err)
-			return
-		}
+func APIPurchaseHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, ok := apiPathID(w, r, "id")
+	if !ok {
+		return
+	}
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+	key, ok := idempotencyKey(w, r)
+	if !ok {
+		return
+	}
 
-		leaderboardMutex.Lock()
-		defer leaderboardMutex.Unlock()
-		cachedTopAuthors = authors
-		leaderboardLastUpdated = time.Now()
-	}()
+	if err := service.BuyItem(userID, itemID, purchaseInput(r), key); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	notifyOutbox()
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func StartCacheUpdater() {
-	ticker := time.NewTicker(cacheDuration)
-	defer ticker.Stop()
+func APICasesHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
 
-	for {
-		select {
-		case <-ticker.C:
-			updateLiveChannelsCache()
-		}
+	cases := []models.APICase{}
+	for _, c := range service.GetCases(userID) {
+		cases = append(cases, models.APICase{
+			ID:          c.ID,
+			Title:       c.Title,
+			Description: c.Description,
+			Price:       c.Price,
+			ImageURL:    service.PublicURL(c.Image),
+		})
 	}
+
+	writeAPIData(w, http.StatusOK, cases, nil)
 }
 
-func StartTopUpdater() {
-	ticker := time.NewTicker(cacheDuration)
-	defer ticker.Stop()
+func APICaseRewardsHandler(w http.ResponseWriter, r *http.Request) {
+	caseID, ok := apiPathID(w, r, "id")
+	if !ok {
+		return
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			updateTopAuthorsCache()
-		}
+	// Несуществующий кейс - 404, а не пустой список наград
+	if _, err := service.GetCaseByID(caseID); err != nil {
+		writeServiceError(w, err)
+		return
 	}
-}
 
-func AddLiveChannelHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO
-}
+	rewards, err := service.GetCaseRewards(caseID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
 
-func GetTopAuthorsHandler(w http.ResponseWriter, r *http.Request) {
-	leaderboardMutex.RLock()
-	defer leaderboardMutex.RUnlock()
+	result := []models.APIReward{}
+	for _, reward := range rewards {
+		result = append(result, apiReward(reward))
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(cachedTopAuthors)
+	writeAPIData(w, http.StatusOK, result, nil)
 }
 
-func LoadMessagesHistoryHandler(w http.ResponseWriter, r *http.Request) {
-	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
-	if err != nil {
-		http.Error(w, "Wrong request", http.StatusBadRequest)
+func APIOpenCaseHandler(w http.ResponseWriter, r *http.Request) {
+	caseID, ok := apiPathID(w, r, "id")
+	if !ok {
+		return
+	}
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
+	key, ok := idempotencyKey(w, r)
+	if !ok {
 		return
 	}
 
-	messages, err := service.LoadMessagesHistory(limit)
+	reward, err := service.OpenCase(caseID, userID, key)
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
-	//log.Println("Messages: " + strconv.Itoa(len(messages)))
+	notifyOutbox()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	writeAPIData(w, http.StatusCreated, apiReward(*reward), nil)
 }
 
-func SendMessageHandler(w http.ResponseWriter, r *http.Request) {
-	// Ограничиваем размер запроса (50 MB для сообщений с файлами)
-	r.ParseMultipartForm(50 << 20)
-
-	// Получаем текст сообщения
-	messageText := r.FormValue("message")
+func APIInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
 
-	// Проверяем авторизацию пользователя
-	session, err := store.Get(r, sessionName)
+	inventory, err := service.GetUserInventory(userID)
 	if err != nil {
-		http.Error(w, "Session error", http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
 
-	userID, ok := session.Values["user_id"]
+	items := []models.APIReward{}
+	for _, item := range inventory {
+		items = append(items, apiReward(item))
+	}
+
+	writeAPIData(w, http.StatusOK, items, nil)
+}
+
+func APIApplyItemHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, ok := apiPathID(w, r, "id")
 	if !ok {
-		http.Error(w, "Unauthorised", http.StatusUnauthorized)
 		return
 	}
+	session, _ := store.Get(r, sessionName)
+	userID, _ := session.Values["user_id"].(int)
 
-	// Проверка на бан
-	if service.IsBanned(userID.(int)) {
-		http.Error(w, "Вы забанены и не можете отправлять сообщения в чат", http.StatusForbidden)
+	inventory, err := service.GetUserInventory(userID)
+	if err != nil {
+		writeServiceError(w, err)
 		return
 	}
 
-	user, err := service.GetUserByID(userID.(int))
+	var item *models.CaseReward
+	for i := range inventory {
+		if inventory[i].ID == itemID {
+			item = &inventory[i]
+			break
+		}
+	}
+	if item == nil {
+		writeServiceError(w, service.ErrNotInInventory)
+		return
+	}
+
+	switch item.Type {
+	case "badge":
+		err = service.ApplyBadge(item.BadgeID, userID)
+	case "auk":
+		lot := strings.TrimSpace(r.FormValue("lot_name"))
+		if lot == "" {
+			writeAPIErrorDetails(w, http.StatusUnprocessableEntity, "Wrong request", map[string]string{"field": "lot_name"})
+			return
+		}
+		err = service.ApplyItem(itemID, userID, lot)
+	default:
+		err = service.ApplyItem(itemID, userID, "")
+	}
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
+	notifyOutbox()
 
-	// Обрабатываем прикрепленные файлы
-	files := r.MultipartForm.File["files"]
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	messageID, err := service.SaveMessage(user.ID, user.CurrentBadgeID, messageText)
+func APIQueueHandler(w http.ResponseWriter, r *http.Request) {
+	queue, err := service.GetQueue()
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
 
-	for _, fileHeader := range files {
-		file, err := fileHeader.Open()
-		if err != nil {
-			log.Printf("Ошибка открытия файла: %v", err)
-			continue
-		}
-		defer file.Close()
+	items := []models.APIQueueItem{}
+	for _, s := range queue {
+		items = append(items, models.APIQueueItem{
+			ID:         s.ID,
+			Submission: s.Submission,
+			AukValue:   s.AukValue,
+			User: models.APIUserRef{
+				DisplayName:     s.DisplayName,
+				ProfileImageURL: s.ProfileImageURL,
+			},
+		})
+	}
 
-		// Проверяем тип файла (только изображения и аудио)
-		buff := make([]byte, 512)
-		_, err = file.Read(buff)
-		if err != nil {
-			log.Printf("Ошибка чтения файла: %v", err)
-			continue
-		}
+	writeAPIData(w, http.StatusOK, items, nil)
+}
 
-		fileType := http.DetectContentType(buff)
-		if !strings.HasPrefix(fileType, "image/") && !strings.HasPrefix(fileType, "audio/") {
-			log.Printf("Недопустимый тип файла: %s", fileType)
-			continue
-		}
+func APIQueueItemHandler(w http.ResponseWriter, r *http.Request) {
+	submissionID, ok := apiPathID(w, r, "id")
+	if !ok {
+		return
+	}
 
-		// Возвращаем указатель файла в начало
-		file.Seek(0, 0)
+	if err := service.DeleteSubmission(submissionID); err != nil {
+		writeServiceError(w, err)
+		return
+	}
 
-		// Создаем директорию для загрузок чата, если её нет
-		os.MkdirAll("./static/chat_uploads", os.ModePerm)
+	w.WriteHeader(http.StatusNoContent)
+}
 
-		// Генерируем уникальное имя файла
-		newFileName := service.GenerateUniqueFileName(fileHeader.Filename)
-		filePath := "./static/chat_uploads/" + newFileName
+func APILiveChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	cacheMutex.RLock()
+	needsUpdate := time.Since(lastUpdateTime) > cacheDuration || len(cachedLiveChannels) == 0
+	cacheMutex.RUnlock()
 
-		// Сохраняем файл
-		dst, err := os.Create(filePath)
-		if err != nil {
-			log.Printf("Ошибка создания файла: %v", err)
-			continue
-		}
+	if needsUpdate {
+		updateLiveChannelsCache()
+	}
 
-		if _, err := io.Copy(dst, file); err != nil {
-			log.Printf("Ошибка копирования файла: %v", err)
-			dst.Close()
-			continue
+	channels := []models.APILiveChannel{}
+	cacheMutex.RLock()
+	for _, c := range cachedLiveChannels {
+		channel := models.APILiveChannel{
+			Login:           c.UserLogin,
+			DisplayName:     c.UserName,
+			ProfileImageURL: c.ProfileImageURL,
+			IsLive:          c.IsLive,
 		}
-		dst.Close()
-
-		// Сохраняем информацию в БД
-		err = service.ClipFile(messageID, "../static/chat_uploads/"+newFileName)
-
-		if err != nil {
-			log.Printf("Ошибка сохранения информации о файле: %v", err)
-			continue
+		if c.IsLive {
+			startedAt := c.StartedAt
+			channel.Title = c.Title
+			channel.GameName = c.GameName
+			channel.ViewerCount = c.ViewerCount
+			channel.StartedAt = &startedAt
+			channel.ThumbnailURL = c.ThumbnailURL
 		}
+		channels = append(channels, channel)
 	}
+	cacheMutex.RUnlock()
 
-	w.WriteHeader(http.StatusOK)
+	// Сначала онлайн, затем по числу зрителей
+	sort.SliceStable(channels, func(i, j int) bool {
+		if channels[i].IsLive != channels[j].IsLive {
+			return channels[i].IsLive
+		}
+		return channels[i].ViewerCount > channels[j].ViewerCount
+	})
+
+	writeAPIData(w, http.StatusOK, channels, nil)
 }
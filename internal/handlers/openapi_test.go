@@ -0,0 +1,444 @@
+package handlers_test
+
+import (
+	"bytes"
+	"database/sql"
+	"ehchobyahs/internal/app"
+	"ehchobyahs/internal/handlers"
+	"ehchobyahs/internal/service"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+// Контрактные тесты публичного API: запросы идут через роутер приложения,
+// база подменена sqlmock, а статусы и тела ответов сверяются с api/openapi.json
+
+const specPath = "api/openapi.json"
+
+func TestMain(m *testing.M) {
+	// Спецификация, шаблоны и статика лежат относительно корня репозитория
+	if err := os.Chdir("../.."); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Setenv("SESSION_SECRET", "contract-tests")
+
+	// UpdateConfig читает список каналов из базы
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	mock.ExpectQuery("SELECT login FROM live_channels").WillReturnRows(sqlmock.NewRows([]string{"login"}))
+	service.UseDB(conn)
+	handlers.UpdateConfig()
+	conn.Close()
+
+	os.Exit(m.Run())
+}
+
+type openAPISpec struct {
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas   map[string]*jsonSchema     `json:"schemas"`
+		Responses map[string]openAPIResponse `json:"responses"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	Responses map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema *jsonSchema `json:"schema"`
+	} `json:"content"`
+}
+
+// Часть JSON Schema, которая используется в спецификации
+type jsonSchema struct {
+	Ref        string                 `json:"$ref"`
+	Type       string                 `json:"type"`
+	Format     string                 `json:"format"`
+	Required   []string               `json:"required"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	Items      *jsonSchema            `json:"items"`
+	AllOf      []*jsonSchema          `json:"allOf"`
+	Enum       []any                  `json:"enum"`
+	Minimum    *float64               `json:"minimum"`
+	Maximum    *float64               `json:"maximum"`
+}
+
+func loadSpec(t *testing.T) *openAPISpec {
+	t.Helper()
+	data, err := os.ReadFile(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec openAPISpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatalf("спецификация не разбирается: %v", err)
+	}
+	return &spec
+}
+
+func (s *openAPISpec) schema(ref string) *jsonSchema {
+	name, ok := strings.CutPrefix(ref, "#/components/schemas/")
+	if !ok || s.Components.Schemas[name] == nil {
+		panic("неизвестная схема " + ref)
+	}
+	return s.Components.Schemas[name]
+}
+
+// Возвращает список расхождений значения со схемой
+func (s *openAPISpec) validate(schema *jsonSchema, value any, at string) []string {
+	if schema.Ref != "" {
+		return s.validate(s.schema(schema.Ref), value, at)
+	}
+
+	var problems []string
+	for _, part := range schema.AllOf {
+		problems = append(problems, s.validate(part, value, at)...)
+	}
+	if value == nil {
+		return append(problems, at+": null не разрешен схемой")
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: ожидался объект, получено %T", at, value))
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				problems = append(problems, at+": нет обязательного поля "+name)
+			}
+		}
+		for name, property := range schema.Properties {
+			if v, ok := object[name]; ok {
+				problems = append(problems, s.validate(property, v, at+"."+name)...)
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: ожидался массив, получено %T", at, value))
+		}
+		for i, item := range array {
+			problems = append(problems, s.validate(schema.Items, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: ожидалась строка, получено %T", at, value))
+		}
+		switch schema.Format {
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				problems = append(problems, at+": не date-time: "+str)
+			}
+		case "uri":
+			if u, err := url.Parse(str); err != nil || u.Scheme == "" || u.Host == "" {
+				problems = append(problems, at+": не абсолютный URI: "+str)
+			}
+		}
+	case "integer", "number":
+		number, ok := value.(float64)
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: ожидалось число, получено %T", at, value))
+		}
+		if schema.Type == "integer" && number != math.Trunc(number) {
+			problems = append(problems, fmt.Sprintf("%s: ожидалось целое, получено %v", at, number))
+		}
+		if schema.Minimum != nil && number < *schema.Minimum {
+			problems = append(problems, fmt.Sprintf("%s: %v меньше минимума %v", at, number, *schema.Minimum))
+		}
+		if schema.Maximum != nil && number > *schema.Maximum {
+			problems = append(problems, fmt.Sprintf("%s: %v больше максимума %v", at, number, *schema.Maximum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s: ожидался boolean, получено %T", at, value))
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, allowed := range schema.Enum {
+			if allowed == value {
+				found = true
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: %v нет в enum %v", at, value, schema.Enum))
+		}
+	}
+	return problems
+}
+
+// Проверяет, что статус описан у операции, а тело подходит под его схему
+func (s *openAPISpec) checkResponse(t *testing.T, method, route string, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	operation, ok := s.Paths[route][strings.ToLower(method)]
+	if !ok {
+		t.Fatalf("%s %s нет в спецификации", method, route)
+	}
+	response, ok := operation.Responses[strconv.Itoa(rec.Code)]
+	if !ok {
+		t.Fatalf("%s %s: статус %d не описан в спецификации, тело: %s", method, route, rec.Code, rec.Body.String())
+	}
+	if name, ok := strings.CutPrefix(response.Ref, "#/components/responses/"); ok {
+		response = s.Components.Responses[name]
+	}
+
+	content, ok := response.Content["application/json"]
+	if !ok {
+		if rec.Body.Len() > 0 {
+			t.Errorf("%s %s: у статуса %d не должно быть тела, получено: %s", method, route, rec.Code, rec.Body.String())
+		}
+		return
+	}
+
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+		t.Errorf("%s %s: Content-Type %q вместо application/json", method, route, contentType)
+	}
+	var body any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s %s: тело не JSON: %v", method, route, err)
+	}
+	for _, problem := range s.validate(content.Schema, body, "body") {
+		t.Errorf("%s %s (%d): %s", method, route, rec.Code, problem)
+	}
+}
+
+type contractEnv struct {
+	t      *testing.T
+	spec   *openAPISpec
+	router *mux.Router
+	mock   sqlmock.Sqlmock
+}
+
+func newContractEnv(t *testing.T) *contractEnv {
+	conn, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.UseDB(conn)
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		conn.Close()
+	})
+
+	return &contractEnv{t: t, spec: loadSpec(t), router: app.NewRouter(), mock: mock}
+}
+
+// Выполняет запрос и сверяет ответ с операцией route из спецификации
+func (e *contractEnv) do(method, target, route, token string, form url.Values) *httptest.ResponseRecorder {
+	e.t.Helper()
+	body := bytes.NewBufferString(form.Encode())
+	req := httptest.NewRequest(method, "/api/v1"+target, body)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	e.router.ServeHTTP(rec, req)
+	e.spec.checkResponse(e.t, method, route, rec)
+	return rec
+}
+
+func (e *contractEnv) expectStatus(rec *httptest.ResponseRecorder, status int) {
+	e.t.Helper()
+	if rec.Code != status {
+		e.t.Fatalf("статус %d вместо %d, тело: %s", rec.Code, status, rec.Body.String())
+	}
+}
+
+func query(sql string) string {
+	return regexp.QuoteMeta(sql)
+}
+
+// API-токен пользователя userID с указанными scope
+func (e *contractEnv) expectToken(tokenID, userID int, scopes ...string) string {
+	e.mock.ExpectQuery(query("FROM api_tokens t")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "scopes", "created_at", "last_used_at"}).
+			AddRow(tokenID, userID, "Тест", "ehw_test", "{"+strings.Join(scopes, ",")+"}", time.Now(), nil))
+	e.mock.ExpectExec(query("UPDATE api_tokens SET last_used_at")).WillReturnResult(sqlmock.NewResult(0, 1))
+	return "ehw_test" + strconv.Itoa(tokenID)
+}
+
+var postColumns = []string{"id", "title", "description", "type", "file_name", "thumbnail", "views", "likes", "fucks",
+	"comments", "uploaded_at", "login", "display_name", "profile_image_url"}
+
+func postRows() *sqlmock.Rows {
+	return sqlmock.NewRows(postColumns).
+		AddRow(5, "Мем", "", "image", "meme.png", "", 10, 2, 0, 1, time.Now(), "streamer", "Streamer", "https://cdn.test/a.png").
+		AddRow(4, "Клип", "Описание", "clip", "<iframe></iframe>", "https://clips.test/t.jpg", 3, 0, 1, 0, time.Now(), "viewer", "Зритель", "https://cdn.test/b.png")
+}
+
+var userColumns = []string{"id", "login", "display_name", "profile_image_url", "role", "followers", "badge", "created_at", "posts"}
+
+func TestSpecRoutesAreServed(t *testing.T) {
+	spec := loadSpec(t)
+	router := app.NewRouter()
+	params := strings.NewReplacer("{id}", "1", "{login}", "streamer")
+
+	for route, operations := range spec.Paths {
+		for method := range operations {
+			req := httptest.NewRequest(strings.ToUpper(method), "/api/v1"+params.Replace(route), nil)
+			var match mux.RouteMatch
+			if !router.Match(req, &match) || match.MatchErr != nil {
+				t.Errorf("%s %s описан в спецификации, но не обслуживается", strings.ToUpper(method), route)
+			}
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	e := newContractEnv(t)
+	rec := e.do("GET", "/openapi.json", "/openapi.json", "", nil)
+	e.expectStatus(rec, http.StatusOK)
+
+	want, err := os.ReadFile(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), want) {
+		t.Error("отдается не тот файл спецификации")
+	}
+}
+
+func TestListPosts(t *testing.T) {
+	e := newContractEnv(t)
+	e.mock.ExpectQuery(query("SELECT COUNT(*) FROM files f")).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	e.mock.ExpectQuery(query("FROM files f")).WithArgs(0, 2, 0).WillReturnRows(postRows())
+
+	rec := e.do("GET", "/posts?limit=2", "/posts", "", nil)
+	e.expectStatus(rec, http.StatusOK)
+
+	var body struct {
+		Pagination struct {
+			HasMore bool `json:"has_more"`
+		} `json:"pagination"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if !body.Pagination.HasMore {
+		t.Error("при 3 постах и limit=2 has_more должен быть true")
+	}
+}
+
+func TestListPostsErrors(t *testing.T) {
+	e := newContractEnv(t)
+	e.expectStatus(e.do("GET", "/posts?limit=0", "/posts", "", nil), http.StatusUnprocessableEntity)
+	e.expectStatus(e.do("GET", "/posts?page=abc", "/posts", "", nil), http.StatusUnprocessableEntity)
+
+	e.mock.ExpectQuery(query("FROM users u")).WithArgs("nobody").WillReturnError(sql.ErrNoRows)
+	e.expectStatus(e.do("GET", "/posts?author=nobody", "/posts", "", nil), http.StatusNotFound)
+}
+
+func TestGetPost(t *testing.T) {
+	e := newContractEnv(t)
+	e.mock.ExpectQuery(query("WHERE f.id = $1")).WithArgs(5).WillReturnRows(postRows())
+	e.expectStatus(e.do("GET", "/posts/5", "/posts/{id}", "", nil), http.StatusOK)
+
+	e.mock.ExpectQuery(query("WHERE f.id = $1")).WithArgs(6).WillReturnError(sql.ErrNoRows)
+	e.expectStatus(e.do("GET", "/posts/6", "/posts/{id}", "", nil), http.StatusNotFound)
+
+	e.expectStatus(e.do("GET", "/posts/abc", "/posts/{id}", "", nil), http.StatusNotFound)
+}
+
+func TestPostComments(t *testing.T) {
+	e := newContractEnv(t)
+	e.mock.ExpectQuery(query("WHERE f.id = $1")).WithArgs(5).WillReturnRows(postRows())
+	e.expectStatus(e.do("GET", "/posts/5/comments?sort=random", "/posts/{id}/comments", "", nil), http.StatusUnprocessableEntity)
+
+	token := e.expectToken(1, 7, "write:posts")
+	e.mock.ExpectQuery(query("WHERE f.id = $1")).WithArgs(5).WillReturnRows(postRows())
+	rec := e.do("POST", "/posts/5/comments", "/posts/{id}/comments", token, url.Values{"text": {"  "}})
+	e.expectStatus(rec, http.StatusUnprocessableEntity)
+}
+
+func TestGetUser(t *testing.T) {
+	e := newContractEnv(t)
+	e.mock.ExpectQuery(query("FROM users u")).WithArgs("streamer").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(7, "streamer", "Streamer", "https://cdn.test/a.png", "user", 12, "", time.Now(), 3))
+	e.expectStatus(e.do("GET", "/users/Streamer", "/users/{login}", "", nil), http.StatusOK)
+
+	e.mock.ExpectQuery(query("FROM users u")).WithArgs("nobody").WillReturnError(sql.ErrNoRows)
+	e.expectStatus(e.do("GET", "/users/nobody", "/users/{login}", "", nil), http.StatusNotFound)
+}
+
+func TestMe(t *testing.T) {
+	e := newContractEnv(t)
+	e.expectStatus(e.do("GET", "/me", "/me", "", nil), http.StatusUnauthorized)
+
+	e.mock.ExpectQuery(query("FROM api_tokens t")).WillReturnError(sql.ErrNoRows)
+	rec := e.do("GET", "/me", "/me", "ehw_unknown", nil)
+	e.expectStatus(rec, http.StatusUnauthorized)
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("у 401 по токену нет WWW-Authenticate")
+	}
+
+	token := e.expectToken(2, 7, "read:posts")
+	e.expectStatus(e.do("GET", "/me", "/me", token, nil), http.StatusForbidden)
+
+	token = e.expectToken(3, 7, "read:profile")
+	e.mock.ExpectQuery(query("FROM users")).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "twitch_id", "login", "display_name", "profile_image_url", "email",
+			"created_at", "role", "rating", "is_banned", "followers"}).
+			AddRow(7, "123", "streamer", "Streamer", "https://cdn.test/a.png", "", time.Now(), "user", 150, false, 12))
+	e.mock.ExpectQuery(query("SELECT badge_id")).WithArgs(7).WillReturnError(sql.ErrNoRows)
+	e.mock.ExpectQuery(query("FROM users u")).WithArgs("streamer").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(7, "streamer", "Streamer", "https://cdn.test/a.png", "user", 12, "", time.Now(), 3))
+	e.expectStatus(e.do("GET", "/me", "/me", token, nil), http.StatusOK)
+}
+
+func TestCaseRewards(t *testing.T) {
+	e := newContractEnv(t)
+	e.mock.ExpectQuery(query("FROM cases")).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "price", "image"}).AddRow(3, "Кейс", 100, "case.png"))
+	e.mock.ExpectQuery(query("FROM cases_rewards")).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "type", "probability"}).AddRow(1, "auk", 0.5).AddRow(2, "vip", 0.5))
+	e.mock.ExpectQuery(query("SELECT auk_value")).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"auk_value"}).AddRow(300))
+	e.mock.ExpectQuery(query("SELECT vip_days")).WithArgs(2).WillReturnRows(sqlmock.NewRows([]string{"vip_days"}).AddRow(7))
+	e.expectStatus(e.do("GET", "/cases/3/rewards", "/cases/{id}/rewards", "", nil), http.StatusOK)
+
+	e.mock.ExpectQuery(query("FROM cases")).WithArgs(4).WillReturnError(sql.ErrNoRows)
+	e.expectStatus(e.do("GET", "/cases/4/rewards", "/cases/{id}/rewards", "", nil), http.StatusNotFound)
+}
+
+func TestQueue(t *testing.T) {
+	e := newContractEnv(t)
+	token := e.expectToken(4, 7, "read:queue")
+	e.mock.ExpectQuery(query("SELECT u.role = 'admin', ARRAY(")).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"admin", "permissions"}).AddRow(false, "{}"))
+	e.expectStatus(e.do("GET", "/queue", "/queue", token, nil), http.StatusForbidden)
+
+	token = e.expectToken(5, 8, "read:queue")
+	e.mock.ExpectQuery(query("SELECT u.role = 'admin', ARRAY(")).WithArgs(8).
+		WillReturnRows(sqlmock.NewRows([]string{"admin", "permissions"}).AddRow(false, "{manage_queue}"))
+	e.mock.ExpectQuery(query("FROM auk_submissions, users")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "display_name", "profile_image_url", "auk_value", "lot"}).
+			AddRow(1, "Зритель", "https://cdn.test/b.png", 500, "Игра"))
+	e.expectStatus(e.do("GET", "/queue", "/queue", token, nil), http.StatusOK)
+}
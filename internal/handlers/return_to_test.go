@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSafeReturnPath(t *testing.T) {
+	tests := []struct {
+		returnTo string
+		want     string
+	}{
+		{"/post/5", "/post/5"},
+		{"/user/streamer?tab=posts#top", "/user/streamer?tab=posts#top"},
+		{"", "/"},
+		{"post/5", "/"},
+		{"https://evil.com", "/"},
+		{"//evil.com", "/"},
+		{"///evil.com", "/"},
+		{"/\\evil.com", "/"},
+		{"\\\\evil.com", "/"},
+		{"/\t/evil.com", "/"},
+		{"/\n/evil.com", "/"},
+		{"/ /evil.com", "/"},
+		{"javascript:alert(1)", "/"},
+		{"/auth/callback", "/"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://example.test/auth/twitch?return_to="+url.QueryEscape(tt.returnTo), nil)
+		if got := safeReturnPath(r); got != tt.want {
+			t.Errorf("return_to %q: получено %q, ожидалось %q", tt.returnTo, got, tt.want)
+		}
+	}
+}
+
+func TestSafeReturnPathReferer(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://example.test/auth/twitch", nil)
+	r.Header.Set("Referer", "http://example.test/feed?page=2")
+	if got := safeReturnPath(r); got != "/feed?page=2" {
+		t.Errorf("Referer своего сайта: получено %q", got)
+	}
+
+	r = httptest.NewRequest("GET", "http://example.test/auth/twitch", nil)
+	r.Header.Set("Referer", "https://evil.com/feed")
+	if got := safeReturnPath(r); got != "/" {
+		t.Errorf("чужой Referer: получено %q", got)
+	}
+}
@@ -75,6 +75,9 @@ type CommentWithAuthor struct {
 	AuthorID              int                 `json:"author_id"`
 	HasLiked              bool                `json:"has_liked"`
 	Badge                 string              `json:"badge_image_url"`
+	Depth                 int                 `json:"depth"`
+	RepliesCount          int                 `json:"replies_count"`
+	Collapsed             bool                `json:"collapsed"`
 }
 
 type Comment struct {
@@ -87,6 +90,19 @@ type Comment struct {
 	UpdatedAt  time.Time `json:"updated_at"`
 	Likes      int       `json:"likes"`
 	AuthorName string    `json:"author_name"`
+	IsEdited   bool      `json:"is_edited"`
+	IsDeleted  bool      `json:"is_deleted"`
+}
+
+type CommentsPage struct {
+	Comments   []CommentWithAuthor `json:"comments"`
+	Sort       string              `json:"sort"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+type CommentEdit struct {
+	Text     string    `json:"text"`
+	EditedAt time.Time `json:"edited_at"`
 }
 
 type Like struct {
@@ -108,6 +124,12 @@ type UserSearchResult struct {
 	ProfileImageURL string `json:"profile_image_url"`
 }
 
+type MentionUser struct {
+	Login           string `json:"login"`
+	DisplayName     string `json:"display_name"`
+	ProfileImageURL string `json:"profile_image_url"`
+}
+
 type ModerationPost struct {
 	ID           int       `json:"id"`
 	AuthorID     int       `json:"author_id"`
@@ -152,12 +174,45 @@ type Stats struct {
 }
 
 type Notification struct {
-	ID            int       `json:"id"`
-	Notification  string    `json:"notification"`
-	Image         string    `json:"image"`
-	Link          string    `json:"link"`
-	FormattedTime string    `json:"time"`
-	CreatedAt     time.Time `json:"created_at"`
+	ID            int               `json:"id"`
+	Type          string            `json:"type"`
+	Params        map[string]string `json:"params"`
+	Actor         string            `json:"actor"`
+	ActorLogin    string            `json:"-"`
+	ActorImage    string            `json:"-"`
+	Notification  string            `json:"notification"`
+	Image         string            `json:"image"`
+	Link          string            `json:"link"`
+	FileID        int               `json:"file_id"`
+	Read          bool              `json:"read"`
+	Others        int               `json:"others"`
+	FormattedTime string            `json:"time"`
+	CreatedAt     time.Time         `json:"created_at"`
+}
+
+type NotificationsPage struct {
+	Notifications []Notification `json:"notifications"`
+	Unread        int            `json:"unread"`
+	NextCursor    int            `json:"next_cursor,omitempty"`
+}
+
+type NotificationEvent struct {
+	Unread       int           `json:"unread"`
+	Notification *Notification `json:"notification,omitempty"`
+}
+
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+type NotificationPreference struct {
+	Category string `json:"category"`
+	Title    string `json:"title"`
+	Enabled  bool   `json:"enabled"`
 }
 
 type ShopItem struct {
@@ -169,6 +224,108 @@ type ShopItem struct {
 	Image   string `json:"image_url"`
 	Owned   bool   `json:"owned"`
 	Rating  int    `json:"rating"`
+
+	// Параметры типа товара, например цвет ника или код эмоута
+	Params map[string]string `json:"params,omitempty"`
+	// Что спросить у покупателя; пусто - ничего
+	InputLabel string `json:"input_label,omitempty"`
+
+	// Cost - цена с учетом скидки, BaseCost - без нее
+	BaseCost       int        `json:"base_cost"`
+	Discount       int        `json:"discount,omitempty"`
+	AvailableFrom  *time.Time `json:"available_from,omitempty"`
+	AvailableUntil *time.Time `json:"available_until,omitempty"`
+	Stock          *int       `json:"stock,omitempty"`
+	Sold           int        `json:"sold"`
+	PerUserLimit   *int       `json:"per_user_limit,omitempty"`
+	Purchased      int        `json:"purchased"`
+	FeaturedSlot   *int       `json:"featured_slot,omitempty"`
+}
+
+// Осталось штук; -1 без ограничения
+func (i ShopItem) Remaining() int {
+	if i.Stock == nil {
+		return -1
+	}
+	return max(*i.Stock-i.Sold, 0)
+}
+
+// Можно ли купить еще: есть остаток и не исчерпан личный лимит
+func (i ShopItem) Purchasable() bool {
+	if i.Remaining() == 0 {
+		return false
+	}
+	return i.PerUserLimit == nil || i.Purchased < *i.PerUserLimit
+}
+
+// Настройки продажи товара из админки. nil - без ограничения
+type ShopItemSettings struct {
+	AvailableFrom  *time.Time `json:"available_from"`
+	AvailableUntil *time.Time `json:"available_until"`
+	Stock          *int       `json:"stock"`
+	PerUserLimit   *int       `json:"per_user_limit"`
+	FeaturedSlot   *int       `json:"featured_slot"`
+}
+
+// Тип товара из реестра, для формы создания товара в админке
+type ShopItemType struct {
+	Type     string   `json:"type"`
+	Title    string   `json:"title"`
+	Params   []string `json:"params"`
+	Unique   bool     `json:"unique"`
+	Cosmetic bool     `json:"cosmetic"`
+}
+
+// Купленный товар в админке, его можно вернуть
+type ShopPurchase struct {
+	ID          int        `json:"id"`
+	DisplayName string     `json:"display_name"`
+	ItemID      int        `json:"item_id"`
+	ItemTitle   string     `json:"item_title"`
+	ItemType    string     `json:"item_type"`
+	Price       int        `json:"price"`
+	Input       string     `json:"input,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RefundedAt  *time.Time `json:"refunded_at,omitempty"`
+}
+
+// Заявка на награду за рейтинг, которую выполняет стример
+type ShopRedemption struct {
+	ID          int       `json:"id"`
+	PurchaseID  int       `json:"purchase_id"`
+	DisplayName string    `json:"display_name"`
+	ItemTitle   string    `json:"item_title"`
+	Input       string    `json:"input"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Купленный предмет оформления профиля или эмоут
+type OwnedShopItem struct {
+	ItemID   int               `json:"item_id"`
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Image    string            `json:"image"`
+	Params   map[string]string `json:"params,omitempty"`
+	Equipped bool              `json:"equipped"`
+}
+
+// Надетое оформление профиля
+type UserCosmetics struct {
+	Frame     string `json:"frame,omitempty"`
+	NameColor string `json:"name_color,omitempty"`
+	Banner    string `json:"banner,omitempty"`
+}
+
+// Скидка на товар или на весь магазин, если ItemID = 0
+type ShopDiscount struct {
+	ID        int       `json:"id"`
+	Title     string    `json:"title"`
+	Percent   int       `json:"percent"`
+	ItemID    int       `json:"item_id,omitempty"`
+	ItemTitle string    `json:"item_title,omitempty"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
 }
 
 type Tokens struct {
@@ -194,6 +351,169 @@ type CaseReward struct {
 	AukValue    int     `json:"auk_value"`
 	Image       string  `json:"image"`
 	Title       string  `json:"title"`
+	OpeningID   int     `json:"opening_id,omitempty"`
+	VIPDays     int     `json:"vip_days,omitempty"`
+
+	// Для инвентаря: сколько штук и откуда они пришли
+	Quantity int              `json:"quantity,omitempty"`
+	Batches  []InventoryBatch `json:"batches,omitempty"`
+}
+
+// Партия предметов в инвентаре: выпала из кейса, подарена или получена обменом
+type InventoryBatch struct {
+	Quantity        int       `json:"quantity"`
+	Source          string    `json:"source"`
+	FromDisplayName string    `json:"from_display_name,omitempty"`
+	AcquiredAt      time.Time `json:"acquired_at"`
+}
+
+type TradeItem struct {
+	RewardID int    `json:"reward_id"`
+	Quantity int    `json:"quantity"`
+	Title    string `json:"title"`
+	Image    string `json:"image"`
+}
+
+// Предложение обмена: Give отдает отправитель, Want - получатель
+type TradeOffer struct {
+	ID              int         `json:"id"`
+	Incoming        bool        `json:"incoming"`
+	FromDisplayName string      `json:"from_display_name"`
+	FromImage       string      `json:"from_image"`
+	ToDisplayName   string      `json:"to_display_name"`
+	ToImage         string      `json:"to_image"`
+	Status          string      `json:"status"`
+	Message         string      `json:"message"`
+	Give            []TradeItem `json:"give"`
+	Want            []TradeItem `json:"want"`
+	CreatedAt       time.Time   `json:"created_at"`
+	ResolvedAt      *time.Time  `json:"resolved_at,omitempty"`
+}
+
+type InventoryTransfer struct {
+	ID              int       `json:"id"`
+	Kind            string    `json:"kind"`
+	Incoming        bool      `json:"incoming"`
+	RewardID        int       `json:"reward_id"`
+	Title           string    `json:"title"`
+	Image           string    `json:"image"`
+	Quantity        int       `json:"quantity"`
+	FromDisplayName string    `json:"from_display_name"`
+	ToDisplayName   string    `json:"to_display_name"`
+	TradeOfferID    int       `json:"trade_offer_id,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Цена выкупа награды одного типа. Value 0 - тип не выкупается
+type ResaleValue struct {
+	Type  string `json:"type"`
+	Value int    `json:"value"`
+}
+
+// Итог продажи предметов. Skipped - дубликаты, которые не продались: у их типа нет цены выкупа
+type RecycleResult struct {
+	Sold     int              `json:"sold"`
+	Credited int              `json:"credited"`
+	Rating   int              `json:"rating"`
+	Skipped  []RecycleSkipped `json:"skipped,omitempty"`
+}
+
+type RecycleSkipped struct {
+	RewardID int `json:"reward_id"`
+	Quantity int `json:"quantity"`
+}
+
+// Пара сидов для честного открытия кейсов. ServerSeed отдается только после раскрытия,
+// NextServerSeedHash - хеш сида, который станет серверным при следующей смене пары
+type CaseSeed struct {
+	ID                 int        `json:"id"`
+	ServerSeed         string     `json:"server_seed,omitempty"`
+	ServerSeedHash     string     `json:"server_seed_hash"`
+	NextServerSeedHash string     `json:"next_server_seed_hash,omitempty"`
+	ClientSeed         string     `json:"client_seed"`
+	Nonce              int        `json:"nonce"`
+	CreatedAt          time.Time  `json:"created_at"`
+	RevealedAt         *time.Time `json:"revealed_at,omitempty"`
+}
+
+// Вероятность награды на момент открытия
+type CaseOpeningReward struct {
+	ID          int     `json:"id"`
+	Probability float64 `json:"probability"`
+}
+
+type CaseOpening struct {
+	ID             int                 `json:"id"`
+	CaseID         int                 `json:"case_id"`
+	CaseTitle      string              `json:"case_title"`
+	RewardID       int                 `json:"reward_id"`
+	DisplayName    string              `json:"display_name"`
+	Price          int                 `json:"price"`
+	ServerSeed     string              `json:"server_seed,omitempty"`
+	ServerSeedHash string              `json:"server_seed_hash"`
+	ClientSeed     string              `json:"client_seed"`
+	Nonce          int                 `json:"nonce"`
+	Roll           float64             `json:"roll"`
+	Rewards        []CaseOpeningReward `json:"rewards"`
+	Revealed       bool                `json:"revealed"`
+	Verified       bool                `json:"verified"`
+	CreatedAt      time.Time           `json:"created_at"`
+}
+
+// Проверка таблицы наград кейса
+type CaseRewardsReport struct {
+	CaseID  int      `json:"case_id"`
+	Title   string   `json:"title"`
+	Price   int      `json:"price"`
+	Rewards int      `json:"rewards"`
+	Sum     float64  `json:"sum"`
+	Valid   bool     `json:"valid"`
+	Issues  []string `json:"issues"`
+}
+
+type CaseSimulationReward struct {
+	ID          int     `json:"id"`
+	Type        string  `json:"type"`
+	Title       string  `json:"title"`
+	Probability float64 `json:"probability"`
+	Value       float64 `json:"value"`
+	Priced      bool    `json:"priced"`
+	Count       int     `json:"count"`
+	Share       float64 `json:"share"`
+}
+
+// Результат виртуальных открытий. Ценность наград считается в рейтинге
+type CaseSimulation struct {
+	CaseID        int                    `json:"case_id"`
+	Price         int                    `json:"price"`
+	Openings      int                    `json:"openings"`
+	Failed        int                    `json:"failed"`
+	ExpectedValue float64                `json:"expected_value"`
+	AverageValue  float64                `json:"average_value"`
+	ReturnRate    float64                `json:"return_rate"`
+	Rewards       []CaseSimulationReward `json:"rewards"`
+}
+
+// VIP на время; после ExpiresAt его отзывает воркер
+type VIPGrant struct {
+	DisplayName string    `json:"display_name"`
+	Login       string    `json:"login"`
+	GrantedAt   time.Time `json:"granted_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Задача outbox на внешнее действие, например выдачу VIP
+type OutboxJob struct {
+	ID            int        `json:"id"`
+	Kind          string     `json:"kind"`
+	UserID        int        `json:"-"`
+	RefID         int        `json:"-"`
+	DisplayName   string     `json:"display_name"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error"`
+	CreatedAt     time.Time  `json:"created_at"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	FailedAt      *time.Time `json:"failed_at,omitempty"`
 }
 
 type AukSubmission struct {
@@ -251,4 +571,314 @@ type MessageWithAuthor struct {
 	Content     string    `json:"content"`
 	FilesURL    []string  `json:"files_urls"`
 	Sent        time.Time `json:"sent_at"`
+	// Эмоуты автора из сообщения: код -> картинка
+	Emotes map[string]string `json:"emotes,omitempty"`
+}
+
+type AnalyticsPoint struct {
+	Day       string `json:"day"`
+	Views     int64  `json:"views"`
+	Likes     int64  `json:"likes"`
+	Fucks     int64  `json:"fucks"`
+	Comments  int64  `json:"comments"`
+	Followers int64  `json:"followers"`
+}
+
+type AnalyticsPost struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	Thumbnail string `json:"thumbnail"`
+	FileName  string `json:"file_name"`
+	Type      string `json:"type"`
+	Views     int64  `json:"views"`
+	Likes     int64  `json:"likes"`
+	Fucks     int64  `json:"fucks"`
+	Comments  int64  `json:"comments"`
+}
+
+type Analytics struct {
+	Days     int              `json:"days"`
+	PostID   int              `json:"post_id,omitempty"`
+	Totals   AnalyticsPoint   `json:"totals"`
+	Series   []AnalyticsPoint `json:"series"`
+	TopPosts []AnalyticsPost  `json:"top_posts"`
+}
+
+type Collection struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	AuthorName  string    `json:"author_name"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	IsPublic    bool      `json:"is_public"`
+	Followers   int       `json:"followers"`
+	PostsCount  int       `json:"posts_count"`
+	Cover       string    `json:"cover"`
+	CreatedAt   time.Time `json:"created_at"`
+	IsOwner     bool      `json:"is_owner"`
+	IsFollowing bool      `json:"is_following"`
+	Contains    bool      `json:"contains"`
+}
+
+type CollectionPost struct {
+	ID         int    `json:"id"`
+	Title      string `json:"title"`
+	Thumbnail  string `json:"thumbnail"`
+	FileName   string `json:"file_name"`
+	Type       string `json:"type"`
+	IsVideo    bool   `json:"is_video"`
+	AuthorName string `json:"author_name"`
+	Position   int    `json:"position"`
+}
+
+type CollectionWithPosts struct {
+	Collection
+	Posts []CollectionPost `json:"posts"`
+}
+
+type SavedPost struct {
+	ID         int       `json:"id"`
+	Title      string    `json:"title"`
+	Thumbnail  string    `json:"thumbnail"`
+	FileName   string    `json:"file_name"`
+	Type       string    `json:"type"`
+	IsVideo    bool      `json:"is_video"`
+	AuthorName string    `json:"author_name"`
+	SavedAt    time.Time `json:"saved_at"`
+}
+
+type BookmarksPage struct {
+	Posts      []SavedPost `json:"posts"`
+	Type       string      `json:"type"`
+	Page       int         `json:"page"`
+	Total      int         `json:"total"`
+	TotalPages int         `json:"total_pages"`
+}
+
+type DigestSettings struct {
+	Frequency string `json:"frequency"`
+	Email     string `json:"email"`
+}
+
+type DigestRecipient struct {
+	UserID           int
+	Email            string
+	DisplayName      string
+	Frequency        string
+	UnsubscribeToken string
+	Since            time.Time
+}
+
+type DigestPost struct {
+	ID         int
+	Title      string
+	AuthorName string
+	Likes      int64
+	URL        string
+}
+
+type Digest struct {
+	Recipient      DigestRecipient
+	Likes          int64
+	Followers      int64
+	Comments       int64
+	TopPosts       []DigestPost
+	UnsubscribeURL string
+	SettingsURL    string
+}
+
+type MailMessage struct {
+	To      string
+	Subject string
+	HTML    string
+	Headers map[string]string
+}
+
+type UserSession struct {
+	ID           int       `json:"id"`
+	Device       string    `json:"device"`
+	IP           string    `json:"ip"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActiveAt time.Time `json:"last_active_at"`
+	LastActive   string    `json:"last_active"`
+	Current      bool      `json:"current"`
+}
+
+type APITokenScope struct {
+	Scope string `json:"scope"`
+	Title string `json:"title"`
+}
+
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsed   string     `json:"last_used,omitempty"`
+	Token      string     `json:"token,omitempty"`
+}
+
+type Permission struct {
+	Name  string `json:"name"`
+	Title string `json:"title"`
+}
+
+type RolePermissions struct {
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+type UserPermission struct {
+	Name     string `json:"name"`
+	Title    string `json:"title"`
+	FromRole bool   `json:"from_role"`
+	Granted  bool   `json:"granted"`
+}
+
+type UserPermissions struct {
+	UserID      int              `json:"user_id"`
+	Login       string           `json:"login"`
+	Role        string           `json:"role"`
+	Permissions []UserPermission `json:"permissions"`
+}
+
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Публичный API v1. Все поля в snake_case, ответы обернуты в data.
+
+type APIResponse struct {
+	Data       interface{}    `json:"data"`
+	Pagination *APIPagination `json:"pagination,omitempty"`
+}
+
+type APIPagination struct {
+	Page       int    `json:"page,omitempty"`
+	Limit      int    `json:"limit"`
+	Total      *int   `json:"total,omitempty"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+type APIUserRef struct {
+	Login           string `json:"login,omitempty"`
+	DisplayName     string `json:"display_name"`
+	ProfileImageURL string `json:"profile_image_url"`
+}
+
+type APIUser struct {
+	APIUserRef
+	Role          string    `json:"role"`
+	Followers     int       `json:"followers"`
+	Posts         int       `json:"posts"`
+	BadgeImageURL string    `json:"badge_image_url,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type APIMe struct {
+	APIUser
+	Balance int `json:"balance"`
+}
+
+type APIPost struct {
+	ID           int        `json:"id"`
+	Title        string     `json:"title"`
+	Description  string     `json:"description"`
+	Type         string     `json:"type"` // image, video или clip
+	MediaURL     string     `json:"media_url,omitempty"`
+	EmbedHTML    string     `json:"embed_html,omitempty"`
+	ThumbnailURL string     `json:"thumbnail_url,omitempty"`
+	Views        int64      `json:"views"`
+	Likes        int64      `json:"likes"`
+	Fucks        int64      `json:"fucks"`
+	Comments     int        `json:"comments"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Author       APIUserRef `json:"author"`
+}
+
+type APIComment struct {
+	ID           int          `json:"id"`
+	PostID       int          `json:"post_id"`
+	ParentID     int          `json:"parent_id,omitempty"`
+	Text         string       `json:"text"`
+	Likes        int          `json:"likes"`
+	RepliesCount int          `json:"replies_count"`
+	IsEdited     bool         `json:"is_edited"`
+	IsDeleted    bool         `json:"is_deleted"`
+	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+	Author       APIUserRef   `json:"author"`
+	Replies      []APIComment `json:"replies,omitempty"`
+}
+
+type APIShopItem struct {
+	ID             int        `json:"id"`
+	Type           string     `json:"type"`
+	Title          string     `json:"title"`
+	Cost           int        `json:"cost"`
+	BaseCost       int        `json:"base_cost"`
+	Discount       int        `json:"discount,omitempty"`
+	ImageURL       string     `json:"image_url,omitempty"`
+	Owned          bool       `json:"owned"`
+	AvailableUntil *time.Time `json:"available_until,omitempty"`
+	Remaining      *int       `json:"remaining,omitempty"`
+	PerUserLimit   *int       `json:"per_user_limit,omitempty"`
+	Purchased      int        `json:"purchased"`
+	Featured       bool       `json:"featured"`
+	InputLabel     string     `json:"input_label,omitempty"`
+}
+
+type APICase struct {
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Price       int    `json:"price"`
+	ImageURL    string `json:"image_url"`
+}
+
+type APIReward struct {
+	ID          int     `json:"id"`
+	Type        string  `json:"type"`
+	Title       string  `json:"title"`
+	ImageURL    string  `json:"image_url,omitempty"`
+	Probability float64 `json:"probability,omitempty"`
+	AukValue    int     `json:"auk_value,omitempty"`
+	OpeningID   int     `json:"opening_id,omitempty"`
+	Quantity    int     `json:"quantity,omitempty"`
+}
+
+type APIQueueItem struct {
+	ID         int        `json:"id"`
+	Submission string     `json:"submission"`
+	AukValue   int        `json:"auk_value"`
+	User       APIUserRef `json:"user"`
+}
+
+type APILiveChannel struct {
+	Login           string     `json:"login"`
+	DisplayName     string     `json:"display_name"`
+	ProfileImageURL string     `json:"profile_image_url,omitempty"`
+	IsLive          bool       `json:"is_live"`
+	Title           string     `json:"title,omitempty"`
+	GameName        string     `json:"game_name,omitempty"`
+	ViewerCount     int        `json:"viewer_count"`
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	ThumbnailURL    string     `json:"thumbnail_url,omitempty"`
+}
+
+type ChatLink struct {
+	TwitchLogin string    `json:"twitch_login"`
+	LinkedAt    time.Time `json:"linked_at"`
+}
+
+type ChatLinkCode struct {
+	Code        string    `json:"code"`
+	TwitchLogin string    `json:"twitch_login"`
+	ExpiresAt   time.Time `json:"expires_at"`
 }
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"database/sql"
+	"ehchobyahs/internal/models"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	UseDB(conn)
+	return mock
+}
+
+func TestAddRewardRejectsOverflow(t *testing.T) {
+	mock := mockDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM cases WHERE id = \\$1 FOR UPDATE").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+	mock.ExpectQuery("SUM\\(probability\\)").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0.8))
+	mock.ExpectRollback()
+
+	err := AddReward(models.CaseReward{CaseID: 5, Type: "auk", AukValue: 100, Probability: 0.3}, false)
+	var validation *ValidationError
+	if !errors.As(err, &validation) || validation.Field != "probability" {
+		t.Fatalf("ожидалась ошибка валидации probability, получено %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddRewardFillsToOne(t *testing.T) {
+	mock := mockDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM cases WHERE id = \\$1 FOR UPDATE").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+	mock.ExpectQuery("SUM\\(probability\\)").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0.7))
+	mock.ExpectExec("INSERT INTO cases_rewards").WithArgs(0.3, 5, 100).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err := AddReward(models.CaseReward{CaseID: 5, Type: "auk", AukValue: 100, Probability: 0.3}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddRewardNormalizeSkipsSumCheck(t *testing.T) {
+	mock := mockDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM cases WHERE id = \\$1 FOR UPDATE").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+	mock.ExpectExec("INSERT INTO cases_rewards").WithArgs(0.9, 5, 7).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err := AddReward(models.CaseReward{CaseID: 5, Type: "badge", BadgeID: 7, Probability: 0.9}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddRewardMissingCase(t *testing.T) {
+	mock := mockDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM cases WHERE id = \\$1 FOR UPDATE").WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+
+	err := AddReward(models.CaseReward{CaseID: 9, Type: "auk", AukValue: 100, Probability: 0.5}, false)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("ожидалось sql.ErrNoRows, получено %v", err)
+	}
+}
+
+func TestCaseRewardIssues(t *testing.T) {
+	if issues := caseRewardIssues(nil); len(issues) != 1 {
+		t.Errorf("пустой кейс: %v", issues)
+	}
+	valid := []models.CaseReward{{ID: 1, Probability: 0.25}, {ID: 2, Probability: 0.75}}
+	if issues := caseRewardIssues(valid); len(issues) != 0 {
+		t.Errorf("корректный кейс: %v", issues)
+	}
+	broken := []models.CaseReward{{ID: 1, Probability: 0}, {ID: 2, Probability: 0.5}}
+	if issues := caseRewardIssues(broken); len(issues) != 2 {
+		t.Errorf("нулевой шанс и сумма 0.5: %v", issues)
+	}
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"ehchobyahs/internal/models"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// Эталон посчитан отдельно: HMAC-SHA256("server-seed", "client:7"), первые 52 бита / 2^52
+const (
+	testServerSeed     = "server-seed"
+	testServerSeedHash = "91024ec49c5bec0b689e42892526320fce08337205c91de94c7a588c20d08eeb"
+	testRoll           = 1733882577528482.0 / (1 << 52)
+)
+
+var testRewards = []models.CaseOpeningReward{
+	{ID: 1, Probability: 0.3},
+	{ID: 2, Probability: 0.5},
+	{ID: 3, Probability: 0.2},
+}
+
+func TestCaseRoll(t *testing.T) {
+	if got := CaseRoll(testServerSeed, "client", 7); got != testRoll {
+		t.Fatalf("CaseRoll() = %v, ожидалось %v", got, testRoll)
+	}
+	if got := CaseRoll(testServerSeed, "client", 8); got == testRoll {
+		t.Fatal("другой nonce дал тот же бросок")
+	}
+	if got := hashSeed(testServerSeed); got != testServerSeedHash {
+		t.Fatalf("hashSeed() = %s", got)
+	}
+}
+
+func TestPickCaseReward(t *testing.T) {
+	tests := []struct {
+		roll float64
+		want int
+	}{
+		{0, 0},
+		{0.2999, 0},
+		{0.3, 1},
+		{testRoll, 1},
+		{0.8, 2},
+		{0.9999999999, 2},
+	}
+	for _, tt := range tests {
+		if got := pickCaseReward(testRewards, tt.roll); got != tt.want {
+			t.Errorf("бросок %v: индекс %d, ожидался %d", tt.roll, got, tt.want)
+		}
+	}
+
+	// Шансы не сходятся в 1 - хвост ничей
+	short := []models.CaseOpeningReward{{ID: 1, Probability: 0.5}}
+	if got := pickCaseReward(short, 0.7); got != -1 {
+		t.Errorf("неполная таблица: индекс %d, ожидался -1", got)
+	}
+}
+
+func TestGetCaseOpeningVerified(t *testing.T) {
+	rewards, _ := json.Marshal(testRewards)
+
+	tests := []struct {
+		name       string
+		serverSeed string
+		seedHash   string
+		rewardID   int
+		want       bool
+	}{
+		{"честное открытие", testServerSeed, testServerSeedHash, 2, true},
+		{"подменен сид", "other-seed", testServerSeedHash, 2, false},
+		{"подменена награда", testServerSeed, testServerSeedHash, 3, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			UseDB(conn)
+
+			mock.ExpectQuery("FROM case_openings co").WithArgs(10).WillReturnRows(sqlmock.NewRows([]string{
+				"id", "case_id", "title", "reward_id", "display_name", "price",
+				"server_seed", "server_seed_hash", "client_seed", "nonce", "roll", "rewards",
+				"revealed", "created_at",
+			}).AddRow(10, 1, "Кейс", tt.rewardID, "Зритель", 100,
+				tt.serverSeed, tt.seedHash, "client", 7, testRoll, rewards,
+				true, time.Now()))
+
+			o, err := GetCaseOpening(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o.Verified != tt.want {
+				t.Errorf("Verified = %v, ожидалось %v", o.Verified, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetCaseOpeningHidesUnrevealedSeed(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	UseDB(conn)
+
+	rewards, _ := json.Marshal(testRewards)
+	mock.ExpectQuery("FROM case_openings co").WithArgs(10).WillReturnRows(sqlmock.NewRows([]string{
+		"id", "case_id", "title", "reward_id", "display_name", "price",
+		"server_seed", "server_seed_hash", "client_seed", "nonce", "roll", "rewards",
+		"revealed", "created_at",
+	}).AddRow(10, 1, "Кейс", 2, "Зритель", 100,
+		testServerSeed, testServerSeedHash, "client", 7, testRoll, rewards,
+		false, time.Now()))
+
+	o, err := GetCaseOpening(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.ServerSeed != "" || o.Verified {
+		t.Errorf("нераскрытый сид: server_seed %q, verified %v", o.ServerSeed, o.Verified)
+	}
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func expectBadgeInventory(mock sqlmock.Sqlmock, userID int, rows *sqlmock.Rows) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM inventory i(.|\\n)*cr.type = 'badge'(.|\\n)*FOR UPDATE OF i").WithArgs(userID).WillReturnRows(rows)
+}
+
+func TestRecycleDuplicatesKeepsOneBadge(t *testing.T) {
+	mock := mockDB(t)
+
+	// Значок 1 в двух партиях (2 + 1), значок 2 в одном экземпляре
+	expectBadgeInventory(mock, 3, sqlmock.NewRows([]string{"reward_id", "quantity"}).
+		AddRow(1, 2).AddRow(1, 1).AddRow(2, 1))
+	mock.ExpectQuery("FROM cases_rewards cr(.|\\n)*resale_values").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(10))
+	mock.ExpectQuery("SELECT id, quantity FROM inventory").WithArgs(3, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "quantity"}).AddRow(11, 2).AddRow(12, 1))
+	mock.ExpectExec("DELETE FROM inventory WHERE id = \\$1").WithArgs(11).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("UPDATE users SET rating = rating \\+ \\$1").WithArgs(20, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"rating"}).AddRow(120))
+	mock.ExpectCommit()
+
+	result, err := RecycleDuplicates(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sold != 2 || result.Credited != 20 || result.Rating != 120 || len(result.Skipped) != 0 {
+		t.Errorf("итог продажи: %+v", result)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecycleDuplicatesSkipsUnsellable(t *testing.T) {
+	mock := mockDB(t)
+
+	expectBadgeInventory(mock, 3, sqlmock.NewRows([]string{"reward_id", "quantity"}).AddRow(1, 3))
+	mock.ExpectQuery("FROM cases_rewards cr(.|\\n)*resale_values").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(0))
+	mock.ExpectRollback()
+
+	result, err := RecycleDuplicates(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sold != 0 || len(result.Skipped) != 1 || result.Skipped[0].RewardID != 1 || result.Skipped[0].Quantity != 2 {
+		t.Errorf("итог продажи: %+v", result)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSellItemNotSellable(t *testing.T) {
+	mock := mockDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM cases_rewards cr(.|\\n)*resale_values").WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(0))
+	mock.ExpectRollback()
+
+	if _, err := SellItem(3, 4, 1); !errors.Is(err, ErrNotSellable) {
+		t.Fatalf("ожидалось ErrNotSellable, получено %v", err)
+	}
+}
+
+func TestSellItemNotEnoughCopies(t *testing.T) {
+	mock := mockDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM cases_rewards cr(.|\\n)*resale_values").WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(15))
+	mock.ExpectQuery("SELECT id, quantity FROM inventory").WithArgs(3, 4).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "quantity"}).AddRow(21, 1))
+	mock.ExpectRollback()
+
+	if _, err := SellItem(3, 4, 2); !errors.Is(err, ErrNotInInventory) {
+		t.Fatalf("ожидалось ErrNotInInventory, получено %v", err)
+	}
+}
@@ -1,33 +1,102 @@
 package service
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
 	"ehchobyahs/internal/models"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"math"
+	"math/big"
 	"math/rand/v2"
+	"mime"
 	"net/http"
+	"net/smtp"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var (
 	db *sql.DB
 )
 
+// Ошибки, по которым обработчики отдают клиенту конкретный статус
+var (
+	ErrUserBanned            = errors.New("user is banned")
+	ErrPostNotFound          = errors.New("post doesn't exist")
+	ErrPostNotLiked          = errors.New("file wasn't liked")
+	ErrCommentNotFound       = errors.New("comment not found")
+	ErrParentCommentNotFound = errors.New("parent comment not found")
+	ErrCommentExists         = errors.New("comment already exists")
+	ErrCommentNotLiked       = errors.New("comment wasn't liked")
+	ErrAlreadyAdmin          = errors.New("user's already admin")
+	ErrNotModerator          = errors.New("user is not a moderator")
+	ErrNotEnoughBalance      = errors.New("not enough balance")
+	ErrAlreadyFollowing      = errors.New("already following")
+	ErrNotFollowing          = errors.New("not following")
+	ErrNotInInventory        = errors.New("item is not in inventory")
+	ErrDuplicateMessage      = errors.New("you can send only unique messages")
+	ErrCollectionNotFound    = errors.New("collection not found")
+	ErrTooManyTokens         = errors.New("too many tokens")
+	ErrCaseOpeningNotFound   = errors.New("case opening not found")
+	ErrCaseMisconfigured     = errors.New("case rewards are misconfigured")
+	ErrCaseSeedChanged       = errors.New("next server seed has changed, reload the seeds")
+	ErrIdempotencyKeyReused  = errors.New("idempotency key was used for another request")
+	ErrOutboxJobNotFound     = errors.New("outbox job not found")
+	ErrRecipientBanned       = errors.New("recipient is banned")
+	ErrTradeOfferNotFound    = errors.New("trade offer not found")
+	ErrTradeItemsMissing     = errors.New("trade items are no longer in inventory")
+	ErrNotSellable           = errors.New("item can't be sold")
+	ErrShopItemNotFound      = errors.New("shop item not found")
+	ErrShopItemUnavailable   = errors.New("shop item is not on sale")
+	ErrShopItemSoldOut       = errors.New("shop item is sold out")
+	ErrPurchaseLimitReached  = errors.New("purchase limit reached")
+	ErrShopDiscountNotFound  = errors.New("discount not found")
+	ErrAlreadyOwned          = errors.New("item is already owned")
+	ErrPurchaseNotFound      = errors.New("purchase not found")
+	ErrRedemptionNotFound    = errors.New("redemption not found")
+	ErrChatLinkCodeInvalid   = errors.New("chat link code is invalid or expired")
+	ErrChatIdentityTaken     = errors.New("twitch account has its own profile")
+)
+
+// Неверное значение поля во входных данных
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
 func InitDB() {
 	var err error
 	db, err = sql.Open("postgres", os.Getenv("DB_URL"))
@@ -36,6 +105,11 @@ func InitDB() {
 	}
 }
 
+// Подменяет подключение к базе, например на тестовое
+func UseDB(conn *sql.DB) {
+	db = conn
+}
+
 func GetUserByID(id int) (*models.User, error) {
 	var user models.User
 	err := db.QueryRow(`
@@ -132,36 +206,12 @@ func CreateOrUpdateUser(twitchUser models.User) (*models.User, error) {
 	}
 
 	if user.IsBanned {
-		return nil, errors.New("user is banned")
+		return nil, ErrUserBanned
 	}
 
 	return GetUserByID(user.ID)
 }
 
-func CheckModeratorOrAdminRole(userID int) bool {
-	user, err := GetUserByID(userID)
-	if err != nil {
-		return false
-	}
-
-	if user.Role == "admin" || user.Role == "moderator" {
-		return true
-	}
-	return false
-}
-
-func CheckAdminRole(userID int) bool {
-	user, err := GetUserByID(userID)
-	if err != nil {
-		return false
-	}
-
-	if user.Role == "admin" {
-		return true
-	}
-	return false
-}
-
 func SaveFile(file *models.File) (int, error) {
 	// var less_than_limit bool
 	// err := db.QueryRow(`
@@ -449,19 +499,7 @@ func FuckYouFile(userID, fileID int) error {
 
 		// Уведомлений нет
 		if count == 0 {
-			var user_display_name, user_profile_image string
-			err = db.QueryRow(`
-		SELECT display_name, profile_image_url FROM users
-		WHERE id = $1
-		`, userID).Scan(&user_display_name, &user_profile_image)
-			if err != nil {
-				return err
-			}
-
-			_, err = db.Exec(`
-		INSERT INTO notifications (user_id, author_id, notification, image, link, file_id, type)
-		VALUES ($1, $2, $3, $4, $5, $6, 'fuck')
-	`, author_id, userID, user_display_name+" послал вас нах под вашей публикацией!", user_profile_image, "https://ehworld.ru/post/"+strconv.Itoa(fileID), fileID)
+			err = addNotification(author_id, userID, fileID, "fuck", nil)
 			if err != nil {
 				return err
 			}
@@ -474,7 +512,7 @@ func FuckYouFile(userID, fileID int) error {
 	`, fileID, fileID)
 		return err
 	} else {
-		return errors.New("user is banned")
+		return ErrUserBanned
 	}
 }
 
@@ -498,7 +536,7 @@ func UnFuckYouFile(userID, fileID int) error {
 // Лайки
 func LikeFile(userID, fileID int) error {
 	if IsBanned(userID) {
-		return errors.New("user is banned")
+		return ErrUserBanned
 	}
 
 	tx, err := db.Begin()
@@ -548,7 +586,7 @@ func LikeFile(userID, fileID int) error {
 	}
 
 	// Создаем уведомление
-	var count int
+	var count, notificationID int
 	err = tx.QueryRow(`
 		SELECT COUNT(*) FROM notifications
 		WHERE author_id = $1 AND file_id = $2 AND user_id = $3 AND type = 'like'
@@ -559,19 +597,7 @@ func LikeFile(userID, fileID int) error {
 
 	// Уведомлений нет
 	if count == 0 {
-		var user_display_name, user_profile_image string
-		err = tx.QueryRow(`
-		SELECT display_name, profile_image_url FROM users
-		WHERE id = $1
-		`, userID).Scan(&user_display_name, &user_profile_image)
-		if err != nil {
-			return err
-		}
-
-		_, err = tx.Exec(`
-		INSERT INTO notifications (user_id, author_id, notification, image, link, file_id, type)
-		VALUES ($1, $2, $3, $4, $5, $6, 'like')
-	`, fileAuthorID, userID, user_display_name+" послал поставил лайк вашей публикации!", user_profile_image, "https://ehworld.ru/post/"+strconv.Itoa(fileID), fileID)
+		notificationID, err = insertNotification(tx, fileAuthorID, userID, fileID, "like", nil)
 		if err != nil {
 			return err
 		}
@@ -588,12 +614,17 @@ func LikeFile(userID, fileID int) error {
 		return err
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	publishNotification(fileAuthorID, notificationID)
+	return nil
 }
 
 func LikeComment(userID, commentID int) error {
 	if IsBanned(userID) {
-		return errors.New("user is banned")
+		return ErrUserBanned
 	}
 
 	tx, err := db.Begin()
@@ -648,10 +679,10 @@ func LikeComment(userID, commentID int) error {
 	}
 
 	// Создаем уведомление
-	var count int
+	var count, notificationID int
 	err = tx.QueryRow(`
 		SELECT COUNT(*) FROM notifications
-		WHERE author_id = $1 AND file_id = $2 AND user_id = $3 AND type = 'like'
+		WHERE author_id = $1 AND file_id = $2 AND user_id = $3 AND type = 'comment_like'
 		`, userID, fileID, commentAuthorID).Scan(&count)
 	if err != nil {
 		return err
@@ -659,19 +690,7 @@ func LikeComment(userID, commentID int) error {
 
 	// Уведомлений нет
 	if count == 0 {
-		var user_display_name, user_profile_image string
-		err = tx.QueryRow(`
-		SELECT display_name, profile_image_url FROM users
-		WHERE id = $1
-		`, userID).Scan(&user_display_name, &user_profile_image)
-		if err != nil {
-			return err
-		}
-
-		_, err = tx.Exec(`
-		INSERT INTO notifications (user_id, author_id, notification, image, link, file_id, type)
-		VALUES ($1, $2, $3, $4, $5, $6, 'like')
-	`, commentAuthorID, userID, user_display_name+" поставил лайк вашему комментарию!", user_profile_image, "https://ehworld.ru/post/"+strconv.Itoa(fileID), fileID)
+		notificationID, err = insertNotification(tx, commentAuthorID, userID, fileID, "comment_like", map[string]string{"comment_id": strconv.Itoa(commentID)})
 		if err != nil {
 			return err
 		}
@@ -687,7 +706,12 @@ func LikeComment(userID, commentID int) error {
 		return err
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	publishNotification(commentAuthorID, notificationID)
+	return nil
 }
 
 func UnlikeFile(userID, fileID int) error {
@@ -708,7 +732,7 @@ func UnlikeFile(userID, fileID int) error {
 
 	affected, _ := res.RowsAffected()
 	if affected == 0 {
-		return errors.New("file wasn't liked")
+		return ErrPostNotLiked
 	}
 
 	// Получаем автора файла
@@ -763,7 +787,7 @@ func UnlikeComment(userID, commentID int) error {
 
 	affected, _ := res.RowsAffected()
 	if affected == 0 {
-		return errors.New("comment wasn't liked")
+		return ErrCommentNotLiked
 	}
 
 	// Получаем автора файла
@@ -840,8 +864,25 @@ func AddComment(comment *models.Comment) (int, error) {
 		return -1, err
 	}
 
+	// Отвечать можно только на живой комментарий того же поста
+	if comment.ParentID != 0 {
+		var exists bool
+		err = db.QueryRow(`
+			SELECT EXISTS(
+				SELECT 1 FROM comments
+				WHERE id = $1 AND file_id = $2 AND is_deleted = FALSE
+			)
+		`, comment.ParentID, comment.FileID).Scan(&exists)
+		if err != nil {
+			return -1, err
+		}
+		if !exists {
+			return -1, ErrParentCommentNotFound
+		}
+	}
+
 	var existingComm int
-	err = db.QueryRow(`SELECT id FROM comments WHERE user_id = $1 AND text = $2 AND file_id = $3`, comment.UserID, comment.Text, comment.FileID).Scan(&existingComm)
+	err = db.QueryRow(`SELECT id FROM comments WHERE user_id = $1 AND text = $2 AND file_id = $3 AND is_deleted = FALSE`, comment.UserID, comment.Text, comment.FileID).Scan(&existingComm)
 	if err == sql.ErrNoRows {
 		var id int
 		if comment.ParentID == 0 {
@@ -849,17 +890,25 @@ func AddComment(comment *models.Comment) (int, error) {
 		INSERT INTO comments (user_id, file_id, text)
 		VALUES ($1, $2, $3) RETURNING id
 	`, comment.UserID, comment.FileID, filteredText).Scan(&id)
-			return id, err
 		} else {
 			err = db.QueryRow(`
 		INSERT INTO comments (user_id, file_id, text, parent_id)
 		VALUES ($1, $2, $3, $4) RETURNING id
 	`, comment.UserID, comment.FileID, filteredText, comment.ParentID).Scan(&id)
-			return id, err
 		}
+		if err != nil {
+			return -1, err
+		}
+
+		// Комментарий уже сохранен, ошибка уведомлений не должна его откатывать
+		comment.Text = filteredText
+		if err := notifyComment(comment); err != nil {
+			log.Println("Не удалось отправить уведомления о комментарии: " + err.Error())
+		}
+		return id, nil
 
 	} else {
-		return -1, errors.New("comment already exists")
+		return -1, ErrCommentExists
 	}
 }
 
@@ -869,216 +918,302 @@ func UpdateComment(comment *models.Comment) error {
 		return err
 	}
 
-	var commentID int
-	err = db.QueryRow(`SELECT id FROM comments WHERE user_id = $1 AND file_id = $2`, comment.UserID, comment.FileID).Scan(&commentID)
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	_, err = db.Exec(`
+	var oldText string
+	err = tx.QueryRow(`
+		SELECT text FROM comments
+		WHERE id = $1 AND is_deleted = FALSE
+		FOR UPDATE
+	`, comment.ID).Scan(&oldText)
+	if err != nil {
+		return ErrCommentNotFound
+	}
+
+	if oldText == filteredText {
+		return nil
+	}
+
+	// Сохраняем предыдущую версию в историю правок
+	_, err = tx.Exec(`
+		INSERT INTO comments_edits (comment_id, text)
+		VALUES ($1, $2)
+	`, comment.ID, oldText)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
 		UPDATE comments 
-		SET text = $1
+		SET text = $1, updated_at = NOW()
 		WHERE id = $2
-	`, filteredText, commentID)
+	`, filteredText, comment.ID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	comment.Text = filteredText
+	return tx.Commit()
 }
 
+// Комментарий только помечается удаленным, чтобы не рвать ветку ответов
 func DeleteComment(comment *models.Comment) error {
 	_, err := db.Exec(`
-		DELETE FROM comments_likes  
-		WHERE comment_id = $1
-	`, comment.ID)
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec(`
-		DELETE FROM comments
+		UPDATE comments
+		SET is_deleted = TRUE
 		WHERE id = $1
 	`, comment.ID)
-	if err != nil {
-		return err
-	}
-	return nil
+	return err
 }
 
-func GetComments(userID, fileID int) ([]models.CommentWithAuthor, error) {
-	// Основные комментарии (без родителя)
+func GetCommentEdits(commentID int) ([]models.CommentEdit, error) {
 	rows, err := db.Query(`
-        SELECT c.id, c.user_id, c.text, c.created_at, c.likes, 
-               u.display_name, u.profile_image_url, u.id
-        FROM comments c
-        JOIN users u ON u.id = c.user_id
-        WHERE c.file_id = $1 AND c.parent_id IS NULL
-        ORDER BY c.created_at DESC
-    `, fileID)
+		SELECT e.text, e.edited_at
+		FROM comments_edits e
+		JOIN comments c ON c.id = e.comment_id
+		WHERE e.comment_id = $1 AND c.is_deleted = FALSE
+		ORDER BY e.edited_at DESC
+	`, commentID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var comments []models.CommentWithAuthor
-	// Обработка и добавление ответов
+	result := []models.CommentEdit{}
 	for rows.Next() {
-		var c models.CommentWithAuthor
-		// Сканирование данных
-		err := rows.Scan(&c.ID, &c.UserID, &c.Text, &c.CreatedAt, &c.Likes, &c.AuthorName, &c.AuthorProfileImageURL, &c.AuthorID)
-		if err != nil {
+		var e models.CommentEdit
+		if err := rows.Scan(&e.Text, &e.EditedAt); err != nil {
 			return nil, err
 		}
+		result = append(result, e)
+	}
 
-		// Проверяем на лайк
-		c.HasLiked, _ = HasLikedComment(userID, c.ID)
+	return result, nil
+}
 
-		// Загружаем значок если есть
-		if HasBadge(c.AuthorID) {
-			err = db.QueryRow(`
-			SELECT badges.image
-			FROM users, badges
-			WHERE users.id = $1 AND users.badge_id = badges.id
-		`, c.AuthorID).Scan(&c.Badge)
-			if err != nil {
-				return nil, err
-			}
-		}
+// Глубина ветки, которая загружается за один запрос. Более глубокие ответы сворачиваются
+// и подгружаются отдельно через GetCommentThread.
+const commentMaxDepth = 5
+
+// Общий список колонок для комментариев, $1 - ID смотрящего пользователя (0 для гостя)
+const commentColumns = `
+	c.id, c.user_id, c.file_id, COALESCE(c.parent_id, 0), c.text, c.created_at,
+	COALESCE(c.updated_at, c.created_at), c.updated_at IS NOT NULL, c.likes, c.is_deleted,
+	u.display_name, u.profile_image_url, COALESCE(b.image, ''),
+	EXISTS(SELECT 1 FROM comments_likes cl WHERE cl.comment_id = c.id AND cl.user_id = $1),
+	(SELECT COUNT(*) FROM comments r WHERE r.parent_id = c.id AND r.is_deleted = FALSE)
+`
+
+const commentJoins = `
+	JOIN users u ON u.id = c.user_id
+	LEFT JOIN badges b ON b.id = u.badge_id
+`
+
+func IsCommentsSort(sort string) bool {
+	return sort == "new" || sort == "top"
+}
+
+func scanComment(row rowScanner, extra ...any) (models.CommentWithAuthor, error) {
+	var c models.CommentWithAuthor
+	dest := []any{
+		&c.ID, &c.UserID, &c.FileID, &c.ParentID, &c.Text, &c.CreatedAt,
+		&c.UpdatedAt, &c.IsEdited, &c.Likes, &c.IsDeleted,
+		&c.AuthorName, &c.AuthorProfileImageURL, &c.Badge,
+		&c.HasLiked, &c.RepliesCount,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return c, err
+	}
 
-		// Получение ответов
-		replies, _ := getReplies(userID, c.Comment.ID)
-		c.Replies = replies
-		comments = append(comments, c)
+	c.AuthorID = c.UserID
+	if c.IsDeleted {
+		c.Text = ""
 	}
-	return comments, nil
+	return c, nil
 }
 
-func GetCommentsUnauthorised(fileID int) ([]models.CommentWithAuthor, error) {
-	// Основные комментарии (без родителя)
-	rows, err := db.Query(`
-        SELECT c.id, c.user_id, c.text, c.created_at, c.likes, 
-               u.display_name, u.profile_image_url, u.id
-        FROM comments c
-        JOIN users u ON u.id = c.user_id
-        WHERE c.file_id = $1 AND c.parent_id IS NULL
-        ORDER BY c.created_at DESC
-    `, fileID)
+// Курсор страницы комментариев: лайки и ID последнего отданного корневого комментария
+func encodeCommentsCursor(likes, id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(likes) + "." + strconv.Itoa(id)))
+}
+
+func decodeCommentsCursor(cursor string) (int, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
 	if err != nil {
-		return nil, err
+		return 0, 0, &ValidationError{Field: "cursor", Message: "wrong cursor"}
 	}
-	defer rows.Close()
-
-	var comments []models.CommentWithAuthor
-	// Обработка и добавление ответов
-	for rows.Next() {
-		var c models.CommentWithAuthor
-		// Сканирование данных
-		err := rows.Scan(&c.ID, &c.UserID, &c.Text, &c.CreatedAt, &c.Likes, &c.AuthorName, &c.AuthorProfileImageURL, &c.AuthorID)
-		if err != nil {
-			return nil, err
-		}
 
-		// Загружаем значок если есть
-		if HasBadge(c.AuthorID) {
-			err = db.QueryRow(`
-			SELECT badges.image
-			FROM users, badges
-			WHERE users.id = $1 AND users.badge_id = badges.id
-		`, c.AuthorID).Scan(&c.Badge)
-			if err != nil {
-				return nil, err
-			}
-		}
+	parts := strings.Split(string(raw), ".")
+	if len(parts) != 2 {
+		return 0, 0, &ValidationError{Field: "cursor", Message: "wrong cursor"}
+	}
 
-		// Получение ответов
-		replies, _ := getRepliesUnauthorised(c.Comment.ID)
-		c.Replies = replies
-		comments = append(comments, c)
+	likes, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, &ValidationError{Field: "cursor", Message: "wrong cursor"}
 	}
-	return comments, nil
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, &ValidationError{Field: "cursor", Message: "wrong cursor"}
+	}
+
+	return likes, id, nil
 }
 
-func getReplies(userID, parentID int) ([]models.CommentWithAuthor, error) {
+// Возвращает страницу корневых комментариев поста вместе с ветками ответов.
+// Вся страница собирается двумя запросами независимо от глубины веток.
+func GetComments(viewerID, fileID int, sort, cursor string, limit int) (models.CommentsPage, error) {
+	page := models.CommentsPage{
+		Comments: []models.CommentWithAuthor{},
+		Sort:     sort,
+	}
+
+	var cursorLikes, cursorID int
+	if cursor != "" {
+		var err error
+		cursorLikes, cursorID, err = decodeCommentsCursor(cursor)
+		if err != nil {
+			return page, err
+		}
+	}
+
 	rows, err := db.Query(`
-		SELECT c.id, c.user_id, c.file_id, c.text, c.created_at, c.likes, u.display_name, u.profile_image_url, u.id 
+		SELECT `+commentColumns+`
 		FROM comments c
-		JOIN users u ON u.id = c.user_id
-		WHERE c.file_id = $1 AND c.is_deleted = FALSE
-		ORDER BY c.created_at DESC
-	`, parentID)
+		`+commentJoins+`
+		WHERE c.file_id = $2 AND c.parent_id IS NULL
+		AND (c.is_deleted = FALSE OR EXISTS(SELECT 1 FROM comments r WHERE r.parent_id = c.id))
+		AND ($3 = 0 OR CASE WHEN $5 = 'top' THEN (c.likes, c.id) < ($4, $3) ELSE c.id < $3 END)
+		ORDER BY CASE WHEN $5 = 'top' THEN c.likes END DESC, c.id DESC
+		LIMIT $6
+	`, viewerID, fileID, cursorID, cursorLikes, sort, limit+1)
 	if err != nil {
-		return nil, err
+		return page, err
 	}
-	defer rows.Close()
 
-	var comments []models.CommentWithAuthor
+	var roots []models.CommentWithAuthor
 	for rows.Next() {
-		var c models.CommentWithAuthor
-		err := rows.Scan(&c.ID, &c.UserID, &c.FileID, &c.Text, &c.CreatedAt, &c.Likes, &c.AuthorName, &c.AuthorProfileImageURL, &c.AuthorID)
+		c, err := scanComment(rows)
 		if err != nil {
-			return nil, err
+			rows.Close()
+			return page, err
 		}
+		roots = append(roots, c)
+	}
+	rows.Close()
 
-		// Проверяем на лайк
-		c.HasLiked, _ = HasLikedComment(userID, c.ID)
+	if len(roots) > limit {
+		roots = roots[:limit]
+		last := roots[len(roots)-1]
+		page.NextCursor = encodeCommentsCursor(last.Likes, last.ID)
+	}
 
-		// Загружаем значок если есть
-		if HasBadge(c.AuthorID) {
-			err = db.QueryRow(`
-			SELECT badges.image
-			FROM users, badges
-			WHERE users.id = $1 AND users.badge_id = badges.id
-		`, c.AuthorID).Scan(&c.Badge)
-			if err != nil {
-				return nil, err
-			}
+	ids := make([]int, len(roots))
+	for i, c := range roots {
+		ids[i] = c.ID
+	}
+
+	children, err := getCommentReplies(viewerID, ids)
+	if err != nil {
+		return page, err
+	}
+
+	for _, c := range roots {
+		c.Replies = buildCommentTree(c.ID, children)
+		if c.IsDeleted && len(c.Replies) == 0 {
+			continue
 		}
+		page.Comments = append(page.Comments, c)
+	}
+
+	return page, nil
+}
+
+// Возвращает комментарий с веткой ответов. Используется для раскрытия свернутых веток,
+// глубина считается от запрошенного комментария.
+func GetCommentThread(viewerID, commentID int) (models.CommentWithAuthor, error) {
+	comment, err := scanComment(db.QueryRow(`
+		SELECT `+commentColumns+`
+		FROM comments c
+		`+commentJoins+`
+		WHERE c.id = $2
+	`, viewerID, commentID))
+	if err != nil {
+		return comment, ErrCommentNotFound
+	}
 
-		comments = append(comments, c)
+	children, err := getCommentReplies(viewerID, []int{commentID})
+	if err != nil {
+		return comment, err
 	}
-	return comments, nil
+
+	comment.Replies = buildCommentTree(commentID, children)
+	return comment, nil
 }
 
-func getRepliesUnauthorised(parentID int) ([]models.CommentWithAuthor, error) {
+// Загружает ответы на комментарии одним рекурсивным запросом и группирует их по родителю
+func getCommentReplies(viewerID int, parentIDs []int) (map[int][]models.CommentWithAuthor, error) {
+	children := make(map[int][]models.CommentWithAuthor)
+	if len(parentIDs) == 0 {
+		return children, nil
+	}
+
 	rows, err := db.Query(`
-		SELECT c.id, c.user_id, c.file_id, c.text, c.created_at, c.likes, u.display_name, u.profile_image_url, u.id 
-		FROM comments c
-		JOIN users u ON u.id = c.user_id
-		WHERE c.file_id = $1 AND c.is_deleted = FALSE
-		ORDER BY c.created_at DESC
-	`, parentID)
+		WITH RECURSIVE thread AS (
+			SELECT c.id, 1 AS depth
+			FROM comments c
+			WHERE c.parent_id = ANY($2)
+			UNION ALL
+			SELECT c.id, t.depth + 1
+			FROM comments c
+			JOIN thread t ON c.parent_id = t.id
+			WHERE t.depth < $3
+		)
+		SELECT `+commentColumns+`, t.depth
+		FROM thread t
+		JOIN comments c ON c.id = t.id
+		`+commentJoins+`
+		ORDER BY c.created_at, c.id
+	`, viewerID, pq.Array(parentIDs), commentMaxDepth)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var comments []models.CommentWithAuthor
 	for rows.Next() {
-		var c models.CommentWithAuthor
-		err := rows.Scan(&c.ID, &c.UserID, &c.FileID, &c.Text, &c.CreatedAt, &c.Likes, &c.AuthorName, &c.AuthorProfileImageURL, &c.AuthorID)
+		var depth int
+		c, err := scanComment(rows, &depth)
 		if err != nil {
 			return nil, err
 		}
 
-		// Загружаем значок если есть
-		if HasBadge(c.AuthorID) {
-			err = db.QueryRow(`
-			SELECT badges.image
-			FROM users, badges
-			WHERE users.id = $1 AND users.badge_id = badges.id
-		`, c.AuthorID).Scan(&c.Badge)
-			if err != nil {
-				return nil, err
-			}
-		}
+		c.Depth = depth
+		c.Collapsed = depth >= commentMaxDepth && c.RepliesCount > 0
+		children[c.ParentID] = append(children[c.ParentID], c)
+	}
+
+	return children, nil
+}
 
-		comments = append(comments, c)
+// Собирает дерево ответов и выбрасывает удаленные комментарии без живых ответов
+func buildCommentTree(parentID int, children map[int][]models.CommentWithAuthor) []models.CommentWithAuthor {
+	var result []models.CommentWithAuthor
+	for _, c := range children[parentID] {
+		c.Replies = buildCommentTree(c.ID, children)
+		if c.IsDeleted && len(c.Replies) == 0 && !c.Collapsed {
+			continue
+		}
+		result = append(result, c)
 	}
-	return comments, nil
+	return result
 }
 
 func IsCommentOwner(comment *models.Comment) bool {
-	if CheckModeratorOrAdminRole(comment.UserID) {
+	if HasPermission(comment.UserID, "moderate_comments") {
 		return true
 	}
 	var ownerID int
@@ -1137,7 +1272,7 @@ func GetFileByIDAuthorised(id, userID int) (*models.FileWithAuthor, error) {
 		&file.Thumbnail, &file.Views, &file.Likes, &file.AuthorName, &file.AuthorProfileImageURL, &file.UploadedAt, &file.IsModerated, &file.Type, &file.Description, &file.Fucks, &file.AuthorID,
 	)
 	if err != nil {
-		return nil, errors.New("post doesn't exist")
+		return nil, ErrPostNotFound
 	}
 
 	if HasBadge(file.AuthorID) {
@@ -1298,6 +1433,7 @@ func GetFeedPosts(userID, offset, limit int) ([]models.FeedFile, error) {
 				) THEN 1 
 				ELSE 0 
 			END, -- 0 = непросмотренные, 1 = просмотренные
+			COALESCE(f.boosted_until > NOW(), false) DESC, -- бусты из магазина
 			(f.views * 0.7 + f.likes * 0.3) DESC
 		LIMIT $2 OFFSET $3;
     `
@@ -1336,7 +1472,7 @@ func GetFeedPosts(userID, offset, limit int) ([]models.FeedFile, error) {
 		err = db.QueryRow(`
 			SELECT COUNT(*)
 			FROM comments
-			WHERE file_id = $1
+			WHERE file_id = $1 AND is_deleted = FALSE
 		`, post.ID).Scan(&commentsCount)
 		if err != nil {
 			return nil, err
@@ -1543,39 +1679,6 @@ func GetLastPosts(limit, offset int) ([]models.MainFile, error) {
 	return files, nil
 }
 
-func GetNotifications(userID int) ([]models.Notification, error) {
-	rows, err := db.Query(`
-        SELECT id, notification, image, link, created_at
-		FROM notifications
-		WHERE mark_seen = false AND user_id = $1
-		ORDER BY created_at DESC
-    `, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var notifications []models.Notification
-	for rows.Next() {
-		var n models.Notification
-		err := rows.Scan(
-			&n.ID, &n.Notification, &n.Image, &n.Link, &n.CreatedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		_, err = db.Exec("UPDATE notifications SET mark_seen = true WHERE id = $1", n.ID)
-		if err != nil {
-			return nil, err
-		}
-
-		n.FormattedTime = FormatTimeAgo(n.CreatedAt)
-		notifications = append(notifications, n)
-	}
-	return notifications, nil
-}
-
 func LogModAction(userID int, action string) error {
 	_, err := db.Exec("INSERT INTO mod_logs (user_id, action) VALUES ($1, $2)", userID, action)
 	if err != nil {
@@ -1586,7 +1689,12 @@ func LogModAction(userID int, action string) error {
 }
 
 func ApprovePost(userID, postID int) error {
-	_, err := db.Exec("UPDATE files SET is_public = true WHERE id = $1", postID)
+	res, err := db.Exec("UPDATE files SET is_public = true WHERE id = $1 AND is_public IS NOT TRUE", postID)
+	if err != nil {
+		return err
+	}
+	// Анонс в чат только при первой публикации
+	published, err := res.RowsAffected()
 	if err != nil {
 		return err
 	}
@@ -1602,11 +1710,17 @@ func ApprovePost(userID, postID int) error {
 		return err
 	}
 
-	_, err = db.Exec("INSERT INTO notifications (user_id, notification, link, file_id, type, image) VALUES ($1, $2, $3, $4, $5, $6)", user_id, "Модераторы одобрили ваш пост!", "https://ehworld.ru/post/"+strconv.Itoa(postID), postID, "approved", "https://ehworld.ru/static/img/approved.svg")
+	err = addNotification(user_id, 0, postID, "approved", nil)
 	if err != nil {
 		return err
 	}
 
+	if published > 0 {
+		if err := enqueueChatAnnouncement(db, outboxChatPostApproved, user_id, postID); err != nil {
+			return err
+		}
+	}
+
 	LogModAction(userID, "Approved post "+strconv.Itoa(postID))
 
 	return nil
@@ -1624,7 +1738,7 @@ func RejectPost(userID, postID int) error {
 		return err
 	}
 
-	_, err = db.Exec("INSERT INTO notifications (user_id, notification, link, file_id, type, image) VALUES ($1, $2, $3, $4, $5, $6)", user_id, "Модераторы отклонили ваш пост, но он все еще доступен по прямой ссылке", "https://ehworld.ru/post/"+strconv.Itoa(postID), postID, "rejected", "https://ehworld.ru/static/img/rejected.svg")
+	err = addNotification(user_id, 0, postID, "rejected", nil)
 	if err != nil {
 		return err
 	}
@@ -1691,6 +1805,10 @@ func BanUser(modID, userID int) error {
 		return err
 	}
 
+	if err := RevokeUserSessions(userID); err != nil {
+		return err
+	}
+
 	LogModAction(modID, "Banned user "+strconv.Itoa(userID))
 
 	return nil
@@ -1726,14 +1844,19 @@ func AddModerator(username string) error {
 	}
 
 	if role != "admin" {
-		_, err = db.Exec("UPDATE users SET role = 'moderator' WHERE id = $1", user_id)
+		// Роль могла смениться между запросами - админа не трогаем
+		res, err := db.Exec("UPDATE users SET role = 'moderator' WHERE id = $1 AND role <> 'admin'", user_id)
 		if err != nil {
 			return err
 		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrAlreadyAdmin
+		}
 
-		return nil
+		// Права меняются - пусть войдет заново
+		return RevokeUserSessions(user_id)
 	} else {
-		return errors.New("user's already admin")
+		return ErrAlreadyAdmin
 	}
 }
 
@@ -1744,12 +1867,22 @@ func DeleteModerator(username string) error {
 		return err
 	}
 
-	_, err = db.Exec("UPDATE users SET role = 'user' WHERE id = $1", user_id)
+	// Снимаем только модератора: админа и обычного пользователя это не касается
+	res, err := db.Exec("UPDATE users SET role = 'user' WHERE id = $1 AND role = 'moderator'", user_id)
 	if err != nil {
 		return err
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotModerator
+	}
 
-	return nil
+	return RevokeUserSessions(user_id)
+}
+
+func GetUserRoleByLogin(username string) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE login = $1", strings.ToLower(username)).Scan(&role)
+	return role, err
 }
 
 func GetBadges() []models.Badge {
@@ -1817,17 +1950,7 @@ func GetStats() (models.Stats, error) {
 }
 
 func HasNotifications(userID int) bool {
-	var nots int
-	err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE id = $1", userID).Scan(&nots)
-	if err != nil {
-		return false
-	}
-
-	if nots > 0 {
-		return true
-	} else {
-		return false
-	}
+	return GetUnreadNotificationsCount(userID) > 0
 }
 
 func HasDescription(postID int) bool {
@@ -2012,7 +2135,8 @@ func GrantVIP(username string) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent {
+	// 422 - пользователь уже VIP, нужное состояние уже есть
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusUnprocessableEntity {
 		body, _ := io.ReadAll(resp.Body)
 		log.Println(string(body))
 		return fmt.Errorf("failed to grant VIP: %s (%s)", resp.Status, string(body))
@@ -2055,7 +2179,8 @@ func RevokeVIP(username string) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent {
+	// 422 - пользователь уже не VIP, отзывать нечего
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusUnprocessableEntity {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("failed to revoke VIP: %s (%s)", resp.Status, string(body))
 	}
@@ -2063,76 +2188,151 @@ func RevokeVIP(username string) error {
 	return nil
 }
 
-func GetItemById(itemID int) (models.ShopItem, error) {
-	var item models.ShopItem
-	err := db.QueryRow(`SELECT id, type, title, cost, image FROM shop_items WHERE id = $1`, itemID).Scan(&item.ID, &item.Type, &item.Title, &item.Cost, &item.Image)
-	if err != nil {
-		log.Println("Failed to select from shop_items")
-		return item, err
-	}
+// Наибольшая из действующих скидок на товар и на весь магазин, в процентах
+const shopItemDiscount = `COALESCE((
+	SELECT MAX(d.percent) FROM shop_discounts d
+	WHERE (d.item_id IS NULL OR d.item_id = si.id) AND d.starts_at <= NOW() AND d.ends_at > NOW()
+), 0)`
 
-	if item.Type == "badge" {
-		err = db.QueryRow(`SELECT badge_id FROM shop_items WHERE id = $1`, itemID).Scan(&item.BadgeId)
-		if err != nil {
-			log.Println("Failed to select badge_id from shop_items")
-			return item, err
-		}
-		return item, nil
-	} else {
-		return item, nil
+// Товар в продаже: окно доступности открыто
+const shopItemOnSale = `(si.available_from IS NULL OR si.available_from <= NOW())
+	AND (si.available_until IS NULL OR si.available_until > NOW())`
+
+const shopItemColumns = `si.id, si.type, COALESCE(si.badge_id, 0), si.title, si.cost, si.image, si.params,
+	si.available_from, si.available_until, si.stock, si.sold, si.per_user_limit, si.featured_slot,
+	` + shopItemDiscount
+
+func scanShopItem(row rowScanner, extra ...any) (models.ShopItem, error) {
+	var i models.ShopItem
+	var params []byte
+	dest := []any{
+		&i.ID, &i.Type, &i.BadgeId, &i.Title, &i.BaseCost, &i.Image, &params,
+		&i.AvailableFrom, &i.AvailableUntil, &i.Stock, &i.Sold, &i.PerUserLimit, &i.FeaturedSlot,
+		&i.Discount,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return i, err
+	}
+	if err := json.Unmarshal(params, &i.Params); err != nil {
+		return i, err
+	}
+	i.Cost = i.BaseCost * (100 - i.Discount) / 100
+	if t, ok := shopItemTypes[i.Type]; ok && t.inputLabel != nil {
+		i.InputLabel = t.inputLabel(i)
 	}
+	return i, nil
 }
 
-func SubtractRating(userID, itemID int) error {
-	user, err := GetUserByID(userID)
-	if err != nil {
-		log.Println("Failed to get user")
-		return err
+func GetItemById(itemID int) (models.ShopItem, error) {
+	item, err := scanShopItem(db.QueryRow("SELECT "+shopItemColumns+" FROM shop_items si WHERE si.id = $1", itemID))
+	if err == sql.ErrNoRows {
+		return item, ErrShopItemNotFound
 	}
+	return item, err
+}
 
-	item, err := GetItemById(itemID)
+// Покупка в одной транзакции: списание и выдача предмета обработчиком его типа.
+// input - ответ покупателя для типов, которые его спрашивают.
+// С непустым idempotencyKey повторный запрос с тем же ключом ничего не меняет
+func BuyItem(userID, itemID int, input, idempotencyKey string) error {
+	tx, err := db.Begin()
 	if err != nil {
-		log.Println("Failed to get item")
 		return err
 	}
+	defer tx.Rollback()
 
-	if user.Rating < item.Cost {
-		return errors.New("not enough balance")
-	} else {
-		switch item.Type {
-		case "vip":
-			err = GrantVIP(user.Login) // Выдать вип
-			if err != nil {
-				return err
-			}
-		case "badge":
-			_, err = db.Exec("INSERT INTO users_items (user_id, item_id) VALUES ($1, $2)", user.ID, itemID)
-			if err != nil {
-				log.Println("Failed to add to users_items")
-				return err
-			}
+	if idempotencyKey != "" {
+		_, claimed, err := claimIdempotencyKey(tx, userID, fmt.Sprintf("buy_item/%d", itemID), idempotencyKey)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return nil
+		}
+	}
 
-			// Сразу применить купленный бадж
-			_, err = db.Exec("UPDATE users SET badge_id = $1 WHERE id = $2", item.BadgeId, userID)
-			if err != nil {
-				log.Println("Failed to apply")
-				return err
-			}
+	// Блокировка строки товара, чтобы остаток не ушел в минус
+	var onSale bool
+	item, err := scanShopItem(tx.QueryRow(`
+		SELECT `+shopItemColumns+`, `+shopItemOnSale+`
+		FROM shop_items si
+		WHERE si.id = $1
+		FOR UPDATE
+	`, itemID), &onSale)
+	if err == sql.ErrNoRows {
+		return ErrShopItemNotFound
+	}
+	if err != nil {
+		log.Println("Не удалось получить товар: " + err.Error())
+		return err
+	}
+	itemType, known := shopItemTypes[item.Type]
+	if !onSale || !known {
+		return ErrShopItemUnavailable
+	}
+	if item.Remaining() == 0 {
+		return ErrShopItemSoldOut
+	}
+	if itemType.unique {
+		var owned bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users_items WHERE user_id = $1 AND item_id = $2)", userID, itemID).Scan(&owned)
+		if err != nil {
+			return err
+		}
+		if owned {
+			return ErrAlreadyOwned
 		}
-		_, err = db.Exec("UPDATE users SET rating = $1 WHERE id = $2", user.Rating-item.Cost, userID)
+	}
+	if item.PerUserLimit != nil {
+		err := tx.QueryRow("SELECT COUNT(*) FROM shop_purchases WHERE user_id = $1 AND item_id = $2 AND refunded_at IS NULL", userID, itemID).Scan(&item.Purchased)
 		if err != nil {
-			log.Println("Failed to increase rating")
 			return err
 		}
+		if item.Purchased >= *item.PerUserLimit {
+			return ErrPurchaseLimitReached
+		}
 	}
-	return nil
+
+	purchase := shopPurchase{UserID: userID, Item: item}
+	if itemType.inputLabel != nil {
+		purchase.Input = strings.TrimSpace(input)
+		if err := itemType.validateInput(tx, purchase); err != nil {
+			return err
+		}
+	}
+
+	if err := chargeRating(tx, userID, item.Cost); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE shop_items SET sold = sold + 1 WHERE id = $1", itemID); err != nil {
+		return err
+	}
+	err = tx.QueryRow(`
+		INSERT INTO shop_purchases (user_id, item_id, price, input)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, userID, itemID, item.Cost, purchase.Input).Scan(&purchase.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := itemType.apply(tx, purchase); err != nil {
+		log.Printf("Не удалось применить товар %s %d: %v", item.Type, itemID, err)
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func BuyItem(userID, itemID int) error {
-	err := SubtractRating(userID, itemID)
+// Списывает рейтинг, только если его хватает
+func chargeRating(tx *sql.Tx, userID, amount int) error {
+	res, err := tx.Exec("UPDATE users SET rating = rating - $1 WHERE id = $2 AND rating >= $1", amount, userID)
 	if err != nil {
 		return err
 	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrNotEnoughBalance
+	}
 	return nil
 }
 
@@ -2151,774 +2351,5943 @@ func HasBadge(userID int) bool {
 	}
 }
 
+// Товары в продаже: сначала витрина по номеру слота, потом остальные
 func GetShopItems(userID int) []models.ShopItem {
 	results := []models.ShopItem{}
 
-	// Поиск предметов
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return results
+	}
+
 	items, err := db.Query(`
-			SELECT id, type, title, cost, image
-			FROM shop_items
-		`)
-	if err == nil {
-		defer items.Close()
-		for items.Next() {
-			var i models.ShopItem
-			if err := items.Scan(&i.ID, &i.Type, &i.Title, &i.Cost, &i.Image); err == nil {
-				if i.Type == "badge" {
-					// Проверка на владение
-					var count int
-					err := db.QueryRow(`SELECT COUNT(*) FROM users_items WHERE user_id = $1 AND item_id = $2`, userID, i.ID).Scan(&count)
-					if err != nil {
-						return nil
-					}
-					if count > 0 {
-						i.Owned = true
-					} else {
-						i.Owned = false
-					}
+		SELECT `+shopItemColumns+`,
+			EXISTS(SELECT 1 FROM users_items ui WHERE ui.user_id = $1 AND ui.item_id = si.id),
+			(SELECT COUNT(*) FROM shop_purchases p WHERE p.user_id = $1 AND p.item_id = si.id AND p.refunded_at IS NULL)
+		FROM shop_items si
+		WHERE `+shopItemOnSale+`
+		ORDER BY si.featured_slot NULLS LAST, si.id
+	`, userID)
+	if err != nil {
+		log.Println("Не удалось получить товары магазина:", err)
+		return results
+	}
+	defer items.Close()
 
-					err = db.QueryRow(`SELECT badge_id FROM shop_items WHERE id = $1`, i.ID).Scan(&i.BadgeId)
-					if err != nil {
-						return nil
-					}
-				}
-				user, _ := GetUserByID(userID)
-				i.Rating = user.Rating
-				results = append(results, i)
-			}
+	for items.Next() {
+		var owned bool
+		var purchased int
+		i, err := scanShopItem(items, &owned, &purchased)
+		if err != nil {
+			log.Println("Не удалось прочитать товар магазина:", err)
+			continue
 		}
+		// Уникальные товары покупаются один раз
+		i.Owned = shopItemTypes[i.Type].unique && owned
+		i.Purchased = purchased
+		i.Rating = user.Rating
+		results = append(results, i)
 	}
 
 	return results
 }
 
-func GetCases(userID int) []models.Case {
-	results := []models.Case{}
+// Управление магазином
 
-	// Поиск кейсов
-	items, err := db.Query(`
-			SELECT id, title, description, price, image
-			FROM cases
-		`)
-	if err == nil {
-		defer items.Close()
-		for items.Next() {
-			var i models.Case
-			if err := items.Scan(&i.ID, &i.Title, &i.Description, &i.Price, &i.Image); err == nil {
-				user, _ := GetUserByID(userID)
-				i.Rating = user.Rating
-				results = append(results, i)
-			}
-		}
+const maxFeaturedSlots = 4
+
+// Все товары с настройками продажи, включая снятые с продажи
+func GetAdminShopItems() ([]models.ShopItem, error) {
+	rows, err := db.Query("SELECT " + shopItemColumns + " FROM shop_items si ORDER BY si.featured_slot NULLS LAST, si.id")
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return results
+	items := []models.ShopItem{}
+	for rows.Next() {
+		i, err := scanShopItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	return items, rows.Err()
 }
 
-func IsVIP(item_type string) bool {
-	return item_type == "vip"
-}
+func UpdateShopItemSettings(itemID int, settings models.ShopItemSettings) error {
+	if settings.AvailableFrom != nil && settings.AvailableUntil != nil && !settings.AvailableUntil.After(*settings.AvailableFrom) {
+		return &ValidationError{Field: "available_until", Message: "sale must end after it starts"}
+	}
+	if settings.Stock != nil && *settings.Stock < 0 {
+		return &ValidationError{Field: "stock", Message: "stock must not be negative"}
+	}
+	if settings.PerUserLimit != nil && *settings.PerUserLimit < 1 {
+		return &ValidationError{Field: "per_user_limit", Message: "limit must be positive"}
+	}
+	if settings.FeaturedSlot != nil && (*settings.FeaturedSlot < 1 || *settings.FeaturedSlot > maxFeaturedSlots) {
+		return &ValidationError{Field: "featured_slot", Message: fmt.Sprintf("slot must be between 1 and %d", maxFeaturedSlots)}
+	}
 
-func SaveTokens(access_token, refresh_token string) error {
-	_, err := db.Exec("UPDATE admin_tokens SET access_token = $1", access_token)
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	_, err = db.Exec("UPDATE admin_tokens SET refresh_token = $1", refresh_token)
+	// Слот витрины переходит к этому товару
+	if settings.FeaturedSlot != nil {
+		_, err := tx.Exec("UPDATE shop_items SET featured_slot = NULL WHERE featured_slot = $1 AND id <> $2", *settings.FeaturedSlot, itemID)
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.Exec(`
+		UPDATE shop_items
+		SET available_from = $1, available_until = $2, stock = $3, per_user_limit = $4, featured_slot = $5
+		WHERE id = $6
+	`, settings.AvailableFrom, settings.AvailableUntil, settings.Stock, settings.PerUserLimit, settings.FeaturedSlot, itemID)
 	if err != nil {
 		return err
 	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrShopItemNotFound
+	}
 
-	return nil
+	return tx.Commit()
 }
 
-func GetTokens() models.Tokens {
-	var tokens models.Tokens
-	var access_token, refresh_token string
-	err := db.QueryRow(`SELECT access_token, refresh_token FROM admin_tokens WHERE id = 1`).Scan(&access_token, &refresh_token)
+// Действующие и будущие скидки
+func GetShopDiscounts() ([]models.ShopDiscount, error) {
+	rows, err := db.Query(`
+		SELECT d.id, d.title, d.percent, COALESCE(d.item_id, 0), COALESCE(si.title, ''), d.starts_at, d.ends_at
+		FROM shop_discounts d
+		LEFT JOIN shop_items si ON si.id = d.item_id
+		WHERE d.ends_at > NOW()
+		ORDER BY d.starts_at, d.id
+	`)
 	if err != nil {
-		return tokens
+		return nil, err
 	}
-	tokens.AccessToken = access_token
-	tokens.RefreshToken = refresh_token
-	return tokens
-}
+	defer rows.Close()
 
-func GetTotalLikes(userID int) int {
-	var result int
-	err := db.QueryRow(`SELECT SUM(likes) FROM files WHERE user_id = $1`, userID).Scan(&result)
-	if err != nil {
-		log.Println("Getting user's (id: " + strconv.Itoa(userID) + " likes error: " + err.Error())
-		return 0
+	discounts := []models.ShopDiscount{}
+	for rows.Next() {
+		var d models.ShopDiscount
+		if err := rows.Scan(&d.ID, &d.Title, &d.Percent, &d.ItemID, &d.ItemTitle, &d.StartsAt, &d.EndsAt); err != nil {
+			return nil, err
+		}
+		discounts = append(discounts, d)
 	}
-	return result
+	return discounts, rows.Err()
 }
 
-func GetTotalFucks(userID int) int {
-	var result int
-	err := db.QueryRow(`SELECT SUM(fucks) FROM files WHERE user_id = $1`, userID).Scan(&result)
-	if err != nil {
-		log.Println("Getting user's fucks error: " + err.Error())
-		return 0
+func AddShopDiscount(d models.ShopDiscount) (int, error) {
+	d.Title = strings.TrimSpace(d.Title)
+	if d.Title == "" {
+		return 0, &ValidationError{Field: "title", Message: "title is required"}
 	}
-	return result
+	if d.Percent < 1 || d.Percent > 99 {
+		return 0, &ValidationError{Field: "percent", Message: "percent must be between 1 and 99"}
+	}
+	if !d.EndsAt.After(d.StartsAt) {
+		return 0, &ValidationError{Field: "ends_at", Message: "discount must end after it starts"}
+	}
+	if d.ItemID != 0 {
+		if _, err := GetItemById(d.ItemID); err != nil {
+			if err == ErrShopItemNotFound {
+				return 0, &ValidationError{Field: "item_id", Message: "shop item not found"}
+			}
+			return 0, err
+		}
+	}
+
+	var itemID sql.NullInt64
+	if d.ItemID != 0 {
+		itemID = sql.NullInt64{Int64: int64(d.ItemID), Valid: true}
+	}
+
+	var id int
+	err := db.QueryRow(`
+		INSERT INTO shop_discounts (title, percent, item_id, starts_at, ends_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, d.Title, d.Percent, itemID, d.StartsAt, d.EndsAt).Scan(&id)
+	return id, err
 }
 
-func GetTotalPosts(userID int) int {
-	var result int
-	err := db.QueryRow(`SELECT COUNT(*) FROM files WHERE user_id = $1`, userID).Scan(&result)
+func DeleteShopDiscount(id int) error {
+	res, err := db.Exec("DELETE FROM shop_discounts WHERE id = $1", id)
 	if err != nil {
-		log.Println("Getting user's posts count error: " + err.Error())
-		return 0
+		return err
 	}
-	return result
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrShopDiscountNotFound
+	}
+	return nil
 }
 
-func GetUserBadges(userID int) ([]models.Badge, error) {
-	var result []models.Badge
+// Типы товаров магазина. Каждый тип сам выдает и отзывает покупку,
+// BuyItem и RefundShopPurchase только вызывают его обработчики.
+// Новый тип - новая запись в shopItemTypes
 
-	// Поиск пользователей
-	badges, err := db.Query(`
-			SELECT badges.id, badges.image
-			FROM (
-				-- Основной значок профиля
-				SELECT badge_id
-				FROM users
-				WHERE id = $1 AND badge_id IS NOT NULL
+// Покупка, которую выдает или отзывает тип товара
+type shopPurchase struct {
+	ID     int
+	UserID int
+	Item   models.ShopItem
+	Input  string
+}
 
-				UNION
+type shopItemType struct {
+	title string
+	// Покупается один раз, владение хранится в users_items
+	unique bool
+	// Предмет оформления профиля, слот совпадает с типом
+	cosmetic bool
+	// Обязательные параметры товара
+	params []string
+
+	// Необязательные: проверка параметров, подготовка товара перед сохранением
+	validateParams func(params map[string]string) error
+	create         func(tx *sql.Tx, item *models.ShopItem) error
+	// Если задан, покупатель отвечает на вопрос, а validateInput проверяет ответ
+	inputLabel    func(item models.ShopItem) string
+	validateInput func(q queryRower, p shopPurchase) error
+
+	apply  func(tx *sql.Tx, p shopPurchase) error
+	revoke func(tx *sql.Tx, p shopPurchase) error
+}
 
-				-- Значки из магазина (users_items)
-				SELECT shop_items.badge_id
-				FROM users_items
-				JOIN shop_items ON users_items.item_id = shop_items.id
-				WHERE 
-					users_items.user_id = $1
-					AND shop_items.type = 'badge'
-					AND shop_items.badge_id IS NOT NULL
+const (
+	maxBoostHours            = 168
+	maxRedemptionInputLength = 500
+)
 
-				UNION
+var (
+	nameColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+	emoteCodePattern = regexp.MustCompile(`^[a-zA-Z0-9_]{2,25}$`)
+)
 
-				-- Значки из инвентаря (inventory)
-				SELECT cases_rewards.badge_id
-				FROM inventory
-				JOIN cases_rewards ON inventory.reward_id = cases_rewards.id
-				WHERE 
-					inventory.user_id = $1
-					AND cases_rewards.type = 'badge'
-					AND cases_rewards.badge_id IS NOT NULL
-			) AS combined_badges
-			JOIN badges ON badges.id = combined_badges.badge_id;
-		`, userID)
-	if err == nil {
-		defer badges.Close()
-		for badges.Next() {
-			var b models.Badge
-			if err := badges.Scan(&b.ID, &b.Image); err == nil {
-				result = append(result, b)
+var shopItemTypes = map[string]shopItemType{
+	"badge": {
+		title:  "Значок",
+		unique: true,
+		create: func(tx *sql.Tx, item *models.ShopItem) error {
+			return tx.QueryRow("INSERT INTO badges (image) VALUES ($1) RETURNING id", item.Image).Scan(&item.BadgeId)
+		},
+		apply: func(tx *sql.Tx, p shopPurchase) error {
+			if err := grantShopItem(tx, p); err != nil {
+				return err
 			}
-		}
-	} else {
-		log.Println("Getting user's badges error: " + err.Error())
-		return nil, err
+			// Сразу применить купленный бадж
+			_, err := tx.Exec("UPDATE users SET badge_id = $1 WHERE id = $2", p.Item.BadgeId, p.UserID)
+			return err
+		},
+		revoke: func(tx *sql.Tx, p shopPurchase) error {
+			if err := takeShopItem(tx, p); err != nil {
+				return err
+			}
+			_, err := tx.Exec("UPDATE users SET badge_id = NULL WHERE id = $1 AND badge_id = $2", p.UserID, p.Item.BadgeId)
+			return err
+		},
+	},
+	"vip": {
+		title:  "VIP",
+		params: []string{"days"},
+		validateParams: func(params map[string]string) error {
+			days, err := strconv.Atoi(params["days"])
+			if err != nil || days < 1 || days > maxVIPDays {
+				return &ValidationError{Field: "days", Message: fmt.Sprintf("days must be between 1 and %d", maxVIPDays)}
+			}
+			return nil
+		},
+		apply: func(tx *sql.Tx, p shopPurchase) error {
+			return extendVIP(tx, p.UserID, vipItemDays(p.Item))
+		},
+		revoke: func(tx *sql.Tx, p shopPurchase) error {
+			return shortenVIP(tx, p.UserID, vipItemDays(p.Item))
+		},
+	},
+	"frame": {
+		title:    "Рамка аватара",
+		unique:   true,
+		cosmetic: true,
+		apply:    equipShopItem,
+		revoke:   unequipShopItem,
+	},
+	"name_color": {
+		title:    "Цвет ника",
+		unique:   true,
+		cosmetic: true,
+		params:   []string{"color"},
+		validateParams: func(params map[string]string) error {
+			if !nameColorPattern.MatchString(params["color"]) {
+				return &ValidationError{Field: "color", Message: "color must look like #a1b2c3"}
+			}
+			return nil
+		},
+		apply:  equipShopItem,
+		revoke: unequipShopItem,
+	},
+	"banner": {
+		title:    "Баннер профиля",
+		unique:   true,
+		cosmetic: true,
+		apply:    equipShopItem,
+		revoke:   unequipShopItem,
+	},
+	"emote": {
+		title:  "Эмоут для чата",
+		unique: true,
+		params: []string{"code"},
+		validateParams: func(params map[string]string) error {
+			if !emoteCodePattern.MatchString(params["code"]) {
+				return &ValidationError{Field: "code", Message: "code must be 2-25 latin letters, digits or _"}
+			}
+			return nil
+		},
+		apply:  grantShopItem,
+		revoke: takeShopItem,
+	},
+	"boost": {
+		title:  "Буст поста",
+		params: []string{"hours"},
+		validateParams: func(params map[string]string) error {
+			hours, err := strconv.Atoi(params["hours"])
+			if err != nil || hours < 1 || hours > maxBoostHours {
+				return &ValidationError{Field: "hours", Message: fmt.Sprintf("hours must be between 1 and %d", maxBoostHours)}
+			}
+			return nil
+		},
+		inputLabel: func(item models.ShopItem) string {
+			return "ID поста"
+		},
+		validateInput: func(q queryRower, p shopPurchase) error {
+			postID, err := strconv.Atoi(p.Input)
+			if err != nil {
+				return &ValidationError{Field: "input", Message: "post id must be a number"}
+			}
+			var authorID int
+			err = q.QueryRow("SELECT user_id FROM files WHERE id = $1 AND is_public = true", postID).Scan(&authorID)
+			if err == sql.ErrNoRows || (err == nil && authorID != p.UserID) {
+				return &ValidationError{Field: "input", Message: "you can boost only your own public posts"}
+			}
+			return err
+		},
+		apply: func(tx *sql.Tx, p shopPurchase) error {
+			_, err := tx.Exec(`
+				UPDATE files
+				SET boosted_until = GREATEST(COALESCE(boosted_until, NOW()), NOW()) + make_interval(hours => $1)
+				WHERE id = $2
+			`, p.Item.Params["hours"], p.Input)
+			return err
+		},
+		revoke: func(tx *sql.Tx, p shopPurchase) error {
+			_, err := tx.Exec(`
+				UPDATE files
+				SET boosted_until = boosted_until - make_interval(hours => $1)
+				WHERE id = $2 AND boosted_until IS NOT NULL
+			`, p.Item.Params["hours"], p.Input)
+			return err
+		},
+	},
+	"redemption": {
+		title:  "Награда за рейтинг",
+		params: []string{"prompt"},
+		inputLabel: func(item models.ShopItem) string {
+			return item.Params["prompt"]
+		},
+		validateInput: func(q queryRower, p shopPurchase) error {
+			if p.Input == "" || len([]rune(p.Input)) > maxRedemptionInputLength {
+				return &ValidationError{Field: "input", Message: fmt.Sprintf("answer must be 1-%d characters", maxRedemptionInputLength)}
+			}
+			return nil
+		},
+		apply: func(tx *sql.Tx, p shopPurchase) error {
+			_, err := tx.Exec(`
+				INSERT INTO shop_redemptions (purchase_id, user_id, item_id, input)
+				VALUES ($1, $2, $3, $4)
+			`, p.ID, p.UserID, p.Item.ID, p.Input)
+			return err
+		},
+		revoke: func(tx *sql.Tx, p shopPurchase) error {
+			_, err := tx.Exec("UPDATE shop_redemptions SET status = 'refunded', resolved_at = NOW() WHERE purchase_id = $1", p.ID)
+			return err
+		},
+	},
+}
+
+func grantShopItem(tx *sql.Tx, p shopPurchase) error {
+	_, err := tx.Exec("INSERT INTO users_items (user_id, item_id) VALUES ($1, $2)", p.UserID, p.Item.ID)
+	return err
+}
+
+func takeShopItem(tx *sql.Tx, p shopPurchase) error {
+	_, err := tx.Exec("DELETE FROM users_items WHERE user_id = $1 AND item_id = $2", p.UserID, p.Item.ID)
+	return err
+}
+
+// Выдает предмет оформления и сразу надевает его
+func equipShopItem(tx *sql.Tx, p shopPurchase) error {
+	if err := grantShopItem(tx, p); err != nil {
+		return err
 	}
+	return equipCosmetic(tx, p.UserID, p.Item.Type, p.Item.ID)
+}
 
-	return result, nil
+func unequipShopItem(tx *sql.Tx, p shopPurchase) error {
+	if err := takeShopItem(tx, p); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM user_cosmetics WHERE user_id = $1 AND item_id = $2", p.UserID, p.Item.ID)
+	return err
 }
 
-func CheckFollow(userID, targetID int) bool {
-	var following bool
-	err := db.QueryRow(`
-		SELECT EXISTS(
-			SELECT 1 FROM follows 
-			WHERE user_id = $1 AND target_id = $2
-		)
-	`, userID, targetID).Scan(&following)
-	if err != nil {
-		log.Println("Checking follow error: " + err.Error())
-		return false
-	}
-	return following
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
 }
 
-func HasFollowings(userID int) bool {
-	var following bool
-	err := db.QueryRow(`
-		SELECT EXISTS(
-			SELECT 1 FROM follows 
-			WHERE user_id = $1
-		)
-	`, userID).Scan(&following)
-	if err != nil {
-		log.Println("Checking followings error: " + err.Error())
-		return false
-	}
-	return following
+func equipCosmetic(e execer, userID int, slot string, itemID int) error {
+	_, err := e.Exec(`
+		INSERT INTO user_cosmetics (user_id, slot, item_id) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, slot) DO UPDATE SET item_id = EXCLUDED.item_id
+	`, userID, slot, itemID)
+	return err
 }
 
-func GetUserPosts(userID int, page int, limit int, contentType string, sort string, search string) ([]models.File, int, error) {
-	var result []models.File
-	var total int
-
-	// Поиск пользователей
-	files, err := db.Query(`
-			SELECT id, file_name, title, thumbnail, uploaded_at, views, likes, type
-			FROM files
-			WHERE user_id = $1
-			AND is_public = true
-			AND is_moderated = true
-			AND (title ILIKE '%' || $5 || '%' OR $5 = '')
-			ORDER BY
-			CASE WHEN $4 = 'popular' THEN views END DESC,
-			CASE WHEN $4 = 'newest' THEN uploaded_at END DESC
-			LIMIT $2 OFFSET (($3 - 1) * $2);
-		`, userID, limit, page, sort, search)
-	if err == nil {
-		defer files.Close()
-		for files.Next() {
-			var f models.File
-			if err := files.Scan(&f.ID, &f.FileName, &f.Title, &f.Thumbnail, &f.UploadedAt, &f.Views, &f.Likes, &f.Type); err == nil {
-				total++
-				if contentType == "image" && IsImageFile(f.FileName) {
-					result = append(result, f)
-				} else if contentType == "video" && IsVideoFile(f.FileName) {
-					result = append(result, f)
-				} else if contentType == "clip" && f.Type == "clip" {
-					result = append(result, f)
-				} else if contentType == "all" {
-					result = append(result, f)
-				}
-			}
-		}
-	} else {
-		log.Println("Getting user's posts error: " + err.Error())
-		return nil, 0, err
+// Типы товаров для админки, по алфавиту
+func ShopItemTypes() []models.ShopItemType {
+	types := make([]models.ShopItemType, 0, len(shopItemTypes))
+	for _, name := range slices.Sorted(maps.Keys(shopItemTypes)) {
+		t := shopItemTypes[name]
+		types = append(types, models.ShopItemType{
+			Type: name, Title: t.title, Params: t.params, Unique: t.unique, Cosmetic: t.cosmetic,
+		})
 	}
-
-	return result, total, nil
+	return types
 }
 
-func Subscribe(userID, targetID int) error {
-	if !CheckFollow(userID, targetID) {
-		_, err := db.Exec("INSERT INTO follows (user_id, target_id) VALUES ($1, $2);", userID, targetID)
-		if err != nil {
-			return err
-		}
-
-		var user_display_name, user_profile_image string
-		err = db.QueryRow(`
-		SELECT display_name, profile_image_url FROM users
-		WHERE id = $1
-		`, userID).Scan(&user_display_name, &user_profile_image)
-		if err != nil {
-			return err
-		}
+// Создает товар любого зарегистрированного типа
+func CreateShopItem(item models.ShopItem) (int, error) {
+	itemType, ok := shopItemTypes[item.Type]
+	if !ok {
+		return 0, &ValidationError{Field: "type", Message: "unknown item type"}
+	}
+	item.Title = strings.TrimSpace(item.Title)
+	if item.Title == "" {
+		return 0, &ValidationError{Field: "title", Message: "title is required"}
+	}
+	if item.Cost < 0 {
+		return 0, &ValidationError{Field: "cost", Message: "cost must not be negative"}
+	}
 
-		_, err = db.Exec(`
-		INSERT INTO notifications (user_id, author_id, notification, image, link, type)
-		VALUES ($1, $2, $3, $4, $5, 'like')
-	`, targetID, userID, user_display_name+" подписался на Вас!", user_profile_image, "https://ehworld.ru/user/"+strconv.Itoa(userID))
-		if err != nil {
-			return err
+	// Сохраняются только параметры, которые знает тип
+	params := map[string]string{}
+	for _, name := range itemType.params {
+		value := strings.TrimSpace(item.Params[name])
+		if value == "" {
+			return 0, &ValidationError{Field: name, Message: name + " is required"}
 		}
-
-		_, err = db.Exec("UPDATE users SET followers = (SELECT COUNT(*) FROM follows WHERE target_id = $1) WHERE id = $1;", targetID)
-		if err != nil {
-			return err
+		params[name] = value
+	}
+	if itemType.validateParams != nil {
+		if err := itemType.validateParams(params); err != nil {
+			return 0, err
 		}
+	}
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return 0, err
+	}
 
-		return nil
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
 	}
-	return errors.New("already following")
-}
+	defer tx.Rollback()
 
-func Unsubscribe(userID, targetID int) error {
-	if CheckFollow(userID, targetID) {
-		_, err := db.Exec("DELETE FROM follows WHERE user_id = $1 AND target_id = $2;", userID, targetID)
-		if err != nil {
-			return err
+	if itemType.create != nil {
+		if err := itemType.create(tx, &item); err != nil {
+			return 0, err
 		}
+	}
 
-		_, err = db.Exec("UPDATE users SET followers = (SELECT COUNT(*) FROM follows WHERE target_id = $1) WHERE id = $1;", targetID)
-		if err != nil {
-			return err
-		}
+	var badgeID sql.NullInt64
+	if item.BadgeId != 0 {
+		badgeID = sql.NullInt64{Int64: int64(item.BadgeId), Valid: true}
+	}
 
-		return nil
+	var id int
+	err = tx.QueryRow(`
+		INSERT INTO shop_items (type, badge_id, title, cost, image, params)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, item.Type, badgeID, item.Title, item.Cost, item.Image, paramsJSON).Scan(&id)
+	if err != nil {
+		return 0, err
 	}
-	return errors.New("not following")
+
+	return id, tx.Commit()
 }
 
-func SaveBadge(image, title string, cost int) error {
-	var id int
-	err := db.QueryRow(`
-		INSERT INTO badges (image)
-		VALUES ($1) RETURNING id
-	`, image).Scan(&id)
+// Возврат покупки: тип товара отзывает выданное, рейтинг возвращается
+func RefundShopPurchase(purchaseID int) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	_, err = db.Exec("INSERT INTO shop_items (type, badge_id, title, cost, image) VALUES ('badge', $1, $2, $3, $4)", id, title, cost, image)
+	var p shopPurchase
+	var price int
+	err = tx.QueryRow(`
+		SELECT id, user_id, item_id, price, input
+		FROM shop_purchases
+		WHERE id = $1 AND refunded_at IS NULL
+		FOR UPDATE
+	`, purchaseID).Scan(&p.ID, &p.UserID, &p.Item.ID, &price, &p.Input)
+	if err == sql.ErrNoRows {
+		return ErrPurchaseNotFound
+	}
 	if err != nil {
 		return err
 	}
 
-	return err
-}
-
-func SaveCase(image, title, description string, price int) (int, error) {
-	var id int
-	err := db.QueryRow(`
-		INSERT INTO cases (image, title, description, price)
-		VALUES ($1, $2, $3, $4) RETURNING id
-	`, image, title, description, price).Scan(&id)
+	p.Item, err = scanShopItem(tx.QueryRow("SELECT "+shopItemColumns+" FROM shop_items si WHERE si.id = $1 FOR UPDATE", p.Item.ID))
 	if err != nil {
-		return -1, err
+		return err
+	}
+	itemType, ok := shopItemTypes[p.Item.Type]
+	if !ok {
+		return fmt.Errorf("unknown item type %q", p.Item.Type)
 	}
 
-	return id, err
-}
-
-func AddReward(reward models.CaseReward) error {
-	switch reward.Type {
-	case "vip":
-		_, err := db.Exec("INSERT INTO cases_rewards (type, probability, case_id) VALUES ('vip', $1, $2)", reward.Probability, reward.CaseID)
-		if err != nil {
-			return err
-		}
-	case "badge":
-		_, err := db.Exec("INSERT INTO cases_rewards (type, probability, case_id, badge_id) VALUES ('badge', $1, $2, $3)", reward.Probability, reward.CaseID, reward.BadgeID)
-		if err != nil {
-			return err
-		}
-	case "auk":
-		_, err := db.Exec("INSERT INTO cases_rewards (type, probability, case_id, auk_value ) VALUES ('auk', $1, $2, $3)", reward.Probability, reward.CaseID, reward.AukValue)
-		if err != nil {
-			return err
-		}
+	if err := itemType.revoke(tx, p); err != nil {
+		return err
+	}
+	if _, err := creditRating(tx, p.UserID, price); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE shop_items SET sold = sold - 1 WHERE id = $1 AND sold > 0", p.Item.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE shop_purchases SET refunded_at = NOW() WHERE id = $1", p.ID); err != nil {
+		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func GetCaseRewards(caseID int) ([]models.CaseReward, error) {
-	var result []models.CaseReward
-
-	// Поиск пользователей
-	rewards, err := db.Query(`
-			SELECT id, type, probability
-			FROM cases_rewards
-			WHERE case_id = $1
-		`, caseID)
-	if err == nil {
-		defer rewards.Close()
-		for rewards.Next() {
-			var r models.CaseReward
-			if err := rewards.Scan(&r.ID, &r.Type, &r.Probability); err == nil {
-				switch r.Type {
-				case "badge":
-					var title string
-					err = db.QueryRow(`
-					SELECT cases_rewards.badge_id, badges.image, shop_items.title
-					FROM cases_rewards, badges, shop_items
-					WHERE cases_rewards.id = $1 AND cases_rewards.badge_id = badges.id AND shop_items.badge_id = badges.id
-					`, r.ID).Scan(&r.BadgeID, &r.Image, &title)
-					if err != nil {
-						return nil, err
-					}
-					r.Title = "Значок " + title
-				case "auk":
-					err = db.QueryRow(`
-					SELECT auk_value
-					FROM cases_rewards
-					WHERE id = $1
-					`, r.ID).Scan(&r.AukValue)
-					if err != nil {
-						return nil, err
-					}
-					r.Image = "../static/img/auk.png"
-					r.Title = strconv.Itoa(r.AukValue) + " рублей для аука"
-				case "vip":
-					r.Image = "../static/img/vip.png"
-					r.Title = "Статус VIP в чате"
-				}
-
-				result = append(result, r)
-			}
-		}
-	} else {
-		log.Println("Getting case rewards error: " + err.Error())
+// Последние покупки в магазине
+func GetShopPurchases(limit, offset int) ([]models.ShopPurchase, error) {
+	rows, err := db.Query(`
+		SELECT p.id, u.display_name, si.id, si.title, si.type, p.price, p.input, p.created_at, p.refunded_at
+		FROM shop_purchases p
+		JOIN users u ON u.id = p.user_id
+		JOIN shop_items si ON si.id = p.item_id
+		ORDER BY p.id DESC
+		LIMIT $1 OFFSET $2
+	`, limit, offset)
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return result, nil
+	purchases := []models.ShopPurchase{}
+	for rows.Next() {
+		var p models.ShopPurchase
+		if err := rows.Scan(&p.ID, &p.DisplayName, &p.ItemID, &p.ItemTitle, &p.ItemType, &p.Price,
+			&p.Input, &p.CreatedAt, &p.RefundedAt); err != nil {
+			return nil, err
+		}
+		purchases = append(purchases, p)
+	}
+	return purchases, rows.Err()
 }
 
-func GetCaseByID(caseID int) (models.Case, error) {
-	var result models.Case
-	err := db.QueryRow(`SELECT id, title, price, image
-						FROM cases
-						WHERE id = $1`, caseID).Scan(&result.ID, &result.Title, &result.Price, &result.Image)
+// Невыполненные заявки на награды за рейтинг
+func GetPendingRedemptions() ([]models.ShopRedemption, error) {
+	rows, err := db.Query(`
+		SELECT r.id, r.purchase_id, u.display_name, si.title, r.input, r.status, r.created_at
+		FROM shop_redemptions r
+		JOIN users u ON u.id = r.user_id
+		JOIN shop_items si ON si.id = r.item_id
+		WHERE r.status = 'pending'
+		ORDER BY r.id
+	`)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	return result, nil
+	redemptions := []models.ShopRedemption{}
+	for rows.Next() {
+		var r models.ShopRedemption
+		if err := rows.Scan(&r.ID, &r.PurchaseID, &r.DisplayName, &r.ItemTitle, &r.Input, &r.Status, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, r)
+	}
+	return redemptions, rows.Err()
 }
 
-func OpenCase(caseID, userID int) (*models.CaseReward, error) {
-	caseData, err := GetCaseByID(caseID)
+func FulfillRedemption(id int) error {
+	res, err := db.Exec("UPDATE shop_redemptions SET status = 'fulfilled', resolved_at = NOW() WHERE id = $1 AND status = 'pending'", id)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrRedemptionNotFound
+	}
+	return nil
+}
 
-	// Проверяем баланс
-	user, err := GetUserByID(userID)
+// Купленные предметы оформления и эмоуты
+func GetOwnedShopItems(userID int) ([]models.OwnedShopItem, error) {
+	rows, err := db.Query(`
+		SELECT si.id, si.type, si.title, si.image, si.params,
+			EXISTS(SELECT 1 FROM user_cosmetics uc WHERE uc.user_id = $1 AND uc.item_id = si.id)
+		FROM users_items ui
+		JOIN shop_items si ON si.id = ui.item_id
+		WHERE ui.user_id = $1 AND si.type NOT IN ('badge', 'vip')
+		ORDER BY si.type, si.id
+	`, userID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	if user.Rating < caseData.Price {
-		return nil, errors.New("insufficient balance")
+	items := []models.OwnedShopItem{}
+	for rows.Next() {
+		var item models.OwnedShopItem
+		var params []byte
+		if err := rows.Scan(&item.ItemID, &item.Type, &item.Title, &item.Image, &params, &item.Equipped); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(params, &item.Params); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
 	}
+	return items, rows.Err()
+}
 
-	// Получаем все награды для кейса
-	rewards, err := GetCaseRewards(caseID)
+// Надевает купленный предмет оформления в слот его типа
+func EquipCosmetic(userID, itemID int) error {
+	var itemType string
+	err := db.QueryRow(`
+		SELECT si.type
+		FROM users_items ui
+		JOIN shop_items si ON si.id = ui.item_id
+		WHERE ui.user_id = $1 AND ui.item_id = $2
+	`, userID, itemID).Scan(&itemType)
+	if err == sql.ErrNoRows {
+		return ErrNotInInventory
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	// Выбираем случайную награду на основе вероятностей
-	var selectedReward *models.CaseReward
-	randValue := rand.Float64()
-
-	currentProb := 0.0
-	for _, reward := range rewards {
-		currentProb += reward.Probability
-		if randValue <= currentProb {
-			selectedReward = &reward
-			break
-		}
+	if !shopItemTypes[itemType].cosmetic {
+		return &ValidationError{Field: "item_id", Message: "item is not a profile cosmetic"}
 	}
 
-	if selectedReward == nil {
-		return nil, errors.New("failed to select reward")
-	}
+	return equipCosmetic(db, userID, itemType, itemID)
+}
 
-	// Обновляем баланс
-	IncrementRating(userID, caseData.Price*-1)
+func UnequipCosmetic(userID int, slot string) error {
+	_, err := db.Exec("DELETE FROM user_cosmetics WHERE user_id = $1 AND slot = $2", userID, slot)
+	return err
+}
 
-	// Добавляем в инвентарь
-	_, err = db.Exec("INSERT INTO inventory (user_id, reward_id) VALUES ($1, $2)", userID, selectedReward.ID)
+// Надетое оформление для страницы профиля
+func GetUserCosmetics(userID int) models.UserCosmetics {
+	var cosmetics models.UserCosmetics
+
+	rows, err := db.Query(`
+		SELECT uc.slot, si.image, si.params
+		FROM user_cosmetics uc
+		JOIN shop_items si ON si.id = uc.item_id
+		WHERE uc.user_id = $1
+	`, userID)
 	if err != nil {
-		return nil, err
+		log.Println("Не удалось получить косметику пользователя: " + err.Error())
+		return cosmetics
 	}
+	defer rows.Close()
 
-	return selectedReward, nil
+	for rows.Next() {
+		var slot, image string
+		var params []byte
+		if err := rows.Scan(&slot, &image, &params); err != nil {
+			continue
+		}
+		switch slot {
+		case "frame":
+			cosmetics.Frame = image
+		case "banner":
+			cosmetics.Banner = image
+		case "name_color":
+			var p map[string]string
+			if json.Unmarshal(params, &p) == nil {
+				cosmetics.NameColor = p["color"]
+			}
+		}
+	}
+	return cosmetics
 }
 
-func GetUserInventory(userID int) ([]models.CaseReward, error) {
-	var result []models.CaseReward
+func GetCases(userID int) []models.Case {
+	results := []models.Case{}
 
-	rewards, err := db.Query(`
-			SELECT DISTINCT cr.id, cr.type
-			FROM cases_rewards cr
-			JOIN inventory inv ON inv.reward_id = cr.id
-			WHERE inv.user_id = $1
-		`, userID)
+	// Поиск кейсов
+	items, err := db.Query(`
+			SELECT id, title, description, price, image
+			FROM cases
+		`)
 	if err == nil {
-		defer rewards.Close()
-		for rewards.Next() {
-			var r models.CaseReward
-			if err := rewards.Scan(&r.ID, &r.Type); err == nil {
-				switch r.Type {
-				case "badge":
-					var title string
-					err = db.QueryRow(`
-					SELECT DISTINCT ON (cr.badge_id) cr.badge_id, b.image, si.title
-					FROM cases_rewards cr
-					JOIN badges b ON cr.badge_id = b.id
-					JOIN shop_items si ON b.id = si.badge_id
-					WHERE cr.id = $1
-					ORDER BY cr.badge_id;
-					`, r.ID).Scan(&r.BadgeID, &r.Image, &title)
-					if err != nil {
-						return nil, err
-					}
-					r.Title = "Значок " + title
-				case "auk":
-					err = db.QueryRow(`
-					SELECT auk_value
-					FROM cases_rewards
-					WHERE id = $1
-					`, r.ID).Scan(&r.AukValue)
-					if err != nil {
-						return nil, err
-					}
-					r.Image = "../static/img/auk.png"
-					r.Title = strconv.Itoa(r.AukValue) + " рублей для аука"
-				case "vip":
-					r.Image = "../static/img/vip.png"
-					r.Title = "Статус VIP в чате"
-				}
-
-				result = append(result, r)
+		defer items.Close()
+		for items.Next() {
+			var i models.Case
+			if err := items.Scan(&i.ID, &i.Title, &i.Description, &i.Price, &i.Image); err == nil {
+				user, _ := GetUserByID(userID)
+				i.Rating = user.Rating
+				results = append(results, i)
 			}
 		}
-	} else {
-		log.Println("Getting user's inventory error: " + err.Error())
-		return nil, err
 	}
 
-	return result, nil
+	return results
 }
 
-func ApplyBadge(badgeID, userID int) error {
-	_, err := db.Exec("UPDATE users SET badge_id = $1 WHERE id = $2", badgeID, userID)
+func IsVIP(item_type string) bool {
+	return item_type == "vip"
+}
+
+func SaveTokens(access_token, refresh_token string) error {
+	_, err := db.Exec("UPDATE admin_tokens SET access_token = $1", access_token)
 	if err != nil {
 		return err
-	} else {
-		return nil
 	}
-}
 
-func UserHasItem(userID, itemID int) bool {
-	var hasItem int
-	err := db.QueryRow(`
-					SELECT COUNT(*)
-					FROM inventory
-					WHERE user_id = $1 AND reward_id = $2
-					`, userID, itemID).Scan(&hasItem)
+	_, err = db.Exec("UPDATE admin_tokens SET refresh_token = $1", refresh_token)
 	if err != nil {
-		return false
+		return err
 	}
 
-	if hasItem > 0 {
-		return true
-	}
-	return false
+	return nil
 }
 
-func ApplyItem(itemID, userID int, lot_name string) error {
-	var item models.CaseReward
-	err := db.QueryRow(`
-					SELECT type
-					FROM cases_rewards
-					WHERE id = $1
-					`, itemID).Scan(&item.Type)
+func GetTokens() models.Tokens {
+	var tokens models.Tokens
+	var access_token, refresh_token string
+	err := db.QueryRow(`SELECT access_token, refresh_token FROM admin_tokens WHERE id = 1`).Scan(&access_token, &refresh_token)
 	if err != nil {
-		return err
+		return tokens
 	}
+	tokens.AccessToken = access_token
+	tokens.RefreshToken = refresh_token
+	return tokens
+}
 
-	// Проверка на наличие предмета в инвентаре
-	if UserHasItem(userID, itemID) {
-		switch item.Type {
-		case "vip":
-			user, err := GetUserByID(userID)
-			if err != nil {
-				return err
-			}
-			err = GrantVIP(user.Login)
-			if err != nil {
-				return err
-			}
-
-			_, err = db.Exec("DELETE FROM inventory WHERE user_id = $1 AND reward_id = $2", userID, itemID)
-			if err != nil {
-				return err
-			}
-		case "auk":
-			_, err = db.Exec("INSERT INTO auk_submissions (user_id, lot, auk_value) VALUES ($1, $2, (SELECT auk_value FROM cases_rewards WHERE id = $3))", userID, lot_name, itemID)
-			if err != nil {
-				return err
-			}
-
-			_, err = db.Exec("DELETE FROM inventory WHERE user_id = $1 AND reward_id = $2", userID, itemID)
-			if err != nil {
-				return err
-			}
-		}
-	} else {
-		return errors.New("item is not in inventory")
+func GetTotalLikes(userID int) int {
+	var result int
+	err := db.QueryRow(`SELECT SUM(likes) FROM files WHERE user_id = $1`, userID).Scan(&result)
+	if err != nil {
+		log.Println("Getting user's (id: " + strconv.Itoa(userID) + " likes error: " + err.Error())
+		return 0
 	}
-
-	return nil
+	return result
 }
 
-func GetQueue() ([]models.AukSubmission, error) {
-	var result []models.AukSubmission
-
-	files, err := db.Query(`
-			SELECT auk_submissions.id, users.display_name, users.profile_image_url, auk_submissions.auk_value, auk_submissions.lot
-			FROM auk_submissions, users
-			WHERE auk_submissions.user_id = users.id AND auk_submissions.done = FALSE;
-		`)
-	if err == nil {
-		defer files.Close()
-		for files.Next() {
-			var s models.AukSubmission
-			if err := files.Scan(&s.ID, &s.DisplayName, &s.ProfileImageURL, &s.AukValue, &s.Submission); err == nil {
-				result = append(result, s)
-			}
-		}
-	} else {
-		log.Println("Getting queue error: " + err.Error())
-		return nil, err
+func GetTotalFucks(userID int) int {
+	var result int
+	err := db.QueryRow(`SELECT SUM(fucks) FROM files WHERE user_id = $1`, userID).Scan(&result)
+	if err != nil {
+		log.Println("Getting user's fucks error: " + err.Error())
+		return 0
 	}
-
-	return result, nil
+	return result
 }
 
-func DeleteSubmission(submissionID int) error {
-	_, err := db.Exec("UPDATE auk_submissions SET done = TRUE WHERE id = $1", submissionID)
+func GetTotalPosts(userID int) int {
+	var result int
+	err := db.QueryRow(`SELECT COUNT(*) FROM files WHERE user_id = $1`, userID).Scan(&result)
 	if err != nil {
-		return err
+		log.Println("Getting user's posts count error: " + err.Error())
+		return 0
 	}
-
-	return nil
+	return result
 }
 
-func LoadChannelsToCheck() []string {
-	var result []string
+func GetUserBadges(userID int) ([]models.Badge, error) {
+	var result []models.Badge
 
-	channels, err := db.Query(`
-			SELECT login FROM live_channels
-		`)
-	if err == nil {
-		defer channels.Close()
-		for channels.Next() {
-			var s string
-			if err := channels.Scan(&s); err == nil {
-				result = append(result, strings.ToLower(s))
-			}
-		}
-	} else {
-		log.Println("Getting channels error: " + err.Error())
-		return nil
-	}
+	// Поиск пользователей
+	badges, err := db.Query(`
+			SELECT badges.id, badges.image
+			FROM (
+				-- Основной значок профиля
+				SELECT badge_id
+				FROM users
+				WHERE id = $1 AND badge_id IS NOT NULL
 
-	log.Println("Channels loaded: " + strconv.Itoa(len(result)))
+				UNION
 
-	return result
-}
+				-- Значки из магазина (users_items)
+				SELECT shop_items.badge_id
+				FROM users_items
+				JOIN shop_items ON users_items.item_id = shop_items.id
+				WHERE 
+					users_items.user_id = $1
+					AND shop_items.type = 'badge'
+					AND shop_items.badge_id IS NOT NULL
 
-func GetLeaderboard() ([]models.User, error) {
-	var result []models.User
+				UNION
 
-	channels, err := db.Query(`
-			SELECT display_name, profile_image_url, followers FROM users ORDER BY followers DESC LIMIT 5;
-		`)
+				-- Значки из инвентаря (inventory)
+				SELECT cases_rewards.badge_id
+				FROM inventory
+				JOIN cases_rewards ON inventory.reward_id = cases_rewards.id
+				WHERE 
+					inventory.user_id = $1
+					AND cases_rewards.type = 'badge'
+					AND cases_rewards.badge_id IS NOT NULL
+			) AS combined_badges
+			JOIN badges ON badges.id = combined_badges.badge_id;
+		`, userID)
 	if err == nil {
-		defer channels.Close()
-		for channels.Next() {
-			var s models.User
-			if err := channels.Scan(&s.DisplayName, &s.ProfileImageURL, &s.Followers); err == nil {
-				result = append(result, s)
+		defer badges.Close()
+		for badges.Next() {
+			var b models.Badge
+			if err := badges.Scan(&b.ID, &b.Image); err == nil {
+				result = append(result, b)
 			}
 		}
 	} else {
-		log.Println("Getting channels error: " + err.Error())
+		log.Println("Getting user's badges error: " + err.Error())
 		return nil, err
 	}
 
 	return result, nil
 }
 
-func LoadMessagesHistory(limit int) ([]models.MessageWithAuthor, error) {
-	var result []models.MessageWithAuthor
-
-	messages, err := db.Query(`
-			SELECT 
-				m.id,
-				CASE 
-					WHEN m.is_anonymous THEN 'Аноним'
-					ELSE u.display_name 
-				END AS display_name,
-				b.image AS badge_url,
-				m.content,
-				m.sent_at
-			FROM messages m
-			LEFT JOIN users u ON m.user_id = u.id
-			LEFT JOIN badges b ON COALESCE(m.badge_id, u.badge_id) = b.id
-			LEFT JOIN messages_files mf ON m.id = mf.message_id
-			GROUP BY m.id, u.display_name, m.is_anonymous, b.image
-			ORDER BY m.id
-			LIMIT $1;
-		`, limit)
-	if err == nil {
-		defer messages.Close()
-		for messages.Next() {
-			var m models.MessageWithAuthor
-			if err := messages.Scan(&m.ID, &m.DisplayName, &m.BadgeURL, &m.Content, &m.Sent); err == nil {
-				files, _ := getFilesURLs(m.ID)
-				m.FilesURL = files
-				result = append(result, m)
-			} else {
-				log.Println(err.Error())
-			}
-		}
-	} else {
-		log.Println("Getting messages error: " + err.Error())
-		return nil, err
+func CheckFollow(userID, targetID int) bool {
+	var following bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM follows 
+			WHERE user_id = $1 AND target_id = $2
+		)
+	`, userID, targetID).Scan(&following)
+	if err != nil {
+		log.Println("Checking follow error: " + err.Error())
+		return false
 	}
+	return following
+}
 
-	return result, nil
+func HasFollowings(userID int) bool {
+	var following bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM follows 
+			WHERE user_id = $1
+		)
+	`, userID).Scan(&following)
+	if err != nil {
+		log.Println("Checking followings error: " + err.Error())
+		return false
+	}
+	return following
 }
 
-func getFilesURLs(messageID int) ([]string, error) {
-	var result []string
+func GetUserPosts(userID int, page int, limit int, contentType string, sort string, search string) ([]models.File, int, error) {
+	var result []models.File
+	var total int
 
+	// Поиск пользователей
 	files, err := db.Query(`
-			SELECT file_name FROM messages_files WHERE message_id = $1;
-		`, messageID)
+			SELECT id, file_name, title, thumbnail, uploaded_at, views, likes, type
+			FROM files
+			WHERE user_id = $1
+			AND is_public = true
+			AND is_moderated = true
+			AND (title ILIKE '%' || $5 || '%' OR $5 = '')
+			ORDER BY
+			CASE WHEN $4 = 'popular' THEN views END DESC,
+			CASE WHEN $4 = 'newest' THEN uploaded_at END DESC
+			LIMIT $2 OFFSET (($3 - 1) * $2);
+		`, userID, limit, page, sort, search)
 	if err == nil {
 		defer files.Close()
 		for files.Next() {
-			var s string
-			if err := files.Scan(&s); err == nil {
-				result = append(result, s)
+			var f models.File
+			if err := files.Scan(&f.ID, &f.FileName, &f.Title, &f.Thumbnail, &f.UploadedAt, &f.Views, &f.Likes, &f.Type); err == nil {
+				total++
+				if contentType == "image" && IsImageFile(f.FileName) {
+					result = append(result, f)
+				} else if contentType == "video" && IsVideoFile(f.FileName) {
+					result = append(result, f)
+				} else if contentType == "clip" && f.Type == "clip" {
+					result = append(result, f)
+				} else if contentType == "all" {
+					result = append(result, f)
+				}
 			}
 		}
 	} else {
-		log.Println("Getting  message files error: " + err.Error())
-		return nil, err
+		log.Println("Getting user's posts error: " + err.Error())
+		return nil, 0, err
 	}
 
-	return result, nil
+	return result, total, nil
 }
 
-func SaveMessage(userID, badgeID int, message string) (int, error) {
-	var lastSimilarMessage string
-	var lastMessageTime time.Time
+func Subscribe(userID, targetID int) error {
+	if !CheckFollow(userID, targetID) {
+		_, err := db.Exec("INSERT INTO follows (user_id, target_id) VALUES ($1, $2);", userID, targetID)
+		if err != nil {
+			return err
+		}
+
+		err = addNotification(targetID, userID, 0, "follow", nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec("UPDATE users SET followers = (SELECT COUNT(*) FROM follows WHERE target_id = $1) WHERE id = $1;", targetID)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+	return ErrAlreadyFollowing
+}
+
+func Unsubscribe(userID, targetID int) error {
+	if CheckFollow(userID, targetID) {
+		_, err := db.Exec("DELETE FROM follows WHERE user_id = $1 AND target_id = $2;", userID, targetID)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec("UPDATE users SET followers = (SELECT COUNT(*) FROM follows WHERE target_id = $1) WHERE id = $1;", targetID)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+	return ErrNotFollowing
+}
+
+func SaveBadge(image, title string, cost int) error {
+	_, err := CreateShopItem(models.ShopItem{Type: "badge", Title: title, Cost: cost, Image: image})
+	return err
+}
 
+func SaveCase(image, title, description string, price int) (int, error) {
+	var id int
 	err := db.QueryRow(`
-        SELECT content, sent_at 
-        FROM messages 
-        WHERE user_id = $1 AND content = $2 
-        ORDER BY sent_at DESC 
-        LIMIT 1
-    `, userID, message).Scan(&lastSimilarMessage, &lastMessageTime)
+		INSERT INTO cases (image, title, description, price)
+		VALUES ($1, $2, $3, $4) RETURNING id
+	`, image, title, description, price).Scan(&id)
+	if err != nil {
+		return -1, err
+	}
+
+	return id, err
+}
+
+// Добавляет награду в кейс. Без normalize сумма шансов кейса не может превысить 1,
+// с normalize шансы считаются весами и приводятся к сумме 1 через NormalizeCaseRewards
+func AddReward(reward models.CaseReward, normalize bool) error {
+	if reward.Probability <= 0 || reward.Probability > 1 {
+		return &ValidationError{Field: "probability", Message: "probability must be in (0, 1]"}
+	}
+
+	switch reward.Type {
+	case "vip":
+		if reward.VIPDays == 0 {
+			reward.VIPDays = defaultVIPDays
+		}
+		if reward.VIPDays < 0 || reward.VIPDays > maxVIPDays {
+			return &ValidationError{Field: "vip_days", Message: fmt.Sprintf("days must be between 1 and %d", maxVIPDays)}
+		}
+	case "badge":
+		if reward.BadgeID == 0 {
+			return &ValidationError{Field: "badge_id", Message: "badge is required"}
+		}
+	case "auk":
+		if reward.AukValue <= 0 {
+			return &ValidationError{Field: "auk_value", Message: "auk value must be positive"}
+		}
+	default:
+		return &ValidationError{Field: "type", Message: "unknown reward type"}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Блокировка кейса: параллельные добавления не проскочат проверку суммы вместе
+	var caseID int
+	if err := tx.QueryRow("SELECT id FROM cases WHERE id = $1 FOR UPDATE", reward.CaseID).Scan(&caseID); err != nil {
+		return err
+	}
+
+	if !normalize {
+		var sum float64
+		err := tx.QueryRow("SELECT COALESCE(SUM(probability), 0) FROM cases_rewards WHERE case_id = $1", reward.CaseID).Scan(&sum)
+		if err != nil {
+			return err
+		}
+		if sum+reward.Probability > 1+caseProbabilityEpsilon {
+			return &ValidationError{Field: "probability", Message: fmt.Sprintf("probabilities would sum to %g", sum+reward.Probability)}
+		}
+	}
+
+	switch reward.Type {
+	case "vip":
+		_, err = tx.Exec("INSERT INTO cases_rewards (type, probability, case_id, vip_days) VALUES ('vip', $1, $2, $3)", reward.Probability, reward.CaseID, reward.VIPDays)
+	case "badge":
+		_, err = tx.Exec("INSERT INTO cases_rewards (type, probability, case_id, badge_id) VALUES ('badge', $1, $2, $3)", reward.Probability, reward.CaseID, reward.BadgeID)
+	case "auk":
+		_, err = tx.Exec("INSERT INTO cases_rewards (type, probability, case_id, auk_value ) VALUES ('auk', $1, $2, $3)", reward.Probability, reward.CaseID, reward.AukValue)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func GetCaseRewards(caseID int) ([]models.CaseReward, error) {
+	var result []models.CaseReward
+
+	// Поиск пользователей
+	rewards, err := db.Query(`
+			SELECT id, type, probability
+			FROM cases_rewards
+			WHERE case_id = $1
+			ORDER BY id
+		`, caseID)
 	if err == nil {
-		// Сообщение найдено
-		if time.Since(lastMessageTime) < 30*time.Second {
-			return -1, errors.New("you can send only unique messages")
+		defer rewards.Close()
+		for rewards.Next() {
+			var r models.CaseReward
+			if err := rewards.Scan(&r.ID, &r.Type, &r.Probability); err == nil {
+				switch r.Type {
+				case "badge":
+					var title string
+					err = db.QueryRow(`
+					SELECT cases_rewards.badge_id, badges.image, shop_items.title
+					FROM cases_rewards, badges, shop_items
+					WHERE cases_rewards.id = $1 AND cases_rewards.badge_id = badges.id AND shop_items.badge_id = badges.id
+					`, r.ID).Scan(&r.BadgeID, &r.Image, &title)
+					if err != nil {
+						return nil, err
+					}
+					r.Title = "Значок " + title
+				case "auk":
+					err = db.QueryRow(`
+					SELECT auk_value
+					FROM cases_rewards
+					WHERE id = $1
+					`, r.ID).Scan(&r.AukValue)
+					if err != nil {
+						return nil, err
+					}
+					r.Image = "../static/img/auk.png"
+					r.Title = strconv.Itoa(r.AukValue) + " рублей для аука"
+				case "vip":
+					err = db.QueryRow(`
+					SELECT vip_days
+					FROM cases_rewards
+					WHERE id = $1
+					`, r.ID).Scan(&r.VIPDays)
+					if err != nil {
+						return nil, err
+					}
+					r.Image = "../static/img/vip.png"
+					r.Title = fmt.Sprintf("Статус VIP в чате на %d дн.", r.VIPDays)
+				}
+
+				result = append(result, r)
+			}
 		}
+	} else {
+		log.Println("Getting case rewards error: " + err.Error())
+		return nil, err
 	}
 
-	var messageID int
-	err = db.QueryRow(
-		"INSERT INTO messages (user_id, badge_id, content) VALUES ($1, $2, $3) RETURNING id",
-		userID, badgeID, message,
-	).Scan(&messageID)
-	return messageID, err
+	return result, nil
 }
 
-func ClipFile(messageID int, fileName string) error {
-	_, err := db.Exec(
-		"INSERT INTO messages_files (message_id, file_name) VALUES ($1, $2)",
-		messageID, fileName,
-	)
+func GetCaseByID(caseID int) (models.Case, error) {
+	var result models.Case
+	err := db.QueryRow(`SELECT id, title, price, image
+						FROM cases
+						WHERE id = $1`, caseID).Scan(&result.ID, &result.Title, &result.Price, &result.Image)
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// Открытие кейса в одной транзакции. С непустым idempotencyKey повтор возвращает ту же награду
+func OpenCase(caseID, userID int, idempotencyKey string) (*models.CaseReward, error) {
+	caseData, err := GetCaseByID(caseID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Получаем все награды для кейса
+	rewards, err := GetCaseRewards(caseID)
+	if err != nil {
+		return nil, err
+	}
+	if len(caseRewardIssues(rewards)) > 0 {
+		return nil, ErrCaseMisconfigured
+	}
+
+	if _, err := GetCaseSeed(userID); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if idempotencyKey != "" {
+		result, claimed, err := claimIdempotencyKey(tx, userID, fmt.Sprintf("case-open/%d", caseID), idempotencyKey)
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			openingID, _ := strconv.Atoi(result)
+			return caseOpeningReward(openingID)
+		}
+	}
+
+	// Берем следующий nonce текущей пары сидов
+	var seedID, nonce int
+	var serverSeed, clientSeed string
+	err = tx.QueryRow(`
+		UPDATE case_seeds SET nonce = nonce + 1
+		WHERE user_id = $1 AND revealed_at IS NULL
+		RETURNING id, server_seed, client_seed, nonce - 1
+	`, userID).Scan(&seedID, &serverSeed, &clientSeed, &nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	// Выбираем награду по броску из сидов
+	snapshot := make([]models.CaseOpeningReward, 0, len(rewards))
+	for _, reward := range rewards {
+		snapshot = append(snapshot, models.CaseOpeningReward{ID: reward.ID, Probability: reward.Probability})
+	}
+	roll := CaseRoll(serverSeed, clientSeed, nonce)
+	index := pickCaseReward(snapshot, roll)
+	if index < 0 {
+		return nil, errors.New("failed to select reward")
+	}
+	selectedReward := rewards[index]
+
+	// Обновляем баланс
+	if err := chargeRating(tx, userID, caseData.Price); err != nil {
+		return nil, err
+	}
+
+	// Добавляем в инвентарь
+	_, err = tx.Exec("INSERT INTO inventory (user_id, reward_id) VALUES ($1, $2)", userID, selectedReward.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(`
+		INSERT INTO case_openings (user_id, case_id, reward_id, seed_id, nonce, roll, price, rewards)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`, userID, caseID, selectedReward.ID, seedID, nonce, roll, caseData.Price, snapshotJSON).Scan(&selectedReward.OpeningID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := enqueueChatAnnouncement(tx, outboxChatCaseWin, userID, selectedReward.OpeningID); err != nil {
+		return nil, err
+	}
+
+	if idempotencyKey != "" {
+		err = saveIdempotencyResult(tx, userID, idempotencyKey, strconv.Itoa(selectedReward.OpeningID))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &selectedReward, nil
+}
+
+// Честное открытие кейсов (commit-reveal).
+// Перед открытием пользователь видит sha256 от серверного сида, а сам сид раскрывается
+// при смене пары. Бросок: первые 52 бита HMAC-SHA256(server_seed, "client_seed:nonce") / 2^52
+
+const maxClientSeedLength = 64
+
+func CaseRoll(serverSeed, clientSeed string, nonce int) float64 {
+	mac := hmac.New(sha256.New, []byte(serverSeed))
+	mac.Write([]byte(clientSeed + ":" + strconv.Itoa(nonce)))
+	sum := mac.Sum(nil)
+	return float64(binary.BigEndian.Uint64(sum[:8])>>12) / (1 << 52)
+}
+
+// Индекс награды, в чей отрезок накопленных вероятностей попал бросок, или -1.
+// Остаток от погрешности округления шансов достается последней награде
+func pickCaseReward(rewards []models.CaseOpeningReward, roll float64) int {
+	currentProb := 0.0
+	for i, reward := range rewards {
+		currentProb += reward.Probability
+		if roll < currentProb {
+			return i
+		}
+	}
+	if len(rewards) > 0 && currentProb >= 1-caseProbabilityEpsilon {
+		return len(rewards) - 1
+	}
+	return -1
+}
+
+// Награда, выпавшая в открытии, для повторного ответа по ключу идемпотентности
+func caseOpeningReward(openingID int) (*models.CaseReward, error) {
+	var caseID, rewardID int
+	err := db.QueryRow("SELECT case_id, reward_id FROM case_openings WHERE id = $1", openingID).Scan(&caseID, &rewardID)
+	if err == sql.ErrNoRows {
+		return nil, ErrCaseOpeningNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rewards, err := GetCaseRewards(caseID)
+	if err != nil {
+		return nil, err
+	}
+	for _, reward := range rewards {
+		if reward.ID == rewardID {
+			reward.OpeningID = openingID
+			return &reward, nil
+		}
+	}
+	return nil, ErrCaseOpeningNotFound
+}
+
+// Проверка и симуляция наград кейсов
+
+// Допустимое отклонение суммы шансов от 1: шансы хранятся в REAL
+const caseProbabilityEpsilon = 1e-4
+
+const maxCaseSimulations = 1000000
+
+func caseRewardIssues(rewards []models.CaseReward) []string {
+	issues := []string{}
+	if len(rewards) == 0 {
+		return append(issues, "case has no rewards")
+	}
+
+	sum := 0.0
+	for _, reward := range rewards {
+		if reward.Probability <= 0 {
+			issues = append(issues, fmt.Sprintf("reward #%d: probability must be positive", reward.ID))
+		}
+		sum += reward.Probability
+	}
+	if math.Abs(sum-1) > caseProbabilityEpsilon {
+		issues = append(issues, fmt.Sprintf("probabilities sum to %g instead of 1", sum))
+	}
+	return issues
+}
+
+func caseRewardsReport(c models.Case) (models.CaseRewardsReport, error) {
+	report := models.CaseRewardsReport{CaseID: c.ID, Title: c.Title, Price: c.Price}
+	rewards, err := GetCaseRewards(c.ID)
+	if err != nil {
+		return report, err
+	}
+
+	report.Rewards = len(rewards)
+	for _, reward := range rewards {
+		report.Sum += reward.Probability
+	}
+	report.Issues = caseRewardIssues(rewards)
+	report.Valid = len(report.Issues) == 0
+	return report, nil
+}
+
+func GetCaseRewardsReports(userID int) ([]models.CaseRewardsReport, error) {
+	reports := []models.CaseRewardsReport{}
+	for _, c := range GetCases(userID) {
+		report, err := caseRewardsReport(c)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// Делит шансы наград кейса на их сумму
+func NormalizeCaseRewards(caseID int) (models.CaseRewardsReport, error) {
+	c, err := GetCaseByID(caseID)
+	if err != nil {
+		return models.CaseRewardsReport{}, err
+	}
+
+	res, err := db.Exec(`
+		UPDATE cases_rewards
+		SET probability = probability / s.total
+		FROM (SELECT SUM(probability) AS total FROM cases_rewards WHERE case_id = $1) s
+		WHERE case_id = $1 AND s.total > 0
+	`, caseID)
+	if err != nil {
+		return models.CaseRewardsReport{}, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return models.CaseRewardsReport{}, ErrCaseMisconfigured
+	}
+
+	return caseRewardsReport(c)
+}
+
+// Ценность награды в рейтинге: цена значка или VIP в магазине, рубли аука по курсу aukRate.
+// VIP оценивается по товару с тем же сроком, а если такого нет - по самому дешевому дню
+// VIP в магазине, умноженному на срок награды. false, если награда в магазине не продается
+func caseRewardValue(reward models.CaseReward, aukRate float64) (float64, bool, error) {
+	switch reward.Type {
+	case "badge":
+		var cost sql.NullInt64
+		err := db.QueryRow("SELECT MIN(cost) FROM shop_items WHERE badge_id = $1", reward.BadgeID).Scan(&cost)
+		if err != nil {
+			return 0, false, err
+		}
+		return float64(cost.Int64), cost.Valid, nil
+	case "vip":
+		var cost, days int
+		err := db.QueryRow(`
+			SELECT cost, days FROM (
+				SELECT cost, COALESCE(NULLIF(params->>'days', '')::int, $2) AS days
+				FROM shop_items WHERE type = 'vip'
+			) vip
+			ORDER BY days = $1 DESC, cost::float8 / days
+			LIMIT 1
+		`, reward.VIPDays, defaultVIPDays).Scan(&cost, &days)
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		return float64(cost) * float64(reward.VIPDays) / float64(days), true, nil
+	case "auk":
+		return float64(reward.AukValue) * aukRate, true, nil
+	}
+	return 0, false, nil
+}
+
+// Прогоняет n виртуальных открытий без списания баланса
+func SimulateCase(caseID, n int, aukRate float64) (models.CaseSimulation, error) {
+	sim := models.CaseSimulation{CaseID: caseID, Openings: n}
+	if n < 1 || n > maxCaseSimulations {
+		return sim, &ValidationError{Field: "n", Message: fmt.Sprintf("n must be between 1 and %d", maxCaseSimulations)}
+	}
+	if aukRate < 0 {
+		return sim, &ValidationError{Field: "auk_rate", Message: "auk rate must not be negative"}
+	}
+
+	c, err := GetCaseByID(caseID)
+	if err != nil {
+		return sim, err
+	}
+	sim.Price = c.Price
+
+	rewards, err := GetCaseRewards(caseID)
+	if err != nil {
+		return sim, err
+	}
+
+	probabilities := make([]models.CaseOpeningReward, 0, len(rewards))
+	for _, reward := range rewards {
+		value, priced, err := caseRewardValue(reward, aukRate)
+		if err != nil {
+			return sim, err
+		}
+		sim.Rewards = append(sim.Rewards, models.CaseSimulationReward{
+			ID:          reward.ID,
+			Type:        reward.Type,
+			Title:       reward.Title,
+			Probability: reward.Probability,
+			Value:       value,
+			Priced:      priced,
+		})
+		probabilities = append(probabilities, models.CaseOpeningReward{ID: reward.ID, Probability: reward.Probability})
+		sim.ExpectedValue += reward.Probability * value
+	}
+
+	total := 0.0
+	for i := 0; i < n; i++ {
+		index := pickCaseReward(probabilities, rand.Float64())
+		if index < 0 {
+			sim.Failed++
+			continue
+		}
+		sim.Rewards[index].Count++
+		total += sim.Rewards[index].Value
+	}
+
+	for i := range sim.Rewards {
+		sim.Rewards[i].Share = float64(sim.Rewards[i].Count) / float64(n)
+	}
+	sim.AverageValue = total / float64(n)
+	if sim.Price > 0 {
+		sim.ReturnRate = sim.ExpectedValue / float64(sim.Price)
+	}
+	return sim, nil
+}
+
+func randomSeed() (string, error) {
+	b := make([]byte, 32)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashSeed(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(sum[:])
+}
+
+func insertCaseSeed(q queryRower, userID int, serverSeed, clientSeed string) (models.CaseSeed, error) {
+	var seed models.CaseSeed
+	var err error
+	if clientSeed == "" {
+		if clientSeed, err = randomSeed(); err != nil {
+			return seed, err
+		}
+		clientSeed = clientSeed[:16]
+	}
+
+	seed.ServerSeedHash = hashSeed(serverSeed)
+	seed.ClientSeed = clientSeed
+	err = q.QueryRow(`
+		INSERT INTO case_seeds (user_id, server_seed, server_seed_hash, client_seed)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, userID, serverSeed, seed.ServerSeedHash, clientSeed).Scan(&seed.ID, &seed.CreatedAt)
+	return seed, err
+}
+
+// Следующий серверный сид. Его хеш показывается до того, как игрок выберет клиентский сид,
+// поэтому сервер не может подобрать сид под уже известный клиентский
+func nextCaseSeedHash(q queryRower, userID int) (string, error) {
+	serverSeed, err := randomSeed()
+	if err != nil {
+		return "", err
+	}
+
+	// Существующий сид не перезаписывается: DO UPDATE нужен только чтобы RETURNING вернул строку
+	var hash string
+	err = q.QueryRow(`
+		INSERT INTO case_next_seeds (user_id, server_seed, server_seed_hash)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET user_id = EXCLUDED.user_id
+		RETURNING server_seed_hash
+	`, userID, serverSeed, hashSeed(serverSeed)).Scan(&hash)
+	return hash, err
+}
+
+// Текущая пара сидов пользователя без серверного сида и хеш следующего серверного сида.
+// Создаются при первом обращении
+func GetCaseSeed(userID int) (models.CaseSeed, error) {
+	var seed models.CaseSeed
+	err := db.QueryRow(`
+		SELECT id, server_seed_hash, client_seed, nonce, created_at
+		FROM case_seeds
+		WHERE user_id = $1 AND revealed_at IS NULL
+	`, userID).Scan(&seed.ID, &seed.ServerSeedHash, &seed.ClientSeed, &seed.Nonce, &seed.CreatedAt)
+	if err == sql.ErrNoRows {
+		var serverSeed string
+		if serverSeed, err = randomSeed(); err != nil {
+			return seed, err
+		}
+		seed, err = insertCaseSeed(db, userID, serverSeed, "")
+	}
+	if err != nil {
+		return seed, err
+	}
+
+	seed.NextServerSeedHash, err = nextCaseSeedHash(db, userID)
+	return seed, err
+}
+
+// Раскрывает текущий серверный сид и начинает новую пару из заранее объявленного
+// следующего серверного сида и указанного клиентского. nextHash - хеш, который видел игрок:
+// если следующий сид успел смениться, ротация не выполняется
+func RotateCaseSeed(userID int, clientSeed, nextHash string) (revealed, current models.CaseSeed, err error) {
+	clientSeed = strings.TrimSpace(clientSeed)
+	if len(clientSeed) > maxClientSeedLength {
+		return revealed, current, &ValidationError{Field: "client_seed", Message: "client seed is too long"}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return revealed, current, err
+	}
+	defer tx.Rollback()
+
+	var serverSeed, serverSeedHash string
+	err = tx.QueryRow(`
+		DELETE FROM case_next_seeds WHERE user_id = $1
+		RETURNING server_seed, server_seed_hash
+	`, userID).Scan(&serverSeed, &serverSeedHash)
+	if err == sql.ErrNoRows || (err == nil && serverSeedHash != nextHash) {
+		return revealed, current, ErrCaseSeedChanged
+	}
+	if err != nil {
+		return revealed, current, err
+	}
+
+	var revealedAt time.Time
+	err = tx.QueryRow(`
+		UPDATE case_seeds SET revealed_at = NOW()
+		WHERE user_id = $1 AND revealed_at IS NULL
+		RETURNING id, server_seed, server_seed_hash, client_seed, nonce, created_at, revealed_at
+	`, userID).Scan(&revealed.ID, &revealed.ServerSeed, &revealed.ServerSeedHash, &revealed.ClientSeed,
+		&revealed.Nonce, &revealed.CreatedAt, &revealedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return revealed, current, err
+	}
+	if err == nil {
+		revealed.RevealedAt = &revealedAt
+	}
+
+	current, err = insertCaseSeed(tx, userID, serverSeed, clientSeed)
+	if err != nil {
+		return revealed, current, err
+	}
+	current.NextServerSeedHash, err = nextCaseSeedHash(tx, userID)
+	if err != nil {
+		return revealed, current, err
+	}
+
+	return revealed, current, tx.Commit()
+}
+
+const caseOpeningColumns = `
+	co.id, co.case_id, c.title, co.reward_id, u.display_name, co.price,
+	s.server_seed, s.server_seed_hash, s.client_seed, co.nonce, co.roll, co.rewards,
+	s.revealed_at IS NOT NULL, co.created_at
+	FROM case_openings co
+	JOIN case_seeds s ON s.id = co.seed_id
+	JOIN cases c ON c.id = co.case_id
+	JOIN users u ON u.id = co.user_id`
+
+func scanCaseOpening(row rowScanner) (models.CaseOpening, error) {
+	var o models.CaseOpening
+	var rewards []byte
+	err := row.Scan(&o.ID, &o.CaseID, &o.CaseTitle, &o.RewardID, &o.DisplayName, &o.Price,
+		&o.ServerSeed, &o.ServerSeedHash, &o.ClientSeed, &o.Nonce, &o.Roll, &rewards,
+		&o.Revealed, &o.CreatedAt)
+	if err != nil {
+		return o, err
+	}
+	if err := json.Unmarshal(rewards, &o.Rewards); err != nil {
+		return o, err
+	}
+
+	// Пока сид не раскрыт, проверить открытие нельзя
+	if !o.Revealed {
+		o.ServerSeed = ""
+		return o, nil
+	}
+	index := pickCaseReward(o.Rewards, CaseRoll(o.ServerSeed, o.ClientSeed, o.Nonce))
+	o.Verified = hashSeed(o.ServerSeed) == o.ServerSeedHash &&
+		index >= 0 && o.Rewards[index].ID == o.RewardID
+	return o, nil
+}
+
+func GetCaseOpening(id int) (models.CaseOpening, error) {
+	o, err := scanCaseOpening(db.QueryRow("SELECT"+caseOpeningColumns+" WHERE co.id = $1", id))
+	if err == sql.ErrNoRows {
+		return o, ErrCaseOpeningNotFound
+	}
+	return o, err
+}
+
+func GetUserCaseOpenings(userID, limit, offset int) ([]models.CaseOpening, error) {
+	rows, err := db.Query("SELECT"+caseOpeningColumns+`
+		WHERE co.user_id = $1
+		ORDER BY co.id DESC
+		LIMIT $2 OFFSET $3
+	`, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	openings := []models.CaseOpening{}
+	for rows.Next() {
+		o, err := scanCaseOpening(rows)
+		if err != nil {
+			return nil, err
+		}
+		openings = append(openings, o)
+	}
+	return openings, rows.Err()
+}
+
+// Название и картинка награды по ее типу
+func fillRewardDetails(r *models.CaseReward) error {
+	switch r.Type {
+	case "badge":
+		var title string
+		err := db.QueryRow(`
+		SELECT DISTINCT ON (cr.badge_id) cr.badge_id, b.image, si.title
+		FROM cases_rewards cr
+		JOIN badges b ON cr.badge_id = b.id
+		JOIN shop_items si ON b.id = si.badge_id
+		WHERE cr.id = $1
+		ORDER BY cr.badge_id;
+		`, r.ID).Scan(&r.BadgeID, &r.Image, &title)
+		if err != nil {
+			return err
+		}
+		r.Title = "Значок " + title
+	case "auk":
+		err := db.QueryRow(`
+		SELECT auk_value
+		FROM cases_rewards
+		WHERE id = $1
+		`, r.ID).Scan(&r.AukValue)
+		if err != nil {
+			return err
+		}
+		r.Image = "../static/img/auk.png"
+		r.Title = strconv.Itoa(r.AukValue) + " рублей для аука"
+	case "vip":
+		err := db.QueryRow("SELECT vip_days FROM cases_rewards WHERE id = $1", r.ID).Scan(&r.VIPDays)
+		if err != nil {
+			return err
+		}
+		r.Image = "../static/img/vip.png"
+		r.Title = fmt.Sprintf("Статус VIP в чате на %d дн.", r.VIPDays)
+	}
+	return nil
+}
+
+// Инвентарь со стопками: одинаковые награды собираются в одну с общим количеством
+func GetUserInventory(userID int) ([]models.CaseReward, error) {
+	var result []models.CaseReward
+
+	rows, err := db.Query(`
+		SELECT inv.reward_id, cr.type, inv.quantity, inv.source, COALESCE(u.display_name, ''), inv.acquired_at
+		FROM inventory inv
+		JOIN cases_rewards cr ON cr.id = inv.reward_id
+		LEFT JOIN users u ON u.id = inv.from_user_id
+		WHERE inv.user_id = $1
+		ORDER BY inv.reward_id, inv.acquired_at, inv.id
+	`, userID)
+	if err != nil {
+		log.Println("Не удалось получить инвентарь пользователя: " + err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var rewardType string
+		var batch models.InventoryBatch
+		if err := rows.Scan(&id, &rewardType, &batch.Quantity, &batch.Source, &batch.FromDisplayName, &batch.AcquiredAt); err != nil {
+			return nil, err
+		}
+
+		if len(result) == 0 || result[len(result)-1].ID != id {
+			result = append(result, models.CaseReward{ID: id, Type: rewardType})
+		}
+		item := &result[len(result)-1]
+		item.Quantity += batch.Quantity
+		item.Batches = append(item.Batches, batch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range result {
+		if err := fillRewardDetails(&result[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func ApplyBadge(badgeID, userID int) error {
+	_, err := db.Exec("UPDATE users SET badge_id = $1 WHERE id = $2", badgeID, userID)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func UserHasItem(userID, itemID int) bool {
+	var hasItem int
+	err := db.QueryRow(`
+					SELECT COUNT(*)
+					FROM inventory
+					WHERE user_id = $1 AND reward_id = $2
+					`, userID, itemID).Scan(&hasItem)
+	if err != nil {
+		return false
+	}
+
+	if hasItem > 0 {
+		return true
+	}
+	return false
+}
+
+func ApplyItem(itemID, userID int, lot_name string) error {
+	var item models.CaseReward
+	err := db.QueryRow(`
+					SELECT type, vip_days
+					FROM cases_rewards
+					WHERE id = $1
+					`, itemID).Scan(&item.Type, &item.VIPDays)
+	if err != nil {
+		return err
+	}
+
+	// Проверка на наличие предмета в инвентаре
+	if !UserHasItem(userID, itemID) {
+		return ErrNotInInventory
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	switch item.Type {
+	case "vip":
+		// VIP выдается через Twitch, поэтому задача уходит в outbox
+		if err := extendVIP(tx, userID, item.VIPDays); err != nil {
+			return err
+		}
+	case "auk":
+		_, err = tx.Exec("INSERT INTO auk_submissions (user_id, lot, auk_value) VALUES ($1, $2, (SELECT auk_value FROM cases_rewards WHERE id = $3))", userID, lot_name, itemID)
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	if err := takeInventory(tx, userID, itemID, 1); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Подарки и обмен предметами
+
+const (
+	maxTradeMessageLength = 200
+	maxTradeItems         = 10
+)
+
+// Забирает quantity штук награды из инвентаря, начиная с самых старых партий
+func takeInventory(tx *sql.Tx, userID, rewardID, quantity int) error {
+	rows, err := tx.Query(`
+		SELECT id, quantity FROM inventory
+		WHERE user_id = $1 AND reward_id = $2
+		ORDER BY acquired_at, id
+		FOR UPDATE
+	`, userID, rewardID)
+	if err != nil {
+		return err
+	}
+
+	type batch struct{ id, quantity int }
+	var batches []batch
+	total := 0
+	for rows.Next() {
+		var b batch
+		if err := rows.Scan(&b.id, &b.quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		batches = append(batches, b)
+		total += b.quantity
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if total < quantity {
+		return ErrNotInInventory
+	}
+
+	for _, b := range batches {
+		if quantity == 0 {
+			break
+		}
+		if b.quantity <= quantity {
+			_, err = tx.Exec("DELETE FROM inventory WHERE id = $1", b.id)
+			quantity -= b.quantity
+		} else {
+			_, err = tx.Exec("UPDATE inventory SET quantity = quantity - $1 WHERE id = $2", quantity, b.id)
+			quantity = 0
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Передает предметы между пользователями и пишет это в историю
+func transferInventory(tx *sql.Tx, kind string, fromUserID, toUserID, rewardID, quantity, offerID int) error {
+	if err := takeInventory(tx, fromUserID, rewardID, quantity); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO inventory (user_id, reward_id, quantity, source, from_user_id)
+		VALUES ($1, $2, $3, $4, $5)
+	`, toUserID, rewardID, quantity, kind, fromUserID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO inventory_transfers (kind, reward_id, quantity, from_user_id, to_user_id, trade_offer_id)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0))
+	`, kind, rewardID, quantity, fromUserID, toUserID, offerID)
+	return err
+}
+
+// Блокирует обоих участников в порядке ID, чтобы встречные обмены не зацикливались,
+// и проверяет баны
+func lockTradeUsers(tx *sql.Tx, userID, otherID int) error {
+	rows, err := tx.Query("SELECT id, is_banned FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE", userID, otherID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	found := 0
+	for rows.Next() {
+		var id int
+		var banned bool
+		if err := rows.Scan(&id, &banned); err != nil {
+			return err
+		}
+		found++
+		if banned && id == userID {
+			return ErrUserBanned
+		}
+		if banned {
+			return ErrRecipientBanned
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if found < 2 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Получатель подарка или обмена по логину
+func tradePartner(userID int, login string) (*models.User, error) {
+	partner, err := GetUserByUsername(login)
+	if err != nil {
+		return nil, err
+	}
+	if partner.ID == userID {
+		return nil, &ValidationError{Field: "login", Message: "you can't trade with yourself"}
+	}
+	return partner, nil
+}
+
+func GiftItem(userID int, login string, rewardID, quantity int) error {
+	if quantity < 1 {
+		return &ValidationError{Field: "quantity", Message: "quantity must be positive"}
+	}
+	partner, err := tradePartner(userID, login)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockTradeUsers(tx, userID, partner.ID); err != nil {
+		return err
+	}
+	if err := transferInventory(tx, "gift", userID, partner.ID, rewardID, quantity, 0); err != nil {
+		return err
+	}
+
+	notificationID, err := insertNotification(tx, partner.ID, userID, 0, "gift", nil)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	publishNotification(partner.ID, notificationID)
+	return nil
+}
+
+// Складывает одинаковые награды и проверяет количество
+func normalizeTradeItems(items []models.TradeItem, field string) ([]models.TradeItem, error) {
+	var result []models.TradeItem
+	index := map[int]int{}
+	for _, item := range items {
+		if item.Quantity < 1 {
+			return nil, &ValidationError{Field: field, Message: "quantity must be positive"}
+		}
+		if i, ok := index[item.RewardID]; ok {
+			result[i].Quantity += item.Quantity
+			continue
+		}
+		index[item.RewardID] = len(result)
+		result = append(result, models.TradeItem{RewardID: item.RewardID, Quantity: item.Quantity})
+	}
+	if len(result) > maxTradeItems {
+		return nil, &ValidationError{Field: field, Message: fmt.Sprintf("no more than %d items", maxTradeItems)}
+	}
+	return result, nil
+}
+
+func inventoryQuantity(q queryRower, userID, rewardID int) (int, error) {
+	var quantity int
+	err := q.QueryRow("SELECT COALESCE(SUM(quantity), 0) FROM inventory WHERE user_id = $1 AND reward_id = $2", userID, rewardID).Scan(&quantity)
+	return quantity, err
+}
+
+func CreateTradeOffer(userID int, login string, give, want []models.TradeItem, message string) (int, error) {
+	message = strings.TrimSpace(message)
+	if len([]rune(message)) > maxTradeMessageLength {
+		return 0, &ValidationError{Field: "message", Message: "message is too long"}
+	}
+	give, err := normalizeTradeItems(give, "give")
+	if err != nil {
+		return 0, err
+	}
+	want, err = normalizeTradeItems(want, "want")
+	if err != nil {
+		return 0, err
+	}
+	if len(give)+len(want) == 0 {
+		return 0, &ValidationError{Field: "give", Message: "offer is empty"}
+	}
+
+	partner, err := tradePartner(userID, login)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := lockTradeUsers(tx, userID, partner.ID); err != nil {
+		return 0, err
+	}
+
+	// Отдавать можно только то, что есть сейчас. При принятии это проверяется еще раз
+	for _, item := range give {
+		quantity, err := inventoryQuantity(tx, userID, item.RewardID)
+		if err != nil {
+			return 0, err
+		}
+		if quantity < item.Quantity {
+			return 0, ErrNotInInventory
+		}
+	}
+
+	var offerID int
+	err = tx.QueryRow(`
+		INSERT INTO trade_offers (from_user_id, to_user_id, message)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, userID, partner.ID, message).Scan(&offerID)
+	if err != nil {
+		return 0, err
+	}
+
+	for side, items := range map[int][]models.TradeItem{userID: give, partner.ID: want} {
+		for _, item := range items {
+			_, err = tx.Exec(`
+				INSERT INTO trade_offer_items (offer_id, user_id, reward_id, quantity)
+				VALUES ($1, $2, $3, $4)
+			`, offerID, side, item.RewardID, item.Quantity)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	notificationID, err := insertNotification(tx, partner.ID, userID, 0, "trade", map[string]string{"context": "offer"})
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	publishNotification(partner.ID, notificationID)
+	return offerID, nil
+}
+
+// Принять или отклонить может получатель, отменить - отправитель
+func ResolveTradeOffer(userID, offerID int, action string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var fromUserID, toUserID int
+	err = tx.QueryRow(`
+		SELECT from_user_id, to_user_id FROM trade_offers
+		WHERE id = $1 AND status = 'pending' AND $2 IN (from_user_id, to_user_id)
+		FOR UPDATE
+	`, offerID, userID).Scan(&fromUserID, &toUserID)
+	if err == sql.ErrNoRows {
+		return ErrTradeOfferNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var status string
+	switch {
+	case action == "accept" && userID == toUserID:
+		status = "accepted"
+	case action == "decline" && userID == toUserID:
+		status = "declined"
+	case action == "cancel" && userID == fromUserID:
+		status = "cancelled"
+	default:
+		return ErrTradeOfferNotFound
+	}
+
+	if status == "accepted" {
+		if err := lockTradeUsers(tx, toUserID, fromUserID); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query("SELECT user_id, reward_id, quantity FROM trade_offer_items WHERE offer_id = $1", offerID)
+		if err != nil {
+			return err
+		}
+		var items []struct{ userID, rewardID, quantity int }
+		for rows.Next() {
+			var item struct{ userID, rewardID, quantity int }
+			if err := rows.Scan(&item.userID, &item.rewardID, &item.quantity); err != nil {
+				rows.Close()
+				return err
+			}
+			items = append(items, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			receiver := toUserID
+			if item.userID == toUserID {
+				receiver = fromUserID
+			}
+			err := transferInventory(tx, "trade", item.userID, receiver, item.rewardID, item.quantity, offerID)
+			if errors.Is(err, ErrNotInInventory) {
+				return ErrTradeItemsMissing
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec("UPDATE trade_offers SET status = $1, resolved_at = NOW() WHERE id = $2", status, offerID)
+	if err != nil {
+		return err
+	}
+
+	// Отправителю сообщаем о решении получателя
+	notificationID := 0
+	if status != "cancelled" {
+		notificationID, err = insertNotification(tx, fromUserID, toUserID, 0, "trade", map[string]string{"context": status})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if notificationID != 0 {
+		publishNotification(fromUserID, notificationID)
+	}
+	return nil
+}
+
+// Входящие и исходящие предложения, сначала ожидающие ответа
+func GetTradeOffers(userID int) ([]models.TradeOffer, error) {
+	rows, err := db.Query(`
+		SELECT o.id, o.to_user_id = $1, f.display_name, f.profile_image_url, t.display_name, t.profile_image_url,
+			o.status, o.message, o.created_at, o.resolved_at
+		FROM trade_offers o
+		JOIN users f ON f.id = o.from_user_id
+		JOIN users t ON t.id = o.to_user_id
+		WHERE $1 IN (o.from_user_id, o.to_user_id)
+		ORDER BY o.status <> 'pending', o.id DESC
+		LIMIT 50
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	offers := []models.TradeOffer{}
+	index := map[int]int{}
+	for rows.Next() {
+		var o models.TradeOffer
+		if err := rows.Scan(&o.ID, &o.Incoming, &o.FromDisplayName, &o.FromImage, &o.ToDisplayName, &o.ToImage,
+			&o.Status, &o.Message, &o.CreatedAt, &o.ResolvedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		o.Give, o.Want = []models.TradeItem{}, []models.TradeItem{}
+		index[o.ID] = len(offers)
+		offers = append(offers, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(offers) == 0 {
+		return offers, nil
+	}
+
+	ids := make([]int64, 0, len(offers))
+	for _, o := range offers {
+		ids = append(ids, int64(o.ID))
+	}
+	items, err := db.Query(`
+		SELECT i.offer_id, i.user_id = o.from_user_id, i.reward_id, cr.type, i.quantity
+		FROM trade_offer_items i
+		JOIN trade_offers o ON o.id = i.offer_id
+		JOIN cases_rewards cr ON cr.id = i.reward_id
+		WHERE i.offer_id = ANY($1)
+		ORDER BY i.reward_id
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer items.Close()
+
+	for items.Next() {
+		var offerID int
+		var fromSender bool
+		reward := models.CaseReward{}
+		var quantity int
+		if err := items.Scan(&offerID, &fromSender, &reward.ID, &reward.Type, &quantity); err != nil {
+			return nil, err
+		}
+		if err := fillRewardDetails(&reward); err != nil {
+			return nil, err
+		}
+
+		item := models.TradeItem{RewardID: reward.ID, Quantity: quantity, Title: reward.Title, Image: reward.Image}
+		o := &offers[index[offerID]]
+		if fromSender {
+			o.Give = append(o.Give, item)
+		} else {
+			o.Want = append(o.Want, item)
+		}
+	}
+	return offers, items.Err()
+}
+
+// История подарков и обменов пользователя
+func GetInventoryTransfers(userID, limit, offset int) ([]models.InventoryTransfer, error) {
+	rows, err := db.Query(`
+		SELECT t.id, t.kind, t.to_user_id = $1, t.reward_id, cr.type, t.quantity,
+			f.display_name, r.display_name, COALESCE(t.trade_offer_id, 0), t.created_at
+		FROM inventory_transfers t
+		JOIN cases_rewards cr ON cr.id = t.reward_id
+		JOIN users f ON f.id = t.from_user_id
+		JOIN users r ON r.id = t.to_user_id
+		WHERE $1 IN (t.from_user_id, t.to_user_id)
+		ORDER BY t.id DESC
+		LIMIT $2 OFFSET $3
+	`, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []models.InventoryTransfer{}
+	for rows.Next() {
+		var t models.InventoryTransfer
+		reward := models.CaseReward{}
+		if err := rows.Scan(&t.ID, &t.Kind, &t.Incoming, &reward.ID, &reward.Type, &t.Quantity,
+			&t.FromDisplayName, &t.ToDisplayName, &t.TradeOfferID, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := fillRewardDetails(&reward); err != nil {
+			return nil, err
+		}
+		t.RewardID, t.Title, t.Image = reward.ID, reward.Title, reward.Image
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
+
+// Продажа предметов обратно за рейтинг
+
+var resaleTypes = []string{"badge", "vip", "auk"}
+
+// Цены выкупа по типам наград. Для типов без цены Value = 0
+func GetResaleValues() ([]models.ResaleValue, error) {
+	values := map[string]int{}
+	rows, err := db.Query("SELECT reward_type, value FROM resale_values")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rewardType string
+		var value int
+		if err := rows.Scan(&rewardType, &value); err != nil {
+			return nil, err
+		}
+		values[rewardType] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]models.ResaleValue, 0, len(resaleTypes))
+	for _, rewardType := range resaleTypes {
+		result = append(result, models.ResaleValue{Type: rewardType, Value: values[rewardType]})
+	}
+	return result, nil
+}
+
+func SetResaleValue(rewardType string, value int) error {
+	if !slices.Contains(resaleTypes, rewardType) {
+		return &ValidationError{Field: "type", Message: "unknown reward type"}
+	}
+	if value < 0 {
+		return &ValidationError{Field: "value", Message: "value must not be negative"}
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO resale_values (reward_type, value) VALUES ($1, $2)
+		ON CONFLICT (reward_type) DO UPDATE SET value = EXCLUDED.value
+	`, rewardType, value)
+	return err
+}
+
+// Забирает предметы и начисляет рейтинг по текущей цене выкупа
+func sellInventory(tx *sql.Tx, userID, rewardID, quantity int) (int, error) {
+	var price int
+	err := tx.QueryRow(`
+		SELECT COALESCE(rv.value, 0)
+		FROM cases_rewards cr
+		LEFT JOIN resale_values rv ON rv.reward_type = cr.type
+		WHERE cr.id = $1
+	`, rewardID).Scan(&price)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotInInventory
+	}
+	if err != nil {
+		return 0, err
+	}
+	if price == 0 {
+		return 0, ErrNotSellable
+	}
+
+	if err := takeInventory(tx, userID, rewardID, quantity); err != nil {
+		return 0, err
+	}
+	return price * quantity, nil
+}
+
+func creditRating(tx *sql.Tx, userID, amount int) (int, error) {
+	var rating int
+	err := tx.QueryRow("UPDATE users SET rating = rating + $1 WHERE id = $2 RETURNING rating", amount, userID).Scan(&rating)
+	return rating, err
+}
+
+func SellItem(userID, rewardID, quantity int) (models.RecycleResult, error) {
+	result := models.RecycleResult{}
+	if quantity < 1 {
+		return result, &ValidationError{Field: "quantity", Message: "quantity must be positive"}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	credited, err := sellInventory(tx, userID, rewardID, quantity)
+	if err != nil {
+		return result, err
+	}
+	rating, err := creditRating(tx, userID, credited)
+	if err != nil {
+		return result, err
+	}
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+
+	return models.RecycleResult{Sold: quantity, Credited: credited, Rating: rating}, nil
+}
+
+// Продает все лишние копии значков, оставляя по одной.
+// Дубликатами считаются только значки: ApplyBadge лишь выставляет users.badge_id, и вторая
+// копия ничего не дает. VIP и аук расходуются при применении, каждая копия - отдельный срок
+// или отдельная заявка, поэтому их лишними не считаем
+func RecycleDuplicates(userID int) (models.RecycleResult, error) {
+	result := models.RecycleResult{}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	// Сначала блокируем строки инвентаря, потом считаем: иначе параллельная продажа
+	// или обмен успеют забрать копии между подсчетом и продажей.
+	// FOR UPDATE нельзя совместить с GROUP BY, поэтому суммируем здесь
+	rows, err := tx.Query(`
+		SELECT i.reward_id, i.quantity
+		FROM inventory i
+		JOIN cases_rewards cr ON cr.id = i.reward_id
+		WHERE i.user_id = $1 AND cr.type = 'badge'
+		ORDER BY i.reward_id, i.id
+		FOR UPDATE OF i
+	`, userID)
+	if err != nil {
+		return result, err
+	}
+	var rewardIDs []int
+	owned := map[int]int{}
+	for rows.Next() {
+		var rewardID, quantity int
+		if err := rows.Scan(&rewardID, &quantity); err != nil {
+			rows.Close()
+			return result, err
+		}
+		if _, ok := owned[rewardID]; !ok {
+			rewardIDs = append(rewardIDs, rewardID)
+		}
+		owned[rewardID] += quantity
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for _, rewardID := range rewardIDs {
+		quantity := owned[rewardID] - 1
+		if quantity < 1 {
+			continue
+		}
+		credited, err := sellInventory(tx, userID, rewardID, quantity)
+		if errors.Is(err, ErrNotSellable) {
+			// Без цены выкупа копии остаются в инвентаре, остальное продаем
+			result.Skipped = append(result.Skipped, models.RecycleSkipped{RewardID: rewardID, Quantity: quantity})
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Sold += quantity
+		result.Credited += credited
+	}
+	if result.Sold == 0 {
+		return result, nil
+	}
+
+	if result.Rating, err = creditRating(tx, userID, result.Credited); err != nil {
+		return result, err
+	}
+	return result, tx.Commit()
+}
+
+func GetQueue() ([]models.AukSubmission, error) {
+	var result []models.AukSubmission
+
+	files, err := db.Query(`
+			SELECT auk_submissions.id, users.display_name, users.profile_image_url, auk_submissions.auk_value, auk_submissions.lot
+			FROM auk_submissions, users
+			WHERE auk_submissions.user_id = users.id AND auk_submissions.done = FALSE;
+		`)
+	if err == nil {
+		defer files.Close()
+		for files.Next() {
+			var s models.AukSubmission
+			if err := files.Scan(&s.ID, &s.DisplayName, &s.ProfileImageURL, &s.AukValue, &s.Submission); err == nil {
+				result = append(result, s)
+			}
+		}
+	} else {
+		log.Println("Getting queue error: " + err.Error())
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func DeleteSubmission(submissionID int) error {
+	_, err := db.Exec("UPDATE auk_submissions SET done = TRUE WHERE id = $1", submissionID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func LoadChannelsToCheck() []string {
+	var result []string
+
+	channels, err := db.Query(`
+			SELECT login FROM live_channels
+		`)
+	if err == nil {
+		defer channels.Close()
+		for channels.Next() {
+			var s string
+			if err := channels.Scan(&s); err == nil {
+				result = append(result, strings.ToLower(s))
+			}
+		}
+	} else {
+		log.Println("Getting channels error: " + err.Error())
+		return nil
+	}
+
+	log.Println("Channels loaded: " + strconv.Itoa(len(result)))
+
+	return result
+}
+
+func GetLeaderboard() ([]models.User, error) {
+	var result []models.User
+
+	channels, err := db.Query(`
+			SELECT display_name, profile_image_url, followers FROM users ORDER BY followers DESC LIMIT 5;
+		`)
+	if err == nil {
+		defer channels.Close()
+		for channels.Next() {
+			var s models.User
+			if err := channels.Scan(&s.DisplayName, &s.ProfileImageURL, &s.Followers); err == nil {
+				result = append(result, s)
+			}
+		}
+	} else {
+		log.Println("Getting channels error: " + err.Error())
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func LoadMessagesHistory(limit int) ([]models.MessageWithAuthor, error) {
+	var result []models.MessageWithAuthor
+
+	messages, err := db.Query(`
+			SELECT 
+				m.id,
+				CASE 
+					WHEN m.is_anonymous THEN 'Аноним'
+					ELSE u.display_name 
+				END AS display_name,
+				b.image AS badge_url,
+				m.content,
+				m.sent_at,
+				CASE WHEN m.is_anonymous THEN 0 ELSE COALESCE(m.user_id, 0) END
+			FROM messages m
+			LEFT JOIN users u ON m.user_id = u.id
+			LEFT JOIN badges b ON COALESCE(m.badge_id, u.badge_id) = b.id
+			LEFT JOIN messages_files mf ON m.id = mf.message_id
+			GROUP BY m.id, u.display_name, m.is_anonymous, b.image
+			ORDER BY m.id
+			LIMIT $1;
+		`, limit)
+	if err == nil {
+		defer messages.Close()
+		for messages.Next() {
+			var m models.MessageWithAuthor
+			var authorID int
+			if err := messages.Scan(&m.ID, &m.DisplayName, &m.BadgeURL, &m.Content, &m.Sent, &authorID); err == nil {
+				files, _ := getFilesURLs(m.ID)
+				m.FilesURL = files
+				// У анонимных сообщений эмоуты не показываются: по ним можно узнать автора
+				if authorID != 0 {
+					m.Emotes, _ = messageEmotes(authorID, m.Content)
+				}
+				result = append(result, m)
+			} else {
+				log.Println(err.Error())
+			}
+		}
+	} else {
+		log.Println("Getting messages error: " + err.Error())
+		return nil, err
+	}
+
+	return result, nil
+}
+
+var emoteInMessagePattern = regexp.MustCompile(`:([a-zA-Z0-9_]{2,25}):`)
+
+// Эмоуты из текста сообщения, которые есть у автора. Код без эмоута остается текстом
+func messageEmotes(userID int, content string) (map[string]string, error) {
+	var codes []string
+	for _, match := range emoteInMessagePattern.FindAllStringSubmatch(content, -1) {
+		codes = append(codes, match[1])
+	}
+	if len(codes) == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT si.params->>'code', si.image
+		FROM users_items ui
+		JOIN shop_items si ON si.id = ui.item_id
+		WHERE ui.user_id = $1 AND si.type = 'emote' AND si.params->>'code' = ANY($2)
+	`, userID, pq.Array(codes))
+	if err != nil {
+		log.Println("Не удалось получить эмоуты пользователя: " + err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	emotes := map[string]string{}
+	for rows.Next() {
+		var code, image string
+		if err := rows.Scan(&code, &image); err != nil {
+			return nil, err
+		}
+		emotes[code] = image
+	}
+	return emotes, rows.Err()
+}
+
+func getFilesURLs(messageID int) ([]string, error) {
+	var result []string
+
+	files, err := db.Query(`
+			SELECT file_name FROM messages_files WHERE message_id = $1;
+		`, messageID)
+	if err == nil {
+		defer files.Close()
+		for files.Next() {
+			var s string
+			if err := files.Scan(&s); err == nil {
+				result = append(result, s)
+			}
+		}
+	} else {
+		log.Println("Getting  message files error: " + err.Error())
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func SaveMessage(userID, badgeID int, message string) (int, error) {
+	var lastSimilarMessage string
+	var lastMessageTime time.Time
+
+	err := db.QueryRow(`
+        SELECT content, sent_at 
+        FROM messages 
+        WHERE user_id = $1 AND content = $2 
+        ORDER BY sent_at DESC 
+        LIMIT 1
+    `, userID, message).Scan(&lastSimilarMessage, &lastMessageTime)
+	if err == nil {
+		// Сообщение найдено
+		if time.Since(lastMessageTime) < 30*time.Second {
+			return -1, ErrDuplicateMessage
+		}
+	}
+
+	var messageID int
+	err = db.QueryRow(
+		"INSERT INTO messages (user_id, badge_id, content) VALUES ($1, $2, $3) RETURNING id",
+		userID, badgeID, message,
+	).Scan(&messageID)
+	if err != nil {
+		return messageID, err
+	}
+
+	if err := notifyChatMentions(userID, message); err != nil {
+		log.Println("Не удалось отправить уведомления об упоминаниях: " + err.Error())
+	}
+	return messageID, nil
+}
+
+func ClipFile(messageID int, fileName string) error {
+	_, err := db.Exec(
+		"INSERT INTO messages_files (message_id, file_name) VALUES ($1, $2)",
+		messageID, fileName,
+	)
+	return err
+}
+
+// Аналитика
+
+// Снимает текущие счетчики постов и подписчиков в дневные срезы.
+// Срез за сегодня перезаписывается при каждом запуске, поэтому к концу дня
+// в таблице остаются итоговые значения.
+func RollupDailyStats() error {
+	_, err := db.Exec(`
+		INSERT INTO post_stats_daily (file_id, day, views, likes, fucks, comments)
+		SELECT f.id, CURRENT_DATE, f.views, f.likes, f.fucks,
+			(SELECT COUNT(*) FROM comments c WHERE c.file_id = f.id AND c.is_deleted = FALSE)
+		FROM files f
+		ON CONFLICT (file_id, day) DO UPDATE SET
+			views = EXCLUDED.views,
+			likes = EXCLUDED.likes,
+			fucks = EXCLUDED.fucks,
+			comments = EXCLUDED.comments
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO user_stats_daily (user_id, day, followers)
+		SELECT id, CURRENT_DATE, followers
+		FROM users
+		ON CONFLICT (user_id, day) DO UPDATE SET
+			followers = EXCLUDED.followers
+	`)
+	return err
+}
+
+func IsAnalyticsPeriod(days int) bool {
+	return days == 7 || days == 30 || days == 90
+}
+
+// Возвращает аналитику автора за последние days дней. Если postID не 0,
+// ряды считаются только по одному посту.
+func GetAnalytics(userID, postID, days int) (models.Analytics, error) {
+	result := models.Analytics{
+		Days:     days,
+		PostID:   postID,
+		Series:   []models.AnalyticsPoint{},
+		TopPosts: []models.AnalyticsPost{},
+	}
+
+	// Срезы пишутся с CURRENT_DATE базы, поэтому и "сегодня" берем оттуда:
+	// часовой пояс процесса может не совпадать с часовым поясом сессии
+	var today time.Time
+	if err := db.QueryRow("SELECT CURRENT_DATE").Scan(&today); err != nil {
+		return result, err
+	}
+	start := today.AddDate(0, 0, -(days - 1))
+	baseKey := start.AddDate(0, 0, -1).Format("2006-01-02")
+
+	// Дневные срезы начиная с дня перед периодом, чтобы было от чего считать прирост
+	snapshots := map[string]models.AnalyticsPoint{}
+	rows, err := db.Query(`
+		SELECT s.day, SUM(s.views), SUM(s.likes), SUM(s.fucks), SUM(s.comments)
+		FROM post_stats_daily s
+		JOIN files f ON f.id = s.file_id
+		WHERE f.user_id = $1 AND ($2 = 0 OR s.file_id = $2) AND s.day >= $3::date
+		GROUP BY s.day
+	`, userID, postID, baseKey)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day time.Time
+		var p models.AnalyticsPoint
+		if err := rows.Scan(&day, &p.Views, &p.Likes, &p.Fucks, &p.Comments); err != nil {
+			return result, err
+		}
+		snapshots[day.Format("2006-01-02")] = p
+	}
+
+	followers := map[string]int64{}
+	if postID == 0 {
+		frows, err := db.Query(`
+			SELECT day, followers FROM user_stats_daily
+			WHERE user_id = $1 AND day >= $2::date
+		`, userID, baseKey)
+		if err != nil {
+			return result, err
+		}
+		defer frows.Close()
+
+		for frows.Next() {
+			var day time.Time
+			var count int64
+			if err := frows.Scan(&day, &count); err != nil {
+				return result, err
+			}
+			followers[day.Format("2006-01-02")] = count
+		}
+	}
+
+	// Переводим накопительные срезы в дневной прирост
+	prev, hasPrev := snapshots[baseKey]
+	prevFollowers, hasPrevFollowers := followers[baseKey]
+	for day := start; !day.After(today); day = day.AddDate(0, 0, 1) {
+		key := day.Format("2006-01-02")
+		point := models.AnalyticsPoint{Day: key}
+
+		if cur, ok := snapshots[key]; ok {
+			if hasPrev {
+				point.Views = max(cur.Views-prev.Views, 0)
+				point.Likes = max(cur.Likes-prev.Likes, 0)
+				point.Fucks = max(cur.Fucks-prev.Fucks, 0)
+				point.Comments = max(cur.Comments-prev.Comments, 0)
+			}
+			prev, hasPrev = cur, true
+		}
+
+		if cur, ok := followers[key]; ok {
+			if hasPrevFollowers {
+				point.Followers = max(cur-prevFollowers, 0)
+			}
+			prevFollowers, hasPrevFollowers = cur, true
+		}
+
+		result.Totals.Views += point.Views
+		result.Totals.Likes += point.Likes
+		result.Totals.Fucks += point.Fucks
+		result.Totals.Comments += point.Comments
+		result.Totals.Followers += point.Followers
+		result.Series = append(result.Series, point)
+	}
+
+	// Лучшие посты за период по приросту просмотров
+	posts, err := db.Query(`
+		SELECT f.id, COALESCE(f.title, ''), COALESCE(f.thumbnail, ''), f.file_name, f.type,
+			cur.views - COALESCE(base.views, 0),
+			cur.likes - COALESCE(base.likes, 0),
+			cur.fucks - COALESCE(base.fucks, 0),
+			cur.comments - COALESCE(base.comments, 0)
+		FROM files f
+		JOIN LATERAL (
+			SELECT views, likes, fucks, comments FROM post_stats_daily
+			WHERE file_id = f.id
+			ORDER BY day DESC LIMIT 1
+		) cur ON true
+		LEFT JOIN LATERAL (
+			SELECT views, likes, fucks, comments FROM post_stats_daily
+			WHERE file_id = f.id AND day < $2::date
+			ORDER BY day DESC LIMIT 1
+		) base ON true
+		WHERE f.user_id = $1 AND ($3 = 0 OR f.id = $3)
+		ORDER BY 6 DESC, 7 DESC
+		LIMIT 10
+	`, userID, start.Format("2006-01-02"), postID)
+	if err != nil {
+		return result, err
+	}
+	defer posts.Close()
+
+	for posts.Next() {
+		var p models.AnalyticsPost
+		err := posts.Scan(&p.ID, &p.Title, &p.Thumbnail, &p.FileName, &p.Type, &p.Views, &p.Likes, &p.Fucks, &p.Comments)
+		if err != nil {
+			return result, err
+		}
+		result.TopPosts = append(result.TopPosts, p)
+	}
+
+	return result, nil
+}
+
+func GetPostAuthorID(postID int) (int, error) {
+	var authorID int
+	err := db.QueryRow("SELECT user_id FROM files WHERE id = $1", postID).Scan(&authorID)
+	return authorID, err
+}
+
+// Коллекции
+
+const collectionColumns = `
+	c.id, c.user_id, u.display_name, c.title, c.description, c.is_public, c.followers, c.created_at,
+	(SELECT COUNT(*) FROM collections_posts cp WHERE cp.collection_id = c.id),
+	COALESCE(cover.thumbnail, ''), COALESCE(cover.file_name, ''), COALESCE(cover.type, ''),
+	EXISTS(SELECT 1 FROM collections_follows cf WHERE cf.collection_id = c.id AND cf.user_id = $1)
+	FROM collections c
+	JOIN users u ON u.id = c.user_id
+	LEFT JOIN LATERAL (
+		SELECT f.thumbnail, f.file_name, f.type
+		FROM collections_posts cp
+		JOIN files f ON f.id = cp.file_id
+		WHERE cp.collection_id = c.id AND f.is_public = true
+		ORDER BY cp.position
+		LIMIT 1
+	) cover ON true
+`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanCollection(row rowScanner, viewerID int, extra ...any) (models.Collection, error) {
+	var c models.Collection
+	var thumbnail, fileName, fileType string
+	dest := []any{
+		&c.ID, &c.UserID, &c.AuthorName, &c.Title, &c.Description, &c.IsPublic, &c.Followers, &c.CreatedAt,
+		&c.PostsCount, &thumbnail, &fileName, &fileType, &c.IsFollowing,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return c, err
+	}
+
+	c.Cover = PostPreviewURL(thumbnail, fileName, fileType)
+	c.IsOwner = c.UserID == viewerID
+	return c, nil
+}
+
+// Возвращает ссылку на превью поста для карточек
+func PostPreviewURL(thumbnail, fileName, fileType string) string {
+	switch {
+	case fileType == "clip":
+		return thumbnail
+	case thumbnail != "":
+		return "../static/uploads/" + thumbnail
+	case fileName != "":
+		return "../static/uploads/" + fileName
+	default:
+		return ""
+	}
+}
+
+func CreateCollection(collection *models.Collection) (int, error) {
+	title, err := FilterBadWords(collection.Title)
+	if err != nil {
+		return -1, err
+	}
+	description, err := FilterBadWords(collection.Description)
+	if err != nil {
+		return -1, err
+	}
+
+	var id int
+	err = db.QueryRow(`
+		INSERT INTO collections (user_id, title, description, is_public)
+		VALUES ($1, $2, $3, $4) RETURNING id
+	`, collection.UserID, title, description, collection.IsPublic).Scan(&id)
+	return id, err
+}
+
+func UpdateCollection(collection *models.Collection) error {
+	title, err := FilterBadWords(collection.Title)
+	if err != nil {
+		return err
+	}
+	description, err := FilterBadWords(collection.Description)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		UPDATE collections
+		SET title = $1, description = $2, is_public = $3
+		WHERE id = $4
+	`, title, description, collection.IsPublic, collection.ID)
+	return err
+}
+
+func DeleteCollection(collectionID int) error {
+	_, err := db.Exec("DELETE FROM collections WHERE id = $1", collectionID)
+	return err
+}
+
+func IsCollectionOwner(userID, collectionID int) bool {
+	var ownerID int
+	err := db.QueryRow("SELECT user_id FROM collections WHERE id = $1", collectionID).Scan(&ownerID)
+	return err == nil && ownerID == userID
+}
+
+// Возвращает коллекцию вместе с постами. Приватные коллекции видит только владелец.
+func GetCollection(collectionID, viewerID int) (*models.CollectionWithPosts, error) {
+	collection, err := scanCollection(db.QueryRow(`SELECT `+collectionColumns+` WHERE c.id = $2`, viewerID, collectionID), viewerID)
+	if err != nil {
+		return nil, ErrCollectionNotFound
+	}
+
+	if !collection.IsPublic && !collection.IsOwner {
+		return nil, ErrCollectionNotFound
+	}
+
+	rows, err := db.Query(`
+		SELECT f.id, COALESCE(f.title, ''), COALESCE(f.thumbnail, ''), f.file_name, f.type, u.display_name, cp.position
+		FROM collections_posts cp
+		JOIN files f ON f.id = cp.file_id
+		JOIN users u ON u.id = f.user_id
+		WHERE cp.collection_id = $1 AND f.is_public = true
+		ORDER BY cp.position, cp.added_at
+	`, collectionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := models.CollectionWithPosts{
+		Collection: collection,
+		Posts:      []models.CollectionPost{},
+	}
+	for rows.Next() {
+		var p models.CollectionPost
+		if err := rows.Scan(&p.ID, &p.Title, &p.Thumbnail, &p.FileName, &p.Type, &p.AuthorName, &p.Position); err != nil {
+			return nil, err
+		}
+		p.IsVideo = IsVideoFile(p.FileName)
+		p.Thumbnail = PostPreviewURL(p.Thumbnail, p.FileName, p.Type)
+		result.Posts = append(result.Posts, p)
+	}
+
+	return &result, nil
+}
+
+// Возвращает коллекции пользователя. Если postID не 0, отмечает коллекции, в которых уже есть этот пост.
+func GetUserCollections(userID, viewerID, postID int) ([]models.Collection, error) {
+	rows, err := db.Query(`
+		SELECT `+collectionColumns+`, EXISTS(SELECT 1 FROM collections_posts cp WHERE cp.collection_id = c.id AND cp.file_id = $3)
+		WHERE c.user_id = $2 AND (c.is_public = true OR c.user_id = $1)
+		ORDER BY c.created_at DESC
+	`, viewerID, userID, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []models.Collection{}
+	for rows.Next() {
+		var contains bool
+		c, err := scanCollection(rows, viewerID, &contains)
+		if err != nil {
+			return nil, err
+		}
+		c.Contains = contains
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+func GetFollowedCollections(userID int) ([]models.Collection, error) {
+	rows, err := db.Query(`
+		SELECT `+collectionColumns+`
+		JOIN collections_follows cfl ON cfl.collection_id = c.id
+		WHERE cfl.user_id = $1 AND (c.is_public = true OR c.user_id = $1)
+		ORDER BY c.created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []models.Collection{}
+	for rows.Next() {
+		c, err := scanCollection(rows, userID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+func AddPostToCollection(collectionID, postID int) error {
+	_, err := db.Exec(`
+		INSERT INTO collections_posts (collection_id, file_id, position)
+		VALUES ($1, $2, (SELECT COALESCE(MAX(position), 0) + 1 FROM collections_posts WHERE collection_id = $1))
+		ON CONFLICT (collection_id, file_id) DO NOTHING
+	`, collectionID, postID)
+	return err
+}
+
+func RemovePostFromCollection(collectionID, postID int) error {
+	_, err := db.Exec("DELETE FROM collections_posts WHERE collection_id = $1 AND file_id = $2", collectionID, postID)
+	return err
+}
+
+// Переставляет посты коллекции в порядке postIDs
+func ReorderCollection(collectionID int, postIDs []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, postID := range postIDs {
+		_, err = tx.Exec(`
+			UPDATE collections_posts SET position = $1
+			WHERE collection_id = $2 AND file_id = $3
+		`, i+1, collectionID, postID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func FollowCollection(userID, collectionID int) error {
+	var isPublic bool
+	var ownerID int
+	err := db.QueryRow("SELECT is_public, user_id FROM collections WHERE id = $1", collectionID).Scan(&isPublic, &ownerID)
+	if err != nil {
+		return err
+	}
+	if !isPublic && ownerID != userID {
+		return ErrCollectionNotFound
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO collections_follows (user_id, collection_id) VALUES ($1, $2)
+		ON CONFLICT (user_id, collection_id) DO NOTHING
+	`, userID, collectionID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE collections SET followers = (SELECT COUNT(*) FROM collections_follows WHERE collection_id = $1) WHERE id = $1", collectionID)
+	return err
+}
+
+func UnfollowCollection(userID, collectionID int) error {
+	_, err := db.Exec("DELETE FROM collections_follows WHERE user_id = $1 AND collection_id = $2", userID, collectionID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE collections SET followers = (SELECT COUNT(*) FROM collections_follows WHERE collection_id = $1) WHERE id = $1", collectionID)
+	return err
+}
+
+// Закладки и "Смотреть позже"
+const savedPostColumns = `f.id, COALESCE(f.title, ''), COALESCE(f.thumbnail, ''), f.file_name, f.type, u.display_name`
+
+// Условие фильтра по типу контента, $2 - тип (all, image, video, clip)
+const savedPostTypeFilter = `
+	AND ($2 = 'all'
+		OR ($2 = 'clip' AND f.type = 'clip')
+		OR ($2 = 'video' AND f.type = 'file' AND LOWER(f.file_name) ~ '\.(mp4|mov|avi|mkv|webm)$')
+		OR ($2 = 'image' AND f.type = 'file' AND LOWER(f.file_name) ~ '\.(png|gif|jpe?g|bmp)$'))
+`
+
+func IsSavedPostType(contentType string) bool {
+	return contentType == "all" || contentType == "image" || contentType == "video" || contentType == "clip"
+}
+
+func scanSavedPost(row rowScanner, extra ...any) (models.SavedPost, error) {
+	var p models.SavedPost
+	dest := []any{&p.ID, &p.Title, &p.Thumbnail, &p.FileName, &p.Type, &p.AuthorName, &p.SavedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return p, err
+	}
+
+	p.IsVideo = p.Type == "file" && IsVideoFile(p.FileName)
+	p.Thumbnail = PostPreviewURL(p.Thumbnail, p.FileName, p.Type)
+	return p, nil
+}
+
+func AddBookmark(userID, fileID int) error {
+	_, err := db.Exec(`
+		INSERT INTO bookmarks (user_id, file_id)
+		SELECT $1, id FROM files WHERE id = $2 AND is_public = true
+		ON CONFLICT DO NOTHING
+	`, userID, fileID)
+	return err
+}
+
+func RemoveBookmark(userID, fileID int) error {
+	_, err := db.Exec("DELETE FROM bookmarks WHERE user_id = $1 AND file_id = $2", userID, fileID)
+	return err
+}
+
+func HasBookmarked(userID, fileID int) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM bookmarks
+			WHERE user_id = $1 AND file_id = $2
+		)
+	`, userID, fileID).Scan(&exists)
+	return exists, err
+}
+
+// Возвращает закладки пользователя постранично, новые сверху
+func GetBookmarks(userID int, contentType string, page, limit int) (models.BookmarksPage, error) {
+	result := models.BookmarksPage{
+		Posts: []models.SavedPost{},
+		Type:  contentType,
+		Page:  page,
+	}
+
+	rows, err := db.Query(`
+		SELECT `+savedPostColumns+`, b.created_at, COUNT(*) OVER()
+		FROM bookmarks b
+		JOIN files f ON f.id = b.file_id
+		JOIN users u ON u.id = f.user_id
+		WHERE b.user_id = $1 AND f.is_public = true
+		`+savedPostTypeFilter+`
+		ORDER BY b.created_at DESC
+		LIMIT $3 OFFSET (($4 - 1) * $3)
+	`, userID, contentType, limit, page)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanSavedPost(rows, &result.Total)
+		if err != nil {
+			return result, err
+		}
+		result.Posts = append(result.Posts, p)
+	}
+
+	// За пределами последней страницы оконная функция ничего не вернет
+	if len(result.Posts) == 0 && page > 1 {
+		err = db.QueryRow(`
+			SELECT COUNT(*)
+			FROM bookmarks b
+			JOIN files f ON f.id = b.file_id
+			WHERE b.user_id = $1 AND f.is_public = true
+			`+savedPostTypeFilter, userID, contentType).Scan(&result.Total)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.TotalPages = int(math.Ceil(float64(result.Total) / float64(limit)))
+	return result, nil
+}
+
+func AddToWatchLater(userID, fileID int) error {
+	_, err := db.Exec(`
+		INSERT INTO watch_later (user_id, file_id)
+		SELECT $1, id FROM files WHERE id = $2 AND is_public = true
+		ON CONFLICT DO NOTHING
+	`, userID, fileID)
+	return err
+}
+
+func RemoveFromWatchLater(userID, fileID int) error {
+	_, err := db.Exec("DELETE FROM watch_later WHERE user_id = $1 AND file_id = $2", userID, fileID)
+	return err
+}
+
+func IsInWatchLater(userID, fileID int) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM watch_later
+			WHERE user_id = $1 AND file_id = $2
+		)
+	`, userID, fileID).Scan(&exists)
+	return exists, err
+}
+
+// Очередь "Смотреть позже" в порядке добавления
+func GetWatchLater(userID int) ([]models.SavedPost, error) {
+	rows, err := db.Query(`
+		SELECT `+savedPostColumns+`, w.added_at
+		FROM watch_later w
+		JOIN files f ON f.id = w.file_id
+		JOIN users u ON u.id = f.user_id
+		WHERE w.user_id = $1 AND f.is_public = true
+		ORDER BY w.added_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []models.SavedPost{}
+	for rows.Next() {
+		p, err := scanSavedPost(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+
+	return result, nil
+}
+
+// Упоминания
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@(\w{3,25})`)
+
+// Возвращает логины, упомянутые в тексте через @login, без повторов
+func ParseMentions(text string) []string {
+	var logins []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		login := strings.ToLower(match[1])
+		if !seen[login] {
+			seen[login] = true
+			logins = append(logins, login)
+		}
+	}
+	return logins
+}
+
+var mentionPrefixPattern = regexp.MustCompile(`^\w{1,25}$`)
+
+// Подсказки для автодополнения упоминаний
+func SearchMentionUsers(prefix string) []models.MentionUser {
+	results := []models.MentionUser{}
+	if !mentionPrefixPattern.MatchString(prefix) {
+		return results
+	}
+
+	rows, err := db.Query(`
+		SELECT login, display_name, profile_image_url
+		FROM users
+		WHERE login LIKE $1 || '%' AND is_banned = false
+		ORDER BY followers DESC, login
+		LIMIT 8
+	`, strings.ReplaceAll(strings.ToLower(prefix), "_", `\_`))
+	if err != nil {
+		log.Println("Ошибка поиска упоминаний: " + err.Error())
+		return results
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u models.MentionUser
+		if err := rows.Scan(&u.Login, &u.DisplayName, &u.ProfileImageURL); err == nil {
+			results = append(results, u)
+		}
+	}
+
+	return results
+}
+
+// Уведомляет упомянутых пользователей, кроме автора и тех, кто есть в notified.
+// notified пополняется, чтобы один человек не получил несколько уведомлений за одно событие.
+func notifyMentions(authorID, fileID int, text string, params map[string]string, notified map[int]bool) error {
+	logins := ParseMentions(text)
+	if len(logins) == 0 {
+		return nil
+	}
+
+	rows, err := db.Query(`
+		SELECT id FROM users
+		WHERE login = ANY($1) AND is_banned = false
+	`, pq.Array(logins))
+	if err != nil {
+		return err
+	}
+
+	var recipients []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil && id != authorID && !notified[id] {
+			recipients = append(recipients, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range recipients {
+		notified[id] = true
+		if err := addNotification(id, authorID, fileID, "mention", params); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Уведомления о новом комментарии: автору родительского комментария, автору поста и упомянутым
+func notifyComment(comment *models.Comment) error {
+	params := map[string]string{"comment_id": strconv.Itoa(comment.ID)}
+	notified := map[int]bool{comment.UserID: true}
+
+	if comment.ParentID != 0 {
+		var parentAuthorID int
+		err := db.QueryRow("SELECT user_id FROM comments WHERE id = $1", comment.ParentID).Scan(&parentAuthorID)
+		if err != nil {
+			return err
+		}
+		if !notified[parentAuthorID] {
+			notified[parentAuthorID] = true
+			err = addNotification(parentAuthorID, comment.UserID, comment.FileID, "reply", params)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var postAuthorID int
+	err := db.QueryRow("SELECT user_id FROM files WHERE id = $1", comment.FileID).Scan(&postAuthorID)
+	if err != nil {
+		return err
+	}
+	if !notified[postAuthorID] {
+		notified[postAuthorID] = true
+		err = addNotification(postAuthorID, comment.UserID, comment.FileID, "comment", params)
+		if err != nil {
+			return err
+		}
+	}
+
+	return notifyMentions(comment.UserID, comment.FileID, comment.Text, map[string]string{
+		"context":    "comment",
+		"comment_id": params["comment_id"],
+	}, notified)
+}
+
+// Уведомления об упоминаниях в чате
+func notifyChatMentions(userID int, message string) error {
+	return notifyMentions(userID, 0, message, map[string]string{"context": "chat"}, map[int]bool{})
+}
+
+// Уведомления
+
+// Категории для настроек уведомлений пользователя
+var NotificationCategories = []models.NotificationPreference{
+	{Category: "likes", Title: "Лайки"},
+	{Category: "fucks", Title: "Посылы"},
+	{Category: "follows", Title: "Подписки"},
+	{Category: "comments", Title: "Комментарии и упоминания"},
+	{Category: "moderation", Title: "Модерация"},
+	{Category: "system", Title: "Системные"},
+}
+
+func notificationCategory(notificationType string) string {
+	switch notificationType {
+	case "like", "comment_like":
+		return "likes"
+	case "fuck":
+		return "fucks"
+	case "follow":
+		return "follows"
+	case "comment", "reply", "mention":
+		return "comments"
+	case "approved", "rejected":
+		return "moderation"
+	default:
+		return "system"
+	}
+}
+
+// Такие уведомления об одном посте за день сворачиваются в одну строку
+const notificationGroupKey = `
+	CASE WHEN n.type IN ('like', 'fuck', 'comment') AND n.file_id IS NOT NULL
+		THEN n.type || ':' || n.file_id || ':' || n.created_at::date
+		ELSE 'id:' || n.id
+	END
+`
+
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Создает уведомление, если пользователь не отключил эту категорию.
+// Текст не хранится: он собирается из типа и params при чтении.
+// Возвращает ID уведомления или 0, если оно не создано.
+func insertNotification(q queryRower, userID, authorID, fileID int, notificationType string, params map[string]string) (int, error) {
+	if params == nil {
+		params = map[string]string{}
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = q.QueryRow(`
+		INSERT INTO notifications (user_id, author_id, file_id, type, params)
+		SELECT $1::int, NULLIF($2::int, 0), NULLIF($3::int, 0), $4::text, $5::jsonb
+		WHERE NOT EXISTS (
+			SELECT 1 FROM notification_preferences
+			WHERE user_id = $1 AND category = $6 AND enabled = false
+		)
+		RETURNING id
+	`, userID, authorID, fileID, notificationType, data, notificationCategory(notificationType)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// Создает уведомление и сразу доставляет его пользователю.
+// Внутри транзакции используйте insertNotification и publishNotification после коммита.
+func addNotification(userID, authorID, fileID int, notificationType string, params map[string]string) error {
+	id, err := insertNotification(db, userID, authorID, fileID, notificationType, params)
+	if err != nil {
+		return err
+	}
+	publishNotification(userID, id)
+	return nil
+}
+
+func GetUnreadNotificationsCount(userID int) int {
+	if count, ok := unreadCounts.get(userID); ok {
+		return count
+	}
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND mark_seen = false", userID).Scan(&count)
+	if err != nil {
+		return 0
+	}
+	unreadCounts.set(userID, count)
+	return count
+}
+
+// История уведомлений с группировкой. Курсор - ID последнего уведомления предыдущей страницы.
+func GetNotifications(userID, cursor, limit int, locale string) (models.NotificationsPage, error) {
+	page := models.NotificationsPage{
+		Notifications: []models.Notification{},
+		Unread:        GetUnreadNotificationsCount(userID),
+	}
+
+	rows, err := db.Query(`
+		WITH groups AS (
+			SELECT `+notificationGroupKey+` AS group_key,
+				MAX(n.id) AS last_id,
+				COUNT(DISTINCT n.author_id) AS authors,
+				BOOL_AND(n.mark_seen) AS seen
+			FROM notifications n
+			WHERE n.user_id = $1
+			GROUP BY group_key
+		)
+		SELECT `+notificationColumns+`, g.authors, g.seen
+		FROM groups g
+		JOIN notifications n ON n.id = g.last_id
+		LEFT JOIN users u ON u.id = n.author_id
+		WHERE ($2 = 0 OR g.last_id < $2)
+		ORDER BY g.last_id DESC
+		LIMIT $3
+	`, userID, cursor, limit+1)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var authors int
+		var read bool
+		n, err := scanNotification(rows, &authors, &read)
+		if err != nil {
+			return page, err
+		}
+		n.Read = read
+
+		if authors > 1 {
+			n.Others = authors - 1
+		}
+		RenderNotification(&n, locale)
+		page.Notifications = append(page.Notifications, n)
+	}
+
+	if len(page.Notifications) > limit {
+		page.Notifications = page.Notifications[:limit]
+		page.NextCursor = page.Notifications[limit-1].ID
+	}
+
+	return page, nil
+}
+
+// Отмечает уведомление прочитанным вместе с остальными уведомлениями его группы
+func MarkNotificationRead(userID, notificationID int) error {
+	_, err := db.Exec(`
+		UPDATE notifications n
+		SET mark_seen = true
+		FROM notifications t
+		WHERE t.id = $1 AND t.user_id = $2 AND n.user_id = $2 AND n.mark_seen = false
+		AND (n.id = t.id OR (
+			t.type IN ('like', 'fuck', 'comment') AND t.file_id IS NOT NULL
+			AND n.type = t.type AND n.file_id = t.file_id
+			AND n.created_at::date = t.created_at::date
+		))
+	`, notificationID, userID)
+	if err != nil {
+		return err
+	}
+	publishUnreadCount(userID)
+	return nil
+}
+
+func MarkAllNotificationsRead(userID int) error {
+	_, err := db.Exec("UPDATE notifications SET mark_seen = true WHERE user_id = $1 AND mark_seen = false", userID)
+	if err != nil {
+		return err
+	}
+	publishUnreadCount(userID)
+	return nil
+}
+
+func GetNotificationPreferences(userID int) ([]models.NotificationPreference, error) {
+	disabled := make(map[string]bool)
+
+	rows, err := db.Query(`
+		SELECT category FROM notification_preferences
+		WHERE user_id = $1 AND enabled = false
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var category string
+		if err := rows.Scan(&category); err != nil {
+			return nil, err
+		}
+		disabled[category] = true
+	}
+
+	result := make([]models.NotificationPreference, len(NotificationCategories))
+	for i, c := range NotificationCategories {
+		c.Enabled = !disabled[c.Category]
+		result[i] = c
+	}
+
+	return result, nil
+}
+
+func SetNotificationPreference(userID int, category string, enabled bool) error {
+	known := false
+	for _, c := range NotificationCategories {
+		if c.Category == category {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return &ValidationError{Field: "category", Message: "unknown notification category"}
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO notification_preferences (user_id, category, enabled)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, category) DO UPDATE SET enabled = EXCLUDED.enabled
+	`, userID, category, enabled)
+	return err
+}
+
+// Удаляет прочитанные уведомления старше readAge и любые старше unreadAge
+func CleanupNotifications(readAge, unreadAge time.Duration) (int64, error) {
+	res, err := db.Exec(`
+		DELETE FROM notifications
+		WHERE (mark_seen = true AND created_at < $1)
+		OR created_at < $2
+	`, time.Now().Add(-readAge), time.Now().Add(-unreadAge))
+	if err != nil {
+		return 0, err
+	}
+	unreadCounts.reset()
+	return res.RowsAffected()
+}
+
+// Уведомления в реальном времени
+
+// Подписчики SSE-потока уведомлений по ID пользователя
+var notificationStreams = struct {
+	sync.RWMutex
+	subscribers map[int]map[chan models.NotificationEvent]struct{}
+}{subscribers: make(map[int]map[chan models.NotificationEvent]struct{})}
+
+func SubscribeNotifications(userID int) (<-chan models.NotificationEvent, func()) {
+	ch := make(chan models.NotificationEvent, 8)
+
+	notificationStreams.Lock()
+	if notificationStreams.subscribers[userID] == nil {
+		notificationStreams.subscribers[userID] = make(map[chan models.NotificationEvent]struct{})
+	}
+	notificationStreams.subscribers[userID][ch] = struct{}{}
+	notificationStreams.Unlock()
+
+	unsubscribe := func() {
+		notificationStreams.Lock()
+		delete(notificationStreams.subscribers[userID], ch)
+		if len(notificationStreams.subscribers[userID]) == 0 {
+			delete(notificationStreams.subscribers, userID)
+		}
+		notificationStreams.Unlock()
+	}
+
+	return ch, unsubscribe
+}
+
+func broadcastNotificationEvent(userID int, event models.NotificationEvent) {
+	notificationStreams.RLock()
+	defer notificationStreams.RUnlock()
+
+	for ch := range notificationStreams.subscribers[userID] {
+		// Медленный клиент не должен блокировать остальных
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Кэш счетчиков непрочитанных, чтобы не ходить в БД при каждом рендере страницы
+const unreadCountTTL = 5 * time.Minute
+
+type unreadCountEntry struct {
+	count     int
+	expiresAt time.Time
+}
+
+type unreadCountCache struct {
+	sync.RWMutex
+	entries map[int]unreadCountEntry
+}
+
+var unreadCounts = &unreadCountCache{entries: make(map[int]unreadCountEntry)}
+
+func (c *unreadCountCache) get(userID int) (int, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	entry, ok := c.entries[userID]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return 0, false
+	}
+	return entry.count, true
+}
+
+func (c *unreadCountCache) set(userID, count int) {
+	c.Lock()
+	c.entries[userID] = unreadCountEntry{count: count, expiresAt: time.Now().Add(unreadCountTTL)}
+	c.Unlock()
+}
+
+func (c *unreadCountCache) invalidate(userID int) {
+	c.Lock()
+	delete(c.entries, userID)
+	c.Unlock()
+}
+
+func (c *unreadCountCache) reset() {
+	c.Lock()
+	c.entries = make(map[int]unreadCountEntry)
+	c.Unlock()
+}
+
+// Рассылает новое уведомление в открытые вкладки и через Web Push
+func publishNotification(userID, notificationID int) {
+	unreadCounts.invalidate(userID)
+	if notificationID == 0 {
+		return
+	}
+
+	go func() {
+		n, err := scanNotification(db.QueryRow(`
+			SELECT `+notificationColumns+`
+			FROM notifications n
+			LEFT JOIN users u ON u.id = n.author_id
+			WHERE n.id = $1
+		`, notificationID))
+		if err != nil {
+			log.Println("Не удалось получить уведомление для отправки: " + err.Error())
+			return
+		}
+
+		// Текст рендерится под язык каждого получателя события
+		broadcastNotificationEvent(userID, models.NotificationEvent{
+			Unread:       GetUnreadNotificationsCount(userID),
+			Notification: &n,
+		})
+
+		RenderNotification(&n, DefaultLocale)
+		sendWebPush(userID, n)
+	}()
+}
+
+// Сообщает открытым вкладкам новый счетчик непрочитанных
+func publishUnreadCount(userID int) {
+	unreadCounts.invalidate(userID)
+	broadcastNotificationEvent(userID, models.NotificationEvent{
+		Unread: GetUnreadNotificationsCount(userID),
+	})
+}
+
+// Web Push (RFC 8030, шифрование RFC 8291, авторизация VAPID RFC 8292)
+
+const (
+	webPushTTL        = 24 * time.Hour
+	webPushRecordSize = 4096
+)
+
+var (
+	vapidOnce sync.Once
+	vapidKey  *ecdsa.PrivateKey
+	// Публичный ключ в несжатом виде, base64url — его ждет pushManager.subscribe
+	vapidPublicKey string
+)
+
+// Ключ берется из VAPID_PRIVATE_KEY (32 байта, base64url). Без него Web Push отключен.
+func loadVAPIDKey() {
+	raw := os.Getenv("VAPID_PRIVATE_KEY")
+	if raw == "" {
+		return
+	}
+
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(raw, "="))
+	if err != nil {
+		log.Println("Неверный VAPID_PRIVATE_KEY: " + err.Error())
+		return
+	}
+
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		log.Println("Неверный VAPID_PRIVATE_KEY: " + err.Error())
+		return
+	}
+
+	public := key.PublicKey().Bytes()
+	vapidKey = &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(d),
+	}
+	vapidPublicKey = base64.RawURLEncoding.EncodeToString(public)
+}
+
+func VAPIDPublicKey() string {
+	vapidOnce.Do(loadVAPIDKey)
+	return vapidPublicKey
+}
+
+// Push-сервисы браузеров. Подписки на другие адреса не принимаются:
+// сервер сам делает на них POST-запросы
+var pushServiceHosts = []string{
+	"fcm.googleapis.com",
+	"push.services.mozilla.com",
+	"push.apple.com",
+	"notify.windows.com",
+}
+
+func pushEndpointAllowed(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.User != nil || u.Port() != "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range pushServiceHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func SavePushSubscription(userID int, sub models.PushSubscription) error {
+	if !pushEndpointAllowed(sub.Endpoint) {
+		return &ValidationError{Field: "endpoint", Message: "invalid push endpoint"}
+	}
+
+	p256dh, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.P256dh, "="))
+	if err != nil || len(p256dh) != 65 {
+		return &ValidationError{Field: "keys.p256dh", Message: "invalid p256dh key"}
+	}
+	auth, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.Auth, "="))
+	if err != nil || len(auth) != 16 {
+		return &ValidationError{Field: "keys.auth", Message: "invalid auth secret"}
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (endpoint) DO UPDATE
+		SET user_id = EXCLUDED.user_id, p256dh = EXCLUDED.p256dh, auth = EXCLUDED.auth
+	`, userID, sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth)
+	return err
+}
+
+func DeletePushSubscription(userID int, endpoint string) error {
+	_, err := db.Exec("DELETE FROM push_subscriptions WHERE user_id = $1 AND endpoint = $2", userID, endpoint)
+	return err
+}
+
+func sendWebPush(userID int, n models.Notification) {
+	if VAPIDPublicKey() == "" {
+		return
+	}
+
+	rows, err := db.Query("SELECT endpoint, p256dh, auth FROM push_subscriptions WHERE user_id = $1", userID)
+	if err != nil {
+		log.Println("Не удалось получить push-подписки: " + err.Error())
+		return
+	}
+
+	var subs []models.PushSubscription
+	for rows.Next() {
+		var sub models.PushSubscription
+		if err := rows.Scan(&sub.Endpoint, &sub.Keys.P256dh, &sub.Keys.Auth); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	rows.Close()
+
+	if len(subs) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(map[string]string{
+		"title": "Ehworld",
+		"body":  n.Notification,
+		"icon":  n.Image,
+		"url":   n.Link,
+	})
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	for _, sub := range subs {
+		status, err := postWebPush(sub, payload)
+		if err != nil {
+			log.Println("Ошибка отправки Web Push: " + err.Error())
+			continue
+		}
+
+		// Подписка отозвана браузером
+		if status == http.StatusNotFound || status == http.StatusGone {
+			if _, err := db.Exec("DELETE FROM push_subscriptions WHERE endpoint = $1", sub.Endpoint); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}
+}
+
+func postWebPush(sub models.PushSubscription, payload []byte) (int, error) {
+	// Старые подписки на посторонние адреса удаляются как отозванные
+	if !pushEndpointAllowed(sub.Endpoint) {
+		return http.StatusGone, nil
+	}
+
+	body, err := encryptWebPush(sub, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil {
+		return 0, err
+	}
+	token, err := vapidToken(endpoint.Scheme + "://" + endpoint.Host)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(webPushTTL.Seconds())))
+	req.Header.Set("Authorization", "vapid t="+token+", k="+vapidPublicKey)
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusGone {
+		return resp.StatusCode, fmt.Errorf("push service returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// JWT (ES256) для заголовка Authorization по VAPID
+func vapidToken(audience string) (string, error) {
+	subject := os.Getenv("VAPID_SUBJECT")
+	if subject == "" {
+		subject = "mailto:admin@ehworld.ru"
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]any{
+		"aud": audience,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(crand.Reader, vapidKey, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Шифрует payload для подписки по схеме aes128gcm (RFC 8291)
+func encryptWebPush(sub models.PushSubscription, payload []byte) ([]byte, error) {
+	clientPublic, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.P256dh, "="))
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.Auth, "="))
+	if err != nil {
+		return nil, err
+	}
+
+	clientKey, err := ecdh.P256().NewPublicKey(clientPublic)
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := ecdh.P256().GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := serverKey.ECDH(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	serverPublic := serverKey.PublicKey().Bytes()
+
+	prkKey, err := hkdf.Extract(sha256.New, sharedSecret, authSecret)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := "WebPush: info\x00" + string(clientPublic) + string(serverPublic)
+	ikm, err := hkdf.Expand(sha256.New, prkKey, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := crand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Одна запись: данные + разделитель последней записи
+	plaintext := append(append([]byte{}, payload...), 0x02)
+	if len(plaintext)+gcm.Overhead() > webPushRecordSize {
+		return nil, errors.New("push payload is too large")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(salt)
+	binary.Write(&buf, binary.BigEndian, uint32(webPushRecordSize))
+	buf.WriteByte(byte(len(serverPublic)))
+	buf.Write(serverPublic)
+	buf.Write(gcm.Seal(nil, nonce, plaintext, nil))
+
+	return buf.Bytes(), nil
+}
+
+// Шаблоны уведомлений
+
+const DefaultLocale = "ru"
+
+// Каталог текстов: ключ - тип уведомления, с суффиксом контекста (.chat) и группировки (.grouped)
+var notificationTemplates = map[string]map[string]string{
+	"ru": {
+		"like":            "{actor} поставил лайк вашей публикации!",
+		"like.grouped":    "{actor} и ещё {others} поставили лайк вашей публикации!",
+		"comment_like":    "{actor} поставил лайк вашему комментарию!",
+		"fuck":            "{actor} послал вас нах под вашей публикацией!",
+		"fuck.grouped":    "{actor} и ещё {others} послали вас нах под вашей публикацией!",
+		"follow":          "{actor} подписался на Вас!",
+		"approved":        "Модераторы одобрили ваш пост!",
+		"rejected":        "Модераторы отклонили ваш пост, но он все еще доступен по прямой ссылке",
+		"comment":         "{actor} прокомментировал вашу публикацию!",
+		"comment.grouped": "{actor} и ещё {others} прокомментировали вашу публикацию!",
+		"reply":           "{actor} ответил на ваш комментарий!",
+		"mention.comment": "{actor} упомянул вас в комментарии!",
+		"mention.chat":    "{actor} упомянул вас в чате!",
+		"gift":            "{actor} подарил вам предмет!",
+		"trade.offer":     "{actor} предлагает вам обмен!",
+		"trade.accepted":  "{actor} принял ваш обмен!",
+		"trade.declined":  "{actor} отклонил ваш обмен",
+		"system":          "{text}",
+		"message":         "{text}",
+		"unknown_actor":   "Кто-то",
+	},
+	"en": {
+		"like":            "{actor} liked your post!",
+		"like.grouped":    "{actor} and {others} others liked your post!",
+		"comment_like":    "{actor} liked your comment!",
+		"fuck":            "{actor} told you to get lost under your post!",
+		"fuck.grouped":    "{actor} and {others} others told you to get lost under your post!",
+		"follow":          "{actor} followed you!",
+		"approved":        "Moderators approved your post!",
+		"rejected":        "Moderators rejected your post, but it is still available by direct link",
+		"comment":         "{actor} commented on your post!",
+		"comment.grouped": "{actor} and {others} others commented on your post!",
+		"reply":           "{actor} replied to your comment!",
+		"mention.comment": "{actor} mentioned you in a comment!",
+		"mention.chat":    "{actor} mentioned you in chat!",
+		"gift":            "{actor} sent you a gift!",
+		"trade.offer":     "{actor} offers you a trade!",
+		"trade.accepted":  "{actor} accepted your trade!",
+		"trade.declined":  "{actor} declined your trade",
+		"system":          "{text}",
+		"message":         "{text}",
+		"unknown_actor":   "Someone",
+	},
+}
+
+// Адрес сайта для ссылок в уведомлениях, задается через BASE_URL
+func BaseURL() string {
+	if base := os.Getenv("BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return "https://ehworld.ru"
+}
+
+// Выбирает поддерживаемый язык из заголовка Accept-Language
+func ParseLocale(acceptLanguage string) string {
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag := strings.ToLower(strings.TrimSpace(strings.SplitN(part, ";", 2)[0]))
+		lang := strings.SplitN(tag, "-", 2)[0]
+		if _, ok := notificationTemplates[lang]; ok {
+			return lang
+		}
+	}
+	return DefaultLocale
+}
+
+const notificationColumns = `
+	n.id, n.type, n.params, COALESCE(n.notification, ''), COALESCE(n.image, ''), COALESCE(n.link, ''),
+	COALESCE(n.file_id, 0), n.created_at, COALESCE(u.display_name, ''), COALESCE(u.login, ''), COALESCE(u.profile_image_url, '')
+`
+
+func scanNotification(row rowScanner, extra ...any) (models.Notification, error) {
+	var n models.Notification
+	var params []byte
+	dest := append([]any{&n.ID, &n.Type, &params, &n.Notification, &n.Image, &n.Link,
+		&n.FileID, &n.CreatedAt, &n.Actor, &n.ActorLogin, &n.ActorImage}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return n, err
+	}
+
+	n.Params = map[string]string{}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &n.Params); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Собирает текст, картинку и ссылку уведомления для указанного языка
+func RenderNotification(n *models.Notification, locale string) {
+	n.FormattedTime = FormatTimeAgo(n.CreatedAt)
+
+	// Старые уведомления хранились уже готовым текстом
+	if len(n.Params) == 0 && n.Notification != "" {
+		if strings.HasPrefix(n.Link, "https://ehworld.ru") {
+			n.Link = BaseURL() + strings.TrimPrefix(n.Link, "https://ehworld.ru")
+		}
+		if strings.HasPrefix(n.Image, "https://ehworld.ru") {
+			n.Image = BaseURL() + strings.TrimPrefix(n.Image, "https://ehworld.ru")
+		}
+		return
+	}
+
+	catalogue, ok := notificationTemplates[locale]
+	if !ok {
+		catalogue = notificationTemplates[DefaultLocale]
+	}
+
+	key := n.Type
+	if context := n.Params["context"]; context != "" {
+		key += "." + context
+	}
+	text, ok := catalogue[key]
+	if grouped, has := catalogue[key+".grouped"]; has && n.Others > 0 {
+		text, ok = grouped, true
+	}
+	if !ok {
+		text = "{text}"
+	}
+
+	actor := n.Actor
+	if actor == "" {
+		actor = catalogue["unknown_actor"]
+	}
+	n.Notification = strings.NewReplacer(
+		"{actor}", actor,
+		"{others}", strconv.Itoa(n.Others),
+		"{text}", n.Params["text"],
+	).Replace(text)
+
+	n.Image = n.ActorImage
+	n.Link = BaseURL() + notificationPath(n)
+	switch n.Type {
+	case "approved", "rejected":
+		n.Image = BaseURL() + "/static/img/" + n.Type + ".svg"
+	case "system", "message":
+		n.Image = BaseURL() + "/static/img/icon.png"
+	}
+}
+
+func notificationPath(n *models.Notification) string {
+	switch {
+	case n.Type == "follow" && n.ActorLogin != "":
+		// Страница профиля ищет пользователя по логину, а не по отображаемому имени
+		return "/user/" + url.PathEscape(n.ActorLogin)
+	case n.Type == "gift" || n.Type == "trade":
+		return "/inventory"
+	case n.Params["context"] == "chat":
+		return "/"
+	case n.Params["link"] != "" && strings.HasPrefix(n.Params["link"], "/"):
+		return n.Params["link"]
+	case n.FileID != 0:
+		return "/post/" + strconv.Itoa(n.FileID)
+	default:
+		return "/notifications"
+	}
+}
+
+// Email-дайджест
+
+const digestTopPostsLimit = 5
+
+func IsDigestFrequency(frequency string) bool {
+	return frequency == "off" || frequency == "daily" || frequency == "weekly"
+}
+
+func digestPeriod(frequency string) time.Duration {
+	if frequency == "weekly" {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+func GetDigestSettings(userID int) (models.DigestSettings, error) {
+	var settings models.DigestSettings
+	err := db.QueryRow(`
+		SELECT COALESCE(d.frequency, 'off'), COALESCE(u.email, '')
+		FROM users u
+		LEFT JOIN email_digests d ON d.user_id = u.id
+		WHERE u.id = $1
+	`, userID).Scan(&settings.Frequency, &settings.Email)
+	return settings, err
+}
+
+func SetDigestFrequency(userID int, frequency string) error {
+	if !IsDigestFrequency(frequency) {
+		return &ValidationError{Field: "frequency", Message: "unknown digest frequency"}
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	// Токен отписки создается один раз и не меняется, чтобы старые письма продолжали работать
+	_, err = db.Exec(`
+		INSERT INTO email_digests (user_id, frequency, unsubscribe_token)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET frequency = EXCLUDED.frequency
+	`, userID, frequency, token)
+	return err
+}
+
+// Проверяет токен отписки, ничего не меняя
+func DigestTokenExists(token string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM email_digests WHERE unsubscribe_token = $1)", token).Scan(&exists)
+	return exists, err
+}
+
+// Отписка по ссылке из письма. Возвращает false, если токен не найден.
+func UnsubscribeDigest(token string) (bool, error) {
+	res, err := db.Exec("UPDATE email_digests SET frequency = 'off' WHERE unsubscribe_token = $1", token)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// Пользователи, которым пора отправить дайджест
+func GetDueDigests() ([]models.DigestRecipient, error) {
+	rows, err := db.Query(`
+		SELECT u.id, u.email, u.display_name, d.frequency, d.unsubscribe_token, d.last_sent_at
+		FROM email_digests d
+		JOIN users u ON u.id = d.user_id
+		WHERE d.frequency <> 'off'
+		AND COALESCE(u.email, '') <> ''
+		AND u.is_banned = false
+		AND (d.last_sent_at IS NULL OR d.last_sent_at < NOW() - CASE d.frequency
+			WHEN 'weekly' THEN INTERVAL '7 days'
+			ELSE INTERVAL '1 day'
+		END)
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []models.DigestRecipient
+	for rows.Next() {
+		var r models.DigestRecipient
+		var lastSent sql.NullTime
+		if err := rows.Scan(&r.UserID, &r.Email, &r.DisplayName, &r.Frequency, &r.UnsubscribeToken, &lastSent); err != nil {
+			return nil, err
+		}
+
+		r.Since = time.Now().Add(-digestPeriod(r.Frequency))
+		if lastSent.Valid && lastSent.Time.After(r.Since) {
+			r.Since = lastSent.Time
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// Собирает активность пользователя с момента r.Since
+func BuildDigest(r models.DigestRecipient) (models.Digest, error) {
+	digest := models.Digest{
+		Recipient:      r,
+		TopPosts:       []models.DigestPost{},
+		UnsubscribeURL: BaseURL() + "/unsubscribe?token=" + url.QueryEscape(r.UnsubscribeToken),
+		SettingsURL:    BaseURL() + "/notifications",
+	}
+
+	// Лайки и подписчики считаются по дневным срезам статистики: у таблиц лайков и подписок нет дат
+	since := r.Since.Format("2006-01-02")
+	err := db.QueryRow(`
+		SELECT
+			COALESCE((SELECT SUM(likes) FROM files WHERE user_id = $1), 0) - COALESCE((
+				SELECT SUM(s.likes) FROM post_stats_daily s
+				JOIN files f ON f.id = s.file_id
+				WHERE f.user_id = $1 AND s.day = $2::date
+			), (SELECT SUM(likes) FROM files WHERE user_id = $1), 0),
+			(SELECT followers FROM users WHERE id = $1) - COALESCE((
+				SELECT followers FROM user_stats_daily WHERE user_id = $1 AND day = $2::date
+			), (SELECT followers FROM users WHERE id = $1)),
+			(SELECT COUNT(*) FROM comments c
+				JOIN files f ON f.id = c.file_id
+				WHERE f.user_id = $1 AND c.user_id <> $1 AND c.is_deleted = false AND c.created_at > $3)
+	`, r.UserID, since, r.Since).Scan(&digest.Likes, &digest.Followers, &digest.Comments)
+	if err != nil {
+		return digest, err
+	}
+	digest.Likes = max(digest.Likes, 0)
+	digest.Followers = max(digest.Followers, 0)
+
+	rows, err := db.Query(`
+		SELECT f.id, COALESCE(f.title, ''), u.display_name, f.likes
+		FROM files f
+		JOIN follows fl ON fl.target_id = f.user_id
+		JOIN users u ON u.id = f.user_id
+		WHERE fl.user_id = $1 AND f.is_public = true AND f.uploaded_at > $2
+		ORDER BY f.likes DESC, f.views DESC
+		LIMIT $3
+	`, r.UserID, r.Since, digestTopPostsLimit)
+	if err != nil {
+		return digest, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.DigestPost
+		if err := rows.Scan(&p.ID, &p.Title, &p.AuthorName, &p.Likes); err != nil {
+			return digest, err
+		}
+		p.URL = BaseURL() + "/post/" + strconv.Itoa(p.ID)
+		digest.TopPosts = append(digest.TopPosts, p)
+	}
+
+	return digest, nil
+}
+
+func MarkDigestSent(userID int) error {
+	_, err := db.Exec("UPDATE email_digests SET last_sent_at = NOW() WHERE user_id = $1", userID)
+	return err
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Отправка почты
+
+// Mailer выбирается переменной MAILER: smtp, file или log (по умолчанию)
+type Mailer interface {
+	Send(msg models.MailMessage) error
+}
+
+var (
+	mailerOnce sync.Once
+	mailer     Mailer
+)
+
+func SendMail(msg models.MailMessage) error {
+	mailerOnce.Do(func() {
+		switch os.Getenv("MAILER") {
+		case "smtp":
+			mailer = smtpMailer{
+				addr:     os.Getenv("SMTP_HOST") + ":" + os.Getenv("SMTP_PORT"),
+				host:     os.Getenv("SMTP_HOST"),
+				username: os.Getenv("SMTP_USER"),
+				password: os.Getenv("SMTP_PASSWORD"),
+				from:     os.Getenv("MAIL_FROM"),
+			}
+		case "file":
+			dir := os.Getenv("MAIL_DIR")
+			if dir == "" {
+				dir = "mail"
+			}
+			mailer = fileMailer{dir: dir}
+		default:
+			mailer = logMailer{}
+		}
+	})
+	return mailer.Send(msg)
+}
+
+func buildMailMessage(from string, msg models.MailMessage) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	for key, value := range msg.Headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	buf.WriteString("\r\n")
+
+	body := base64.StdEncoding.EncodeToString([]byte(msg.HTML))
+	for len(body) > 76 {
+		buf.WriteString(body[:76] + "\r\n")
+		body = body[76:]
+	}
+	buf.WriteString(body + "\r\n")
+
+	return buf.Bytes()
+}
+
+type smtpMailer struct {
+	addr, host, username, password, from string
+}
+
+func (m smtpMailer) Send(msg models.MailMessage) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{msg.To}, buildMailMessage(m.from, msg))
+}
+
+// Складывает письма в .eml файлы, удобно для локальной разработки
+type fileMailer struct {
+	dir string
+}
+
+func (m fileMailer) Send(msg models.MailMessage) error {
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(msg.To))
+	return os.WriteFile(filepath.Join(m.dir, name), buildMailMessage("ehworld@localhost", msg), 0644)
+}
+
+type logMailer struct{}
+
+func (logMailer) Send(msg models.MailMessage) error {
+	log.Printf("Письмо для %s: %s (%d байт)", msg.To, msg.Subject, len(msg.HTML))
+	return nil
+}
+
+// Сессии
+
+// В базе хранится только хеш токена из куки
+func sessionTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Загружает данные сессии и обновляет время последней активности.
+// Сессии забаненных пользователей не загружаются.
+func LoadSession(token, ip, userAgent string) ([]byte, error) {
+	hash := sessionTokenHash(token)
+
+	var data []byte
+	err := db.QueryRow(`
+		SELECT s.data FROM sessions s
+		LEFT JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = $1 AND s.expires_at > NOW()
+		AND COALESCE(u.is_banned, false) = false
+	`, hash).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Не пишем в базу на каждый запрос
+	_, err = db.Exec(`
+		UPDATE sessions SET last_active_at = NOW(), ip = $2, user_agent = $3
+		WHERE token_hash = $1 AND last_active_at < NOW() - INTERVAL '1 minute'
+	`, hash, ip, userAgent)
+	if err != nil {
+		log.Println("Не удалось обновить активность сессии: " + err.Error())
+	}
+
+	return data, nil
+}
+
+func SaveSession(token string, userID int, data []byte, ip, userAgent string, expiresAt time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO sessions (token_hash, user_id, data, ip, user_agent, expires_at)
+		VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6)
+		ON CONFLICT (token_hash) DO UPDATE SET
+			user_id = EXCLUDED.user_id,
+			data = EXCLUDED.data,
+			expires_at = EXCLUDED.expires_at,
+			last_active_at = NOW()
+	`, sessionTokenHash(token), userID, data, ip, userAgent, expiresAt)
+	return err
+}
+
+func DeleteSession(token string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE token_hash = $1", sessionTokenHash(token))
+	return err
+}
+
+func GetUserSessions(userID int, currentToken string) ([]models.UserSession, error) {
+	rows, err := db.Query(`
+		SELECT id, COALESCE(user_agent, ''), COALESCE(ip, ''), created_at, last_active_at, token_hash = $2
+		FROM sessions
+		WHERE user_id = $1 AND expires_at > NOW()
+		ORDER BY last_active_at DESC
+	`, userID, sessionTokenHash(currentToken))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.UserSession{}
+	for rows.Next() {
+		var s models.UserSession
+		var userAgent string
+		if err := rows.Scan(&s.ID, &userAgent, &s.IP, &s.CreatedAt, &s.LastActiveAt, &s.Current); err != nil {
+			return nil, err
+		}
+		s.Device = DescribeUserAgent(userAgent)
+		s.LastActive = FormatTimeAgo(s.LastActiveAt)
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+func RevokeSession(userID, sessionID int) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE id = $1 AND user_id = $2", sessionID, userID)
+	return err
+}
+
+func RevokeOtherSessions(userID int, currentToken string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id = $1 AND token_hash <> $2", userID, sessionTokenHash(currentToken))
+	return err
+}
+
+// Разлогинивает пользователя на всех устройствах
+func RevokeUserSessions(userID int) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id = $1", userID)
+	return err
+}
+
+func CleanupSessions() (int64, error) {
+	res, err := db.Exec("DELETE FROM sessions WHERE expires_at < NOW()")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Короткое описание устройства по User-Agent, например "Chrome, Windows"
+func DescribeUserAgent(userAgent string) string {
+	browser := "Неизвестный браузер"
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/") || strings.Contains(userAgent, "Opera"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "YaBrowser/"):
+		browser = "Яндекс Браузер"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	system := ""
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		system = "Android"
+	case strings.Contains(userAgent, "iPhone") || strings.Contains(userAgent, "iPad"):
+		system = "iOS"
+	case strings.Contains(userAgent, "Windows"):
+		system = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		system = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		system = "Linux"
+	}
+
+	if system == "" {
+		return browser
+	}
+	return browser + ", " + system
+}
+
+// API-токены
+
+const (
+	apiTokenPrefix  = "ehw_"
+	maxAPITokens    = 20
+	apiTokenNameMax = 50
+)
+
+var APITokenScopes = []models.APITokenScope{
+	{Scope: "read:posts", Title: "Чтение постов, ленты и закладок"},
+	{Scope: "write:posts", Title: "Загрузка постов, лайки и комментарии"},
+	{Scope: "read:queue", Title: "Чтение очереди аука"},
+	{Scope: "chat:send", Title: "Отправка сообщений в чат"},
+	{Scope: "read:profile", Title: "Чтение профиля, баланса и инвентаря"},
+	{Scope: "write:follows", Title: "Подписки на авторов"},
+	{Scope: "write:shop", Title: "Покупки, открытие кейсов и применение предметов"},
+	{Scope: "write:queue", Title: "Управление очередью аука"},
+}
+
+func IsAPITokenScope(scope string) bool {
+	for _, s := range APITokenScopes {
+		if s.Scope == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Создает токен. Сам токен возвращается только здесь, в базе хранится его хеш.
+func CreateAPIToken(userID int, name string, scopes []string) (models.APIToken, string, error) {
+	var token models.APIToken
+
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > apiTokenNameMax {
+		return token, "", &ValidationError{Field: "name", Message: "invalid token name"}
+	}
+	if len(scopes) == 0 {
+		return token, "", &ValidationError{Field: "scope", Message: "no scopes"}
+	}
+	for _, scope := range scopes {
+		if !IsAPITokenScope(scope) {
+			return token, "", &ValidationError{Field: "scope", Message: "unknown scope " + scope}
+		}
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE user_id = $1", userID).Scan(&count); err != nil {
+		return token, "", err
+	}
+	if count >= maxAPITokens {
+		return token, "", ErrTooManyTokens
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return token, "", err
+	}
+	raw := apiTokenPrefix + secret
+
+	token = models.APIToken{
+		UserID: userID,
+		Name:   name,
+		Prefix: raw[:len(apiTokenPrefix)+6],
+		Scopes: scopes,
+	}
+	err = db.QueryRow(`
+		INSERT INTO api_tokens (user_id, name, token_hash, prefix, scopes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, userID, name, sessionTokenHash(raw), token.Prefix, pq.Array(scopes)).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return token, "", err
+	}
+
+	return token, raw, nil
+}
+
+func GetAPITokens(userID int) ([]models.APIToken, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, name, prefix, scopes, created_at, last_used_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func scanAPIToken(row rowScanner) (models.APIToken, error) {
+	var token models.APIToken
+	var lastUsed sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.Prefix, pq.Array(&token.Scopes), &token.CreatedAt, &lastUsed)
+	if err != nil {
+		return token, err
+	}
+	if lastUsed.Valid {
+		token.LastUsedAt = &lastUsed.Time
+		token.LastUsed = FormatTimeAgo(lastUsed.Time)
+	}
+	return token, nil
+}
+
+func RevokeAPIToken(userID, tokenID int) error {
+	res, err := db.Exec("DELETE FROM api_tokens WHERE id = $1 AND user_id = $2", tokenID, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Проверяет токен из заголовка Authorization и отмечает время использования
+func AuthenticateAPIToken(raw string) (models.APIToken, error) {
+	if !strings.HasPrefix(raw, apiTokenPrefix) {
+		return models.APIToken{}, errors.New("invalid token")
+	}
+
+	hash := sessionTokenHash(raw)
+	token, err := scanAPIToken(db.QueryRow(`
+		SELECT t.id, t.user_id, t.name, t.prefix, t.scopes, t.created_at, t.last_used_at
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND u.is_banned = false
+	`, hash))
+	if err != nil {
+		return token, err
+	}
+
+	_, err = db.Exec(`
+		UPDATE api_tokens SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`, token.ID)
+	if err != nil {
+		log.Println("Не удалось обновить использование токена: " + err.Error())
+	}
+
+	return token, nil
+}
+
+// Права, которые можно выдать роли или пользователю. Админ имеет все права.
+var Permissions = []models.Permission{
+	{Name: "approve_posts", Title: "Одобрение и отклонение постов"},
+	{Name: "delete_posts", Title: "Удаление постов"},
+	{Name: "moderate_comments", Title: "Правка и удаление чужих комментариев"},
+	{Name: "ban_users", Title: "Блокировка пользователей"},
+	{Name: "admin_panel", Title: "Доступ к админ панели"},
+	{Name: "manage_moderators", Title: "Назначение модераторов"},
+	{Name: "manage_shop", Title: "Управление магазином и значками"},
+	{Name: "manage_cases", Title: "Управление кейсами"},
+	{Name: "manage_queue", Title: "Управление очередью аука"},
+	{Name: "manage_live_channels", Title: "Управление live-каналами"},
+	{Name: "view_analytics", Title: "Просмотр чужой аналитики"},
+	{Name: "manage_bot", Title: "Подключение Twitch-бота"},
+	{Name: "manage_permissions", Title: "Управление правами"},
+}
+
+// Роли, права которых настраиваются. admin сюда не входит.
+var PermissionRoles = []string{"user", "moderator"}
+
+func IsPermission(name string) bool {
+	for _, p := range Permissions {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isPermissionRole(role string) bool {
+	for _, r := range PermissionRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Право есть у админа, у роли пользователя или выдано ему лично.
+// Забаненным не доступно ничего.
+func HasPermission(userID int, permission string) bool {
+	var allowed bool
+	err := db.QueryRow(`
+		SELECT u.role = 'admin'
+			OR EXISTS (SELECT 1 FROM role_permissions rp WHERE rp.role = u.role AND rp.permission = $2)
+			OR EXISTS (SELECT 1 FROM user_permissions up WHERE up.user_id = u.id AND up.permission = $2)
+		FROM users u
+		WHERE u.id = $1 AND u.is_banned = false
+	`, userID, permission).Scan(&allowed)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("Не удалось проверить право " + permission + ": " + err.Error())
+		}
+		return false
+	}
+	return allowed
+}
+
+// Все права пользователя одним запросом, для проверок в рамках одного HTTP-запроса
+func GetUserPermissionSet(userID int) map[string]bool {
+	set := map[string]bool{}
+	var admin bool
+	var granted []string
+	err := db.QueryRow(`
+		SELECT u.role = 'admin', ARRAY(
+			SELECT rp.permission FROM role_permissions rp WHERE rp.role = u.role
+			UNION
+			SELECT up.permission FROM user_permissions up WHERE up.user_id = u.id
+		)
+		FROM users u
+		WHERE u.id = $1 AND u.is_banned = false
+	`, userID).Scan(&admin, pq.Array(&granted))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("Не удалось получить права пользователя: " + err.Error())
+		}
+		return set
+	}
+
+	for _, permission := range granted {
+		set[permission] = true
+	}
+	if admin {
+		for _, p := range Permissions {
+			set[p.Name] = true
+		}
+	}
+	return set
+}
+
+func GetRolePermissions() ([]models.RolePermissions, error) {
+	byRole := map[string][]string{}
+	rows, err := db.Query("SELECT role, permission FROM role_permissions ORDER BY role, permission")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var role, permission string
+		if err := rows.Scan(&role, &permission); err != nil {
+			return nil, err
+		}
+		byRole[role] = append(byRole[role], permission)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := []models.RolePermissions{}
+	for _, role := range PermissionRoles {
+		permissions := byRole[role]
+		if permissions == nil {
+			permissions = []string{}
+		}
+		result = append(result, models.RolePermissions{Role: role, Permissions: permissions})
+	}
+	return result, nil
+}
+
+func SetRolePermission(role, permission string, enabled bool) error {
+	if !isPermissionRole(role) {
+		return &ValidationError{Field: "role", Message: "unknown role " + role}
+	}
+	if !IsPermission(permission) {
+		return &ValidationError{Field: "permission", Message: "unknown permission " + permission}
+	}
+
+	var err error
+	if enabled {
+		_, err = db.Exec(`
+			INSERT INTO role_permissions (role, permission) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, role, permission)
+	} else {
+		_, err = db.Exec("DELETE FROM role_permissions WHERE role = $1 AND permission = $2", role, permission)
+	}
+	return err
+}
+
+func GetUserPermissions(username string) (models.UserPermissions, error) {
+	var result models.UserPermissions
+	err := db.QueryRow("SELECT id, login, role FROM users WHERE login = $1", strings.ToLower(username)).
+		Scan(&result.UserID, &result.Login, &result.Role)
+	if err != nil {
+		return result, err
+	}
+
+	fromRole := map[string]bool{}
+	granted := map[string]bool{}
+	rows, err := db.Query(`
+		SELECT permission, true FROM role_permissions WHERE role = $1
+		UNION ALL
+		SELECT permission, false FROM user_permissions WHERE user_id = $2
+	`, result.Role, result.UserID)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var permission string
+		var isRole bool
+		if err := rows.Scan(&permission, &isRole); err != nil {
+			return result, err
+		}
+		if isRole {
+			fromRole[permission] = true
+		} else {
+			granted[permission] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for _, p := range Permissions {
+		result.Permissions = append(result.Permissions, models.UserPermission{
+			Name:     p.Name,
+			Title:    p.Title,
+			FromRole: fromRole[p.Name] || result.Role == "admin",
+			Granted:  granted[p.Name],
+		})
+	}
+	return result, nil
+}
+
+func SetUserPermission(adminID int, username, permission string, enabled bool) error {
+	if !IsPermission(permission) {
+		return &ValidationError{Field: "permission", Message: "unknown permission " + permission}
+	}
+
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE login = $1", strings.ToLower(username)).Scan(&userID)
+	if err != nil {
+		return err
+	}
+
+	if enabled {
+		_, err = db.Exec(`
+			INSERT INTO user_permissions (user_id, permission, granted_by) VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING
+		`, userID, permission, adminID)
+	} else {
+		_, err = db.Exec("DELETE FROM user_permissions WHERE user_id = $1 AND permission = $2", userID, permission)
+	}
+	return err
+}
+
+// API v1
+
+// Абсолютная ссылка на файл из static. Внешние ссылки возвращаются как есть.
+func PublicURL(path string) string {
+	if path == "" || strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	return BaseURL() + "/" + strings.TrimLeft(path, "./")
+}
+
+const apiPostColumns = `
+	f.id, COALESCE(f.title, ''), f.description, f.type, f.file_name, COALESCE(f.thumbnail, ''), f.views, f.likes, f.fucks,
+	(SELECT COUNT(*) FROM comments c WHERE c.file_id = f.id AND c.is_deleted = FALSE),
+	f.uploaded_at, u.login, u.display_name, u.profile_image_url
+`
+
+func scanAPIPost(row rowScanner) (models.APIPost, error) {
+	var p models.APIPost
+	var fileType, fileName, thumbnail string
+	err := row.Scan(&p.ID, &p.Title, &p.Description, &fileType, &fileName, &thumbnail, &p.Views, &p.Likes, &p.Fucks,
+		&p.Comments, &p.CreatedAt, &p.Author.Login, &p.Author.DisplayName, &p.Author.ProfileImageURL)
+	if err != nil {
+		return p, err
+	}
+
+	switch {
+	case fileType == "clip":
+		// Для клипов в file_name лежит готовый iframe
+		p.Type = "clip"
+		p.EmbedHTML = fileName
+		p.ThumbnailURL = thumbnail
+	case IsVideoFile(fileName):
+		p.Type = "video"
+		p.MediaURL = PublicURL("static/uploads/" + fileName)
+		if thumbnail != "" {
+			p.ThumbnailURL = PublicURL("static/uploads/" + thumbnail)
+		}
+	default:
+		p.Type = "image"
+		p.MediaURL = PublicURL("static/uploads/" + fileName)
+		p.ThumbnailURL = p.MediaURL
+	}
+	return p, nil
+}
+
+// Опубликованные посты, новые сначала. authorID = 0 - посты всех авторов.
+func GetAPIPosts(authorID, limit, offset int) ([]models.APIPost, int, error) {
+	var total int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM files f
+		WHERE f.is_public = true AND f.is_moderated = true AND ($1 = 0 OR f.user_id = $1)
+	`, authorID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`
+		SELECT `+apiPostColumns+`
+		FROM files f
+		JOIN users u ON u.id = f.user_id
+		WHERE f.is_public = true AND f.is_moderated = true AND ($1 = 0 OR f.user_id = $1)
+		ORDER BY f.uploaded_at DESC, f.id DESC
+		LIMIT $2 OFFSET $3
+	`, authorID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	posts := []models.APIPost{}
+	for rows.Next() {
+		p, err := scanAPIPost(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, total, rows.Err()
+}
+
+func GetAPIPost(postID int) (models.APIPost, error) {
+	p, err := scanAPIPost(db.QueryRow(`
+		SELECT `+apiPostColumns+`
+		FROM files f
+		JOIN users u ON u.id = f.user_id
+		WHERE f.id = $1 AND f.is_public = true AND f.is_moderated = true
+	`, postID))
+	if err == sql.ErrNoRows {
+		return p, ErrPostNotFound
+	}
+	return p, err
+}
+
+// Профиль по логину. Забаненные пользователи не отдаются.
+func GetAPIUser(login string) (models.APIUser, int, error) {
+	var u models.APIUser
+	var userID int
+	err := db.QueryRow(`
+		SELECT u.id, u.login, u.display_name, u.profile_image_url, u.role, u.followers, COALESCE(b.image, ''), u.created_at,
+			(SELECT COUNT(*) FROM files f WHERE f.user_id = u.id AND f.is_public = true AND f.is_moderated = true)
+		FROM users u
+		LEFT JOIN badges b ON b.id = u.badge_id
+		WHERE u.login = $1 AND u.is_banned = false
+	`, strings.ToLower(login)).Scan(&userID, &u.Login, &u.DisplayName, &u.ProfileImageURL, &u.Role, &u.Followers,
+		&u.BadgeImageURL, &u.CreatedAt, &u.Posts)
+	if err != nil {
+		return u, 0, err
+	}
+	u.BadgeImageURL = PublicURL(u.BadgeImageURL)
+	return u, userID, nil
+}
+
+// Ключи идемпотентности
+
+const (
+	MaxIdempotencyKeyLength = 255
+	idempotencyKeyTTL       = 24 * time.Hour
+)
+
+// Запоминает ключ в транзакции покупки. claimed = false, если ключ уже использован
+// для того же запроса, тогда result содержит сохраненный результат
+func claimIdempotencyKey(tx *sql.Tx, userID int, scope, key string) (result string, claimed bool, err error) {
+	res, err := tx.Exec(`
+		INSERT INTO idempotency_keys (user_id, key, scope)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, key) DO NOTHING
+	`, userID, key, scope)
+	if err != nil {
+		return "", false, err
+	}
+	if affected, _ := res.RowsAffected(); affected > 0 {
+		return "", true, nil
+	}
+
+	var storedScope string
+	err = tx.QueryRow("SELECT scope, result FROM idempotency_keys WHERE user_id = $1 AND key = $2", userID, key).Scan(&storedScope, &result)
+	if err != nil {
+		return "", false, err
+	}
+	if storedScope != scope {
+		return "", false, ErrIdempotencyKeyReused
+	}
+	return result, false, nil
+}
+
+func saveIdempotencyResult(tx *sql.Tx, userID int, key, result string) error {
+	_, err := tx.Exec("UPDATE idempotency_keys SET result = $1 WHERE user_id = $2 AND key = $3", result, userID, key)
+	return err
+}
+
+func CleanupIdempotencyKeys() (int64, error) {
+	res, err := db.Exec("DELETE FROM idempotency_keys WHERE created_at < $1", time.Now().Add(-idempotencyKeyTTL))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// VIP на время. Выдача и отзыв в Twitch идут через outbox,
+// истекшие VIP находит ExpireVIPs, ее вызывает воркер outbox
+
+const (
+	defaultVIPDays = 30
+	maxVIPDays     = 365
+)
+
+// Срок VIP товара; у старых товаров без параметра - срок по умолчанию
+func vipItemDays(item models.ShopItem) int {
+	if days, err := strconv.Atoi(item.Params["days"]); err == nil && days > 0 {
+		return days
+	}
+	return defaultVIPDays
+}
+
+// Продлевает VIP на days дней от текущего срока или от сейчас.
+// Выдача в Twitch нужна, только если VIP уже отозван или его не было
+func extendVIP(tx *sql.Tx, userID, days int) error {
+	var revoked bool
+	err := tx.QueryRow("SELECT revoked_at IS NOT NULL FROM vip_grants WHERE user_id = $1 FOR UPDATE", userID).Scan(&revoked)
+	needsGrant := err == sql.ErrNoRows || revoked
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO vip_grants (user_id, expires_at) VALUES ($1, NOW() + make_interval(days => $2))
+		ON CONFLICT (user_id) DO UPDATE SET
+			expires_at = GREATEST(vip_grants.expires_at, NOW()) + make_interval(days => $2),
+			granted_at = CASE WHEN vip_grants.revoked_at IS NULL THEN vip_grants.granted_at ELSE NOW() END,
+			revoked_at = NULL
+	`, userID, days)
+	if err != nil {
+		return err
+	}
+
+	if !needsGrant {
+		return nil
+	}
+	return enqueueOutbox(tx, outboxGrantVIP, userID)
+}
+
+// Сокращает срок при возврате покупки. Если срок вышел, VIP отзовет ExpireVIPs
+func shortenVIP(tx *sql.Tx, userID, days int) error {
+	_, err := tx.Exec(`
+		UPDATE vip_grants SET expires_at = expires_at - make_interval(days => $2)
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID, days)
+	return err
+}
+
+// Срок VIP вышел или VIP отозван. Без записи о сроке - false
+func vipExpired(userID int) (bool, error) {
+	var expired bool
+	err := db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM vip_grants WHERE user_id = $1 AND (revoked_at IS NOT NULL OR expires_at <= NOW()))
+	`, userID).Scan(&expired)
+	return expired, err
+}
+
+// Помечает истекшие VIP отозванными и ставит отзыв в Twitch в outbox.
+// Возвращает число истекших
+func ExpireVIPs() (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE vip_grants SET revoked_at = NOW()
+		WHERE user_id IN (
+			SELECT user_id FROM vip_grants
+			WHERE revoked_at IS NULL AND expires_at <= NOW()
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING user_id
+	`)
+	if err != nil {
+		return 0, err
+	}
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, userID := range userIDs {
+		if err := enqueueOutbox(tx, outboxRevokeVIP, userID); err != nil {
+			return 0, err
+		}
+	}
+	return len(userIDs), tx.Commit()
+}
+
+// Действующие VIP, сначала те, что скоро истекут
+func GetActiveVIPs() ([]models.VIPGrant, error) {
+	rows, err := db.Query(`
+		SELECT u.display_name, u.login, g.granted_at, g.expires_at
+		FROM vip_grants g
+		JOIN users u ON u.id = g.user_id
+		WHERE g.revoked_at IS NULL
+		ORDER BY g.expires_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []models.VIPGrant{}
+	for rows.Next() {
+		var g models.VIPGrant
+		if err := rows.Scan(&g.DisplayName, &g.Login, &g.GrantedAt, &g.ExpiresAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// Outbox внешних действий. Задача пишется в транзакции покупки,
+// а выполняется воркером с повторами, пока не кончатся попытки
+
+const (
+	outboxGrantVIP         = "grant_vip"
+	outboxRevokeVIP        = "revoke_vip"
+	outboxChatPostApproved = "chat_post_approved"
+	outboxChatCaseWin      = "chat_case_win"
+	outboxMaxAttempts      = 10
+	outboxBatchSize        = 10
+	outboxMaxRetryWait     = time.Hour
+	// На это время задача закрепляется за воркером. Если воркер упал,
+	// задачу после аренды возьмет другой
+	outboxLease = 5 * time.Minute
+)
+
+func enqueueOutbox(tx *sql.Tx, kind string, userID int) error {
+	_, err := tx.Exec("INSERT INTO outbox (kind, user_id) VALUES ($1, $2)", kind, userID)
+	return err
+}
+
+func runOutboxJob(job models.OutboxJob) error {
+	kind, userID := job.Kind, job.UserID
+	switch kind {
+	case outboxChatPostApproved, outboxChatCaseWin:
+		message, err := chatAnnouncement(job)
+		if err != nil || message == "" {
+			return err
+		}
+		return sendChatMessage(message)
+	case outboxGrantVIP, outboxRevokeVIP:
+		// Задачи могут выполниться не по порядку из-за повторов,
+		// поэтому выдача и отзыв сверяются с текущим сроком VIP
+		expired, err := vipExpired(userID)
+		if err != nil {
+			return err
+		}
+		if expired == (kind == outboxGrantVIP) {
+			return nil
+		}
+		user, err := GetUserByID(userID)
+		if err != nil {
+			return err
+		}
+		if kind == outboxGrantVIP {
+			return GrantVIP(user.Login)
+		}
+		return RevokeVIP(user.Login)
+	}
+	return fmt.Errorf("unknown outbox job %q", kind)
+}
+
+// Пауза перед следующей попыткой: 1, 2, 4... минуты, но не больше часа
+func outboxRetryWait(attempts int) time.Duration {
+	wait := time.Minute << min(attempts-1, 6)
+	return min(wait, outboxMaxRetryWait)
+}
+
+// Выполняет готовые задачи outbox. Задачи берутся в аренду коротким запросом:
+// next_attempt_at сдвигается на outboxLease, поэтому другие воркеры их не возьмут.
+// Запросы в Twitch идут вне транзакций, результат каждой задачи пишется отдельно.
+// Возвращает число выполненных задач
+func ProcessOutbox() (int, error) {
+	rows, err := db.Query(`
+		UPDATE outbox SET next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE done_at IS NULL AND failed_at IS NULL AND next_attempt_at <= NOW()
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, kind, user_id, COALESCE(ref_id, 0), attempts
+	`, outboxBatchSize, int(outboxLease.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+
+	var jobs []models.OutboxJob
+	for rows.Next() {
+		var job models.OutboxJob
+		if err := rows.Scan(&job.ID, &job.Kind, &job.UserID, &job.RefID, &job.Attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		jobs = append(jobs, job)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	// RETURNING не сохраняет порядок подзапроса
+	slices.SortFunc(jobs, func(a, b models.OutboxJob) int { return a.ID - b.ID })
+
+	done := 0
+	for _, job := range jobs {
+		jobErr := runOutboxJob(job)
+		if jobErr == nil {
+			_, err = db.Exec("UPDATE outbox SET done_at = NOW(), attempts = attempts + 1, last_error = '' WHERE id = $1", job.ID)
+			done++
+		} else {
+			log.Printf("Задача outbox %d (%s) не выполнена: %v", job.ID, job.Kind, jobErr)
+			attempts := job.Attempts + 1
+			_, err = db.Exec(`
+				UPDATE outbox
+				SET attempts = $2, last_error = $3, next_attempt_at = $4,
+					failed_at = CASE WHEN $2 >= $5 THEN NOW() END
+				WHERE id = $1
+			`, job.ID, attempts, jobErr.Error(), time.Now().Add(outboxRetryWait(attempts)), outboxMaxAttempts)
+		}
+		if err != nil {
+			return done, err
+		}
+	}
+
+	return done, nil
+}
+
+// Невыполненные задачи, сначала те, у которых кончились попытки
+func GetPendingOutboxJobs() ([]models.OutboxJob, error) {
+	rows, err := db.Query(`
+		SELECT o.id, o.kind, o.user_id, u.display_name, o.attempts, o.last_error,
+			o.created_at, o.next_attempt_at, o.failed_at
+		FROM outbox o
+		JOIN users u ON u.id = o.user_id
+		WHERE o.done_at IS NULL
+		ORDER BY o.failed_at IS NULL, o.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []models.OutboxJob{}
+	for rows.Next() {
+		var job models.OutboxJob
+		if err := rows.Scan(&job.ID, &job.Kind, &job.UserID, &job.DisplayName, &job.Attempts, &job.LastError,
+			&job.CreatedAt, &job.NextAttemptAt, &job.FailedAt); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Возвращает задачу в очередь с новым запасом попыток
+func RetryOutboxJob(id int) error {
+	res, err := db.Exec(`
+		UPDATE outbox
+		SET attempts = 0, failed_at = NULL, next_attempt_at = NOW()
+		WHERE id = $1 AND done_at IS NULL
+	`, id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrOutboxJobNotFound
+	}
+	return nil
+}
+
+// Чат-бот канала. Работает от аккаунта, авторизованного на /admin:
+// команды читает по IRC, анонсы отправляет через Helix из outbox.
+// Включается переменной CHAT_BOT=on
+
+const (
+	chatIRCAddr         = "irc.chat.twitch.tv:6697"
+	chatReadTimeout     = 6 * time.Minute // Twitch присылает PING примерно раз в 5 минут
+	chatWriteTimeout    = 10 * time.Second
+	chatCommandCooldown = 5 * time.Second
+	chatMessageMaxRunes = 500
+	chatTopSize         = 5
+	chatLinkCodeLength  = 8
+	chatLinkCodeTTL     = 10 * time.Minute
+)
+
+// Без похожих символов: код набирают руками в чате
+const chatLinkCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var twitchLoginPattern = regexp.MustCompile(`^[a-z0-9_]{2,25}$`)
+
+func ChatBotEnabled() bool {
+	return os.Getenv("CHAT_BOT") == "on"
+}
+
+// Ставит анонс в outbox; без включенного бота ничего не делает
+func enqueueChatAnnouncement(e execer, kind string, userID, refID int) error {
+	if !ChatBotEnabled() {
+		return nil
+	}
+	_, err := e.Exec("INSERT INTO outbox (kind, user_id, ref_id) VALUES ($1, $2, $3)", kind, userID, refID)
+	return err
+}
+
+// Текст анонса; пустой, если пост успели скрыть или открытие не найдено
+func chatAnnouncement(job models.OutboxJob) (string, error) {
+	switch job.Kind {
+	case outboxChatPostApproved:
+		var author, title string
+		err := db.QueryRow(`
+			SELECT u.display_name, COALESCE(f.title, '')
+			FROM files f
+			JOIN users u ON u.id = f.user_id
+			WHERE f.id = $1 AND f.is_public = true
+		`, job.RefID).Scan(&author, &title)
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		link := BaseURL() + "/post/" + strconv.Itoa(job.RefID)
+		if title == "" {
+			return fmt.Sprintf("Новый пост от %s: %s", author, link), nil
+		}
+		return fmt.Sprintf("Новый пост от %s: «%s» %s", author, title, link), nil
+	case outboxChatCaseWin:
+		reward, err := caseOpeningReward(job.RefID)
+		if err == ErrCaseOpeningNotFound {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		var author, caseTitle string
+		err = db.QueryRow(`
+			SELECT u.display_name, c.title
+			FROM case_openings co
+			JOIN users u ON u.id = co.user_id
+			JOIN cases c ON c.id = co.case_id
+			WHERE co.id = $1
+		`, job.RefID).Scan(&author, &caseTitle)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s открыл кейс «%s» и получил: %s", author, caseTitle, reward.Title), nil
+	}
+	return "", fmt.Errorf("unknown announcement %q", job.Kind)
+}
+
+// Пользователи Helix по запросу вида "id=123"; с пустым запросом - владелец токена
+func helixUsers(token, query string) ([]models.TwitchUser, error) {
+	req, err := http.NewRequest("GET", "https://api.twitch.tv/helix/users?"+query, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Client-Id", os.Getenv("TWITCH_CLIENT_ID_BOT"))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to get users: %s (%s)", resp.Status, string(body))
+	}
+
+	var result models.TwitchUsersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 {
+		return nil, errors.New("user not found")
+	}
+	return result.Data, nil
+}
+
+// Одна строка не длиннее лимита Twitch
+func chatText(message string) string {
+	message = strings.Join(strings.Fields(message), " ")
+	if runes := []rune(message); len(runes) > chatMessageMaxRunes {
+		message = string(runes[:chatMessageMaxRunes-1]) + "…"
+	}
+	return message
+}
+
+// Сообщение в чат канала через Helix (scope user:write:chat)
+func sendChatMessage(message string) error {
+	token, err := RefreshTwitchToken()
+	if err != nil {
+		return err
+	}
+	bot, err := helixUsers(token, "")
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"broadcaster_id": os.Getenv("TWITCH_CHANNEL_ID"),
+		"sender_id":      bot[0].ID,
+		"message":        chatText(message),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", "https://api.twitch.tv/helix/chat/messages", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Client-Id", os.Getenv("TWITCH_CLIENT_ID_BOT"))
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to send chat message: %s (%s)", resp.Status, string(body))
+	}
+
+	var result struct {
+		Data []struct {
+			IsSent     bool `json:"is_sent"`
+			DropReason *struct {
+				Message string `json:"message"`
+			} `json:"drop_reason"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if len(result.Data) > 0 && !result.Data[0].IsSent {
+		if reason := result.Data[0].DropReason; reason != nil {
+			return fmt.Errorf("chat message dropped: %s", reason.Message)
+		}
+		return errors.New("chat message dropped")
+	}
+	return nil
+}
+
+type ircMessage struct {
+	tags     map[string]string
+	nick     string
+	command  string
+	trailing string
+}
+
+var ircTagUnescaper = strings.NewReplacer(`\s`, " ", `\:`, ";", `\\`, `\`, `\r`, "\r", `\n`, "\n")
+
+// Строка IRC вида "@tags :prefix COMMAND params :trailing"
+func parseIRCMessage(line string) ircMessage {
+	msg := ircMessage{tags: map[string]string{}}
+	if strings.HasPrefix(line, "@") {
+		var tags string
+		tags, line, _ = strings.Cut(line[1:], " ")
+		for _, tag := range strings.Split(tags, ";") {
+			key, value, _ := strings.Cut(tag, "=")
+			msg.tags[key] = ircTagUnescaper.Replace(value)
+		}
+	}
+	if strings.HasPrefix(line, ":") {
+		var prefix string
+		prefix, line, _ = strings.Cut(line[1:], " ")
+		msg.nick, _, _ = strings.Cut(prefix, "!")
+	}
+	line, msg.trailing, _ = strings.Cut(line, " :")
+	if fields := strings.Fields(line); len(fields) > 0 {
+		msg.command = fields[0]
+	}
+	return msg
+}
+
+// Подключается к чату канала и отвечает на команды, пока соединение живо.
+// Всегда возвращает ошибку, после которой воркер переподключается
+func RunChatBot() error {
+	token, err := RefreshTwitchToken()
+	if err != nil {
+		return err
+	}
+	bot, err := helixUsers(token, "")
+	if err != nil {
+		return err
+	}
+	channel, err := helixUsers(token, "id="+url.QueryEscape(os.Getenv("TWITCH_CHANNEL_ID")))
+	if err != nil {
+		return err
+	}
+	room := "#" + channel[0].Login
+
+	conn, err := tls.Dial("tcp", chatIRCAddr, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	send := func(line string) error {
+		conn.SetWriteDeadline(time.Now().Add(chatWriteTimeout))
+		_, err := io.WriteString(conn, line+"\r\n")
+		return err
+	}
+
+	for _, line := range []string{
+		"CAP REQ :twitch.tv/tags twitch.tv/commands",
+		"PASS oauth:" + token,
+		"NICK " + bot[0].Login,
+		"JOIN " + room,
+	} {
+		if err := send(line); err != nil {
+			return err
+		}
+	}
+	log.Printf("Чат-бот %s подключен к %s", bot[0].Login, room)
+
+	cooldowns := map[string]time.Time{}
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(chatReadTimeout))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		msg := parseIRCMessage(strings.TrimRight(line, "\r\n"))
+		switch msg.command {
+		case "PING":
+			err = send("PONG :" + msg.trailing)
+		case "RECONNECT":
+			return errors.New("twitch asked to reconnect")
+		case "NOTICE":
+			if strings.Contains(msg.trailing, "authentication failed") || strings.Contains(msg.trailing, "Improperly formatted auth") {
+				return errors.New(msg.trailing)
+			}
+		case "PRIVMSG":
+			chatterID := msg.tags["user-id"]
+			now := time.Now()
+			if chatterID == "" || chatterID == bot[0].ID || now.Before(cooldowns[chatterID]) {
+				continue
+			}
+			reply := chatCommand(chatterID, msg.nick, msg.trailing)
+			if reply == "" {
+				continue
+			}
+			if len(cooldowns) > 1000 {
+				maps.DeleteFunc(cooldowns, func(_ string, until time.Time) bool { return now.After(until) })
+			}
+			cooldowns[chatterID] = now.Add(chatCommandCooldown)
+			err = send(fmt.Sprintf("@reply-parent-msg-id=%s PRIVMSG %s :%s", msg.tags["id"], room, chatText(reply)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Ответ на сообщение из чата; пустая строка, если это не команда бота
+func chatCommand(chatterID, login, text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	var reply string
+	var err error
+	switch strings.ToLower(fields[0]) {
+	case "!top":
+		reply, err = chatTopReply()
+	case "!auk":
+		reply, err = chatAukReply()
+	case "!balance":
+		reply, err = chatBalanceReply(chatterID)
+	case "!link":
+		if len(fields) < 2 {
+			return "Получите код в настройках на сайте и отправьте !link <код>"
+		}
+		reply, err = chatLinkReply(fields[1], chatterID, login)
+	default:
+		return ""
+	}
+	if err != nil {
+		log.Printf("Чат-бот: команда %s: %v", fields[0], err)
+		return "Не получилось, попробуйте позже"
+	}
+	return reply
+}
+
+func chatTopReply() (string, error) {
+	top, err := GetRatingTop(chatTopSize)
+	if err != nil {
+		return "", err
+	}
+	if len(top) == 0 {
+		return "Рейтинг пока пуст", nil
+	}
+	places := make([]string, 0, len(top))
+	for i, user := range top {
+		places = append(places, fmt.Sprintf("%d. %s — %d", i+1, user.DisplayName, user.Rating))
+	}
+	return "Топ по рейтингу: " + strings.Join(places, ", "), nil
+}
+
+func chatAukReply() (string, error) {
+	queue, err := GetQueue()
+	if err != nil {
+		return "", err
+	}
+	if len(queue) == 0 {
+		return "Очередь аукциона пуста", nil
+	}
+	total, top := 0, queue[0]
+	for _, s := range queue {
+		total += s.AukValue
+		if s.AukValue > top.AukValue {
+			top = s
+		}
+	}
+	return fmt.Sprintf("Лотов в очереди аукциона: %d на %d ₽, больше всех у %s — %d ₽",
+		len(queue), total, top.DisplayName, top.AukValue), nil
+}
+
+func chatBalanceReply(chatterID string) (string, error) {
+	userID, err := chatUserID(chatterID)
+	if err == sql.ErrNoRows {
+		return "Аккаунт не найден на сайте. Войдите через Twitch или привяжите аккаунт командой !link", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Рейтинг %s: %d", user.DisplayName, user.Rating), nil
+}
+
+func chatLinkReply(code, chatterID, login string) (string, error) {
+	user, err := LinkChatIdentity(code, chatterID, login)
+	switch err {
+	case nil:
+		return "Аккаунт привязан к профилю " + user.DisplayName, nil
+	case ErrChatLinkCodeInvalid:
+		return "Код не подходит, устарел или выдан для другого аккаунта Twitch. Получите новый в настройках", nil
+	case ErrChatIdentityTaken:
+		return "У этого аккаунта Twitch уже есть свой профиль на сайте", nil
+	}
+	return "", err
+}
+
+// Лучшие по рейтингу, без забаненных
+func GetRatingTop(limit int) ([]models.User, error) {
+	rows, err := db.Query(`
+		SELECT display_name, rating FROM users
+		WHERE is_banned IS NOT TRUE
+		ORDER BY rating DESC, id
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.User
+	for rows.Next() {
+		var u models.User
+		if err := rows.Scan(&u.DisplayName, &u.Rating); err != nil {
+			return nil, err
+		}
+		result = append(result, u)
+	}
+	return result, rows.Err()
+}
+
+// Привязка аккаунта Twitch из чата к профилю. Аккаунт, которым выполнен
+// вход на сайт, бот узнает сам; привязка нужна, чтобы писать с другого.
+// Явная привязка важнее совпадения twitch_id
+
+func chatUserID(chatterID string) (int, error) {
+	var userID sql.NullInt64
+	err := db.QueryRow(`
+		SELECT COALESCE(
+			(SELECT user_id FROM chat_links WHERE twitch_user_id = $1),
+			(SELECT id FROM users WHERE twitch_id = $1)
+		)
+	`, chatterID).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+	if !userID.Valid {
+		return 0, sql.ErrNoRows
+	}
+	return int(userID.Int64), nil
+}
+
+func chatLinkCode() (string, error) {
+	b := make([]byte, chatLinkCodeLength)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = chatLinkCodeAlphabet[int(b[i])%len(chatLinkCodeAlphabet)]
+	}
+	return string(b), nil
+}
+
+// Новый код привязки для аккаунта twitchLogin; прежние коды пользователя перестают действовать.
+// Код виден всем в чате, поэтому принять его можно только от этого аккаунта
+func CreateChatLinkCode(userID int, twitchLogin string) (models.ChatLinkCode, error) {
+	var result models.ChatLinkCode
+	twitchLogin = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(twitchLogin), "@"))
+	if !twitchLoginPattern.MatchString(twitchLogin) {
+		return result, &ValidationError{Field: "login", Message: "twitch login must be 2-25 latin letters, digits or _"}
+	}
+
+	code, err := chatLinkCode()
+	if err != nil {
+		return result, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM chat_link_codes WHERE user_id = $1 OR expires_at < NOW()", userID)
+	if err != nil {
+		return result, err
+	}
+	err = tx.QueryRow(`
+		INSERT INTO chat_link_codes (code, user_id, twitch_login, expires_at) VALUES ($1, $2, $3, $4)
+		RETURNING code, twitch_login, expires_at
+	`, code, userID, twitchLogin, time.Now().Add(chatLinkCodeTTL)).Scan(&result.Code, &result.TwitchLogin, &result.ExpiresAt)
+	if err != nil {
+		return result, err
+	}
+
+	return result, tx.Commit()
+}
+
+// Привязывает аккаунт из чата по коду. Код принимается только от логина, указанного
+// при его получении: чужое сообщение с подсмотренным кодом его не тратит.
+// Аккаунт, уже привязанный к другому профилю, переезжает: код подтверждает,
+// что им владеет тот же человек
+func LinkChatIdentity(code, chatterID, login string) (*models.User, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(`
+		DELETE FROM chat_link_codes WHERE code = $1 AND twitch_login = $2 AND expires_at > NOW()
+		RETURNING user_id
+	`, strings.ToUpper(code), strings.ToLower(login)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, ErrChatLinkCodeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ownerID int
+	err = tx.QueryRow("SELECT id FROM users WHERE twitch_id = $1", chatterID).Scan(&ownerID)
+	if err == nil && ownerID != userID {
+		return nil, ErrChatIdentityTaken
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM chat_links WHERE twitch_user_id = $1", chatterID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO chat_links (user_id, twitch_user_id, twitch_login) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET twitch_user_id = EXCLUDED.twitch_user_id, twitch_login = EXCLUDED.twitch_login, linked_at = NOW()
+	`, userID, chatterID, login)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetUserByID(userID)
+}
+
+// Привязанный аккаунт из чата или nil
+func GetChatLink(userID int) (*models.ChatLink, error) {
+	var link models.ChatLink
+	err := db.QueryRow("SELECT twitch_login, linked_at FROM chat_links WHERE user_id = $1", userID).Scan(&link.TwitchLogin, &link.LinkedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func UnlinkChat(userID int) error {
+	_, err := db.Exec("DELETE FROM chat_links WHERE user_id = $1", userID)
 	return err
 }
@@ -519,6 +519,10 @@ document.addEventListener('DOMContentLoaded', () => {
                             <label>Вероятность (0-1):</label>
                             <input type="number" id="vipProbability" step="0.01" min="0" max="1" value="0.1" class="form-control">
                         </div>
+                        <div class="reward-probability">
+                            <label>Дней VIP:</label>
+                            <input type="number" id="vipDays" min="1" max="365" value="30" class="form-control">
+                        </div>
                     </div>
                 `;
                 break;
@@ -580,9 +584,15 @@ document.addEventListener('DOMContentLoaded', () => {
                     alert('Введите корректную вероятность');
                     return;
                 }
+                const vipDays = parseInt(document.getElementById('vipDays').value);
+                if (isNaN(vipDays)) {
+                    alert('Введите срок VIP в днях');
+                    return;
+                }
                 reward = {
                     type: 'vip',
-                    probability: vipProb
+                    probability: vipProb,
+                    vipDays: vipDays
                 };
                 break;
                 
@@ -631,9 +641,17 @@ document.addEventListener('DOMContentLoaded', () => {
         renderRewardsList();
     });
 
+    const rewardsSum = document.getElementById('rewardsSum');
+    const normalizeRewards = document.getElementById('normalizeRewards');
+
+    function rewardsProbabilitySum() {
+        return caseRewards.reduce((sum, reward) => sum + reward.probability, 0);
+    }
+
     // Отрисовка списка наград
     function renderRewardsList() {
         rewardsList.innerHTML = '';
+        rewardsSum.textContent = Number(rewardsProbabilitySum().toFixed(6));
         
         caseRewards.forEach((reward, index) => {
             const card = document.createElement('div');
@@ -645,7 +663,7 @@ document.addEventListener('DOMContentLoaded', () => {
                     content = `
                         <img src="../static/img/vip.png" alt="VIP" class="reward-image">
                         <div class="reward-info">
-                            <div>VIP</div>
+                            <div>VIP на ${reward.vipDays} дн.</div>
                             <div class="reward-probability">
                                 Вероятность: <strong>${reward.probability}</strong>
                             </div>
@@ -699,9 +717,12 @@ document.addEventListener('DOMContentLoaded', () => {
             formData.append('case_id', caseId);
             formData.append('type', reward.type);
             formData.append('probability', reward.probability);
+            formData.append('normalize', normalizeRewards.checked);
             
             if (reward.type === 'badge') {
                 formData.append('badge_id', reward.badgeId);
+            } else if (reward.type === 'vip') {
+                formData.append('vip_days', reward.vipDays);
             } else if (reward.type === 'auk') {
                 formData.append('auk_value', reward.aukValue);
             }
@@ -719,6 +740,13 @@ document.addEventListener('DOMContentLoaded', () => {
                 console.error('Ошибка при добавлении награды:', error);
             }
         }
+
+        if (normalizeRewards.checked) {
+            const response = await fetch(`/api/admin/cases/${caseId}/normalize`, { method: 'POST' });
+            if (!response.ok) {
+                console.error('Ошибка нормализации шансов:', await response.text());
+            }
+        }
     }
 
     // Обработчик кнопки добавления
@@ -738,6 +766,15 @@ document.addEventListener('DOMContentLoaded', () => {
 
         const description = caseDescriptionInput.value.trim();
 
+        if (caseRewards.length === 0) {
+            alert('Добавьте награды кейса');
+            return;
+        }
+        if (!normalizeRewards.checked && Math.abs(rewardsProbabilitySum() - 1) > 1e-4) {
+            alert('Сумма шансов должна равняться 1 или включите приведение шансов');
+            return;
+        }
+
         const price = parseFloat(costCaseInput.value);
         if (isNaN(price) || price < 0) {
             alert('Введите корректную стоимость (число больше или равно 0)');
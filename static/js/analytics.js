@@ -0,0 +1,127 @@
+document.addEventListener('DOMContentLoaded', () => {
+    const periodButtons = document.querySelectorAll('.period-button');
+    const topPosts = document.getElementById('topPosts');
+    const params = new URLSearchParams(window.location.search);
+    const postId = params.get('post_id');
+
+    let chart = null;
+
+    if (postId) {
+        document.querySelector('.analytics-header .section-title').textContent = 'Аналитика поста';
+    }
+
+    // Загрузка аналитики за выбранный период
+    function loadAnalytics(days) {
+        let url = `/api/analytics?days=${days}`;
+        if (postId) {
+            url += `&post_id=${encodeURIComponent(postId)}`;
+        }
+
+        fetch(url)
+            .then(response => {
+                if (!response.ok) {
+                    throw new Error('Ошибка загрузки аналитики');
+                }
+                return response.json();
+            })
+            .then(data => {
+                renderTotals(data.totals);
+                renderChart(data.series);
+                renderTopPosts(data.top_posts);
+            })
+            .catch(error => {
+                console.error('Ошибка:', error);
+                topPosts.innerHTML = '<div class="empty-analytics">Не удалось загрузить аналитику</div>';
+            });
+    }
+
+    function renderTotals(totals) {
+        document.querySelectorAll('.total-value').forEach(el => {
+            el.textContent = totals[el.dataset.metric] || 0;
+        });
+    }
+
+    function renderChart(series) {
+        const labels = series.map(point => {
+            const [year, month, day] = point.day.split('-');
+            return `${day}.${month}`;
+        });
+
+        const datasets = [
+            { label: 'Просмотры', data: series.map(p => p.views), borderColor: '#8225fc' },
+            { label: 'Лайки', data: series.map(p => p.likes), borderColor: '#28a745' },
+            { label: 'Посылы', data: series.map(p => p.fucks), borderColor: '#dc3545' },
+            { label: 'Комментарии', data: series.map(p => p.comments), borderColor: '#ffc107' },
+            { label: 'Подписчики', data: series.map(p => p.followers), borderColor: '#17a2b8' }
+        ].map(dataset => ({ ...dataset, tension: 0.3, fill: false }));
+
+        if (chart) {
+            chart.data.labels = labels;
+            chart.data.datasets = datasets;
+            chart.update();
+            return;
+        }
+
+        chart = new Chart(document.getElementById('trendChart'), {
+            type: 'line',
+            data: { labels, datasets },
+            options: {
+                responsive: true,
+                maintainAspectRatio: false,
+                plugins: {
+                    legend: { labels: { color: '#ffffff' } }
+                },
+                scales: {
+                    x: { ticks: { color: 'rgba(255, 255, 255, 0.7)' } },
+                    y: { beginAtZero: true, ticks: { color: 'rgba(255, 255, 255, 0.7)', precision: 0 } }
+                }
+            }
+        });
+    }
+
+    function renderTopPosts(posts) {
+        if (!posts || posts.length === 0) {
+            topPosts.innerHTML = '<div class="empty-analytics">За этот период данных пока нет</div>';
+            return;
+        }
+
+        topPosts.innerHTML = '';
+        posts.forEach(post => {
+            const item = document.createElement('a');
+            item.className = 'top-post';
+            item.href = `/post/${post.id}`;
+
+            let preview = '';
+            if (post.type === 'clip') {
+                preview = post.thumbnail;
+            } else if (post.thumbnail) {
+                preview = `../static/uploads/${post.thumbnail}`;
+            } else {
+                preview = `../static/uploads/${post.file_name}`;
+            }
+
+            item.innerHTML = `
+                <img src="${preview}" alt="" class="top-post-thumbnail">
+                <div class="top-post-info">
+                    <div class="top-post-title"></div>
+                    <div class="top-post-stats">
+                        👁 ${post.views} · ❤ ${post.likes} · 🖕 ${post.fucks} · 💬 ${post.comments}
+                    </div>
+                </div>
+            `;
+            item.querySelector('.top-post-title').textContent = post.title;
+
+            topPosts.appendChild(item);
+        });
+    }
+
+    periodButtons.forEach(button => {
+        button.addEventListener('click', () => {
+            periodButtons.forEach(b => b.classList.remove('active'));
+            button.classList.add('active');
+            loadAnalytics(button.dataset.days);
+        });
+    });
+
+    loadAnalytics(7);
+});
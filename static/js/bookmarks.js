@@ -0,0 +1,67 @@
+// Закладки и "Смотреть позже"
+document.addEventListener('DOMContentLoaded', function() {
+    const bookmarkBtn = document.getElementById('bookmarkBtn');
+    if (bookmarkBtn) {
+        bookmarkBtn.addEventListener('click', function() {
+            const active = bookmarkBtn.classList.contains('active');
+
+            fetch(`/api/bookmarks/${bookmarkBtn.dataset.postId}`, { method: active ? 'DELETE' : 'POST' })
+                .then(response => {
+                    if (!response.ok) throw new Error('Ошибка при изменении закладки');
+                    bookmarkBtn.classList.toggle('active', !active);
+                    bookmarkBtn.textContent = active ? 'В закладки' : 'В закладках';
+                })
+                .catch(error => console.error('Ошибка:', error));
+        });
+    }
+
+    const watchLaterBtn = document.getElementById('watchLaterBtn');
+    if (watchLaterBtn) {
+        const postId = watchLaterBtn.dataset.postId;
+
+        function setWatchLater(active) {
+            watchLaterBtn.classList.toggle('active', active);
+            watchLaterBtn.textContent = active ? 'В списке «Смотреть позже»' : 'Смотреть позже';
+        }
+
+        watchLaterBtn.addEventListener('click', function() {
+            const active = watchLaterBtn.classList.contains('active');
+
+            fetch(`/api/watch-later/${postId}`, { method: active ? 'DELETE' : 'POST' })
+                .then(response => {
+                    if (!response.ok) throw new Error('Ошибка при изменении списка');
+                    setWatchLater(!active);
+                })
+                .catch(error => console.error('Ошибка:', error));
+        });
+
+        // Досмотренное видео убираем из очереди
+        const video = document.getElementById('mainVideo');
+        if (video) {
+            video.addEventListener('ended', function() {
+                if (!watchLaterBtn.classList.contains('active')) return;
+
+                fetch(`/api/watch-later/${postId}`, { method: 'DELETE' })
+                    .then(response => {
+                        if (response.ok) setWatchLater(false);
+                    })
+                    .catch(error => console.error('Ошибка:', error));
+            });
+        }
+    }
+
+    // Удаление со страницы закладок
+    document.querySelectorAll('.saved-remove').forEach(button => {
+        button.addEventListener('click', function(e) {
+            e.preventDefault();
+
+            const card = button.closest('.saved-card');
+            fetch(`/api/${button.dataset.list}/${card.dataset.postId}`, { method: 'DELETE' })
+                .then(response => {
+                    if (!response.ok) throw new Error('Ошибка при удалении');
+                    card.remove();
+                })
+                .catch(error => console.error('Ошибка:', error));
+        });
+    });
+});
@@ -0,0 +1,110 @@
+document.addEventListener('DOMContentLoaded', () => {
+    const reportsList = document.getElementById('caseReportsList');
+    const simulationCount = document.getElementById('simulationCount');
+    const simulationAukRate = document.getElementById('simulationAukRate');
+    const simulation = document.getElementById('caseSimulation');
+    const simulationSummary = document.getElementById('caseSimulationSummary');
+    const simulationList = document.getElementById('caseSimulationList');
+
+    function cell(text) {
+        const td = document.createElement('td');
+        td.textContent = text;
+        return td;
+    }
+
+    function button(text, onClick) {
+        const btn = document.createElement('button');
+        btn.className = 'btn btn-secondary';
+        btn.textContent = text;
+        btn.addEventListener('click', onClick);
+        return btn;
+    }
+
+    function percent(value) {
+        return `${(value * 100).toFixed(2)}%`;
+    }
+
+    // Отчеты по наградам кейсов
+    function loadReports() {
+        fetch('/api/admin/cases')
+            .then(response => response.json())
+            .then(renderReports)
+            .catch(error => console.error('Error loading case reports:', error));
+    }
+
+    function renderReports(reports) {
+        reportsList.innerHTML = '';
+        reports.forEach(report => {
+            const row = document.createElement('tr');
+            row.appendChild(cell(report.title));
+            row.appendChild(cell(report.rewards));
+            row.appendChild(cell(Number(report.sum.toFixed(6))));
+
+            const issues = cell(report.valid ? 'Нет' : report.issues.join('; '));
+            issues.className = report.valid ? 'case-valid' : 'case-invalid';
+            row.appendChild(issues);
+
+            const actions = document.createElement('td');
+            if (!report.valid && report.rewards > 0) {
+                actions.appendChild(button('Нормализовать', () => normalize(report.case_id)));
+            }
+            actions.appendChild(button('Симулировать', () => simulate(report.case_id)));
+            row.appendChild(actions);
+
+            reportsList.appendChild(row);
+        });
+    }
+
+    function normalize(caseId) {
+        fetch(`/api/admin/cases/${caseId}/normalize`, { method: 'POST' })
+            .then(response => {
+                if (!response.ok) {
+                    throw new Error(response.status);
+                }
+                loadReports();
+            })
+            .catch(error => {
+                console.error('Error normalizing case:', error);
+                alert('Не удалось нормализовать шансы');
+            });
+    }
+
+    // Виртуальные открытия кейса
+    function simulate(caseId) {
+        const params = new URLSearchParams({ n: simulationCount.value, auk_rate: simulationAukRate.value });
+        fetch(`/api/admin/cases/${caseId}/simulate?${params}`)
+            .then(async response => {
+                const data = await response.json();
+                if (!response.ok) {
+                    throw new Error(data.error.message);
+                }
+                renderSimulation(data);
+            })
+            .catch(error => alert(`Ошибка симуляции: ${error.message}`));
+    }
+
+    function renderSimulation(data) {
+        let summary = `Открытий: ${data.openings}. Цена: ${data.price} э. ` +
+            `Ожидаемая ценность: ${data.expected_value.toFixed(2)} э ` +
+            `(${percent(data.return_rate)} от цены), в симуляции: ${data.average_value.toFixed(2)} э.`;
+        if (data.failed > 0) {
+            summary += ` Без награды: ${data.failed}.`;
+        }
+        simulationSummary.textContent = summary;
+
+        simulationList.innerHTML = '';
+        (data.rewards || []).forEach(reward => {
+            const row = document.createElement('tr');
+            row.appendChild(cell(reward.title));
+            row.appendChild(cell(percent(reward.probability)));
+            row.appendChild(cell(reward.count));
+            row.appendChild(cell(percent(reward.share)));
+            row.appendChild(cell(reward.priced ? `${reward.value} э` : 'Не продается'));
+            simulationList.appendChild(row);
+        });
+
+        simulation.style.display = 'block';
+    }
+
+    loadReports();
+});
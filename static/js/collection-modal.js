@@ -0,0 +1,83 @@
+// Добавление поста в коллекции
+document.addEventListener('DOMContentLoaded', function() {
+    const addBtn = document.getElementById('addToCollectionBtn');
+    const modal = document.getElementById('collectionModal');
+    if (!addBtn || !modal) return;
+
+    const postId = addBtn.dataset.postId;
+    const list = document.getElementById('collectionModalList');
+    const form = document.getElementById('collectionModalForm');
+
+    function loadCollections() {
+        fetch(`/api/collections?post_id=${postId}`)
+            .then(response => {
+                if (!response.ok) throw new Error('Ошибка при загрузке коллекций');
+                return response.json();
+            })
+            .then(collections => {
+                list.innerHTML = '';
+                if (!collections || collections.length === 0) {
+                    list.innerHTML = '<div class="collection-modal-empty">У вас пока нет коллекций</div>';
+                    return;
+                }
+
+                collections.forEach(collection => {
+                    const label = document.createElement('label');
+                    label.className = 'collection-modal-item';
+
+                    const checkbox = document.createElement('input');
+                    checkbox.type = 'checkbox';
+                    checkbox.checked = collection.contains;
+                    checkbox.addEventListener('change', () => toggle(collection.id, checkbox));
+
+                    const title = document.createElement('span');
+                    title.textContent = collection.title + (collection.is_public ? '' : ' 🔒');
+
+                    label.appendChild(checkbox);
+                    label.appendChild(title);
+                    list.appendChild(label);
+                });
+            })
+            .catch(error => console.error('Ошибка:', error));
+    }
+
+    function toggle(collectionId, checkbox) {
+        fetch(`/api/collections/${collectionId}/posts/${postId}`, { method: checkbox.checked ? 'POST' : 'DELETE' })
+            .then(response => {
+                if (!response.ok) throw new Error('Ошибка при изменении коллекции');
+            })
+            .catch(error => {
+                console.error('Ошибка:', error);
+                checkbox.checked = !checkbox.checked;
+            });
+    }
+
+    addBtn.addEventListener('click', function() {
+        modal.style.display = 'flex';
+        loadCollections();
+    });
+
+    document.getElementById('closeCollectionModal').addEventListener('click', function() {
+        modal.style.display = 'none';
+    });
+
+    modal.addEventListener('click', function(e) {
+        if (e.target === modal) modal.style.display = 'none';
+    });
+
+    form.addEventListener('submit', function(e) {
+        e.preventDefault();
+
+        const formData = new FormData();
+        formData.append('title', form.title.value.trim());
+        formData.append('post_id', postId);
+
+        fetch('/api/collections', { method: 'POST', body: formData })
+            .then(response => {
+                if (!response.ok) throw new Error('Ошибка при создании коллекции');
+                form.reset();
+                loadCollections();
+            })
+            .catch(error => console.error('Ошибка:', error));
+    });
+});
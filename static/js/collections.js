@@ -0,0 +1,143 @@
+// Коллекции
+document.addEventListener('DOMContentLoaded', function() {
+    const createForm = document.getElementById('createCollectionForm');
+    if (createForm) {
+        createForm.addEventListener('submit', function(e) {
+            e.preventDefault();
+
+            const formData = new FormData();
+            formData.append('title', createForm.title.value.trim());
+            formData.append('description', createForm.description.value.trim());
+            formData.append('is_public', createForm.is_public.checked);
+
+            fetch('/api/collections', { method: 'POST', body: formData })
+                .then(response => {
+                    if (!response.ok) throw new Error('Ошибка при создании коллекции');
+                    return response.json();
+                })
+                .then(data => {
+                    window.location.href = `/collection/${data.id}`;
+                })
+                .catch(error => {
+                    console.error('Ошибка:', error);
+                    alert('Не удалось создать коллекцию');
+                });
+        });
+    }
+
+    const collectionData = document.getElementById('collectionData');
+    if (!collectionData) return;
+
+    const collectionId = collectionData.dataset.collectionId;
+
+    document.getElementById('shareCollectionBtn')?.addEventListener('click', function() {
+        const url = `${window.location.origin}/collection/${collectionId}`;
+        navigator.clipboard.writeText(url)
+            .then(() => {
+                this.textContent = 'Ссылка скопирована';
+                setTimeout(() => this.textContent = 'Поделиться', 2000);
+            })
+            .catch(() => prompt('Скопируйте ссылку:', url));
+    });
+
+    const followBtn = document.getElementById('followCollectionBtn');
+    if (followBtn) {
+        followBtn.addEventListener('click', function() {
+            const following = followBtn.dataset.following === 'true';
+
+            fetch(`/api/collections/${collectionId}/follow`, { method: following ? 'DELETE' : 'POST' })
+                .then(response => {
+                    if (!response.ok) throw new Error('Ошибка при подписке');
+
+                    const counter = document.getElementById('collectionFollowers');
+                    counter.textContent = parseInt(counter.textContent) + (following ? -1 : 1);
+                    followBtn.dataset.following = (!following).toString();
+                    followBtn.textContent = following ? 'Подписаться' : 'Отписаться';
+                })
+                .catch(error => console.error('Ошибка:', error));
+        });
+    }
+
+    const editForm = document.getElementById('editCollectionForm');
+    document.getElementById('editCollectionBtn')?.addEventListener('click', function() {
+        editForm.style.display = editForm.style.display === 'none' ? 'flex' : 'none';
+    });
+
+    if (editForm) {
+        editForm.addEventListener('submit', function(e) {
+            e.preventDefault();
+
+            const formData = new FormData();
+            formData.append('title', editForm.title.value.trim());
+            formData.append('description', editForm.description.value.trim());
+            formData.append('is_public', editForm.is_public.checked);
+
+            fetch(`/api/collections/${collectionId}`, {
+                method: 'PUT',
+                body: new URLSearchParams(formData)
+            })
+                .then(response => {
+                    if (!response.ok) throw new Error('Ошибка при сохранении коллекции');
+                    window.location.reload();
+                })
+                .catch(error => {
+                    console.error('Ошибка:', error);
+                    alert('Не удалось сохранить коллекцию');
+                });
+        });
+    }
+
+    document.getElementById('deleteCollectionBtn')?.addEventListener('click', function() {
+        if (!confirm('Удалить коллекцию?')) return;
+
+        fetch(`/api/collections/${collectionId}`, { method: 'DELETE' })
+            .then(response => {
+                if (!response.ok) throw new Error('Ошибка при удалении коллекции');
+                window.location.href = '/collections';
+            })
+            .catch(error => console.error('Ошибка:', error));
+    });
+
+    const postsContainer = document.getElementById('collectionPosts');
+
+    function saveOrder() {
+        const posts = Array.from(postsContainer.querySelectorAll('.collection-post'))
+            .map(post => parseInt(post.dataset.postId));
+
+        fetch(`/api/collections/${collectionId}/order`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ posts: posts })
+        })
+            .then(response => {
+                if (!response.ok) throw new Error('Ошибка при сохранении порядка');
+            })
+            .catch(error => console.error('Ошибка:', error));
+    }
+
+    postsContainer.addEventListener('click', function(e) {
+        const post = e.target.closest('.collection-post');
+        if (!post) return;
+
+        if (e.target.classList.contains('move-up')) {
+            const prev = post.previousElementSibling;
+            if (prev) {
+                postsContainer.insertBefore(post, prev);
+                saveOrder();
+            }
+        } else if (e.target.classList.contains('move-down')) {
+            const next = post.nextElementSibling;
+            if (next) {
+                postsContainer.insertBefore(next, post);
+                saveOrder();
+            }
+        } else if (e.target.classList.contains('remove-post')) {
+            fetch(`/api/collections/${collectionId}/posts/${post.dataset.postId}`, { method: 'DELETE' })
+                .then(response => {
+                    if (!response.ok) throw new Error('Ошибка при удалении поста из коллекции');
+                    post.remove();
+                })
+                .catch(error => console.error('Ошибка:', error));
+        }
+    });
+});
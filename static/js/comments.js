@@ -0,0 +1,375 @@
+// Комментарии: ветки ответов, сортировка и подгрузка страниц
+document.addEventListener('DOMContentLoaded', function() {
+    const list = document.getElementById('commentsList');
+    if (!list) return;
+
+    const fileId = list.dataset.fileId;
+    const userId = parseInt(list.dataset.userId) || 0;
+    const isModerator = list.dataset.moderator === 'true';
+    const form = document.getElementById('commentForm');
+    const loadMoreBtn = document.getElementById('loadMoreComments');
+    const CLICK_DELAY = 120;
+
+    let sort = 'new';
+    let nextCursor = '';
+    let lastLikeClick = 0;
+
+    const likeIcon = '<svg width="16" height="16" viewBox="0 0 24 24"><path d="M16.5,3C13.605,3,12,5.09,12,5.09S10.395,3,7.5,3C4.462,3,2,5.462,2,8.5c0,4.171,4.912,8.8,10,12.5 c5.088-3.7,10-8.329,10-12.5C22,5.462,19.538,3,16.5,3z" fill="#65676B"/></svg>';
+
+    function redirectGuest() {
+        if (userId) return false;
+        window.location.href = '/';
+        return true;
+    }
+
+    function timeAgo(value) {
+        const seconds = Math.floor((Date.now() - new Date(value).getTime()) / 1000);
+        if (seconds < 60) return 'только что';
+        const minutes = Math.floor(seconds / 60);
+        if (minutes < 60) return `${minutes} мин. назад`;
+        const hours = Math.floor(minutes / 60);
+        if (hours < 24) return `${hours} ч. назад`;
+        const days = Math.floor(hours / 24);
+        if (days < 30) return `${days} дн. назад`;
+        return new Date(value).toLocaleDateString('ru-RU');
+    }
+
+    function createElement(tag, className, text) {
+        const element = document.createElement(tag);
+        if (className) element.className = className;
+        if (text !== undefined) element.textContent = text;
+        return element;
+    }
+
+    function renderComment(comment) {
+        const element = createElement('div', 'comment');
+        element.dataset.commentId = comment.id;
+        if (comment.parent_id) element.dataset.parentId = comment.parent_id;
+
+        const avatar = createElement('img', 'comment-avatar');
+        avatar.src = comment.author_image;
+        avatar.alt = comment.author_name;
+        avatar.addEventListener('click', () => window.location.href = `/user/${comment.author_name}`);
+
+        const content = createElement('div', 'comment-content');
+        const header = createElement('div', 'comment-header');
+
+        const author = createElement('div', 'username-badge-comment');
+        const authorLink = createElement('a', 'comment-author', comment.author_name);
+        authorLink.href = `/user/${comment.author_name}`;
+        author.appendChild(authorLink);
+        if (comment.badge_image_url) {
+            const badge = createElement('img', 'user-badge');
+            badge.src = comment.badge_image_url;
+            badge.alt = 'Badge';
+            badge.width = 20;
+            badge.height = 20;
+            author.appendChild(badge);
+        }
+        header.appendChild(author);
+        header.appendChild(createElement('span', 'comment-time', timeAgo(comment.created_at)));
+
+        if (comment.is_edited && !comment.is_deleted) {
+            const edited = createElement('button', 'comment-edited', 'изменено');
+            edited.title = 'История правок';
+            header.appendChild(edited);
+        }
+
+        const isOwner = userId && comment.user_id === userId;
+        if (!comment.is_deleted && (isOwner || isModerator)) {
+            const actions = createElement('div', 'comment-actions');
+            const toggle = createElement('button', 'comment-menu-toggle', '⋮');
+            const menu = createElement('div', 'comment-menu');
+            if (isOwner) menu.appendChild(createElement('button', 'comment-edit', 'Изменить'));
+            menu.appendChild(createElement('button', 'comment-delete', 'Удалить'));
+            actions.appendChild(toggle);
+            actions.appendChild(menu);
+            header.appendChild(actions);
+        }
+
+        content.appendChild(header);
+
+        if (comment.is_deleted) {
+            content.appendChild(createElement('p', 'comment-text comment-deleted', 'Комментарий удален'));
+        } else {
+            const text = createElement('p', 'comment-text', comment.text);
+            linkifyMentions(text);
+            content.appendChild(text);
+        }
+
+        const footer = createElement('div', 'comment-footer');
+        if (!comment.is_deleted) {
+            const like = createElement('div', 'like-comment');
+            like.dataset.commentId = comment.id;
+            const likeBtn = createElement('button', 'comment-like' + (comment.has_liked ? ' liked' : ''));
+            likeBtn.innerHTML = likeIcon;
+            like.appendChild(likeBtn);
+            like.appendChild(createElement('span', '', comment.likes));
+            footer.appendChild(like);
+            footer.appendChild(createElement('button', 'comment-reply', 'Ответить'));
+        }
+        content.appendChild(footer);
+
+        const replyForm = createElement('div', 'comment-reply-form');
+        replyForm.style.display = 'none';
+        const replyText = createElement('textarea', 'reply-textarea');
+        replyText.placeholder = 'Ваш ответ...';
+        const replyControls = createElement('div', 'reply-controls');
+        replyControls.appendChild(createElement('button', 'btn-send-reply', 'Отправить'));
+        replyControls.appendChild(createElement('button', 'btn-cancel-reply', 'Отмена'));
+        replyForm.appendChild(replyText);
+        if (userId) attachMentionAutocomplete(replyText);
+        replyForm.appendChild(replyControls);
+        content.appendChild(replyForm);
+
+        const replies = createElement('div', 'comment-replies');
+        (comment.replies || []).forEach(reply => replies.appendChild(renderComment(reply)));
+        if (comment.collapsed) {
+            const expand = createElement('button', 'comment-expand', `Показать ответы (${comment.replies_count})`);
+            replies.appendChild(expand);
+        }
+        if (!replies.children.length) replies.style.display = 'none';
+        content.appendChild(replies);
+
+        element.appendChild(avatar);
+        element.appendChild(content);
+        return element;
+    }
+
+    function repliesOf(commentElement) {
+        return commentElement.querySelector(':scope > .comment-content > .comment-replies');
+    }
+
+    function loadComments(reset) {
+        if (reset) {
+            nextCursor = '';
+            list.innerHTML = '';
+        }
+
+        const params = new URLSearchParams({ sort });
+        if (nextCursor) params.set('cursor', nextCursor);
+
+        fetch(`/api/comments/${fileId}?${params}`)
+            .then(response => {
+                if (!response.ok) throw new Error('Ошибка при загрузке комментариев');
+                return response.json();
+            })
+            .then(page => {
+                page.comments.forEach(comment => list.appendChild(renderComment(comment)));
+                nextCursor = page.next_cursor || '';
+                loadMoreBtn.style.display = nextCursor ? 'block' : 'none';
+            })
+            .catch(error => console.error('Ошибка:', error));
+    }
+
+    document.querySelectorAll('.comments-sort-button').forEach(button => {
+        button.addEventListener('click', function() {
+            if (button.dataset.sort === sort) return;
+            document.querySelectorAll('.comments-sort-button').forEach(b => b.classList.remove('active'));
+            button.classList.add('active');
+            sort = button.dataset.sort;
+            loadComments(true);
+        });
+    });
+
+    loadMoreBtn.addEventListener('click', () => loadComments(false));
+
+    function sendComment(text, parentId) {
+        return fetch(`/api/comment/${fileId}`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+            body: new URLSearchParams({ text, parent_id: parentId || '' })
+        }).then(response => {
+            if (!response.ok) throw new Error('Ошибка при отправке комментария');
+            return response.json();
+        });
+    }
+
+    // Отправка комментария
+    form.addEventListener('submit', function(e) {
+        e.preventDefault();
+        if (redirectGuest()) return;
+
+        const text = form.querySelector('textarea').value.trim();
+        if (!text) return;
+
+        sendComment(text)
+            .then(comment => {
+                list.prepend(renderComment(comment));
+                form.reset();
+            })
+            .catch(error => console.error('Ошибка:', error));
+    });
+
+    list.addEventListener('click', function(e) {
+        const commentElement = e.target.closest('.comment');
+        if (!commentElement) return;
+        const commentId = commentElement.dataset.commentId;
+
+        // Лайк комментария
+        const like = e.target.closest('.like-comment');
+        if (like) {
+            if (redirectGuest()) return;
+
+            const now = Date.now();
+            if (now - lastLikeClick < CLICK_DELAY) return;
+            lastLikeClick = now;
+
+            const likeBtn = like.querySelector('button');
+            const isLiked = likeBtn.classList.contains('liked');
+            fetch(`/api/likecomment/${commentId}`, { method: isLiked ? 'DELETE' : 'POST' })
+                .then(response => {
+                    if (!response.ok) return;
+                    likeBtn.classList.toggle('liked');
+                    const count = like.querySelector('span');
+                    count.textContent = parseInt(count.textContent) + (isLiked ? -1 : 1);
+                });
+            return;
+        }
+
+        const replyForm = commentElement.querySelector(':scope > .comment-content > .comment-reply-form');
+
+        if (e.target.classList.contains('comment-reply')) {
+            if (redirectGuest()) return;
+            replyForm.style.display = 'block';
+            replyForm.querySelector('textarea').focus();
+        } else if (e.target.classList.contains('btn-cancel-reply')) {
+            replyForm.style.display = 'none';
+        } else if (e.target.classList.contains('btn-send-reply')) {
+            const textarea = replyForm.querySelector('textarea');
+            const text = textarea.value.trim();
+            if (!text) return;
+
+            sendComment(text, commentId)
+                .then(comment => {
+                    const replies = repliesOf(commentElement);
+                    replies.appendChild(renderComment(comment));
+                    replies.style.display = '';
+                    textarea.value = '';
+                    replyForm.style.display = 'none';
+                })
+                .catch(error => console.error('Ошибка:', error));
+        } else if (e.target.classList.contains('comment-menu-toggle')) {
+            const menu = e.target.nextElementSibling;
+            menu.style.display = menu.style.display === 'block' ? 'none' : 'block';
+        } else if (e.target.classList.contains('comment-delete')) {
+            if (!confirm('Удалить комментарий?')) return;
+
+            fetch(`/api/comment/${commentId}`, { method: 'DELETE' })
+                .then(response => {
+                    if (!response.ok) return;
+                    const replies = repliesOf(commentElement);
+                    if (replies.children.length) {
+                        // Ветка остается, скрываем только сам текст
+                        const textElement = commentElement.querySelector(':scope > .comment-content > .comment-text');
+                        textElement.textContent = 'Комментарий удален';
+                        textElement.classList.add('comment-deleted');
+                        commentElement.querySelector(':scope > .comment-content > .comment-footer').innerHTML = '';
+                        commentElement.querySelector(':scope > .comment-content > .comment-header > .comment-actions')?.remove();
+                    } else {
+                        commentElement.remove();
+                    }
+                });
+        } else if (e.target.classList.contains('comment-edit')) {
+            e.target.closest('.comment-menu').style.display = 'none';
+            startEdit(commentElement, commentId);
+        } else if (e.target.classList.contains('comment-edited')) {
+            toggleHistory(commentElement, commentId);
+        } else if (e.target.classList.contains('comment-expand')) {
+            fetch(`/api/comments/thread/${commentId}`)
+                .then(response => {
+                    if (!response.ok) throw new Error('Ошибка при загрузке ответов');
+                    return response.json();
+                })
+                .then(thread => {
+                    const replies = repliesOf(commentElement);
+                    replies.innerHTML = '';
+                    (thread.replies || []).forEach(reply => replies.appendChild(renderComment(reply)));
+                })
+                .catch(error => console.error('Ошибка:', error));
+        }
+    });
+
+    // Редактирование комментария
+    function startEdit(commentElement, commentId) {
+        const textElement = commentElement.querySelector(':scope > .comment-content > .comment-text');
+        if (!textElement) return;
+
+        const textarea = createElement('textarea', 'edit-textarea');
+        textarea.value = textElement.textContent;
+
+        const controls = createElement('div', 'edit-controls');
+        const saveButton = createElement('button', 'btn-save', 'Сохранить');
+        const cancelButton = createElement('button', 'btn-cancel', 'Отмена');
+        controls.appendChild(saveButton);
+        controls.appendChild(cancelButton);
+
+        textElement.replaceWith(textarea);
+        textarea.after(controls);
+        attachMentionAutocomplete(textarea);
+
+        function finish() {
+            textarea.replaceWith(textElement);
+            controls.remove();
+        }
+
+        saveButton.addEventListener('click', function() {
+            const text = textarea.value.trim();
+            if (!text) return;
+
+            fetch(`/api/comment/${commentId}`, {
+                method: 'PUT',
+                headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+                body: new URLSearchParams({ text })
+            })
+                .then(response => {
+                    if (!response.ok) throw new Error('Ошибка при изменении комментария');
+                    return response.json();
+                })
+                .then(comment => {
+                    textElement.textContent = comment.text;
+                    linkifyMentions(textElement);
+                    const header = commentElement.querySelector(':scope > .comment-content > .comment-header');
+                    if (!header.querySelector('.comment-edited')) {
+                        const edited = createElement('button', 'comment-edited', 'изменено');
+                        edited.title = 'История правок';
+                        header.querySelector('.comment-time').after(edited);
+                    }
+                    finish();
+                })
+                .catch(error => console.error('Ошибка:', error));
+        });
+
+        cancelButton.addEventListener('click', finish);
+    }
+
+    // История правок
+    function toggleHistory(commentElement, commentId) {
+        const content = commentElement.querySelector(':scope > .comment-content');
+        const existing = content.querySelector(':scope > .comment-history');
+        if (existing) {
+            existing.remove();
+            return;
+        }
+
+        fetch(`/api/comment/${commentId}/history`)
+            .then(response => {
+                if (!response.ok) throw new Error('Ошибка при загрузке истории');
+                return response.json();
+            })
+            .then(edits => {
+                const history = createElement('div', 'comment-history');
+                edits.forEach(edit => {
+                    const item = createElement('div', 'comment-history-item');
+                    item.appendChild(createElement('span', 'comment-time', timeAgo(edit.edited_at)));
+                    item.appendChild(createElement('p', 'comment-history-text', edit.text));
+                    history.appendChild(item);
+                });
+                content.querySelector(':scope > .comment-text').after(history);
+            })
+            .catch(error => console.error('Ошибка:', error));
+    }
+
+    if (userId) attachMentionAutocomplete(form.querySelector('textarea'));
+    loadComments(true);
+});
@@ -0,0 +1,76 @@
+// Купленное оформление профиля: рамки, цвета ника, баннеры и эмоуты
+document.addEventListener('DOMContentLoaded', () => {
+    const section = document.getElementById('cosmeticsSection');
+    const grid = document.getElementById('cosmeticsGrid');
+
+    const typeTitles = {
+        frame: 'Рамка аватара',
+        name_color: 'Цвет ника',
+        banner: 'Баннер профиля',
+        emote: 'Эмоут'
+    };
+
+    function loadCosmetics() {
+        fetch('/api/cosmetics')
+            .then(response => response.json())
+            .then(renderCosmetics)
+            .catch(error => console.error('Ошибка загрузки оформления:', error));
+    }
+
+    function renderCosmetics(items) {
+        grid.innerHTML = '';
+        section.style.display = items.length === 0 ? 'none' : 'block';
+
+        items.forEach(item => {
+            const card = document.createElement('div');
+            card.className = 'item-card';
+
+            const imageBox = document.createElement('div');
+            imageBox.className = 'item-image';
+            const image = document.createElement('img');
+            image.src = item.image;
+            image.alt = item.title;
+            imageBox.appendChild(image);
+
+            const content = document.createElement('div');
+            content.className = 'item-content';
+            const title = document.createElement('h3');
+            title.className = 'item-title';
+            title.textContent = item.title;
+            if (item.type === 'name_color') {
+                title.style.color = item.params.color;
+            }
+            const kind = document.createElement('ul');
+            kind.className = 'item-batches';
+            kind.textContent = item.type === 'emote'
+                ? `${typeTitles.emote} :${item.params.code}:`
+                : typeTitles[item.type];
+
+            const footer = document.createElement('div');
+            footer.className = 'item-footer';
+            if (item.type !== 'emote') {
+                const button = document.createElement('button');
+                button.className = 'gift-button';
+                button.textContent = item.equipped ? 'Снять' : 'Надеть';
+                button.addEventListener('click', () => toggle(item));
+                footer.appendChild(button);
+            }
+
+            content.append(title, kind, footer);
+            card.append(imageBox, content);
+            grid.appendChild(card);
+        });
+    }
+
+    async function toggle(item) {
+        const response = item.equipped
+            ? await fetch(`/api/cosmetics/${item.type}`, { method: 'DELETE' })
+            : await fetch(`/api/cosmetics/${item.item_id}`, { method: 'POST' });
+        if (!response.ok) {
+            alert('Не удалось изменить оформление');
+        }
+        loadCosmetics();
+    }
+
+    loadCosmetics();
+});
@@ -0,0 +1,42 @@
+// Добавляет CSRF-токен ко всем изменяющим запросам на наш сайт
+(function() {
+    const meta = document.querySelector('meta[name="csrf-token"]');
+    const token = meta ? meta.content : '';
+    if (!token) return;
+
+    const safeMethods = /^(GET|HEAD|OPTIONS)$/i;
+
+    function isSameOrigin(url) {
+        return new URL(url, window.location.href).origin === window.location.origin;
+    }
+
+    const originalFetch = window.fetch;
+    window.fetch = function(input, init) {
+        init = init || {};
+        const request = input instanceof Request ? input : null;
+        const method = init.method || (request ? request.method : 'GET');
+        const url = request ? request.url : String(input);
+
+        if (!safeMethods.test(method) && isSameOrigin(url)) {
+            const headers = new Headers(init.headers || (request ? request.headers : undefined));
+            headers.set('X-CSRF-Token', token);
+            init = Object.assign({}, init, { headers });
+        }
+
+        return originalFetch.call(this, input, init);
+    };
+
+    const originalOpen = XMLHttpRequest.prototype.open;
+    XMLHttpRequest.prototype.open = function(method, url) {
+        this.csrfProtected = !safeMethods.test(method) && isSameOrigin(url);
+        return originalOpen.apply(this, arguments);
+    };
+
+    const originalSend = XMLHttpRequest.prototype.send;
+    XMLHttpRequest.prototype.send = function() {
+        if (this.csrfProtected) {
+            this.setRequestHeader('X-CSRF-Token', token);
+        }
+        return originalSend.apply(this, arguments);
+    };
+})();
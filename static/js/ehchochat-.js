@@ -26,6 +26,7 @@ class EhchoChat {
             if (e.key === 'Enter') this.sendMessage();
         });
         this.fileInput.addEventListener('change', (e) => this.handleFileSelect(e));
+        attachMentionAutocomplete(this.messageInput);
         
         // Загружаем историю сообщений
         this.loadMessageHistory();
@@ -206,6 +207,8 @@ class EhchoChat {
         const content = document.createElement('div');
         content.className = 'message-content';
         content.innerHTML = DOMPurify.sanitize(message.content);
+        linkifyMentions(content);
+        this.renderEmotes(content, message.emotes);
         
         messageElement.appendChild(header);
         messageElement.appendChild(content);
@@ -243,6 +246,36 @@ class EhchoChat {
         this.messagesContainer.appendChild(messageElement);
     }
     
+    // Заменяет :code: на картинки эмоутов, которые есть у автора
+    renderEmotes(element, emotes) {
+        if (!emotes) return;
+
+        const walker = document.createTreeWalker(element, NodeFilter.SHOW_TEXT);
+        const nodes = [];
+        while (walker.nextNode()) nodes.push(walker.currentNode);
+
+        nodes.forEach(node => {
+            const parts = node.textContent.split(/:([a-zA-Z0-9_]{2,25}):/);
+            if (parts.length === 1) return;
+
+            const fragment = document.createDocumentFragment();
+            parts.forEach((part, i) => {
+                // Нечетные части - коды из скобок регулярки
+                if (i % 2 === 1 && emotes[part]) {
+                    const img = document.createElement('img');
+                    img.className = 'chat-emote';
+                    img.src = emotes[part];
+                    img.alt = `:${part}:`;
+                    img.title = `:${part}:`;
+                    fragment.appendChild(img);
+                } else {
+                    fragment.appendChild(document.createTextNode(i % 2 === 1 ? `:${part}:` : part));
+                }
+            });
+            node.replaceWith(fragment);
+        });
+    }
+
     scrollToBottom() {
         this.messagesContainer.scrollTop = this.messagesContainer.scrollHeight;
     }
@@ -0,0 +1,57 @@
+// Независимая проверка открытия кейса в браузере
+document.addEventListener('DOMContentLoaded', async () => {
+    const page = document.getElementById('fairPage');
+    const result = document.getElementById('fairBrowserResult');
+    if (!result) return;
+
+    const encoder = new TextEncoder();
+
+    function toHex(buffer) {
+        return Array.from(new Uint8Array(buffer))
+            .map(b => b.toString(16).padStart(2, '0'))
+            .join('');
+    }
+
+    async function roll(serverSeed, clientSeed, nonce) {
+        const key = await crypto.subtle.importKey(
+            'raw', encoder.encode(serverSeed), { name: 'HMAC', hash: 'SHA-256' }, false, ['sign']
+        );
+        const sum = await crypto.subtle.sign('HMAC', key, encoder.encode(`${clientSeed}:${nonce}`));
+        const bits = new DataView(sum).getBigUint64(0) >> 12n;
+        return Number(bits) / 2 ** 52;
+    }
+
+    // Остаток от погрешности округления шансов достается последней награде
+    function pickReward(rewards, value) {
+        let current = 0;
+        for (const reward of rewards) {
+            current += reward.probability;
+            if (value < current) {
+                return reward;
+            }
+        }
+        if (rewards.length > 0 && current >= 1 - 1e-4) {
+            return rewards[rewards.length - 1];
+        }
+        return null;
+    }
+
+    try {
+        const response = await fetch(`/api/case-openings/${page.dataset.id}`);
+        const opening = await response.json();
+
+        const hash = toHex(await crypto.subtle.digest('SHA-256', encoder.encode(opening.server_seed)));
+        const value = await roll(opening.server_seed, opening.client_seed, opening.nonce);
+        const reward = pickReward(opening.rewards, value);
+
+        const ok = hash === opening.server_seed_hash && value === opening.roll &&
+            reward !== null && reward.id === opening.reward_id;
+        result.textContent = ok
+            ? `Проверка в браузере: бросок ${value}, награда #${reward.id} — совпадает`
+            : 'Проверка в браузере: результат не совпадает';
+        result.classList.add(ok ? 'fair-ok' : 'fair-fail');
+    } catch (error) {
+        console.error('Ошибка проверки:', error);
+        result.textContent = 'Не удалось проверить в браузере';
+    }
+});
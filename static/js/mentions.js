@@ -0,0 +1,145 @@
+// Упоминания: ссылки на профили и автодополнение @login
+const MENTION_PATTERN = /(^|[^\w@])@(\w{3,25})/g;
+
+// Заменяет @login в текстовых узлах элемента на ссылки на профиль
+function linkifyMentions(element) {
+    const walker = document.createTreeWalker(element, NodeFilter.SHOW_TEXT);
+    const nodes = [];
+    while (walker.nextNode()) {
+        if (!walker.currentNode.parentElement.closest('a')) nodes.push(walker.currentNode);
+    }
+
+    nodes.forEach(node => {
+        const text = node.textContent;
+        MENTION_PATTERN.lastIndex = 0;
+        if (!MENTION_PATTERN.test(text)) return;
+
+        const fragment = document.createDocumentFragment();
+        let lastIndex = 0;
+        MENTION_PATTERN.lastIndex = 0;
+        let match;
+        while ((match = MENTION_PATTERN.exec(text)) !== null) {
+            const start = match.index + match[1].length;
+            fragment.appendChild(document.createTextNode(text.slice(lastIndex, start)));
+
+            const link = document.createElement('a');
+            link.className = 'mention';
+            link.href = `/user/${match[2].toLowerCase()}`;
+            link.textContent = `@${match[2]}`;
+            fragment.appendChild(link);
+
+            lastIndex = start + match[2].length + 1;
+        }
+        fragment.appendChild(document.createTextNode(text.slice(lastIndex)));
+        node.replaceWith(fragment);
+    });
+}
+
+// Подключает выпадающий список подсказок к полю ввода
+function attachMentionAutocomplete(input) {
+    if (!input || input.dataset.mentions) return;
+    input.dataset.mentions = 'true';
+
+    // Список создается при первом показе, чтобы не плодить элементы для каждого поля
+    let dropdown = null;
+    let items = [];
+    let selected = 0;
+    let query = null;
+    let timer = null;
+
+    function currentQuery() {
+        const before = input.value.slice(0, input.selectionStart);
+        const match = before.match(/(?:^|[^\w@])@(\w{1,25})$/);
+        return match ? match[1] : null;
+    }
+
+    function hide() {
+        if (dropdown) dropdown.style.display = 'none';
+        items = [];
+    }
+
+    function render() {
+        if (!dropdown) {
+            dropdown = document.createElement('div');
+            dropdown.className = 'mention-dropdown';
+            document.body.appendChild(dropdown);
+        }
+        dropdown.innerHTML = '';
+        items.forEach((user, i) => {
+            const item = document.createElement('div');
+            item.className = 'mention-item' + (i === selected ? ' active' : '');
+
+            const avatar = document.createElement('img');
+            avatar.src = user.profile_image_url;
+            avatar.alt = '';
+            const name = document.createElement('span');
+            name.textContent = user.display_name;
+            const login = document.createElement('span');
+            login.className = 'mention-login';
+            login.textContent = `@${user.login}`;
+
+            item.appendChild(avatar);
+            item.appendChild(name);
+            item.appendChild(login);
+            item.addEventListener('mousedown', e => {
+                e.preventDefault();
+                insert(user.login);
+            });
+            dropdown.appendChild(item);
+        });
+
+        const rect = input.getBoundingClientRect();
+        dropdown.style.left = `${rect.left + window.scrollX}px`;
+        dropdown.style.top = `${rect.bottom + window.scrollY}px`;
+        dropdown.style.minWidth = `${Math.min(rect.width, 260)}px`;
+        dropdown.style.display = items.length ? 'block' : 'none';
+    }
+
+    function insert(login) {
+        const caret = input.selectionStart;
+        const before = input.value.slice(0, caret).replace(/@\w*$/, `@${login} `);
+        input.value = before + input.value.slice(caret);
+        input.setSelectionRange(before.length, before.length);
+        input.focus();
+        hide();
+    }
+
+    input.addEventListener('input', function() {
+        query = currentQuery();
+        clearTimeout(timer);
+        if (!query) {
+            hide();
+            return;
+        }
+
+        timer = setTimeout(() => {
+            const requested = query;
+            fetch(`/api/mentions?q=${encodeURIComponent(requested)}`)
+                .then(response => response.ok ? response.json() : [])
+                .then(users => {
+                    if (requested !== query) return;
+                    items = users;
+                    selected = 0;
+                    render();
+                })
+                .catch(() => hide());
+        }, 200);
+    });
+
+    input.addEventListener('keydown', function(e) {
+        if (!items.length) return;
+
+        if (e.key === 'ArrowDown' || e.key === 'ArrowUp') {
+            e.preventDefault();
+            selected = (selected + (e.key === 'ArrowDown' ? 1 : items.length - 1)) % items.length;
+            render();
+        } else if (e.key === 'Enter' || e.key === 'Tab') {
+            e.preventDefault();
+            insert(items[selected].login);
+        } else if (e.key === 'Escape') {
+            hide();
+        }
+    });
+
+    input.addEventListener('blur', () => setTimeout(hide, 100));
+}
@@ -0,0 +1,142 @@
+document.addEventListener('DOMContentLoaded', function() {
+    const historyList = document.getElementById('historyList');
+    const moreButton = document.getElementById('historyMore');
+    const readAllButton = document.getElementById('historyReadAll');
+    let nextCursor = 0;
+
+    function loadHistory() {
+        moreButton.disabled = true;
+
+        fetch(`/api/notifications?cursor=${nextCursor}`)
+            .then(response => response.json())
+            .then(page => {
+                if (nextCursor === 0 && page.notifications.length === 0) {
+                    historyList.innerHTML = '<div class="empty-notification">Уведомлений нет</div>';
+                }
+
+                page.notifications.forEach(notification => {
+                    historyList.appendChild(createNotificationItem(notification));
+                });
+
+                nextCursor = page.next_cursor || 0;
+                moreButton.style.display = nextCursor ? 'block' : 'none';
+            })
+            .catch(error => {
+                console.error('Ошибка загрузки уведомлений:', error);
+                historyList.innerHTML = '<div class="error-notification">Не удалось загрузить уведомления</div>';
+            })
+            .finally(() => {
+                moreButton.disabled = false;
+            });
+    }
+
+    moreButton.addEventListener('click', loadHistory);
+
+    document.addEventListener('notification', function(e) {
+        const empty = historyList.querySelector('.empty-notification');
+        if (empty) empty.remove();
+        historyList.prepend(createNotificationItem(e.detail));
+    });
+
+    setupWebPush();
+
+    readAllButton.addEventListener('click', function() {
+        markAllNotificationsRead().catch(error => console.error(error));
+    });
+
+    document.querySelectorAll('#preferencesList input[type="checkbox"]').forEach(checkbox => {
+        checkbox.addEventListener('change', function() {
+            const body = new URLSearchParams({
+                category: checkbox.dataset.category,
+                enabled: checkbox.checked
+            });
+
+            fetch('/api/notifications/preferences', { method: 'PUT', body })
+                .then(response => {
+                    if (!response.ok) throw new Error('Не удалось сохранить настройку');
+                })
+                .catch(error => {
+                    console.error(error);
+                    checkbox.checked = !checkbox.checked;
+                });
+        });
+    });
+
+    const digestSelect = document.getElementById('digestFrequency');
+    if (digestSelect) {
+        let savedFrequency = digestSelect.value;
+        digestSelect.addEventListener('change', function() {
+            fetch('/api/digest', {
+                method: 'PUT',
+                body: new URLSearchParams({ frequency: digestSelect.value })
+            })
+                .then(response => {
+                    if (!response.ok) throw new Error('Не удалось сохранить настройку дайджеста');
+                    savedFrequency = digestSelect.value;
+                })
+                .catch(error => {
+                    console.error(error);
+                    digestSelect.value = savedFrequency;
+                });
+        });
+    }
+
+    loadHistory();
+});
+
+function urlBase64ToUint8Array(value) {
+    const padding = '='.repeat((4 - value.length % 4) % 4);
+    const base64 = (value + padding).replace(/-/g, '+').replace(/_/g, '/');
+    return Uint8Array.from(atob(base64), c => c.charCodeAt(0));
+}
+
+// Push-уведомления при закрытой вкладке. Кнопка появляется, только если сервер настроил VAPID.
+async function setupWebPush() {
+    const toggle = document.getElementById('pushToggle');
+    if (!toggle || !('serviceWorker' in navigator) || !('PushManager' in window)) return;
+
+    const response = await fetch('/api/push/key');
+    if (!response.ok) return;
+    const { key } = await response.json();
+
+    const registration = await navigator.serviceWorker.register('/static/js/push-sw.js');
+    let subscription = await registration.pushManager.getSubscription();
+
+    function render() {
+        toggle.textContent = subscription ? 'Отключить push-уведомления' : 'Включить push-уведомления';
+    }
+
+    toggle.style.display = 'inline-block';
+    render();
+
+    toggle.addEventListener('click', async function() {
+        toggle.disabled = true;
+        try {
+            if (subscription) {
+                await fetch('/api/push/subscription', {
+                    method: 'DELETE',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify(subscription)
+                });
+                await subscription.unsubscribe();
+                subscription = null;
+            } else {
+                subscription = await registration.pushManager.subscribe({
+                    userVisibleOnly: true,
+                    applicationServerKey: urlBase64ToUint8Array(key)
+                });
+                const saved = await fetch('/api/push/subscription', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify(subscription)
+                });
+                if (!saved.ok) throw new Error('Не удалось сохранить подписку');
+            }
+        } catch (error) {
+            console.error('Ошибка настройки push-уведомлений:', error);
+        } finally {
+            toggle.disabled = false;
+            render();
+        }
+    });
+}
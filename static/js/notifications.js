@@ -1,58 +1,137 @@
+// Элемент уведомления для выпадающего списка и страницы уведомлений
+function createNotificationItem(notification) {
+    const item = document.createElement('a');
+    item.href = notification.link || '#';
+    item.className = 'notification-item' + (notification.read ? '' : ' unread');
+
+    const image = document.createElement('img');
+    image.src = notification.image;
+    image.alt = 'Notification';
+    image.className = 'notification-image';
+
+    const content = document.createElement('div');
+    content.className = 'notification-content';
+
+    const text = document.createElement('div');
+    text.className = 'notification-text';
+    text.textContent = notification.notification;
+
+    const time = document.createElement('div');
+    time.className = 'notification-time';
+    time.textContent = notification.time;
+
+    content.append(text, time);
+    item.append(image, content);
+
+    // Клик отмечает уведомление (и его группу) прочитанным, потом переходим по ссылке
+    item.addEventListener('click', function(e) {
+        if (notification.read) return;
+        e.preventDefault();
+
+        fetch(`/api/notifications/${notification.id}/read`, { method: 'POST' })
+            .catch(error => console.error('Ошибка отметки уведомления:', error))
+            .finally(() => {
+                if (notification.link) {
+                    window.location.href = notification.link;
+                } else {
+                    notification.read = true;
+                    item.classList.remove('unread');
+                }
+            });
+    });
+
+    return item;
+}
+
+function setNotificationIndicator(hasUnread) {
+    const icon = document.querySelector('#notificationButton img');
+    if (!icon) return;
+    icon.src = hasUnread ? '../static/img/notifications-active.svg' : '../static/img/notifications-1.svg';
+}
+
+function markAllNotificationsRead() {
+    return fetch('/api/notifications/read', { method: 'POST' })
+        .then(response => {
+            if (!response.ok) throw new Error('Не удалось отметить уведомления');
+            document.querySelectorAll('.notification-item.unread').forEach(item => item.classList.remove('unread'));
+            setNotificationIndicator(false);
+        });
+}
+
 document.addEventListener('DOMContentLoaded', function() {
-            const notificationButton = document.getElementById('notificationButton');
-            const notificationDropdown = document.getElementById('notificationDropdown');
-            
-            if (notificationButton) {
-                notificationButton.addEventListener('click', function(e) {
-                    e.stopPropagation();
-                    notificationDropdown.classList.toggle('show');
-                    loadNotifications();
-                });
+    const notificationButton = document.getElementById('notificationButton');
+    const notificationDropdown = document.getElementById('notificationDropdown');
+    const readAllButton = document.getElementById('notificationReadAll');
+
+    if (!notificationButton || !notificationDropdown) return;
+
+    notificationButton.addEventListener('click', function(e) {
+        e.stopPropagation();
+        notificationDropdown.classList.toggle('show');
+        if (notificationDropdown.classList.contains('show')) {
+            loadNotifications();
+        }
+    });
+
+    if (readAllButton) {
+        readAllButton.addEventListener('click', function(e) {
+            e.stopPropagation();
+            markAllNotificationsRead().catch(error => console.error(error));
+        });
+    }
+
+    // Новые уведомления приходят по SSE, без опроса сервера
+    if (window.EventSource) {
+        const stream = new EventSource('/api/notifications/stream');
+
+        stream.addEventListener('message', function(e) {
+            const event = JSON.parse(e.data);
+            setNotificationIndicator(event.unread > 0);
+
+            if (!event.notification) return;
+
+            const notificationList = document.getElementById('notificationList');
+            if (notificationDropdown.classList.contains('show')) {
+                const empty = notificationList.querySelector('.empty-notification');
+                if (empty) empty.remove();
+                notificationList.prepend(createNotificationItem(event.notification));
             }
-            
-            // Закрытие при клике вне области
-            document.addEventListener('click', function(e) {
-                if (!notificationDropdown.contains(e.target) && 
-                    !notificationButton.contains(e.target)) {
-                    notificationDropdown.classList.remove('show');
+
+            document.dispatchEvent(new CustomEvent('notification', { detail: event.notification }));
+        });
+    }
+
+    // Закрытие при клике вне области
+    document.addEventListener('click', function(e) {
+        if (!notificationDropdown.contains(e.target) &&
+            !notificationButton.contains(e.target)) {
+            notificationDropdown.classList.remove('show');
+        }
+    });
+
+    function loadNotifications() {
+        const notificationList = document.getElementById('notificationList');
+
+        notificationList.innerHTML = '<div class="loading-notification">Загрузка...</div>';
+
+        fetch('/api/notifications?limit=10')
+            .then(response => response.json())
+            .then(page => {
+                notificationList.innerHTML = '';
+                setNotificationIndicator(page.unread > 0);
+
+                if (page.notifications.length === 0) {
+                    notificationList.innerHTML = '<div class="empty-notification">Уведомлений нет</div>';
+                    return;
                 }
+
+                page.notifications.forEach(notification => {
+                    notificationList.appendChild(createNotificationItem(notification));
+                });
+            })
+            .catch(error => {
+                console.error('Ошибка загрузки уведомлений:', error);
+                notificationList.innerHTML = '<div class="error-notification">Уведомлений нет</div>';
             });
-            
-            function loadNotifications() {
-                const notificationList = document.getElementById('notificationList');
-                
-                // Очищаем предыдущие уведомления
-                notificationList.innerHTML = '<div class="loading-notification">Загрузка...</div>';
-                
-                fetch('/api/notifications')
-                    .then(response => response.json())
-                    .then(notifications => {
-                        notificationList.innerHTML = '';
-                        
-                        if (notifications.length === 0) {
-                            notificationList.innerHTML = '<div class="empty-notification">Уведомлений нет</div>';
-                            return;
-                        }
-                        
-                        notifications.forEach(notification => {
-                            const item = document.createElement('a');
-                            item.href = notification.link;
-                            item.className = 'notification-item';
-                            
-                            item.innerHTML = `
-                                <img src="${notification.image}" alt="Notification" class="notification-image">
-                                <div class="notification-content">
-                                    <div class="notification-text">${notification.notification}</div>
-                                    <div class="notification-time">${notification.time}</div>
-                                </div>
-                            `;
-                            
-                            notificationList.appendChild(item);
-                        });
-                    })
-                    .catch(error => {
-                        console.error('Ошибка загрузки уведомлений:', error);
-                        notificationList.innerHTML = '<div class="error-notification">Уведомлений нет</div>';
-                    });
-            }
-        });
\ No newline at end of file
+    }
+});
@@ -0,0 +1,87 @@
+document.addEventListener('DOMContentLoaded', () => {
+    const empty = document.getElementById('outboxEmpty');
+    const table = document.getElementById('outboxTable');
+    const list = document.getElementById('outboxList');
+
+    function cell(text) {
+        const td = document.createElement('td');
+        td.textContent = text;
+        return td;
+    }
+
+    // Невыполненные задачи outbox
+    function loadJobs() {
+        fetch('/api/admin/outbox')
+            .then(response => response.json())
+            .then(renderJobs)
+            .catch(error => console.error('Error loading outbox:', error));
+    }
+
+    function renderJobs(jobs) {
+        list.innerHTML = '';
+        empty.style.display = jobs.length === 0 ? 'block' : 'none';
+        table.style.display = jobs.length === 0 ? 'none' : 'block';
+
+        jobs.forEach(job => {
+            const row = document.createElement('tr');
+            row.appendChild(cell(job.display_name));
+            row.appendChild(cell(job.attempts));
+            row.appendChild(cell(job.last_error || '—'));
+            row.appendChild(cell(job.failed_at
+                ? 'Попытки кончились'
+                : new Date(job.next_attempt_at).toLocaleString()));
+
+            const actions = document.createElement('td');
+            const retry = document.createElement('button');
+            retry.className = 'btn btn-secondary';
+            retry.textContent = 'Повторить';
+            retry.addEventListener('click', () => retryJob(job.id));
+            actions.appendChild(retry);
+            row.appendChild(actions);
+
+            list.appendChild(row);
+        });
+    }
+
+    function retryJob(id) {
+        fetch(`/api/admin/outbox/${id}/retry`, { method: 'POST' })
+            .then(response => {
+                if (!response.ok) {
+                    throw new Error(response.status);
+                }
+                // Воркер выполняет задачу в фоне
+                setTimeout(loadJobs, 2000);
+            })
+            .catch(error => {
+                console.error('Error retrying job:', error);
+                alert('Не удалось повторить выдачу');
+            });
+    }
+
+    // VIP на время и сроки их окончания
+    const vipsEmpty = document.getElementById('vipsEmpty');
+    const vipsTable = document.getElementById('vipsTable');
+    const vipsList = document.getElementById('vipsList');
+
+    function loadVIPs() {
+        fetch('/api/admin/vips')
+            .then(response => response.json())
+            .then(grants => {
+                vipsList.innerHTML = '';
+                vipsEmpty.style.display = grants.length === 0 ? 'block' : 'none';
+                vipsTable.style.display = grants.length === 0 ? 'none' : 'block';
+
+                grants.forEach(grant => {
+                    const row = document.createElement('tr');
+                    row.appendChild(cell(grant.display_name));
+                    row.appendChild(cell(new Date(grant.granted_at).toLocaleString()));
+                    row.appendChild(cell(new Date(grant.expires_at).toLocaleString()));
+                    vipsList.appendChild(row);
+                });
+            })
+            .catch(error => console.error('Error loading VIPs:', error));
+    }
+
+    loadJobs();
+    loadVIPs();
+});
@@ -0,0 +1,184 @@
+document.addEventListener('DOMContentLoaded', () => {
+    const roleHead = document.getElementById('rolePermissionsHead');
+    const roleList = document.getElementById('rolePermissionsList');
+    const searchInput = document.getElementById('permissionsSearch');
+    const searchResults = document.getElementById('searchResultsPermissions');
+    const userTable = document.getElementById('userPermissions');
+    const userRole = document.getElementById('userPermissionsRole');
+    const userList = document.getElementById('userPermissionsList');
+
+    const roleTitles = {
+        user: 'Пользователь',
+        moderator: 'Модератор',
+        admin: 'Админ'
+    };
+
+    let searchTimeout;
+    let selectedUsername = null;
+
+    function checkbox(checked, disabled, onChange) {
+        const input = document.createElement('input');
+        input.type = 'checkbox';
+        input.checked = checked;
+        input.disabled = disabled;
+        if (onChange) {
+            input.addEventListener('change', () => onChange(input));
+        }
+        return input;
+    }
+
+    // Сохранение права, при ошибке галочка возвращается назад
+    function savePermission(url, permission, input) {
+        const body = new URLSearchParams({ permission, enabled: input.checked });
+        return fetch(url, { method: 'PUT', body })
+            .then(response => {
+                if (!response.ok) {
+                    throw new Error(response.status);
+                }
+                return response;
+            })
+            .catch(error => {
+                input.checked = !input.checked;
+                console.error('Error saving permission:', error);
+            });
+    }
+
+    // Матрица прав ролей
+    function loadRolePermissions() {
+        fetch('/api/admin/permissions')
+            .then(response => response.json())
+            .then(data => renderRolePermissions(data))
+            .catch(error => console.error('Error loading permissions:', error));
+    }
+
+    function renderRolePermissions(data) {
+        while (roleHead.children.length > 1) {
+            roleHead.removeChild(roleHead.lastChild);
+        }
+        data.roles.forEach(role => {
+            const th = document.createElement('th');
+            th.textContent = roleTitles[role.role] || role.role;
+            roleHead.appendChild(th);
+        });
+        const adminTh = document.createElement('th');
+        adminTh.textContent = roleTitles.admin;
+        roleHead.appendChild(adminTh);
+
+        roleList.innerHTML = '';
+        data.permissions.forEach(permission => {
+            const row = document.createElement('tr');
+            const title = document.createElement('td');
+            title.textContent = permission.title;
+            row.appendChild(title);
+
+            data.roles.forEach(role => {
+                const cell = document.createElement('td');
+                cell.appendChild(checkbox(role.permissions.includes(permission.name), false, input => {
+                    savePermission(`/api/admin/permissions/roles/${role.role}`, permission.name, input)
+                        .then(() => {
+                            if (selectedUsername) {
+                                loadUserPermissions(selectedUsername);
+                            }
+                        });
+                }));
+                row.appendChild(cell);
+            });
+
+            // Админу доступно все
+            const adminCell = document.createElement('td');
+            adminCell.appendChild(checkbox(true, true));
+            row.appendChild(adminCell);
+
+            roleList.appendChild(row);
+        });
+    }
+
+    // Права конкретного пользователя
+    function loadUserPermissions(username) {
+        fetch(`/api/admin/permissions/users/${encodeURIComponent(username)}`)
+            .then(response => response.json())
+            .then(data => renderUserPermissions(data))
+            .catch(error => console.error('Error loading user permissions:', error));
+    }
+
+    function renderUserPermissions(data) {
+        userRole.textContent = roleTitles[data.role] || data.role;
+        userList.innerHTML = '';
+
+        data.permissions.forEach(permission => {
+            const row = document.createElement('tr');
+            const title = document.createElement('td');
+            title.textContent = permission.title;
+            row.appendChild(title);
+
+            const roleCell = document.createElement('td');
+            roleCell.appendChild(checkbox(permission.from_role, true));
+            row.appendChild(roleCell);
+
+            const grantCell = document.createElement('td');
+            grantCell.appendChild(checkbox(permission.granted, data.role === 'admin', input => {
+                savePermission(`/api/admin/permissions/users/${encodeURIComponent(data.login)}`, permission.name, input);
+            }));
+            row.appendChild(grantCell);
+
+            userList.appendChild(row);
+        });
+
+        userTable.style.display = 'block';
+    }
+
+    searchInput.addEventListener('input', () => {
+        const query = searchInput.value.trim();
+
+        if (query.length < 2) {
+            searchResults.innerHTML = '';
+            searchResults.style.display = 'none';
+            return;
+        }
+
+        clearTimeout(searchTimeout);
+        searchTimeout = setTimeout(() => {
+            fetch(`/api/admin/users?q=${encodeURIComponent(query)}`)
+                .then(response => response.json())
+                .then(users => {
+                    searchResults.innerHTML = '';
+                    if (users.length === 0) {
+                        searchResults.innerHTML = '<div class="result-item">Пользователи не найдены</div>';
+                        searchResults.style.display = 'block';
+                        return;
+                    }
+
+                    users.forEach(user => {
+                        const item = document.createElement('div');
+                        item.className = 'result-item';
+                        const avatar = document.createElement('img');
+                        avatar.src = user.profile_image_url;
+                        avatar.alt = user.display_name;
+                        avatar.className = 'result-avatar';
+                        const name = document.createElement('span');
+                        name.textContent = user.display_name;
+                        item.append(avatar, name);
+
+                        item.addEventListener('click', () => {
+                            searchInput.value = user.display_name;
+                            selectedUsername = user.display_name;
+                            searchResults.style.display = 'none';
+                            loadUserPermissions(user.display_name);
+                        });
+
+                        searchResults.appendChild(item);
+                    });
+
+                    searchResults.style.display = 'block';
+                });
+        }, 300);
+    });
+
+    document.addEventListener('click', (e) => {
+        if (!searchInput.contains(e.target) && !searchResults.contains(e.target)) {
+            searchResults.style.display = 'none';
+        }
+    });
+
+    loadRolePermissions();
+});
@@ -0,0 +1,85 @@
+// Последовательный просмотр коллекции на странице поста
+document.addEventListener('DOMContentLoaded', function() {
+    const panel = document.getElementById('playlistPanel');
+    const collectionId = new URLSearchParams(window.location.search).get('collection');
+    if (!panel || !collectionId) return;
+
+    const postId = parseInt(panel.dataset.postId);
+    const autoplay = document.getElementById('playlistAutoplay');
+    autoplay.checked = localStorage.getItem('playlistAutoplay') !== 'false';
+    autoplay.addEventListener('change', function() {
+        localStorage.setItem('playlistAutoplay', autoplay.checked);
+    });
+
+    function postURL(post) {
+        return `/post/${post.id}?collection=${collectionId}`;
+    }
+
+    function setNav(link, post) {
+        if (post) {
+            link.href = postURL(post);
+        } else {
+            link.classList.add('disabled');
+            link.removeAttribute('href');
+        }
+    }
+
+    fetch(`/api/collections/${collectionId}`)
+        .then(response => {
+            if (!response.ok) throw new Error('Коллекция недоступна');
+            return response.json();
+        })
+        .then(collection => {
+            const posts = collection.posts || [];
+            const index = posts.findIndex(post => post.id === postId);
+            if (index === -1) return;
+
+            const title = document.getElementById('playlistTitle');
+            title.textContent = collection.title;
+            title.href = `/collection/${collection.id}`;
+            document.getElementById('playlistPosition').textContent = `${index + 1} / ${posts.length}`;
+
+            const prev = posts[index - 1];
+            const next = posts[index + 1];
+            setNav(document.getElementById('playlistPrev'), prev);
+            setNav(document.getElementById('playlistNext'), next);
+
+            const items = document.getElementById('playlistItems');
+            posts.forEach((post, i) => {
+                const item = document.createElement('a');
+                item.className = 'playlist-item' + (i === index ? ' active' : '');
+                item.href = postURL(post);
+
+                const thumbnail = document.createElement('img');
+                thumbnail.src = post.thumbnail;
+                thumbnail.alt = '';
+
+                const info = document.createElement('div');
+                info.className = 'playlist-item-info';
+                const itemTitle = document.createElement('div');
+                itemTitle.className = 'playlist-item-title';
+                itemTitle.textContent = post.title;
+                const author = document.createElement('div');
+                author.className = 'playlist-item-author';
+                author.textContent = post.author_name;
+                info.appendChild(itemTitle);
+                info.appendChild(author);
+
+                item.appendChild(thumbnail);
+                item.appendChild(info);
+                items.appendChild(item);
+            });
+
+            panel.style.display = 'block';
+            items.querySelector('.active')?.scrollIntoView({ block: 'nearest' });
+
+            // Автопереход к следующему посту после окончания видео
+            const video = document.getElementById('mainVideo');
+            if (video && next) {
+                video.addEventListener('ended', function() {
+                    if (autoplay.checked) window.location.href = postURL(next);
+                });
+            }
+        })
+        .catch(error => console.error('Ошибка при загрузке коллекции:', error));
+});
@@ -0,0 +1,18 @@
+// Service worker для push-уведомлений
+self.addEventListener('push', function(event) {
+    if (!event.data) return;
+
+    const data = event.data.json();
+    event.waitUntil(
+        self.registration.showNotification(data.title || 'Ehworld', {
+            body: data.body,
+            icon: data.icon || '/static/img/icon.png',
+            data: { url: data.url || '/notifications' }
+        })
+    );
+});
+
+self.addEventListener('notificationclick', function(event) {
+    event.notification.close();
+    event.waitUntil(clients.openWindow(event.notification.data.url));
+});
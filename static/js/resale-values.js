@@ -0,0 +1,67 @@
+document.addEventListener('DOMContentLoaded', () => {
+    const list = document.getElementById('resaleValuesList');
+
+    const typeTitles = {
+        badge: 'Значок',
+        vip: 'VIP',
+        auk: 'Аукцион'
+    };
+
+    // Цены выкупа по типам наград
+    function loadValues() {
+        fetch('/api/resale-values')
+            .then(response => response.json())
+            .then(renderValues)
+            .catch(error => console.error('Error loading resale values:', error));
+    }
+
+    function renderValues(values) {
+        list.innerHTML = '';
+
+        values.forEach(value => {
+            const row = document.createElement('tr');
+
+            const type = document.createElement('td');
+            type.textContent = typeTitles[value.type] || value.type;
+            row.appendChild(type);
+
+            const inputCell = document.createElement('td');
+            const input = document.createElement('input');
+            input.type = 'number';
+            input.className = 'cost-input';
+            input.min = 0;
+            input.value = value.value;
+            inputCell.appendChild(input);
+            row.appendChild(inputCell);
+
+            const actions = document.createElement('td');
+            const save = document.createElement('button');
+            save.className = 'btn btn-secondary';
+            save.textContent = 'Сохранить';
+            save.addEventListener('click', () => saveValue(value.type, input.value));
+            actions.appendChild(save);
+            row.appendChild(actions);
+
+            list.appendChild(row);
+        });
+    }
+
+    function saveValue(type, value) {
+        fetch(`/api/admin/resale-values/${type}`, {
+            method: 'PUT',
+            body: new URLSearchParams({ value })
+        })
+            .then(response => {
+                if (!response.ok) {
+                    throw new Error(response.status);
+                }
+                loadValues();
+            })
+            .catch(error => {
+                console.error('Error saving resale value:', error);
+                alert('Не удалось сохранить цену');
+            });
+    }
+
+    loadValues();
+});
@@ -0,0 +1,79 @@
+// Продажа предметов обратно за рейтинг
+document.addEventListener('DOMContentLoaded', () => {
+    const recycleButton = document.getElementById('recycleDuplicatesBtn');
+    const prices = {};
+
+    async function errorMessage(response) {
+        try {
+            const data = await response.json();
+            return data.error.message;
+        } catch (e) {
+            return response.status;
+        }
+    }
+
+    fetch('/api/resale-values')
+        .then(response => response.json())
+        .then(values => {
+            values.forEach(value => prices[value.type] = value.value);
+
+            // Кнопка продажи только у предметов, которые выкупаются
+            document.querySelectorAll('.item-card').forEach(card => {
+                const price = prices[card.dataset.type];
+                if (!price) return;
+
+                const button = card.querySelector('.sell-button');
+                button.textContent = `Продать за ${price}`;
+                button.style.display = '';
+                button.addEventListener('click', () => sellItem(card, price));
+            });
+
+            if (!prices.badge) {
+                recycleButton.style.display = 'none';
+            }
+        })
+        .catch(error => console.error('Ошибка загрузки цен выкупа:', error));
+
+    async function sellItem(card, price) {
+        let quantity = 1;
+        if (Number(card.dataset.quantity) > 1) {
+            quantity = Number(prompt(`Сколько продать? (по ${price} за штуку)`, '1'));
+            if (!quantity) return;
+        } else if (!confirm(`Продать предмет за ${price}?`)) {
+            return;
+        }
+
+        const response = await fetch(`/api/inventory/${card.dataset.id}/sell`, {
+            method: 'POST',
+            body: new URLSearchParams({ quantity })
+        });
+        if (!response.ok) {
+            alert(`Не удалось продать: ${await errorMessage(response)}`);
+            return;
+        }
+        const result = await response.json();
+        alert(`Продано: ${result.sold}, начислено ${result.credited}. Рейтинг: ${result.rating}`);
+        location.reload();
+    }
+
+    recycleButton.addEventListener('click', async () => {
+        if (!confirm('Продать все лишние копии значков? По одной копии останется.')) return;
+
+        const response = await fetch('/api/inventory/recycle-duplicates', { method: 'POST' });
+        if (!response.ok) {
+            alert(`Не удалось продать: ${await errorMessage(response)}`);
+            return;
+        }
+        const result = await response.json();
+        const skipped = (result.skipped || []).reduce((sum, item) => sum + item.quantity, 0);
+        if (result.sold === 0) {
+            alert(skipped ? 'Дубликаты пока нельзя продать: цена выкупа не задана' : 'Дубликатов нет');
+            return;
+        }
+        if (skipped) {
+            alert(`Не продано ${skipped} шт.: цена выкупа не задана`);
+        }
+        alert(`Продано: ${result.sold}, начислено ${result.credited}. Рейтинг: ${result.rating}`);
+        location.reload();
+    });
+});
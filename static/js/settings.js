@@ -0,0 +1,161 @@
+document.addEventListener('DOMContentLoaded', function() {
+    const sessionsList = document.getElementById('sessionsList');
+    const revokeOthers = document.getElementById('revokeOtherSessions');
+
+    sessionsList.addEventListener('click', function(e) {
+        const button = e.target.closest('.session-revoke');
+        if (!button) return;
+
+        const item = button.closest('.session-item');
+        button.disabled = true;
+
+        fetch(`/api/sessions/${item.dataset.sessionId}`, { method: 'DELETE' })
+            .then(response => {
+                if (!response.ok) throw new Error('Не удалось завершить сессию');
+                item.remove();
+            })
+            .catch(error => {
+                console.error(error);
+                button.disabled = false;
+            });
+    });
+
+    const tokenForm = document.getElementById('tokenForm');
+    const tokensList = document.getElementById('tokensList');
+    const tokenCreated = document.getElementById('tokenCreated');
+
+    tokenForm.addEventListener('submit', function(e) {
+        e.preventDefault();
+
+        const body = new URLSearchParams(new FormData(tokenForm));
+        if (!body.has('scope')) {
+            alert('Выберите хотя бы одно право');
+            return;
+        }
+
+        fetch('/api/tokens', { method: 'POST', body })
+            .then(response => {
+                if (!response.ok) throw new Error('Не удалось создать токен');
+                return response.json();
+            })
+            .then(token => {
+                document.getElementById('tokenValue').textContent = token.token;
+                tokenCreated.style.display = 'flex';
+                tokensList.prepend(createTokenItem(token));
+                tokenForm.reset();
+            })
+            .catch(error => {
+                console.error(error);
+                alert(error.message);
+            });
+    });
+
+    tokensList.addEventListener('click', function(e) {
+        const button = e.target.closest('.token-revoke');
+        if (!button) return;
+        if (!confirm('Отозвать токен? Клиенты с ним перестанут работать.')) return;
+
+        const item = button.closest('.session-item');
+        button.disabled = true;
+
+        fetch(`/api/tokens/${item.dataset.tokenId}`, { method: 'DELETE' })
+            .then(response => {
+                if (!response.ok) throw new Error('Не удалось отозвать токен');
+                item.remove();
+            })
+            .catch(error => {
+                console.error(error);
+                button.disabled = false;
+            });
+    });
+
+    function createTokenItem(token) {
+        const item = document.createElement('div');
+        item.className = 'session-item';
+        item.dataset.tokenId = token.id;
+
+        const info = document.createElement('div');
+        info.className = 'session-info';
+
+        const name = document.createElement('span');
+        name.className = 'session-device';
+        name.textContent = token.name + ' ';
+        const prefix = document.createElement('code');
+        prefix.textContent = token.prefix + '…';
+        name.appendChild(prefix);
+
+        const meta = document.createElement('span');
+        meta.className = 'session-meta';
+        meta.textContent = token.scopes.join(', ') + ' · не использовался';
+
+        info.append(name, meta);
+
+        const revoke = document.createElement('button');
+        revoke.className = 'token-revoke session-revoke';
+        revoke.textContent = 'Отозвать';
+
+        item.append(info, revoke);
+        return item;
+    }
+
+    revokeOthers.addEventListener('click', function() {
+        if (!confirm('Завершить все сессии, кроме текущей?')) return;
+
+        fetch('/api/sessions', { method: 'DELETE' })
+            .then(response => {
+                if (!response.ok) throw new Error('Не удалось завершить сессии');
+                sessionsList.querySelectorAll('.session-item').forEach(item => {
+                    if (item.querySelector('.session-revoke')) item.remove();
+                });
+            })
+            .catch(error => console.error(error));
+    });
+
+    // Привязка аккаунта из чата Twitch, секция есть только при включенном боте
+    const chatLinkCreate = document.getElementById('chatLinkCreate');
+    if (chatLinkCreate) {
+        const chatLink = document.getElementById('chatLink');
+        const chatLinkCode = document.getElementById('chatLinkCode');
+
+        // Код привязывается к логину: из чата его примут только от этого аккаунта
+        chatLinkCreate.addEventListener('click', function() {
+            const login = document.getElementById('chatLinkTwitchLogin').value.trim();
+            if (!login) {
+                alert('Укажите логин Twitch, с которого будете писать в чат');
+                return;
+            }
+
+            fetch('/api/chat-link', {
+                method: 'POST',
+                body: new URLSearchParams({ login: login })
+            })
+                .then(response => {
+                    if (response.status === 422) {
+                        throw new Error('Логин Twitch: только латинские буквы, цифры и _');
+                    }
+                    if (!response.ok) throw new Error('Не удалось получить код');
+                    return response.json();
+                })
+                .then(code => {
+                    document.getElementById('chatLinkFor').textContent = code.twitch_login;
+                    document.getElementById('chatLinkCommand').textContent = '!link ' + code.code;
+                    chatLinkCode.style.display = 'flex';
+                })
+                .catch(error => {
+                    console.error(error);
+                    alert(error.message);
+                });
+        });
+
+        document.getElementById('chatUnlink').addEventListener('click', function() {
+            if (!confirm('Отвязать аккаунт Twitch от профиля?')) return;
+
+            fetch('/api/chat-link', { method: 'DELETE' })
+                .then(response => {
+                    if (!response.ok) throw new Error('Не удалось отвязать аккаунт');
+                    chatLink.style.display = 'none';
+                })
+                .catch(error => console.error(error));
+        });
+    }
+});
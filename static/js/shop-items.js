@@ -0,0 +1,164 @@
+document.addEventListener('DOMContentLoaded', () => {
+    const typeSelect = document.getElementById('newItemType');
+    const paramsContainer = document.getElementById('newItemParams');
+    const purchasesList = document.getElementById('purchasesList');
+    const redemptionsList = document.getElementById('redemptionsList');
+    const redemptionsEmpty = document.getElementById('redemptionsEmpty');
+
+    const paramTitles = {
+        color: 'Цвет ника, #a1b2c3',
+        code: 'Код эмоута',
+        hours: 'Часов буста',
+        prompt: 'Вопрос покупателю',
+        days: 'Дней VIP'
+    };
+
+    let types = [];
+
+    function cell(content) {
+        const td = document.createElement('td');
+        if (content instanceof Node) {
+            td.appendChild(content);
+        } else {
+            td.textContent = content;
+        }
+        return td;
+    }
+
+    function button(text, onClick) {
+        const element = document.createElement('button');
+        element.className = 'btn btn-secondary';
+        element.textContent = text;
+        element.addEventListener('click', onClick);
+        return element;
+    }
+
+    async function errorMessage(response) {
+        try {
+            const data = await response.json();
+            return data.error.message;
+        } catch (e) {
+            return response.status;
+        }
+    }
+
+    // Типы товаров из реестра и их параметры
+    fetch('/api/admin/shop/types')
+        .then(response => response.json())
+        .then(data => {
+            types = data;
+            types.forEach(type => {
+                const option = document.createElement('option');
+                option.value = type.type;
+                option.textContent = type.title;
+                typeSelect.appendChild(option);
+            });
+            renderParams();
+        })
+        .catch(error => console.error('Error loading item types:', error));
+
+    function renderParams() {
+        paramsContainer.innerHTML = '';
+        const type = types.find(t => t.type === typeSelect.value);
+        (type?.params || []).forEach(param => {
+            const input = document.createElement('input');
+            input.type = 'text';
+            input.className = 'title-input';
+            input.dataset.param = param;
+            input.placeholder = paramTitles[param] || param;
+            paramsContainer.appendChild(input);
+        });
+    }
+
+    typeSelect.addEventListener('change', renderParams);
+
+    document.getElementById('addShopItemBtn').addEventListener('click', async () => {
+        const file = document.getElementById('newItemFile').files[0];
+        if (!file) {
+            alert('Выберите картинку товара');
+            return;
+        }
+
+        const formData = new FormData();
+        formData.append('type', typeSelect.value);
+        formData.append('title', document.getElementById('newItemTitle').value);
+        formData.append('cost', document.getElementById('newItemCost').value);
+        formData.append('file', file);
+        paramsContainer.querySelectorAll('input').forEach(input => {
+            formData.append(`param_${input.dataset.param}`, input.value);
+        });
+
+        const response = await fetch('/api/admin/shop/items', { method: 'POST', body: formData });
+        if (!response.ok) {
+            alert(`Не удалось добавить товар: ${await errorMessage(response)}`);
+            return;
+        }
+        alert('Товар добавлен');
+        location.reload();
+    });
+
+    // Заявки на награды за рейтинг
+    function loadRedemptions() {
+        fetch('/api/admin/shop/redemptions')
+            .then(response => response.json())
+            .then(redemptions => {
+                redemptionsList.innerHTML = '';
+                redemptionsEmpty.style.display = redemptions.length === 0 ? 'block' : 'none';
+
+                redemptions.forEach(redemption => {
+                    const row = document.createElement('tr');
+                    [cell(redemption.display_name), cell(redemption.item_title), cell(redemption.input),
+                        cell(new Date(redemption.created_at).toLocaleString()),
+                        cell(button('Выполнено', () => fulfill(redemption.id))),
+                        cell(button('Вернуть рейтинг', () => refund(redemption.purchase_id)))
+                    ].forEach(td => row.appendChild(td));
+                    redemptionsList.appendChild(row);
+                });
+            })
+            .catch(error => console.error('Error loading redemptions:', error));
+    }
+
+    async function fulfill(id) {
+        const response = await fetch(`/api/admin/shop/redemptions/${id}/fulfill`, { method: 'POST' });
+        if (!response.ok) {
+            alert(`Ошибка: ${await errorMessage(response)}`);
+        }
+        loadRedemptions();
+    }
+
+    // Покупки и возвраты
+    function loadPurchases() {
+        fetch('/api/admin/shop/purchases')
+            .then(response => response.json())
+            .then(purchases => {
+                purchasesList.innerHTML = '';
+
+                purchases.forEach(purchase => {
+                    const row = document.createElement('tr');
+                    const action = purchase.refunded_at
+                        ? 'Возвращено'
+                        : button('Вернуть', () => refund(purchase.id));
+                    [cell(purchase.display_name), cell(purchase.item_title), cell(purchase.price),
+                        cell(purchase.input || '—'), cell(new Date(purchase.created_at).toLocaleString()),
+                        cell(action)
+                    ].forEach(td => row.appendChild(td));
+                    purchasesList.appendChild(row);
+                });
+            })
+            .catch(error => console.error('Error loading purchases:', error));
+    }
+
+    async function refund(purchaseId) {
+        if (!confirm('Отозвать покупку и вернуть рейтинг?')) return;
+
+        const response = await fetch(`/api/admin/shop/purchases/${purchaseId}/refund`, { method: 'POST' });
+        if (!response.ok) {
+            alert(`Не удалось вернуть: ${await errorMessage(response)}`);
+        }
+        loadPurchases();
+        loadRedemptions();
+    }
+
+    loadRedemptions();
+    loadPurchases();
+});
@@ -0,0 +1,168 @@
+document.addEventListener('DOMContentLoaded', () => {
+    const itemsList = document.getElementById('shopItemsList');
+    const discountsList = document.getElementById('shopDiscountsList');
+    const discountItem = document.getElementById('discountItem');
+
+    function cell(content) {
+        const td = document.createElement('td');
+        if (content instanceof Node) {
+            td.appendChild(content);
+        } else {
+            td.textContent = content;
+        }
+        return td;
+    }
+
+    function input(type, value) {
+        const element = document.createElement('input');
+        element.type = type;
+        element.className = 'cost-input';
+        element.value = value ?? '';
+        if (type === 'number') element.min = 0;
+        return element;
+    }
+
+    // Значение для datetime-local в локальном времени
+    function toLocalInput(value) {
+        if (!value) return '';
+        const date = new Date(value);
+        date.setMinutes(date.getMinutes() - date.getTimezoneOffset());
+        return date.toISOString().slice(0, 16);
+    }
+
+    function fromLocalInput(value) {
+        return value ? new Date(value).toISOString() : null;
+    }
+
+    function numberOrNull(value) {
+        return value === '' ? null : Number(value);
+    }
+
+    async function errorMessage(response) {
+        try {
+            const data = await response.json();
+            return data.error.message;
+        } catch (e) {
+            return response.status;
+        }
+    }
+
+    // Товары и их настройки продажи
+    function loadItems() {
+        fetch('/api/admin/shop/items')
+            .then(response => response.json())
+            .then(renderItems)
+            .catch(error => console.error('Error loading shop items:', error));
+    }
+
+    function renderItems(items) {
+        itemsList.innerHTML = '';
+        discountItem.length = 1;
+
+        items.forEach(item => {
+            const option = document.createElement('option');
+            option.value = item.id;
+            option.textContent = item.title;
+            discountItem.appendChild(option);
+
+            const from = input('datetime-local', toLocalInput(item.available_from));
+            const until = input('datetime-local', toLocalInput(item.available_until));
+            const stock = input('number', item.stock);
+            const limit = input('number', item.per_user_limit);
+            const slot = input('number', item.featured_slot);
+            slot.max = 4;
+
+            const save = document.createElement('button');
+            save.className = 'btn btn-secondary';
+            save.textContent = 'Сохранить';
+            save.addEventListener('click', () => saveItem(item.id, {
+                available_from: fromLocalInput(from.value),
+                available_until: fromLocalInput(until.value),
+                stock: numberOrNull(stock.value),
+                per_user_limit: numberOrNull(limit.value),
+                featured_slot: numberOrNull(slot.value)
+            }));
+
+            const row = document.createElement('tr');
+            [cell(item.title), cell(from), cell(until), cell(stock), cell(item.sold),
+                cell(limit), cell(slot), cell(save)].forEach(td => row.appendChild(td));
+            itemsList.appendChild(row);
+        });
+    }
+
+    async function saveItem(id, settings) {
+        const response = await fetch(`/api/admin/shop/items/${id}`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(settings)
+        });
+        if (!response.ok) {
+            alert(`Не удалось сохранить: ${await errorMessage(response)}`);
+            return;
+        }
+        loadItems();
+    }
+
+    // Скидки
+    function loadDiscounts() {
+        fetch('/api/admin/shop/discounts')
+            .then(response => response.json())
+            .then(renderDiscounts)
+            .catch(error => console.error('Error loading discounts:', error));
+    }
+
+    function renderDiscounts(discounts) {
+        discountsList.innerHTML = '';
+
+        discounts.forEach(discount => {
+            const remove = document.createElement('button');
+            remove.className = 'btn btn-secondary';
+            remove.textContent = 'Удалить';
+            remove.addEventListener('click', () => deleteDiscount(discount.id));
+
+            const row = document.createElement('tr');
+            [cell(discount.title), cell(`${discount.percent}%`), cell(discount.item_title || 'Весь магазин'),
+                cell(new Date(discount.starts_at).toLocaleString()), cell(new Date(discount.ends_at).toLocaleString()),
+                cell(remove)].forEach(td => row.appendChild(td));
+            discountsList.appendChild(row);
+        });
+    }
+
+    document.getElementById('addDiscountBtn').addEventListener('click', async () => {
+        const starts = document.getElementById('discountStarts').value;
+        const ends = document.getElementById('discountEnds').value;
+        if (!starts || !ends) {
+            alert('Укажите начало и конец скидки');
+            return;
+        }
+
+        const response = await fetch('/api/admin/shop/discounts', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                title: document.getElementById('discountTitle').value,
+                percent: Number(document.getElementById('discountPercent').value),
+                item_id: Number(discountItem.value),
+                starts_at: fromLocalInput(starts),
+                ends_at: fromLocalInput(ends)
+            })
+        });
+        if (!response.ok) {
+            alert(`Не удалось добавить скидку: ${await errorMessage(response)}`);
+            return;
+        }
+        loadDiscounts();
+    });
+
+    async function deleteDiscount(id) {
+        const response = await fetch(`/api/admin/shop/discounts/${id}`, { method: 'DELETE' });
+        if (!response.ok) {
+            alert(`Не удалось удалить скидку: ${await errorMessage(response)}`);
+            return;
+        }
+        loadDiscounts();
+    }
+
+    loadItems();
+    loadDiscounts();
+});
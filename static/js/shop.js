@@ -1,26 +1,47 @@
 // Обработка покупки значков
 document.addEventListener('DOMContentLoaded', function() {
+    // Ключ идемпотентности живет до успешного ответа, поэтому повторный клик
+    // или повтор после обрыва связи не спишут баланс дважды
+    const idempotencyKeys = {};
+
+    function idempotencyKey(action) {
+        if (!idempotencyKeys[action]) {
+            idempotencyKeys[action] = crypto.randomUUID();
+        }
+        return idempotencyKeys[action];
+    }
+
     const buyButtons = document.querySelectorAll('.buy-button:not(:disabled)');
     
     buyButtons.forEach(button => {
         button.addEventListener('click', function() {
             const badgeId = this.getAttribute('data-id');
+
+            // Бусту нужен пост, награде за рейтинг - ответ на вопрос
+            let input = '';
+            const inputLabel = this.getAttribute('data-input-label');
+            if (inputLabel) {
+                input = prompt(inputLabel);
+                if (input === null) return;
+            }
                     
             fetch('/api/buy_item/'+badgeId, {
                 method: 'POST',
                 headers: {
-                    'Content-Type': 'application/json'
+                    'Content-Type': 'application/json',
+                    'Idempotency-Key': idempotencyKey(`buy/${badgeId}`)
                 },
-                body: JSON.stringify({ badge_id: badgeId })
+                body: JSON.stringify({ badge_id: badgeId, input })
             })
-            .then(response => response.status)
-            .then(data => {
-                if (data.success) {
+            .then(async response => {
+                if (response.ok) {
                     location.reload(); // Обновляем страницу
-                } else {
-                    location.reload();
-                    alert('Ошибка: ' + data.message);
+                    return;
                 }
+                // Товар закончился, снят с продажи или исчерпан лимит
+                const data = await response.json();
+                alert('Ошибка: ' + data.error.message);
+                location.reload();
             })
             .catch(error => {
                 console.error('Ошибка:', error);
@@ -38,6 +59,63 @@ document.addEventListener('DOMContentLoaded', function() {
     const closeRewardBtn = document.getElementById('closeRewardBtn');
     
     let currentCaseId = null;
+
+    const serverSeedHash = document.getElementById('serverSeedHash');
+    const seedNonce = document.getElementById('seedNonce');
+    const nextServerSeedHash = document.getElementById('nextServerSeedHash');
+    const clientSeedInput = document.getElementById('clientSeedInput');
+    const revealedSeed = document.getElementById('revealedSeed');
+
+    function renderSeed(seed) {
+        serverSeedHash.textContent = seed.server_seed_hash;
+        seedNonce.textContent = seed.nonce;
+        nextServerSeedHash.textContent = seed.next_server_seed_hash;
+        clientSeedInput.value = seed.client_seed;
+    }
+
+    // Текущая пара сидов
+    function loadSeed() {
+        fetch('/api/case-seed')
+            .then(response => response.json())
+            .then(renderSeed)
+            .catch(error => console.error('Ошибка загрузки сидов:', error));
+    }
+
+    // Смена сидов раскрывает старый серверный сид, а серверным становится тот,
+    // чей хеш был показан до ввода клиентского сида
+    document.getElementById('rotateSeedBtn').addEventListener('click', () => {
+        fetch('/api/case-seed', {
+            method: 'POST',
+            body: new URLSearchParams({
+                client_seed: clientSeedInput.value,
+                next_server_seed_hash: nextServerSeedHash.textContent
+            })
+        })
+            .then(response => {
+                if (response.status === 409) {
+                    alert('Следующий серверный сид изменился. Проверьте новый хеш и повторите смену');
+                    loadSeed();
+                    return null;
+                }
+                if (!response.ok) {
+                    throw new Error(response.status);
+                }
+                return response.json();
+            })
+            .then(data => {
+                if (!data) {
+                    return;
+                }
+                renderSeed(data.current);
+                revealedSeed.textContent = data.revealed
+                    ? `Раскрыт серверный сид: ${data.revealed.server_seed}`
+                    : '';
+            })
+            .catch(error => {
+                console.error('Ошибка смены сидов:', error);
+                alert('Не удалось сменить сиды');
+            });
+    });
     
     // Открытие модального окна кейса
     caseButtons.forEach(button => {
@@ -80,6 +158,9 @@ document.addEventListener('DOMContentLoaded', function() {
                     console.error('Ошибка загрузки наград:', error);
                     rewardsGrid.innerHTML = '<p>Не удалось загрузить награды</p>';
                 });
+
+            revealedSeed.textContent = '';
+            loadSeed();
             
             modal.style.display = 'block';
         });
@@ -101,13 +182,17 @@ document.addEventListener('DOMContentLoaded', function() {
         try {
             const response = await fetch(`/api/case-open/${currentCaseId}`, {
                 method: 'POST',
+                headers: { 'Idempotency-Key': idempotencyKey(`case/${currentCaseId}`) }
             });
 
             if (response.ok) {
                 const respData = await response.json();
+                delete idempotencyKeys[`case/${currentCaseId}`];
                 // Показываем выпавшую награду
                 document.getElementById('rewardImage').src = respData.image;
                 document.getElementById('rewardTitle').textContent = respData.title;
+                document.getElementById('rewardVerifyLink').href = `/fair/${respData.opening_id}`;
+                seedNonce.textContent = Number(seedNonce.textContent) + 1;
                 
                 // Скрываем основное окно, показываем награду
                 document.querySelector('.modal-content').style.display = 'none';
@@ -0,0 +1,224 @@
+// Подарки, обмены и история передач предметов
+document.addEventListener('DOMContentLoaded', () => {
+    const giftModal = document.getElementById('giftModal');
+    const giftLogin = document.getElementById('giftLogin');
+    const giftQuantity = document.getElementById('giftQuantity');
+    const tradeLogin = document.getElementById('tradeLogin');
+    const tradeBuilder = document.getElementById('tradeBuilder');
+    const tradeGive = document.getElementById('tradeGive');
+    const tradeWant = document.getElementById('tradeWant');
+    const tradeMessage = document.getElementById('tradeMessage');
+    const tradeOffers = document.getElementById('tradeOffers');
+    const transfersList = document.getElementById('transfersList');
+
+    const statusTitles = {
+        pending: 'Ожидает ответа',
+        accepted: 'Принят',
+        declined: 'Отклонен',
+        cancelled: 'Отменен'
+    };
+
+    let giftItemId = null;
+    let tradePartner = null;
+
+    async function errorMessage(response) {
+        try {
+            const data = await response.json();
+            return data.error.message;
+        } catch (e) {
+            return response.status;
+        }
+    }
+
+    // Подарок
+    document.querySelectorAll('.gift-button').forEach(button => {
+        button.addEventListener('click', () => {
+            const card = button.closest('.item-card');
+            giftItemId = card.dataset.id;
+            giftLogin.value = '';
+            giftQuantity.value = 1;
+            giftQuantity.max = card.dataset.quantity;
+            giftModal.style.display = 'flex';
+        });
+    });
+
+    document.getElementById('cancelGift').addEventListener('click', () => {
+        giftModal.style.display = 'none';
+    });
+
+    document.getElementById('submitGift').addEventListener('click', async () => {
+        const body = new URLSearchParams({ login: giftLogin.value.trim(), quantity: giftQuantity.value });
+        const response = await fetch(`/api/inventory/${giftItemId}/gift`, { method: 'POST', body });
+        if (!response.ok) {
+            alert(`Не удалось подарить: ${await errorMessage(response)}`);
+            return;
+        }
+        location.reload();
+    });
+
+    // Поля количества для предметов одной стороны обмена
+    function renderTradeItems(container, items) {
+        container.innerHTML = '';
+        if (items.length === 0) {
+            container.textContent = 'Нет предметов';
+            return;
+        }
+        items.forEach(item => {
+            const row = document.createElement('label');
+            row.className = 'trade-item';
+            const img = document.createElement('img');
+            img.src = item.image;
+            const title = document.createElement('span');
+            title.textContent = `${item.title} (${item.quantity})`;
+            const input = document.createElement('input');
+            input.type = 'number';
+            input.min = 0;
+            input.max = item.quantity;
+            input.value = 0;
+            input.dataset.rewardId = item.id;
+            row.append(img, title, input);
+            container.appendChild(row);
+        });
+    }
+
+    function selectedItems(container) {
+        return Array.from(container.querySelectorAll('input'))
+            .map(input => ({ reward_id: Number(input.dataset.rewardId), quantity: Number(input.value) }))
+            .filter(item => item.quantity > 0);
+    }
+
+    document.getElementById('tradeLoadBtn').addEventListener('click', async () => {
+        const login = tradeLogin.value.trim();
+        if (!login) return;
+
+        const theirs = await fetch(`/api/trades/inventory/${encodeURIComponent(login)}`);
+        if (!theirs.ok) {
+            alert(`Пользователь не найден: ${await errorMessage(theirs)}`);
+            return;
+        }
+
+        tradePartner = login;
+        renderTradeItems(tradeGive, Array.from(document.querySelectorAll('.item-card')).map(card => ({
+            id: card.dataset.id,
+            title: card.querySelector('.item-title').textContent,
+            image: card.querySelector('.item-image img').src,
+            quantity: card.dataset.quantity
+        })));
+        renderTradeItems(tradeWant, await theirs.json() || []);
+        tradeBuilder.style.display = 'block';
+    });
+
+    document.getElementById('tradeSubmitBtn').addEventListener('click', async () => {
+        const response = await fetch('/api/trades', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                login: tradePartner,
+                give: selectedItems(tradeGive),
+                want: selectedItems(tradeWant),
+                message: tradeMessage.value
+            })
+        });
+        if (!response.ok) {
+            alert(`Не удалось отправить предложение: ${await errorMessage(response)}`);
+            return;
+        }
+        tradeBuilder.style.display = 'none';
+        tradeMessage.value = '';
+        loadOffers();
+    });
+
+    // Список предложений
+    function itemsText(items) {
+        return items.length === 0
+            ? 'ничего'
+            : items.map(item => `${item.title} ×${item.quantity}`).join(', ');
+    }
+
+    function offerButton(text, offerId, action) {
+        const button = document.createElement('button');
+        button.className = 'case-button';
+        button.textContent = text;
+        button.addEventListener('click', async () => {
+            const response = await fetch(`/api/trades/${offerId}/${action}`, { method: 'POST' });
+            if (!response.ok) {
+                alert(`Ошибка: ${await errorMessage(response)}`);
+            }
+            if (action === 'accept' && response.ok) {
+                location.reload();
+                return;
+            }
+            loadOffers();
+        });
+        return button;
+    }
+
+    function loadOffers() {
+        fetch('/api/trades')
+            .then(response => response.json())
+            .then(offers => {
+                tradeOffers.innerHTML = '';
+                offers.forEach(offer => {
+                    const card = document.createElement('div');
+                    card.className = 'trade-offer';
+
+                    const title = document.createElement('div');
+                    title.className = 'trade-offer-title';
+                    title.textContent = offer.incoming
+                        ? `${offer.from_display_name} предлагает: ${itemsText(offer.give)} за ${itemsText(offer.want)}`
+                        : `Вы предлагаете ${offer.to_display_name}: ${itemsText(offer.give)} за ${itemsText(offer.want)}`;
+                    card.appendChild(title);
+
+                    if (offer.message) {
+                        const message = document.createElement('div');
+                        message.className = 'trade-offer-message';
+                        message.textContent = offer.message;
+                        card.appendChild(message);
+                    }
+
+                    const footer = document.createElement('div');
+                    footer.className = 'item-footer';
+                    const status = document.createElement('span');
+                    status.className = `trade-status trade-${offer.status}`;
+                    status.textContent = statusTitles[offer.status];
+                    footer.appendChild(status);
+                    if (offer.status === 'pending' && offer.incoming) {
+                        footer.append(offerButton('Принять', offer.id, 'accept'), offerButton('Отклонить', offer.id, 'decline'));
+                    } else if (offer.status === 'pending') {
+                        footer.appendChild(offerButton('Отменить', offer.id, 'cancel'));
+                    }
+                    card.appendChild(footer);
+
+                    tradeOffers.appendChild(card);
+                });
+            })
+            .catch(error => console.error('Ошибка загрузки обменов:', error));
+    }
+
+    // История передач
+    function loadTransfers() {
+        fetch('/api/inventory/transfers')
+            .then(response => response.json())
+            .then(transfers => {
+                transfersList.innerHTML = '';
+                if (transfers.length === 0) {
+                    transfersList.textContent = 'Пока ничего не передавали';
+                    return;
+                }
+                transfers.forEach(transfer => {
+                    const row = document.createElement('div');
+                    row.className = 'transfer-row';
+                    const kind = transfer.kind === 'gift' ? 'Подарок' : 'Обмен';
+                    const direction = transfer.incoming
+                        ? `от ${transfer.from_display_name}`
+                        : `для ${transfer.to_display_name}`;
+                    row.textContent = `${new Date(transfer.created_at).toLocaleString()} — ${kind} ${direction}: ${transfer.title} ×${transfer.quantity}`;
+                    transfersList.appendChild(row);
+                });
+            })
+            .catch(error => console.error('Ошибка загрузки истории:', error));
+    }
+
+    loadOffers();
+    loadTransfers();
+});